@@ -0,0 +1,156 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"time"
+)
+
+// ErrMaxAllowedSpaceReached is returned by writes when the DB is read-only
+// because the sstables in the DB directory have reached
+// Options.MaxAllowedSpaceUsage.
+var ErrMaxAllowedSpaceReached = errors.New("pebble: max allowed space reached")
+
+// errMemTableNotFlushed is returned by resume if the immutable memtables could
+// not all be flushed.
+var errMemTableNotFlushed = errors.New("pebble: immutable memtable not ready for flush")
+
+// resumeInterval is the interval at which a DB which ran out of space attempts
+// to resume.
+const resumeInterval = time.Second
+
+// isOutOfSpace returns true if err indicates that the device holding the DB
+// is full, or that Options.MaxAllowedSpaceUsage has been reached.
+func isOutOfSpace(err error) bool {
+	switch e := err.(type) {
+	case *os.PathError:
+		err = e.Err
+	case *os.LinkError:
+		err = e.Err
+	case *os.SyscallError:
+		err = e.Err
+	}
+	return err == syscall.ENOSPC || err == ErrMaxAllowedSpaceReached
+}
+
+// setBackgroundError puts the DB into a read-only state after a write, flush
+// or compaction ran out of space. Writes fail with err, and flushes are not
+// scheduled, until a background goroutine succeeds in resuming the DB.
+//
+// d.mu must be held when calling this.
+func (d *DB) setBackgroundError(err error) {
+	if d.mu.bgErr != nil {
+		// The DB is already read-only.
+		return
+	}
+	d.mu.bgErr = err
+	go d.resumeLoop()
+	d.opts.Logger.Infof("pebble: out of space, writes are stopped: %v", err)
+	if d.opts.EventListener != nil && d.opts.EventListener.BackgroundError != nil {
+		d.opts.EventListener.BackgroundError(err)
+	}
+	// Wake up any writes waiting for room in the memtable so that they fail.
+	d.mu.mem.cond.Broadcast()
+	d.mu.compact.cond.Broadcast()
+}
+
+// resumeLoop periodically attempts to resume the DB after it became read-only,
+// until it succeeds or the DB is closed.
+func (d *DB) resumeLoop() {
+	ticker := time.NewTicker(resumeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.closedCh:
+			return
+		case <-ticker.C:
+		}
+
+		d.mu.Lock()
+		if d.mu.closed {
+			d.mu.Unlock()
+			return
+		}
+		d.mu.resuming = true
+		err := d.resume()
+		d.mu.resuming = false
+		d.mu.compact.cond.Broadcast()
+		d.mu.Unlock()
+		if err == nil {
+			return
+		}
+	}
+}
+
+// resume attempts to return the DB to normal operation after it became
+// read-only. Obsolete files are deleted, the WAL is replaced if writing to it
+// failed, and the immutable memtables are flushed. If any of these fail, or
+// Options.MaxAllowedSpaceUsage is still reached, the DB remains read-only.
+// Compactions continue to run while the DB is read-only, as they may reclaim
+// space (see reserveCompactionSpace).
+//
+// d.mu must be held when calling this, but the mutex may be dropped and
+// re-acquired during the course of this method.
+func (d *DB) resume() error {
+	jobID := d.mu.nextJobID
+	d.mu.nextJobID++
+	d.deleteObsoleteFiles(jobID)
+	// Retry compactions, which are not scheduled after a compaction runs out of
+	// space until the next attempt to resume.
+	d.mu.compact.outOfSpace = false
+	d.maybeScheduleCompaction()
+	if d.fileManager.maxAllowedSpaceReached() {
+		return ErrMaxAllowedSpaceReached
+	}
+
+	// Wait for any in-progress memtable switch or flush to finish. New flushes
+	// are not scheduled while the DB is read-only.
+	for {
+		if d.mu.mem.switching {
+			d.mu.mem.cond.Wait()
+			continue
+		}
+		if d.mu.compact.flushing {
+			d.mu.compact.cond.Wait()
+			continue
+		}
+		break
+	}
+
+	if d.mu.log.failed {
+		// Writes may have been lost from the failed WAL. Switch to a new WAL,
+		// and flush the memtable whose writes it held.
+		if err := d.switchMemTable(nil); err != nil {
+			return err
+		}
+		d.mu.log.failed = false
+	}
+
+	d.mu.compact.flushing = true
+	var err error
+	for err == nil && len(d.mu.mem.queue) > 1 && d.mu.mem.queue[0].readyForFlush() {
+		err = d.flush1()
+	}
+	d.mu.compact.flushing = false
+	if err != nil {
+		return err
+	}
+	if len(d.mu.mem.queue) > 1 {
+		// The oldest immutable memtable is still referenced by a write which was
+		// applying to it. Don't resume until it has been flushed, as flushes of
+		// the memtables behind it would wait on it.
+		return errMemTableNotFlushed
+	}
+
+	d.mu.bgErr = nil
+	d.opts.Logger.Infof("pebble: resumed writes")
+	d.maybeScheduleFlush()
+	d.maybeScheduleCompaction()
+	return nil
+}
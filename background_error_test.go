@@ -0,0 +1,415 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/storage"
+)
+
+// fullDisk is a storage.Injector which fails creates, writes and syncs with
+// ENOSPC while the disk is full.
+type fullDisk struct {
+	full int32
+}
+
+func (f *fullDisk) setFull(full bool) {
+	var v int32
+	if full {
+		v = 1
+	}
+	atomic.StoreInt32(&f.full, v)
+}
+
+func (f *fullDisk) MaybeError(op storage.Op, name string) error {
+	if atomic.LoadInt32(&f.full) == 0 {
+		return nil
+	}
+	switch op {
+	case storage.OpCreate, storage.OpWrite, storage.OpSync:
+		return syscall.ENOSPC
+	}
+	return nil
+}
+
+// errorRecorder records the errors passed to EventListener.BackgroundError.
+type errorRecorder struct {
+	mu   sync.Mutex
+	errs []error
+}
+
+func (r *errorRecorder) record(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.errs = append(r.errs, err)
+}
+
+func (r *errorRecorder) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.errs)
+}
+
+// waitForResume waits for the DB to resume accepting writes.
+func waitForResume(t *testing.T, d *DB) {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		err := d.Set([]byte("resume"), nil, nil)
+		if err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("DB did not resume: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestOutOfSpace(t *testing.T) {
+	testCases := []struct {
+		name string
+		// fill runs out of space while writing to the DB, returning the keys
+		// which were written and must be present once the DB resumes.
+		fill func(d *DB) ([]string, error)
+	}{
+		{"flush", func(d *DB) ([]string, error) {
+			if err := d.Set([]byte("a"), []byte("a"), nil); err != nil {
+				return nil, err
+			}
+			return []string{"a"}, d.Flush()
+		}},
+		{"sync", func(d *DB) ([]string, error) {
+			// The batch is applied to the memtable even though syncing the WAL
+			// fails, and is flushed when the DB resumes.
+			return []string{"a"}, d.Set([]byte("a"), []byte("a"), db.Sync)
+		}},
+		{"nosync", func(d *DB) ([]string, error) {
+			// Writing to the WAL fails once the writes which are flushed to it in
+			// the background run out of space. The earlier batches are applied to
+			// the memtable and are flushed when the DB resumes.
+			var keys []string
+			value := make([]byte, 1024)
+			for i := 0; i < 100000; i++ {
+				key := fmt.Sprintf("%05d", i)
+				if err := d.Set([]byte(key), value, db.NoSync); err != nil {
+					return keys, err
+				}
+				keys = append(keys, key)
+			}
+			return keys, nil
+		}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			disk := &fullDisk{}
+			fs := storage.NewFaultStorage(storage.NewMem(), false)
+			fs.SetInjector(disk)
+			var recorder errorRecorder
+			opts := &db.Options{
+				Storage: fs,
+				EventListener: &db.EventListener{
+					BackgroundError: recorder.record,
+				},
+			}
+			d, err := Open("", opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			disk.setFull(true)
+			keys, err := tc.fill(d)
+			if !isOutOfSpace(err) {
+				t.Fatalf("expected out of space error, but found %v", err)
+			}
+			// The DB is read-only until it resumes.
+			if err := d.Set([]byte("b"), []byte("b"), nil); !isOutOfSpace(err) {
+				t.Fatalf("expected out of space error, but found %v", err)
+			}
+			if err := d.Flush(); !isOutOfSpace(err) {
+				t.Fatalf("expected out of space error, but found %v", err)
+			}
+			// Compactions of the sstables are still allowed, though there are none.
+			if err := d.Compact([]byte("a"), []byte("z")); err != nil {
+				t.Fatal(err)
+			}
+			for _, key := range keys {
+				if _, err := d.Get([]byte(key)); err != nil {
+					t.Fatalf("%s: %v", key, err)
+				}
+			}
+			if n := recorder.count(); n != 1 {
+				t.Fatalf("expected 1 background error, but found %d", n)
+			}
+
+			// Attempts to resume fail while the disk is full.
+			time.Sleep(2 * resumeInterval)
+			if err := d.Set([]byte("b"), []byte("b"), nil); !isOutOfSpace(err) {
+				t.Fatalf("expected out of space error, but found %v", err)
+			}
+
+			disk.setFull(false)
+			waitForResume(t, d)
+			if n := recorder.count(); n != 1 {
+				t.Fatalf("expected 1 background error, but found %d", n)
+			}
+			if err := d.Set([]byte("b"), []byte("b"), db.Sync); err != nil {
+				t.Fatal(err)
+			}
+			// None of the memtables were left behind by the failed writes.
+			flushed := make(chan error, 1)
+			go func() { flushed <- d.Flush() }()
+			select {
+			case err := <-flushed:
+				if err != nil {
+					t.Fatal(err)
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatalf("flush did not complete")
+			}
+			if err := d.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			// The writes which were applied before the DB ran out of space were
+			// flushed when it resumed, and survive a crash.
+			if err := fs.Crash(); err != nil {
+				t.Fatal(err)
+			}
+			d, err = Open("", opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, key := range append(keys, "b") {
+				if _, err := d.Get([]byte(key)); err != nil {
+					t.Fatalf("%s: %v", key, err)
+				}
+			}
+			if err := d.Close(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestMaxAllowedSpaceUsage(t *testing.T) {
+	mem := storage.NewMem()
+	var recorder errorRecorder
+	opts := &db.Options{
+		Storage: mem,
+		EventListener: &db.EventListener{
+			BackgroundError: recorder.record,
+		},
+		// Prevent automatic compactions.
+		L0CompactionThreshold: 100,
+		L0StopWritesThreshold: 100,
+	}
+	d, err := Open("", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The file manager tracks the size of each table on disk.
+	expectedSize := func(d *DB) uint64 {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		var size uint64
+		for _, files := range d.mu.versions.currentVersion().files {
+			for i := range files {
+				stat, err := mem.Stat(dbFilename("", fileTypeTable, files[i].fileNum))
+				if err != nil {
+					t.Fatal(err)
+				}
+				size += uint64(stat.Size())
+			}
+		}
+		return size
+	}
+	for i := 0; i < 4; i++ {
+		for j := 0; j < 100; j++ {
+			key := fmt.Sprintf("%03d", j)
+			if err := d.Set([]byte(key), []byte(fmt.Sprint(i)), nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := d.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	size := d.fileManager.totalSize()
+	if expected := expectedSize(d); size != expected {
+		t.Fatalf("expected %d bytes, but found %d", expected, size)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reopen the DB with the limit reached. The size of the existing tables is
+	// determined when the DB is opened.
+	opts.MaxAllowedSpaceUsage = size
+	d, err = Open("", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := d.fileManager.totalSize(); s != size {
+		t.Fatalf("expected %d bytes, but found %d", size, s)
+	}
+
+	// A compaction of all of the tables does not fit under the limit.
+	if err := d.Compact([]byte("000"), []byte("100")); err != errNoSpaceForCompaction {
+		t.Fatalf("expected %v, but found %v", errNoSpaceForCompaction, err)
+	}
+
+	// Flushes fail once the limit is reached, making the DB read-only.
+	if err := d.Set([]byte("a"), []byte("a"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.AsyncFlush(); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		err := d.Set([]byte("b"), []byte("b"), nil)
+		if err == ErrMaxAllowedSpaceReached {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("DB did not become read-only")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := recorder.count(); n != 1 {
+		t.Fatalf("expected 1 background error, but found %d", n)
+	}
+
+	// While the DB is read-only, the compaction is allowed to temporarily exceed
+	// the limit. The tables hold 4 versions of each key, so the compaction
+	// reduces the space used below the limit and the DB resumes.
+	if err := d.Compact([]byte("000"), []byte("100")); err != nil {
+		t.Fatal(err)
+	}
+	if s, expected := d.fileManager.totalSize(), expectedSize(d); s != expected || s >= size {
+		t.Fatalf("expected %d bytes (less than %d), but found %d", expected, size, s)
+	}
+	waitForResume(t, d)
+	if n := recorder.count(); n != 1 {
+		t.Fatalf("expected 1 background error, but found %d", n)
+	}
+	if v, err := d.Get([]byte("a")); err != nil || string(v) != "a" {
+		t.Fatalf("expected a, but found %s (%v)", v, err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCompactionFreeSpace(t *testing.T) {
+	// A compaction whose outputs would not fit in the free space on the device
+	// is refused, even without Options.MaxAllowedSpaceUsage.
+	fs := &freeSpaceStorage{Storage: storage.NewMem()}
+	d, err := Open("", &db.Options{
+		Storage: fs,
+		// Prevent automatic compactions.
+		L0CompactionThreshold: 100,
+		L0StopWritesThreshold: 100,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, value := range []string{"1", "2"} {
+		if err := d.Set([]byte("a"), []byte(value), nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Compact([]byte("a"), []byte("b")); err != errNoSpaceForCompaction {
+		t.Fatalf("expected %v, but found %v", errNoSpaceForCompaction, err)
+	}
+
+	atomic.StoreUint64(&fs.free, 1<<20)
+	if err := d.Compact([]byte("a"), []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCompactionFreeSpaceStall(t *testing.T) {
+	// Writes stall waiting for an L0 compaction which does not fit in the free
+	// space on the device. The compaction is retried, and writes resume, once
+	// space is freed.
+	fs := &freeSpaceStorage{Storage: storage.NewMem()}
+	d, err := Open("", &db.Options{
+		Storage:               fs,
+		L0CompactionThreshold: 2,
+		L0StopWritesThreshold: 4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		for i := 0; i < 10; i++ {
+			if err := d.Set([]byte("a"), []byte(fmt.Sprint(i)), nil); err != nil {
+				done <- err
+				return
+			}
+			if err := d.Flush(); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		d.mu.Lock()
+		stalled := d.mu.compact.stalled
+		d.mu.Unlock()
+		if stalled {
+			break
+		}
+		select {
+		case err := <-done:
+			t.Fatalf("expected writes to stall, but found %v", err)
+		default:
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("writes did not stall")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	atomic.StoreUint64(&fs.free, 1<<20)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("writes did not resume")
+	}
+	if v, err := d.Get([]byte("a")); err != nil || string(v) != "9" {
+		t.Fatalf("expected 9, but found %s (%v)", v, err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -100,8 +100,9 @@ type Batch struct {
 	// memtable.
 	flushable *flushableBatch
 
-	commit  sync.WaitGroup
-	applied uint32 // updated atomically
+	commit    sync.WaitGroup
+	commitErr error
+	applied   uint32 // updated atomically
 }
 
 var _ Reader = (*Batch)(nil)
@@ -151,6 +152,7 @@ func (b *Batch) release() {
 	b.db = nil
 	b.flushable = nil
 	b.commit = sync.WaitGroup{}
+	b.commitErr = nil
 	atomic.StoreUint32(&b.applied, 0)
 
 	if b.index == nil {
@@ -319,6 +321,27 @@ func (b *Batch) Delete(key []byte, _ *db.WriteOptions) error {
 	return nil
 }
 
+// ingestSST adds an entry recording the ingestion of the sstable with the
+// specified file number to the batch. A batch containing such entries is only
+// written to the WAL, and is never applied to a memtable.
+func (b *Batch) ingestSST(fileNum uint64) error {
+	var buf [binary.MaxVarintLen64]byte
+	key := buf[:binary.PutUvarint(buf[:], fileNum)]
+	if len(b.data) == 0 {
+		b.init(len(key) + binary.MaxVarintLen64 + batchHeaderLen)
+	}
+	if !b.increment() {
+		return ErrInvalidBatch
+	}
+
+	pos := len(b.data)
+	b.grow(1 + maxVarintLen32 + len(key))
+	b.data[pos] = byte(db.InternalKeyKindIngestSST)
+	_, varlen1 := b.copyStr(pos+1, key)
+	b.data = b.data[:len(b.data)-(maxVarintLen32-varlen1)]
+	return nil
+}
+
 // DeleteRange deletes all of the keys (and values) in the range [start,end)
 // (inclusive on start, exclusive on end).
 //
@@ -540,7 +563,7 @@ func batchDecode(data []byte, offset uint32) (kind db.InternalKeyKind, ukey []by
 		return 0, nil, nil, false
 	}
 	kind, p = db.InternalKeyKind(p[0]), p[1:]
-	if kind > db.InternalKeyKindMax {
+	if kind > db.InternalKeyKindMax && kind != db.InternalKeyKindIngestSST {
 		return 0, nil, nil, false
 	}
 	p, ukey, ok = batchDecodeStr(p)
@@ -579,7 +602,7 @@ func (r *batchReader) next() (kind db.InternalKeyKind, ukey []byte, value []byte
 		return 0, nil, nil, false
 	}
 	kind, *r = db.InternalKeyKind(p[0]), p[1:]
-	if kind > db.InternalKeyKindMax {
+	if kind > db.InternalKeyKindMax && kind != db.InternalKeyKindIngestSST {
 		return 0, nil, nil, false
 	}
 	ukey, ok = r.nextStr()
@@ -700,6 +723,9 @@ type flushableBatch struct {
 	// range deletion iterator is requested.
 	tombstones []rangedel.Tombstone
 
+	// The number of the WAL the batch was written to.
+	logNum uint64
+
 	flushedCh chan struct{}
 }
 
@@ -819,6 +845,10 @@ func (b *flushableBatch) flushed() chan struct{} {
 	return b.flushedCh
 }
 
+func (b *flushableBatch) logNumber() uint64 {
+	return b.logNum
+}
+
 func (b *flushableBatch) readyForFlush() bool {
 	return true
 }
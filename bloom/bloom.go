@@ -132,6 +132,46 @@ func hash(b []byte) uint32 {
 	return h
 }
 
+type blockFilterWriter struct {
+	bitsPerKey int
+	hashes     []uint32
+}
+
+// AddKey implements the db.FilterWriter interface.
+func (w *blockFilterWriter) AddKey(key []byte) {
+	w.hashes = append(w.hashes, hash(key))
+}
+
+// Finish implements the db.FilterWriter interface.
+func (w *blockFilterWriter) Finish(buf []byte) []byte {
+	// The block filter format matches the LevelDB (and RocksDB block-based)
+	// filter format.
+	nBits := len(w.hashes) * w.bitsPerKey
+	// For small len(hashes), we can see a very high false positive rate. Fix it
+	// by enforcing a minimum bloom filter length.
+	if nBits < 64 {
+		nBits = 64
+	}
+	nBytes := (nBits + 7) / 8
+	nBits = nBytes * 8
+	// +1: 1 byte for num-probes
+	buf, filter := extend(buf, nBytes+1)
+
+	nProbes := calculateProbes(w.bitsPerKey)
+	for _, h := range w.hashes {
+		delta := h>>17 | h<<15 // rotate right 17 bits
+		for j := uint32(0); j < nProbes; j++ {
+			bitPos := h % uint32(nBits)
+			filter[bitPos/8] |= 1 << (bitPos % 8)
+			h += delta
+		}
+	}
+	filter[nBytes] = byte(nProbes)
+
+	w.hashes = w.hashes[:0]
+	return buf
+}
+
 type tableFilterWriter struct {
 	bitsPerKey int
 	hashes     []uint32
@@ -205,6 +245,8 @@ func (p FilterPolicy) Name() string {
 // MayContain implements the db.FilterPolicy interface.
 func (p FilterPolicy) MayContain(ftype db.FilterType, f, key []byte) bool {
 	switch ftype {
+	case db.BlockFilter:
+		return blockFilter(f).MayContain(key)
 	case db.TableFilter:
 		return tableFilter(f).MayContain(key)
 	default:
@@ -215,6 +257,10 @@ func (p FilterPolicy) MayContain(ftype db.FilterType, f, key []byte) bool {
 // NewWriter implements the db.FilterPolicy interface.
 func (p FilterPolicy) NewWriter(ftype db.FilterType) db.FilterWriter {
 	switch ftype {
+	case db.BlockFilter:
+		return &blockFilterWriter{
+			bitsPerKey: int(p),
+		}
 	case db.TableFilter:
 		return &tableFilterWriter{
 			bitsPerKey: int(p),
@@ -129,6 +129,48 @@ loop:
 	}
 }
 
+func TestBlockFilter(t *testing.T) {
+	le32 := func(i int) []byte {
+		b := make([]byte, 4)
+		b[0] = uint8(uint32(i) >> 0)
+		b[1] = uint8(uint32(i) >> 8)
+		b[2] = uint8(uint32(i) >> 16)
+		b[3] = uint8(uint32(i) >> 24)
+		return b
+	}
+
+	w := FilterPolicy(10).NewWriter(db.BlockFilter)
+	if f := blockFilter(w.Finish(nil)); f.MayContain([]byte("hello")) {
+		t.Fatalf("empty filter unexpectedly contains key")
+	}
+
+	for _, length := range []int{1, 10, 100, 1000, 10000} {
+		for i := 0; i < length; i++ {
+			w.AddKey(le32(i))
+		}
+		f := blockFilter(w.Finish(nil))
+		// The filter uses 10 bits per key, with a minimum of 64 bits, plus a
+		// trailing byte for the number of probes.
+		if maxLen := (length*10+63)/8 + 8 + 1; len(f) > maxLen {
+			t.Errorf("length=%d: len(f)=%d > max len %d", length, len(f), maxLen)
+		}
+		for i := 0; i < length; i++ {
+			if !FilterPolicy(10).MayContain(db.BlockFilter, f, le32(i)) {
+				t.Fatalf("length=%d: did not contain key %d", length, i)
+			}
+		}
+		nFalsePositive := 0
+		for i := 0; i < 10000; i++ {
+			if f.MayContain(le32(1e9 + i)) {
+				nFalsePositive++
+			}
+		}
+		if nFalsePositive > 0.02*10000 {
+			t.Errorf("length=%d: %d false positives in 10000", length, nFalsePositive)
+		}
+	}
+}
+
 func TestHash(t *testing.T) {
 	// The magic want numbers come from running the C++ leveldb code in hash.cc.
 	testCases := []struct {
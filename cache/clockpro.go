@@ -20,9 +20,12 @@ It is MIT licensed, like the original.
 package cache // import "github.com/petermattis/pebble/cache"
 
 import (
+	"runtime"
 	"sync"
 	"sync/atomic"
 	"unsafe"
+
+	"github.com/petermattis/pebble/internal/manual"
 )
 
 type entryType int8
@@ -50,25 +53,11 @@ type key struct {
 	offset  uint64
 }
 
-type value struct {
-	ptr unsafe.Pointer
-}
-
-func (v *value) set(b []byte) {
-	atomic.StorePointer(&v.ptr, unsafe.Pointer(&b))
-}
-
-func (v *value) get() []byte {
-	p := (*[]byte)(atomic.LoadPointer(&v.ptr))
-	if p == nil {
-		return nil
-	}
-	return *p
-}
-
 type entry struct {
-	key       key
-	val       value
+	key key
+	// val holds a *value, or nil for a test entry. It is accessed atomically so
+	// that a WeakHandle can retrieve the value without holding the shard mutex.
+	val       unsafe.Pointer
 	blockLink struct {
 		next *entry
 		prev *entry
@@ -77,9 +66,13 @@ type entry struct {
 		next *entry
 		prev *entry
 	}
-	size  int64
-	ptype entryType
-	ref   int32
+	size     int64
+	ptype    entryType
+	btype    BlockType
+	priority Priority
+	ref      int32
+	// The shard containing the entry, used to count hits through a WeakHandle.
+	shard *shard
 }
 
 func (e *entry) init() *entry {
@@ -130,25 +123,374 @@ func (e *entry) unlinkFile() *entry {
 	return next
 }
 
-func (e *entry) Get() []byte {
-	b := e.val.get()
-	if b == nil {
+// setValue sets the value of the entry, releasing the cache's reference to
+// the previous value.
+func (e *entry) setValue(v *value) {
+	old := (*value)(atomic.SwapPointer(&e.val, unsafe.Pointer(v)))
+	if old != nil {
+		old.release()
+	}
+}
+
+// acquireValue returns the value of the entry with a reference added, or nil
+// if the entry has no value.
+func (e *entry) acquireValue() *value {
+	v := (*value)(atomic.LoadPointer(&e.val))
+	if v == nil || !v.acquire() {
 		return nil
 	}
 	atomic.StoreInt32(&e.ref, 1)
-	return b
+	return v
+}
+
+func (e *entry) Get() Handle {
+	v := e.acquireValue()
+	if v == nil {
+		return Handle{}
+	}
+	atomic.AddInt64(&e.shard.stats[e.btype].Hits, 1)
+	return Handle{entry: e, value: v}
 }
 
 // WeakHandle provides a "weak" reference to an entry in the cache. A weak
 // reference allows the entry to be evicted, but also provides fast access
 type WeakHandle interface {
-	// Get retrieves the value associated with the weak handle, returning nil if
-	// no value is present.
-	Get() []byte
+	// Get retrieves the value associated with the weak handle, returning an
+	// empty handle if no value is present. A non-empty handle must be
+	// released.
+	Get() Handle
 }
 
-// Cache ...
+// BlockType identifies the type of a cached block. Statistics are maintained
+// separately for each type.
+type BlockType int8
+
+// The available block types.
+const (
+	DataBlock BlockType = iota
+	IndexBlock
+	FilterBlock
+	RangeDelBlock
+	// MetaBlock is any other block, such as the metaindex and properties
+	// blocks.
+	MetaBlock
+	// NumBlockTypes is the number of block types.
+	NumBlockTypes
+)
+
+func (t BlockType) String() string {
+	switch t {
+	case DataBlock:
+		return "data"
+	case IndexBlock:
+		return "index"
+	case FilterBlock:
+		return "filter"
+	case RangeDelBlock:
+		return "range-del"
+	case MetaBlock:
+		return "meta"
+	}
+	return "unknown"
+}
+
+// Priority determines how a block is retained in the cache.
+type Priority int8
+
+const (
+	// LowPriority blocks are managed by CLOCK-Pro. Blocks which are only
+	// accessed once, such as the data blocks read by a large scan, are evicted
+	// quickly.
+	LowPriority Priority = iota
+	// HighPriority blocks are kept in preference to low priority blocks. High
+	// priority blocks are held in a separate pool which is limited to
+	// highPriorityRatio of the capacity. When the pool is full, the least
+	// recently accessed high priority blocks are demoted to low priority.
+	HighPriority
+	// Pinned blocks are never evicted, though they count towards the size of the
+	// cache. A pinned block remains in the cache until it is unpinned (see
+	// Cache.Pin and Cache.Unpin) or its file is evicted.
+	Pinned
+)
+
+// highPriorityRatio is the fraction of the capacity reserved for high priority
+// blocks.
+const highPriorityRatio = 0.5
+
+// Stats holds the cache statistics for a block type.
+type Stats struct {
+	// Hits is the number of lookups which found the block in the cache,
+	// including lookups through a WeakHandle.
+	Hits int64
+	// Misses is the number of lookups which did not find the block.
+	Misses int64
+	// Inserts is the number of blocks added to the cache.
+	Inserts int64
+	// Evictions is the number of blocks evicted to make room for other blocks.
+	Evictions int64
+	// SecondaryHits is the number of lookups which missed in memory but found
+	// the block in the secondary cache.
+	SecondaryHits int64
+}
+
+// Cache implements the CLOCK-Pro caching algorithm. The cache is divided into
+// shards, selected by hashing the file number and offset, in order to reduce
+// contention on the cache mutex. Each shard has its own clock hands and an
+// equal share of the capacity.
+//
+// Cached values are allocated outside of the Go heap (see Alloc) so that a
+// large cache does not burden the garbage collector. Values are reference
+// counted: a value evicted from the cache is not freed until every Handle
+// referring to it has been released.
 type Cache struct {
+	maxSize   int64
+	shards    []shard
+	secondary *SecondaryCache
+}
+
+const (
+	// minShardSize is the minimum capacity of a shard. Small caches use fewer
+	// shards so that each shard is large enough to hold a useful number of
+	// blocks.
+	minShardSize = 512 << 10 // 512 KB
+	// maxShardsPerCPU limits the number of shards to a small multiple of the
+	// number of CPUs, beyond which additional shards do not reduce contention.
+	maxShardsPerCPU = 4
+)
+
+// New creates a new cache of the specified size. Memory for the cache is
+// allocated on demand, not during initialization. The cache must be closed
+// once it is no longer in use in order to free the memory.
+func New(size int64) *Cache {
+	shards := int64(maxShardsPerCPU * runtime.NumCPU())
+	if n := size / minShardSize; shards > n {
+		shards = n
+	}
+	if shards < 1 {
+		shards = 1
+	}
+	return newShardedCache(size, int(shards))
+}
+
+// NewWithSecondary creates a new cache of the specified size, backed by a
+// secondary cache which receives the blocks evicted from memory.
+func NewWithSecondary(size int64, secondary *SecondaryCache) *Cache {
+	c := New(size)
+	c.secondary = secondary
+	for i := range c.shards {
+		c.shards[i].secondary = secondary
+	}
+	return c
+}
+
+func newShardedCache(size int64, shards int) *Cache {
+	c := &Cache{
+		maxSize: size,
+		shards:  make([]shard, shards),
+	}
+	// Divide the capacity evenly between the shards, with the remainder spread
+	// across the first shards, so that the shard capacities sum to size.
+	for i := range c.shards {
+		shardSize := size / int64(shards)
+		if int64(i) < size%int64(shards) {
+			shardSize++
+		}
+		c.shards[i].init(shardSize)
+	}
+	return c
+}
+
+func (c *Cache) getShard(fileNum, offset uint64) *shard {
+	if len(c.shards) == 1 {
+		return &c.shards[0]
+	}
+	// Inlined version of fnv.New64 + Write over the 16 bytes of the file number
+	// and offset.
+	const (
+		offset64 = 14695981039346656037
+		prime64  = 1099511628211
+	)
+	h := uint64(offset64)
+	for i := 0; i < 8; i++ {
+		h *= prime64
+		h ^= fileNum & 0xff
+		fileNum >>= 8
+	}
+	for i := 0; i < 8; i++ {
+		h *= prime64
+		h ^= offset & 0xff
+		offset >>= 8
+	}
+	return &c.shards[h%uint64(len(c.shards))]
+}
+
+// Alloc allocates a byte slice of the specified size from manually managed
+// memory. The slice must either be passed to Set, which takes ownership of
+// it, or be freed with Free.
+func (c *Cache) Alloc(n int) []byte {
+	return manual.New(n)
+}
+
+// Free frees a byte slice allocated by Alloc which was not passed to Set.
+func (c *Cache) Free(b []byte) {
+	manual.Free(b)
+}
+
+// Get retrieves the cache value for the specified file and offset, returning
+// an empty handle if no value is present. A non-empty handle must be released
+// once the value is no longer in use. The lookup is counted in the statistics
+// for the specified block type.
+func (c *Cache) Get(fileNum, offset uint64, t BlockType) Handle {
+	if c == nil {
+		return Handle{}
+	}
+	return c.getShard(fileNum, offset).Get(fileNum, offset, t)
+}
+
+// GetSecondary retrieves the value for the specified file and offset from the
+// secondary cache, returning an empty handle if there is no secondary cache or
+// the value is not present in it. A value found in the secondary cache is
+// added to the cache with the specified type and priority. GetSecondary reads
+// from local storage, so it should only be called after a miss in Get.
+func (c *Cache) GetSecondary(fileNum, offset uint64, t BlockType, p Priority) Handle {
+	if c == nil || c.secondary == nil {
+		return Handle{}
+	}
+	b := c.secondary.get(fileNum, offset)
+	if b == nil {
+		return Handle{}
+	}
+	s := c.getShard(fileNum, offset)
+	atomic.AddInt64(&s.stats[t].SecondaryHits, 1)
+	return s.Set(fileNum, offset, b, t, p)
+}
+
+// Set sets the cache value for the specified file and offset, overwriting an
+// existing value if present. The value must have been allocated by Alloc, and
+// the cache takes ownership of it. A Handle referring to the value is returned
+// and must be released once the value is no longer in use. The handle's weak
+// handle (see Handle.Weak) provides faster retrieval of the cached value than
+// Get (lock-free and avoidance of the map lookup).
+//
+// Set is valid on a nil cache, in which case the value is freed when the
+// returned handle is released.
+func (c *Cache) Set(fileNum, offset uint64, value []byte, t BlockType, p Priority) Handle {
+	if c == nil {
+		return Handle{value: newValue(value)}
+	}
+	return c.getShard(fileNum, offset).Set(fileNum, offset, value, t, p)
+}
+
+// Pin raises the priority of a cached value to Pinned. It is a no-op if the
+// value is not present.
+func (c *Cache) Pin(fileNum, offset uint64) {
+	if c == nil {
+		return
+	}
+	c.getShard(fileNum, offset).Pin(fileNum, offset)
+}
+
+// Unpin reduces the priority of a pinned value to HighPriority, allowing it
+// to be evicted. It is a no-op if the value is not present or is not pinned.
+func (c *Cache) Unpin(fileNum, offset uint64) {
+	if c == nil {
+		return
+	}
+	c.getShard(fileNum, offset).Unpin(fileNum, offset)
+}
+
+// EvictFile evicts all of the cache values for the specified file. The blocks
+// of a file are spread across the shards, so every shard is visited.
+func (c *Cache) EvictFile(fileNum uint64) {
+	if c == nil {
+		return
+	}
+	for i := range c.shards {
+		c.shards[i].EvictFile(fileNum)
+	}
+	if c.secondary != nil {
+		c.secondary.evictFile(fileNum)
+	}
+}
+
+// RetainFiles evicts the blocks of every file for which live returns false
+// from the secondary cache, if there is one. The secondary cache outlives the
+// DB, and may hold the blocks of files which were deleted while it was not in
+// use, so a DB calls RetainFiles with its live files when it is opened.
+func (c *Cache) RetainFiles(live func(fileNum uint64) bool) {
+	if c == nil || c.secondary == nil {
+		return
+	}
+	c.secondary.retainFiles(live)
+}
+
+// Close removes all of the values from the cache. The memory for a value is
+// freed immediately, or once the last outstanding Handle referring to it is
+// released. Cached values are allocated outside of the Go heap, so a cache
+// which is discarded without being closed leaks its memory. The cache must
+// not be used after it is closed. A secondary cache is not closed along with
+// the cache. It is valid to call Close multiple times.
+func (c *Cache) Close() {
+	if c == nil {
+		return
+	}
+	for i := range c.shards {
+		c.shards[i].Close()
+	}
+}
+
+// MaxSize returns the max size of the cache.
+func (c *Cache) MaxSize() int64 {
+	if c == nil {
+		return 0
+	}
+	return c.maxSize
+}
+
+// Size returns the current space used by the cache.
+func (c *Cache) Size() int64 {
+	var size int64
+	for i := range c.shards {
+		size += c.shards[i].Size()
+	}
+	return size
+}
+
+// PinnedSize returns the space used by pinned values. Pinned values count
+// towards the size of the cache but are never evicted, so the pinned size is
+// not limited by the capacity of the cache.
+func (c *Cache) PinnedSize() int64 {
+	if c == nil {
+		return 0
+	}
+	var size int64
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.Lock()
+		size += s.countPinned
+		s.mu.Unlock()
+	}
+	return size
+}
+
+// Stats returns the statistics for the specified block type.
+func (c *Cache) Stats(t BlockType) Stats {
+	var s Stats
+	if c == nil {
+		return s
+	}
+	for i := range c.shards {
+		st := &c.shards[i].stats[t]
+		s.Hits += atomic.LoadInt64(&st.Hits)
+		s.Misses += atomic.LoadInt64(&st.Misses)
+		s.Inserts += atomic.LoadInt64(&st.Inserts)
+		s.Evictions += atomic.LoadInt64(&st.Evictions)
+		s.SecondaryHits += atomic.LoadInt64(&st.SecondaryHits)
+	}
+	return s
+}
+
+type shard struct {
 	mu sync.Mutex
 
 	maxSize  int64
@@ -163,73 +505,112 @@ type Cache struct {
 	countHot  int64
 	countCold int64
 	countTest int64
-}
 
-// New creates a new cache of the specified size. Memory for the cache is
-// allocated on demand, not during initialization.
-func New(size int64) *Cache {
-	return &Cache{
-		maxSize:  size,
-		coldSize: size,
-		blocks:   make(map[key]*entry),
-		files:    make(map[uint64]*entry),
-	}
+	// The high priority pool is a ring of entries, separate from the CLOCK-Pro
+	// ring, with a hand giving each entry a second chance before it is demoted.
+	// Pinned entries are not linked into either ring.
+	handHigh    *entry
+	countHigh   int64
+	countPinned int64
+
+	// stats is allocated separately to guarantee the 64-bit alignment required
+	// for atomic access.
+	stats *[NumBlockTypes]Stats
+
+	// secondary, if non-nil, receives the blocks evicted from the shard.
+	secondary *SecondaryCache
 }
 
-// Get retrieves the cache value for the specified file and offset, returning
-// nil if no value is present.
-func (c *Cache) Get(fileNum, offset uint64) []byte {
-	if c == nil {
-		return nil
-	}
+func (c *shard) init(size int64) {
+	c.maxSize = size
+	c.coldSize = size
+	c.blocks = make(map[key]*entry)
+	c.files = make(map[uint64]*entry)
+	c.stats = new([NumBlockTypes]Stats)
+}
 
+func (c *shard) Get(fileNum, offset uint64, t BlockType) Handle {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
 	e := c.blocks[key{fileNum: fileNum, offset: offset}]
-	if e == nil {
-		return nil
+	if e != nil {
+		if v := e.acquireValue(); v != nil {
+			atomic.AddInt64(&c.stats[t].Hits, 1)
+			return Handle{entry: e, value: v}
+		}
 	}
-	return e.Get()
+	atomic.AddInt64(&c.stats[t].Misses, 1)
+	return Handle{}
 }
 
-// Set sets the cache value for the specified file and offset, overwriting an
-// existing value if present. A WeakHandle is returned which provides faster
-// retrieval of the cached value than Get (lock-free and avoidance of the map
-// lookup).
-func (c *Cache) Set(fileNum, offset uint64, value []byte) WeakHandle {
-	if c == nil {
-		return nil
-	}
-
+func (c *shard) Set(fileNum, offset uint64, b []byte, t BlockType, p Priority) Handle {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	atomic.AddInt64(&c.stats[t].Inserts, 1)
+
+	// The value starts with the cache's reference. Add a reference for the
+	// returned handle before the value is published, as the entry may be
+	// evicted (releasing the cache's reference) before Set returns.
+	v := newValue(b)
+	v.acquire()
+
 	k := key{fileNum: fileNum, offset: offset}
 	e := c.blocks[k]
+	if e != nil && e.priority != p {
+		// The priority is changing. Remove the existing entry and add it back.
+		c.remove(e)
+		e = nil
+	}
 	if e == nil {
 		// no cache entry? add it
-		e = &entry{ptype: etCold, key: k, size: int64(len(value))}
+		e = &entry{ptype: etCold, key: k, size: int64(len(b)), btype: t, priority: p, shard: c}
 		e.init()
-		e.val.set(value)
+		e.setValue(v)
 		c.metaAdd(k, e)
-		c.countCold += e.size
-		return e
+		switch p {
+		case HighPriority:
+			c.countHigh += e.size
+			c.shrinkHigh()
+		case Pinned:
+			c.countPinned += e.size
+		default:
+			c.countCold += e.size
+		}
+		return Handle{entry: e, value: v}
+	}
+
+	e.btype = t
+	if p != LowPriority {
+		// cache entry was a high priority or pinned page
+		e.setValue(v)
+		atomic.StoreInt32(&e.ref, 1)
+		delta := int64(len(b)) - e.size
+		e.size = int64(len(b))
+		if p == HighPriority {
+			c.countHigh += delta
+			c.shrinkHigh()
+		} else {
+			c.countPinned += delta
+		}
+		c.evict()
+		return Handle{entry: e, value: v}
 	}
 
-	if e.val.get() != nil {
+	if atomic.LoadPointer(&e.val) != nil {
 		// cache entry was a hot or cold page
-		e.val.set(value)
+		e.setValue(v)
 		atomic.StoreInt32(&e.ref, 1)
-		delta := int64(len(value)) - e.size
-		e.size = int64(len(value))
+		delta := int64(len(b)) - e.size
+		e.size = int64(len(b))
 		if e.ptype == etHot {
 			c.countHot += delta
 		} else {
 			c.countCold += delta
 		}
 		c.evict()
-		return e
+		return Handle{entry: e, value: v}
 	}
 
 	// cache entry was a test page
@@ -238,21 +619,56 @@ func (c *Cache) Set(fileNum, offset uint64, value []byte) WeakHandle {
 		c.coldSize = c.maxSize
 	}
 	atomic.StoreInt32(&e.ref, 0)
-	e.val.set(value)
 	e.ptype = etHot
 	c.countTest -= e.size
 	c.metaDel(e)
+	e.size = int64(len(b))
 	c.metaAdd(k, e)
+	e.setValue(v)
 	c.countHot += e.size
-	return e
+	return Handle{entry: e, value: v}
 }
 
-// EvictFile evicts all of the cache values for the specified file.
-func (c *Cache) EvictFile(fileNum uint64) {
-	if c == nil {
+func (c *shard) Pin(fileNum, offset uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e := c.blocks[key{fileNum: fileNum, offset: offset}]
+	if e == nil || e.priority == Pinned || atomic.LoadPointer(&e.val) == nil {
+		return
+	}
+	if e.priority == HighPriority {
+		c.unlinkHigh(e)
+		c.countHigh -= e.size
+	} else {
+		if e.ptype == etHot {
+			c.countHot -= e.size
+		} else {
+			c.countCold -= e.size
+		}
+		c.unlinkClock(e)
+	}
+	e.priority = Pinned
+	c.countPinned += e.size
+}
+
+func (c *shard) Unpin(fileNum, offset uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e := c.blocks[key{fileNum: fileNum, offset: offset}]
+	if e == nil || e.priority != Pinned {
 		return
 	}
+	c.countPinned -= e.size
+	e.priority = HighPriority
+	c.linkHigh(e)
+	c.countHigh += e.size
+	c.shrinkHigh()
+}
 
+// EvictFile evicts all of the cache values for the specified file.
+func (c *shard) EvictFile(fileNum uint64) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
@@ -261,43 +677,118 @@ func (c *Cache) EvictFile(fileNum uint64) {
 		return
 	}
 	for b, n := blocks, (*entry)(nil); ; b = n {
-		switch b.ptype {
-		case etHot:
-			c.countHot -= b.size
-		case etCold:
-			c.countCold -= b.size
-		case etTest:
-			c.countTest -= b.size
-		}
 		n = b.fileLink.next
-		c.metaDel(b)
+		c.remove(b)
 		if b == n {
 			break
 		}
 	}
 }
 
-// MaxSize returns the max size of the cache.
-func (c *Cache) MaxSize() int64 {
-	if c == nil {
-		return 0
+// Close removes all of the entries from the shard, releasing the shard's
+// references to their values.
+func (c *shard) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, e := range c.blocks {
+		e.setValue(nil)
 	}
-	return c.maxSize
+	c.blocks = make(map[key]*entry)
+	c.files = make(map[uint64]*entry)
+	c.handHot, c.handCold, c.handTest, c.handHigh = nil, nil, nil, nil
+	c.countHot, c.countCold, c.countTest = 0, 0, 0
+	c.countHigh, c.countPinned = 0, 0
+	c.coldSize = c.maxSize
 }
 
-// Size returns the current space used by the cache.
-func (c *Cache) Size() int64 {
+// Size returns the current space used by the shard.
+func (c *shard) Size() int64 {
 	c.mu.Lock()
-	size := c.countHot + c.countCold
+	size := c.countHot + c.countCold + c.countHigh + c.countPinned
 	c.mu.Unlock()
 	return size
 }
 
-func (c *Cache) metaAdd(key key, e *entry) {
+// remove removes an entry from the shard, regardless of its priority.
+func (c *shard) remove(e *entry) {
+	switch {
+	case e.priority == HighPriority:
+		c.countHigh -= e.size
+	case e.priority == Pinned:
+		c.countPinned -= e.size
+	case e.ptype == etHot:
+		c.countHot -= e.size
+	case e.ptype == etCold:
+		c.countCold -= e.size
+	case e.ptype == etTest:
+		c.countTest -= e.size
+	}
+	c.metaDel(e)
+}
+
+// linkHigh adds an entry to the high priority pool.
+func (c *shard) linkHigh(e *entry) {
+	if c.handHigh == nil {
+		c.handHigh = e
+	} else {
+		c.handHigh.link(e)
+	}
+}
+
+// unlinkHigh removes an entry from the high priority pool.
+func (c *shard) unlinkHigh(e *entry) {
+	if e == c.handHigh {
+		c.handHigh = c.handHigh.next()
+	}
+	if e.unlink() == e {
+		c.handHigh = nil
+	}
+}
+
+// shrinkHigh demotes high priority entries to cold entries until the high
+// priority pool fits within its share of the capacity. An entry which has been
+// accessed since the hand last passed it is given a second chance.
+func (c *shard) shrinkHigh() {
+	limit := int64(float64(c.maxSize) * highPriorityRatio)
+	for c.countHigh > limit && c.handHigh != nil {
+		e := c.handHigh
+		if atomic.LoadInt32(&e.ref) == 1 {
+			atomic.StoreInt32(&e.ref, 0)
+			c.handHigh = c.handHigh.next()
+			continue
+		}
+		c.unlinkHigh(e)
+		c.countHigh -= e.size
+		e.priority = LowPriority
+		e.ptype = etCold
+		c.linkClock(e)
+		c.countCold += e.size
+	}
+}
+
+func (c *shard) metaAdd(key key, e *entry) {
 	c.evict()
 
 	c.blocks[key] = e
 
+	switch e.priority {
+	case HighPriority:
+		c.linkHigh(e)
+	case Pinned:
+	default:
+		c.linkClock(e)
+	}
+
+	if fileBlocks := c.files[key.fileNum]; fileBlocks == nil {
+		c.files[key.fileNum] = e
+	} else {
+		fileBlocks.linkFile(e)
+	}
+}
+
+// linkClock adds an entry to the CLOCK-Pro ring.
+func (c *shard) linkClock(e *entry) {
 	if c.handHot == nil {
 		// first element
 		c.handHot = e
@@ -310,17 +801,29 @@ func (c *Cache) metaAdd(key key, e *entry) {
 	if c.handCold == c.handHot {
 		c.handCold = c.handCold.prev()
 	}
+}
 
-	if fileBlocks := c.files[key.fileNum]; fileBlocks == nil {
-		c.files[key.fileNum] = e
+func (c *shard) metaDel(e *entry) {
+	e.setValue(nil)
+	delete(c.blocks, e.key)
+
+	switch e.priority {
+	case HighPriority:
+		c.unlinkHigh(e)
+	case Pinned:
+	default:
+		c.unlinkClock(e)
+	}
+
+	if next := e.unlinkFile(); e == next {
+		delete(c.files, e.key.fileNum)
 	} else {
-		fileBlocks.linkFile(e)
+		c.files[e.key.fileNum] = next
 	}
 }
 
-func (c *Cache) metaDel(e *entry) {
-	delete(c.blocks, e.key)
-
+// unlinkClock removes an entry from the CLOCK-Pro ring.
+func (c *shard) unlinkClock(e *entry) {
 	if e == c.handHot {
 		c.handHot = c.handHot.prev()
 	}
@@ -337,21 +840,18 @@ func (c *Cache) metaDel(e *entry) {
 		c.handCold = nil
 		c.handTest = nil
 	}
-
-	if next := e.unlinkFile(); e == next {
-		delete(c.files, e.key.fileNum)
-	} else {
-		c.files[e.key.fileNum] = next
-	}
 }
 
-func (c *Cache) evict() {
-	for c.maxSize <= c.countHot+c.countCold {
+func (c *shard) evict() {
+	// High priority and pinned entries count towards the capacity, but are
+	// never evicted by the clock hands.
+	for c.maxSize <= c.countHot+c.countCold+c.countHigh+c.countPinned &&
+		c.countHot+c.countCold > 0 {
 		c.runHandCold()
 	}
 }
 
-func (c *Cache) runHandCold() {
+func (c *shard) runHandCold() {
 	if c.handCold == nil {
 		return
 	}
@@ -364,7 +864,13 @@ func (c *Cache) runHandCold() {
 			c.countCold -= e.size
 			c.countHot += e.size
 		} else {
-			e.val.set(nil)
+			if c.secondary != nil {
+				if v := (*value)(atomic.LoadPointer(&e.val)); v != nil && v.acquire() {
+					c.secondary.add(e.key, v)
+				}
+			}
+			e.setValue(nil)
+			atomic.AddInt64(&c.stats[e.btype].Evictions, 1)
 			e.ptype = etTest
 			c.countCold -= e.size
 			c.countTest += e.size
@@ -374,14 +880,17 @@ func (c *Cache) runHandCold() {
 		}
 	}
 
-	c.handCold = c.handCold.next()
+	// Running the test hand may have removed the last entry in the ring.
+	if c.handCold != nil {
+		c.handCold = c.handCold.next()
+	}
 
 	for c.maxSize-c.coldSize <= c.countHot {
 		c.runHandHot()
 	}
 }
 
-func (c *Cache) runHandHot() {
+func (c *shard) runHandHot() {
 	if c.handHot == c.handTest {
 		c.runHandTest()
 	}
@@ -403,7 +912,7 @@ func (c *Cache) runHandHot() {
 	c.handHot = c.handHot.next()
 }
 
-func (c *Cache) runHandTest() {
+func (c *shard) runHandTest() {
 	if c.countCold > 0 && c.handTest == c.handCold {
 		c.runHandCold()
 	}
@@ -8,9 +8,28 @@ import (
 	"bytes"
 	"os"
 	"strconv"
+	"sync"
 	"testing"
 )
 
+// testValue returns a value of length n filled with s, allocated from the
+// cache's manually managed memory.
+func testValue(cache *Cache, s string, n int) []byte {
+	b := cache.Alloc(n)
+	copy(b, bytes.Repeat([]byte(s), n))
+	return b
+}
+
+// testGet returns a copy of the cached value, or nil if no value is present.
+func testGet(cache *Cache, fileNum, offset uint64, t BlockType) []byte {
+	h := cache.Get(fileNum, offset, t)
+	defer h.Release()
+	if h.Get() == nil {
+		return nil
+	}
+	return append([]byte(nil), h.Get()...)
+}
+
 func TestCache(t *testing.T) {
 	// Test data was generated from the python code
 	f, err := os.Open("testdata/cache")
@@ -19,6 +38,8 @@ func TestCache(t *testing.T) {
 	}
 
 	cache := New(200)
+
+	defer cache.Close()
 	scanner := bufio.NewScanner(f)
 
 	for scanner.Scan() {
@@ -31,9 +52,9 @@ func TestCache(t *testing.T) {
 		wantHit := fields[1][0] == 'h'
 
 		var hit bool
-		v := cache.Get(uint64(key), 0)
+		v := testGet(cache, uint64(key), 0, DataBlock)
 		if v == nil {
-			cache.Set(uint64(key), 0, append([]byte(nil), fields[0][0]))
+			cache.Set(uint64(key), 0, testValue(cache, string(fields[0][:1]), 1), DataBlock, LowPriority).Release()
 		} else {
 			hit = true
 			if !bytes.Equal(v, fields[0][:1]) {
@@ -48,24 +69,91 @@ func TestCache(t *testing.T) {
 
 func TestWeakHandle(t *testing.T) {
 	cache := New(5)
-	cache.Set(1, 0, bytes.Repeat([]byte("a"), 5))
-	h := cache.Set(0, 0, bytes.Repeat([]byte("b"), 5))
+	defer cache.Close()
+	cache.Set(1, 0, testValue(cache, "a", 5), DataBlock, LowPriority).Release()
+	h := cache.Set(0, 0, testValue(cache, "b", 5), DataBlock, LowPriority)
+	w := h.Weak()
+	if v := w.Get(); string(v.Get()) != "bbbbb" {
+		t.Fatalf("expected bbbbb, but found %v", v.Get())
+	} else {
+		v.Release()
+	}
+	cache.Set(2, 0, testValue(cache, "a", 5), DataBlock, LowPriority).Release()
+	if v := w.Get(); v.Get() != nil {
+		t.Fatalf("expected nil, but found %s", v.Get())
+	}
+	// The evicted value remains valid until the handle is released.
 	if v := h.Get(); string(v) != "bbbbb" {
-		t.Fatalf("expected bbbbb, but found %v", v)
+		t.Fatalf("expected bbbbb, but found %s", v)
 	}
-	cache.Set(2, 0, bytes.Repeat([]byte("a"), 5))
-	if v := h.Get(); v != nil {
-		t.Fatalf("expected nil, but found %s", v)
+	h.Release()
+}
+
+func TestHandleRefs(t *testing.T) {
+	cache := New(100)
+	defer cache.Close()
+	h := cache.Set(1, 0, testValue(cache, "a", 5), DataBlock, LowPriority)
+	if refs := h.value.refs; refs != 2 {
+		t.Fatalf("expected 2 refs, but found %d", refs)
+	}
+	h2 := cache.Get(1, 0, DataBlock)
+	if refs := h.value.refs; refs != 3 {
+		t.Fatalf("expected 3 refs, but found %d", refs)
+	}
+	h2.Release()
+
+	// Evicting the value releases the cache's reference, but the value remains
+	// valid until the handle is released.
+	cache.EvictFile(1)
+	if refs := h.value.refs; refs != 1 {
+		t.Fatalf("expected 1 ref, but found %d", refs)
+	}
+	if v := h.Get(); string(v) != "aaaaa" {
+		t.Fatalf("expected aaaaa, but found %s", v)
+	}
+	if v := h.Weak().Get(); v.Get() != nil {
+		t.Fatalf("expected nil, but found %s", v.Get())
+	}
+	h.Release()
+	if refs := h.value.refs; refs != 0 {
+		t.Fatalf("expected 0 refs, but found %d", refs)
+	}
+}
+
+func TestCacheClose(t *testing.T) {
+	cache := newShardedCache(100, 2)
+	cache.Set(1, 0, testValue(cache, "a", 5), DataBlock, LowPriority).Release()
+	cache.Set(2, 0, testValue(cache, "b", 5), IndexBlock, Pinned).Release()
+	h := cache.Set(3, 0, testValue(cache, "c", 5), DataBlock, HighPriority)
+
+	// Closing the cache releases the cache's references, but the value
+	// referred to by the outstanding handle remains valid until the handle is
+	// released.
+	cache.Close()
+	if size := cache.Size(); size != 0 {
+		t.Fatalf("expected cache size 0, but found %d", size)
 	}
+	if refs := h.value.refs; refs != 1 {
+		t.Fatalf("expected 1 ref, but found %d", refs)
+	}
+	if v := h.Get(); string(v) != "ccccc" {
+		t.Fatalf("expected ccccc, but found %s", v)
+	}
+	h.Release()
+	if refs := h.value.refs; refs != 0 {
+		t.Fatalf("expected 0 refs, but found %d", refs)
+	}
+	cache.Close()
 }
 
 func TestEvictFile(t *testing.T) {
 	cache := New(100)
-	cache.Set(0, 0, bytes.Repeat([]byte("a"), 5))
-	cache.Set(1, 0, bytes.Repeat([]byte("a"), 5))
-	cache.Set(2, 0, bytes.Repeat([]byte("a"), 5))
-	cache.Set(2, 1, bytes.Repeat([]byte("a"), 5))
-	cache.Set(2, 2, bytes.Repeat([]byte("a"), 5))
+	defer cache.Close()
+	cache.Set(0, 0, testValue(cache, "a", 5), DataBlock, LowPriority).Release()
+	cache.Set(1, 0, testValue(cache, "a", 5), DataBlock, LowPriority).Release()
+	cache.Set(2, 0, testValue(cache, "a", 5), DataBlock, LowPriority).Release()
+	cache.Set(2, 1, testValue(cache, "a", 5), DataBlock, LowPriority).Release()
+	cache.Set(2, 2, testValue(cache, "a", 5), DataBlock, LowPriority).Release()
 	if expected, size := int64(25), cache.Size(); expected != size {
 		t.Fatalf("expected cache size %d, but found %d", expected, size)
 	}
@@ -82,3 +170,194 @@ func TestEvictFile(t *testing.T) {
 		t.Fatalf("expected cache size %d, but found %d", expected, size)
 	}
 }
+
+func TestShardedCache(t *testing.T) {
+	cache := newShardedCache(1001, 4)
+	defer cache.Close()
+	var maxSize int64
+	for i := range cache.shards {
+		maxSize += cache.shards[i].maxSize
+	}
+	if expected := int64(1001); expected != maxSize || expected != cache.MaxSize() {
+		t.Fatalf("expected max size %d, but found %d and %d", expected, maxSize, cache.MaxSize())
+	}
+
+	// The blocks of a file are spread across the shards.
+	for i := uint64(0); i < 20; i++ {
+		cache.Set(1, i<<12, testValue(cache, "a", 5), DataBlock, LowPriority).Release()
+		cache.Set(2, i<<12, testValue(cache, "b", 5), DataBlock, LowPriority).Release()
+	}
+	used := 0
+	for i := range cache.shards {
+		if cache.shards[i].Size() > 0 {
+			used++
+		}
+	}
+	if used < 2 {
+		t.Fatalf("expected blocks in multiple shards, but found %d", used)
+	}
+	if expected, size := int64(200), cache.Size(); expected != size {
+		t.Fatalf("expected cache size %d, but found %d", expected, size)
+	}
+	for i := uint64(0); i < 20; i++ {
+		if v := testGet(cache, 2, i<<12, DataBlock); string(v) != "bbbbb" {
+			t.Fatalf("expected bbbbb, but found %s", v)
+		}
+	}
+
+	cache.EvictFile(1)
+	if expected, size := int64(100), cache.Size(); expected != size {
+		t.Fatalf("expected cache size %d, but found %d", expected, size)
+	}
+	for i := uint64(0); i < 20; i++ {
+		if v := testGet(cache, 1, i<<12, DataBlock); v != nil {
+			t.Fatalf("expected nil, but found %s", v)
+		}
+	}
+}
+
+func TestShardedCacheConcurrent(t *testing.T) {
+	cache := newShardedCache(1<<20, 8)
+	defer cache.Close()
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				fileNum, offset := uint64(g), uint64(i%100)<<12
+				if testGet(cache, fileNum, offset, DataBlock) == nil {
+					cache.Set(fileNum, offset, testValue(cache, "a", 100), DataBlock, LowPriority).Release()
+				}
+				if i%250 == 0 {
+					cache.EvictFile(uint64((g + 1) % 8))
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	if size := cache.Size(); size > cache.MaxSize() {
+		t.Fatalf("expected cache size <= %d, but found %d", cache.MaxSize(), size)
+	}
+}
+
+func TestStats(t *testing.T) {
+	cache := New(100)
+	defer cache.Close()
+	if v := testGet(cache, 1, 0, DataBlock); v != nil {
+		t.Fatalf("expected nil, but found %s", v)
+	}
+	cache.Set(1, 0, testValue(cache, "a", 10), DataBlock, LowPriority).Release()
+	h := cache.Set(1, 1, testValue(cache, "b", 10), IndexBlock, HighPriority)
+	h.Release()
+	cache.Get(1, 0, DataBlock).Release()
+	cache.Get(1, 1, IndexBlock).Release()
+	h.Weak().Get().Release()
+	cache.Get(1, 2, FilterBlock).Release()
+
+	expected := map[BlockType]Stats{
+		DataBlock:   {Hits: 1, Misses: 1, Inserts: 1},
+		IndexBlock:  {Hits: 2, Inserts: 1},
+		FilterBlock: {Misses: 1},
+	}
+	for bt := BlockType(0); bt < NumBlockTypes; bt++ {
+		if s := cache.Stats(bt); expected[bt] != s {
+			t.Fatalf("%s: expected %+v, but found %+v", bt, expected[bt], s)
+		}
+	}
+
+	// Filling the cache with data blocks evicts the first data block.
+	for i := uint64(2); i < 20; i++ {
+		cache.Set(1, i, testValue(cache, "c", 10), DataBlock, LowPriority).Release()
+	}
+	if s := cache.Stats(DataBlock); s.Evictions == 0 {
+		t.Fatalf("expected evictions, but found %+v", s)
+	}
+	if s := cache.Stats(IndexBlock); s.Evictions != 0 {
+		t.Fatalf("expected no evictions, but found %+v", s)
+	}
+}
+
+func TestPriority(t *testing.T) {
+	cache := newShardedCache(100, 1)
+	defer cache.Close()
+	cache.Set(1, 0, testValue(cache, "i", 10), IndexBlock, HighPriority).Release()
+	cache.Set(1, 1, testValue(cache, "f", 10), FilterBlock, HighPriority).Release()
+
+	// A scan over many data blocks does not evict the high priority blocks.
+	for i := uint64(0); i < 100; i++ {
+		cache.Set(2, i, testValue(cache, "d", 10), DataBlock, LowPriority).Release()
+	}
+	if v := testGet(cache, 1, 0, IndexBlock); string(v) != "iiiiiiiiii" {
+		t.Fatalf("expected index block, but found %s", v)
+	}
+	if v := testGet(cache, 1, 1, FilterBlock); string(v) != "ffffffffff" {
+		t.Fatalf("expected filter block, but found %s", v)
+	}
+	if size := cache.Size(); size > cache.MaxSize() {
+		t.Fatalf("expected cache size <= %d, but found %d", cache.MaxSize(), size)
+	}
+
+	// The high priority pool is limited to half of the capacity. Overflowing it
+	// demotes the blocks which have not been accessed recently.
+	for i := uint64(2); i < 10; i++ {
+		cache.Set(1, i, testValue(cache, "i", 10), IndexBlock, HighPriority).Release()
+	}
+	if high := cache.shards[0].countHigh; high > 50 {
+		t.Fatalf("expected high priority size <= 50, but found %d", high)
+	}
+	if size := cache.Size(); size > cache.MaxSize() {
+		t.Fatalf("expected cache size <= %d, but found %d", cache.MaxSize(), size)
+	}
+}
+
+func TestPinned(t *testing.T) {
+	cache := newShardedCache(100, 1)
+	defer cache.Close()
+	cache.Set(1, 0, testValue(cache, "p", 40), IndexBlock, Pinned).Release()
+	for i := uint64(0); i < 100; i++ {
+		cache.Set(2, i, testValue(cache, "d", 10), DataBlock, LowPriority).Release()
+	}
+	if v := testGet(cache, 1, 0, IndexBlock); len(v) != 40 {
+		t.Fatalf("expected pinned block, but found %s", v)
+	}
+	if size := cache.Size(); size > cache.MaxSize() {
+		t.Fatalf("expected cache size <= %d, but found %d", cache.MaxSize(), size)
+	}
+
+	// Once unpinned, the block is retained as a high priority block.
+	cache.Unpin(1, 0)
+	if pinned, high := cache.shards[0].countPinned, cache.shards[0].countHigh; pinned != 0 || high != 40 {
+		t.Fatalf("expected pinned=0 high=40, but found pinned=%d high=%d", pinned, high)
+	}
+
+	// Changing the priority of a cached block moves it between the pools.
+	cache.Set(1, 0, testValue(cache, "p", 40), IndexBlock, Pinned).Release()
+	if pinned, high := cache.shards[0].countPinned, cache.shards[0].countHigh; pinned != 40 || high != 0 {
+		t.Fatalf("expected pinned=40 high=0, but found pinned=%d high=%d", pinned, high)
+	}
+	cache.EvictFile(1)
+	if pinned := cache.shards[0].countPinned; pinned != 0 {
+		t.Fatalf("expected pinned=0, but found %d", pinned)
+	}
+	if v := testGet(cache, 1, 0, IndexBlock); v != nil {
+		t.Fatalf("expected nil, but found %s", v)
+	}
+}
+
+func BenchmarkCacheGet(b *testing.B) {
+	const size = 100000
+	cache := New(size << 10)
+	defer cache.Close()
+	for i := uint64(0); i < size; i++ {
+		cache.Set(0, i, cache.Alloc(1), DataBlock, LowPriority).Release()
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		var i uint64
+		for pb.Next() {
+			cache.Get(0, i%size, DataBlock).Release()
+			i++
+		}
+	})
+}
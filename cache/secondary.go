@@ -0,0 +1,554 @@
+// Copyright 2018. All rights reserved. Use of this source code is governed by
+// an MIT-style license that can be found in the LICENSE file.
+
+package cache
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/petermattis/pebble/internal/crc"
+	"github.com/petermattis/pebble/internal/manual"
+	"github.com/petermattis/pebble/storage"
+)
+
+const (
+	// secondaryHeaderLen is the length of the header preceding each block in a
+	// segment: checksum (4 bytes), length (4 bytes), file number (8 bytes) and
+	// offset (8 bytes). The checksum covers the remainder of the header and the
+	// block.
+	secondaryHeaderLen = 24
+	// secondaryNumSegments is the number of segments the capacity of the
+	// secondary cache is divided into. The oldest segment is discarded as a
+	// whole when the cache is full, so more segments make the eviction finer
+	// grained.
+	secondaryNumSegments = 8
+	// minSecondarySegmentSize is the minimum size of a segment.
+	minSecondarySegmentSize = 1 << 20 // 1 MB
+	// secondaryQueueLen is the number of evicted blocks which may be waiting to
+	// be written. Blocks evicted while the queue is full are dropped.
+	secondaryQueueLen = 256
+	secondarySuffix   = ".cache"
+	// secondaryTombstone is the offset recorded for a tombstone, an empty
+	// block which marks the preceding blocks of its file as evicted.
+	secondaryTombstone = math.MaxUint64
+)
+
+type secondarySegment struct {
+	num  uint64
+	r    storage.File
+	w    storage.File // nil once the segment is no longer being written
+	size int64
+	keys []key
+	// refs is the number of references to the segment: one held by the
+	// secondary cache until the segment is discarded or closed, and one held
+	// by each read of the segment in progress. The segment files are closed
+	// once the last reference is released, and the segment is removed if
+	// obsolete is set.
+	refs     int32
+	obsolete bool
+}
+
+type secondaryLoc struct {
+	seg    *secondarySegment
+	offset int64
+	length int
+}
+
+type secondaryWrite struct {
+	key   key
+	value *value
+	// evict, if non-empty, lists the files whose blocks are to be evicted.
+	evict []uint64
+	// done, if non-nil, is closed once the write and the preceding writes
+	// have completed.
+	done chan struct{}
+}
+
+// SecondaryCache is a second tier for a Cache which stores evicted blocks in
+// files on local storage. It is intended for use when the sstables live on
+// slower storage than the secondary cache directory, such as a network
+// attached volume with a local SSD. Blocks evicted from memory are written to
+// the secondary cache in the background, and a block found in the secondary
+// cache is promoted back into memory (see Cache.GetSecondary).
+//
+// The blocks are appended to a sequence of segment files. When the secondary
+// cache is full, the oldest segment is deleted. The index of the blocks is
+// held in memory and is rebuilt from the segment files when the secondary
+// cache is reopened, so the cached blocks survive restarts.
+//
+// The blocks are keyed by file number and offset, the same as in the Cache,
+// so the directory must not be shared between DBs and must be cleared if the
+// DB is recreated. Evicting a file writes a tombstone, so that its blocks are
+// not restored when the secondary cache is reopened, and a DB evicts the files
+// which are no longer live when it is opened (see Cache.RetainFiles). This
+// prevents stale blocks from being returned if a file number is reused.
+type SecondaryCache struct {
+	fs          storage.Storage
+	dir         string
+	maxSize     int64
+	segmentSize int64
+
+	// mu protects the index and the segments. The segment files are written
+	// with mu held, but are read without it: a read holds a reference to the
+	// segment, so that the segment is not closed or removed while it is read.
+	mu struct {
+		sync.RWMutex
+		index    map[key]secondaryLoc
+		files    map[uint64]map[uint64]struct{}
+		segments []*secondarySegment // oldest first
+		size     int64
+		nextNum  uint64
+		buf      []byte
+		err      error
+	}
+
+	closeMu sync.RWMutex
+	closed  bool
+	writeCh chan secondaryWrite
+	wg      sync.WaitGroup
+}
+
+// NewSecondaryCache opens the secondary cache stored in dir, creating the
+// directory if it does not exist, and rebuilds the index of the blocks in it.
+// The secondary cache holds up to size bytes of blocks. It should be passed to
+// NewWithSecondary, and must be closed after the Cache is no longer in use.
+func NewSecondaryCache(fs storage.Storage, dir string, size int64) (*SecondaryCache, error) {
+	s := &SecondaryCache{
+		fs:          fs,
+		dir:         dir,
+		maxSize:     size,
+		segmentSize: size / secondaryNumSegments,
+		writeCh:     make(chan secondaryWrite, secondaryQueueLen),
+	}
+	if s.segmentSize < minSecondarySegmentSize {
+		s.segmentSize = minSecondarySegmentSize
+	}
+	s.mu.index = make(map[key]secondaryLoc)
+	s.mu.files = make(map[uint64]map[uint64]struct{})
+	s.mu.nextNum = 1
+
+	if err := fs.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	if err := s.load(); err != nil {
+		s.closeSegments()
+		return nil, err
+	}
+	s.mu.Lock()
+	err := s.newSegmentLocked()
+	s.mu.Unlock()
+	if err != nil {
+		s.closeSegments()
+		return nil, err
+	}
+
+	s.wg.Add(1)
+	go s.writeLoop()
+	return s, nil
+}
+
+// load rebuilds the index from the existing segments.
+func (s *SecondaryCache) load() error {
+	ls, err := s.fs.List(s.dir)
+	if err != nil {
+		return err
+	}
+	var nums []uint64
+	for _, name := range ls {
+		if !strings.HasSuffix(name, secondarySuffix) {
+			continue
+		}
+		num, err := strconv.ParseUint(strings.TrimSuffix(name, secondarySuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		nums = append(nums, num)
+	}
+	sort.Slice(nums, func(i, j int) bool { return nums[i] < nums[j] })
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, num := range nums {
+		f, err := s.fs.Open(s.segmentPath(num))
+		if err != nil {
+			return err
+		}
+		seg := &secondarySegment{num: num, r: f, refs: 1}
+		s.mu.segments = append(s.mu.segments, seg)
+		if err := s.scanSegmentLocked(seg); err != nil {
+			return err
+		}
+		s.mu.size += seg.size
+		s.mu.nextNum = num + 1
+	}
+	s.evictLocked()
+	return nil
+}
+
+// scanSegmentLocked adds the blocks in the segment to the index. A segment
+// ends at the first block which is incomplete or fails its checksum, which is
+// the result of a write interrupted by a crash.
+func (s *SecondaryCache) scanSegmentLocked(seg *secondarySegment) error {
+	info, err := seg.r.Stat()
+	if err != nil {
+		return err
+	}
+	fileSize := info.Size()
+	var header [secondaryHeaderLen]byte
+	for seg.size+secondaryHeaderLen <= fileSize {
+		if _, err := seg.r.ReadAt(header[:], seg.size); err != nil {
+			return err
+		}
+		length := int64(binary.LittleEndian.Uint32(header[4:8]))
+		if seg.size+secondaryHeaderLen+length > fileSize {
+			break
+		}
+		b := make([]byte, length)
+		if _, err := seg.r.ReadAt(b, seg.size+secondaryHeaderLen); err != nil && err != io.EOF {
+			return err
+		}
+		if binary.LittleEndian.Uint32(header[0:4]) != crc.New(header[4:]).Update(b).Value() {
+			break
+		}
+		k := key{
+			fileNum: binary.LittleEndian.Uint64(header[8:16]),
+			offset:  binary.LittleEndian.Uint64(header[16:24]),
+		}
+		if k.offset == secondaryTombstone {
+			// The tombstone only evicts the blocks which precede it, so blocks of
+			// a reused file number which follow it are retained.
+			s.deleteFileLocked(k.fileNum)
+		} else {
+			s.addLocked(k, secondaryLoc{seg: seg, offset: seg.size + secondaryHeaderLen, length: int(length)})
+		}
+		seg.size += secondaryHeaderLen + length
+	}
+	return nil
+}
+
+func (s *SecondaryCache) segmentPath(num uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%06d%s", num, secondarySuffix))
+}
+
+// newSegmentLocked starts writing a new segment.
+func (s *SecondaryCache) newSegmentLocked() error {
+	if n := len(s.mu.segments); n > 0 && s.mu.segments[n-1].w != nil {
+		last := s.mu.segments[n-1]
+		if err := last.w.Close(); err != nil {
+			return err
+		}
+		last.w = nil
+	}
+	path := s.segmentPath(s.mu.nextNum)
+	w, err := s.fs.Create(path)
+	if err != nil {
+		return err
+	}
+	r, err := s.fs.Open(path)
+	if err != nil {
+		w.Close()
+		return err
+	}
+	s.mu.segments = append(s.mu.segments, &secondarySegment{num: s.mu.nextNum, r: r, w: w, refs: 1})
+	s.mu.nextNum++
+	return nil
+}
+
+func (s *SecondaryCache) addLocked(k key, loc secondaryLoc) {
+	s.mu.index[k] = loc
+	offsets := s.mu.files[k.fileNum]
+	if offsets == nil {
+		offsets = make(map[uint64]struct{})
+		s.mu.files[k.fileNum] = offsets
+	}
+	offsets[k.offset] = struct{}{}
+	loc.seg.keys = append(loc.seg.keys, k)
+}
+
+// deleteFileLocked removes the blocks of the specified file from the index.
+func (s *SecondaryCache) deleteFileLocked(fileNum uint64) {
+	for offset := range s.mu.files[fileNum] {
+		delete(s.mu.index, key{fileNum: fileNum, offset: offset})
+	}
+	delete(s.mu.files, fileNum)
+}
+
+func (s *SecondaryCache) deleteLocked(k key) {
+	delete(s.mu.index, k)
+	if offsets := s.mu.files[k.fileNum]; offsets != nil {
+		delete(offsets, k.offset)
+		if len(offsets) == 0 {
+			delete(s.mu.files, k.fileNum)
+		}
+	}
+}
+
+// evictLocked deletes the oldest segments until the secondary cache fits
+// within its capacity. The segment being written is never deleted.
+func (s *SecondaryCache) evictLocked() {
+	for s.mu.size > s.maxSize && len(s.mu.segments) > 1 {
+		seg := s.mu.segments[0]
+		s.mu.segments = s.mu.segments[1:]
+		s.mu.size -= seg.size
+		for _, k := range seg.keys {
+			if loc, ok := s.mu.index[k]; ok && loc.seg == seg {
+				s.deleteLocked(k)
+			}
+		}
+		seg.obsolete = true
+		// Errors are ignored: the blocks are already gone from the index, and a
+		// leftover segment is only scanned again on the next open.
+		_ = s.unrefSegment(seg)
+	}
+}
+
+// unrefSegment releases a reference to the segment, closing the segment files
+// and removing an obsolete segment once the last reference is released.
+func (s *SecondaryCache) unrefSegment(seg *secondarySegment) error {
+	if atomic.AddInt32(&seg.refs, -1) != 0 {
+		return nil
+	}
+	err := seg.r.Close()
+	if seg.w != nil {
+		if err2 := seg.w.Close(); err == nil {
+			err = err2
+		}
+	}
+	if seg.obsolete {
+		if err2 := s.fs.Remove(s.segmentPath(seg.num)); err == nil {
+			err = err2
+		}
+	}
+	return err
+}
+
+// get returns a copy of the block, allocated from manually managed memory, or
+// nil if the block is not present.
+func (s *SecondaryCache) get(fileNum, offset uint64) []byte {
+	k := key{fileNum: fileNum, offset: offset}
+	s.mu.RLock()
+	loc, ok := s.mu.index[k]
+	if ok {
+		atomic.AddInt32(&loc.seg.refs, 1)
+	}
+	s.mu.RUnlock()
+	if !ok {
+		return nil
+	}
+	defer s.unrefSegment(loc.seg)
+
+	var header [secondaryHeaderLen]byte
+	if _, err := loc.seg.r.ReadAt(header[:], loc.offset-secondaryHeaderLen); err != nil {
+		return nil
+	}
+	b := manual.New(loc.length)
+	if n, err := loc.seg.r.ReadAt(b, loc.offset); n != loc.length || (err != nil && err != io.EOF) {
+		manual.Free(b)
+		return nil
+	}
+	if binary.LittleEndian.Uint32(header[0:4]) != crc.New(header[4:]).Update(b).Value() {
+		// The block is corrupt. It is left in the index, but not returned.
+		manual.Free(b)
+		return nil
+	}
+	return b
+}
+
+// add queues an evicted block to be written to the secondary cache, taking
+// ownership of a reference to the value. The block is dropped if the queue is
+// full, as add is called with a cache shard locked and must not block.
+func (s *SecondaryCache) add(k key, v *value) {
+	s.closeMu.RLock()
+	defer s.closeMu.RUnlock()
+	if s.closed {
+		v.release()
+		return
+	}
+	select {
+	case s.writeCh <- secondaryWrite{key: k, value: v}:
+	default:
+		v.release()
+	}
+}
+
+func (s *SecondaryCache) writeLoop() {
+	defer s.wg.Done()
+	for w := range s.writeCh {
+		switch {
+		case w.value != nil:
+			s.write(w.key, w.value.buf)
+			w.value.release()
+		case len(w.evict) > 0:
+			s.evictFiles(w.evict)
+		}
+		if w.done != nil {
+			close(w.done)
+		}
+	}
+}
+
+// flush waits for the queued blocks to be written.
+func (s *SecondaryCache) flush() {
+	s.queueAndWait(secondaryWrite{})
+}
+
+// queueAndWait queues w, which unlike the blocks queued by add is never
+// dropped, and waits for it to complete. Nothing is done if the secondary
+// cache is closed.
+func (s *SecondaryCache) queueAndWait(w secondaryWrite) {
+	w.done = make(chan struct{})
+	s.closeMu.RLock()
+	if s.closed {
+		s.closeMu.RUnlock()
+		return
+	}
+	s.writeCh <- w
+	s.closeMu.RUnlock()
+	<-w.done
+}
+
+// write appends a block to the segment being written.
+func (s *SecondaryCache) write(k key, b []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.mu.index[k]; ok {
+		return
+	}
+	s.appendLocked(k, b)
+}
+
+// appendLocked appends a block, or a tombstone, to the segment being written.
+func (s *SecondaryCache) appendLocked(k key, b []byte) {
+	if s.mu.err != nil {
+		return
+	}
+	buf := s.mu.buf[:0]
+	buf = append(buf, make([]byte, secondaryHeaderLen)...)
+	binary.LittleEndian.PutUint32(buf[4:8], uint32(len(b)))
+	binary.LittleEndian.PutUint64(buf[8:16], k.fileNum)
+	binary.LittleEndian.PutUint64(buf[16:24], k.offset)
+	buf = append(buf, b...)
+	binary.LittleEndian.PutUint32(buf[0:4], crc.New(buf[4:]).Value())
+	s.mu.buf = buf
+
+	seg := s.mu.segments[len(s.mu.segments)-1]
+	if _, err := seg.w.Write(buf); err != nil {
+		// Stop writing to the secondary cache. Any partially written block fails
+		// its checksum, and the blocks already written remain readable.
+		s.mu.err = err
+		return
+	}
+	if k.offset != secondaryTombstone {
+		s.addLocked(k, secondaryLoc{seg: seg, offset: seg.size + secondaryHeaderLen, length: len(b)})
+	}
+	seg.size += int64(len(buf))
+	s.mu.size += int64(len(buf))
+
+	if seg.size >= s.segmentSize {
+		if err := s.newSegmentLocked(); err != nil {
+			s.mu.err = err
+			return
+		}
+	}
+	s.evictLocked()
+}
+
+// evictFile removes the blocks of the specified file from the secondary cache,
+// including those still queued to be written. The space used by the blocks is
+// reclaimed when their segments are deleted.
+func (s *SecondaryCache) evictFile(fileNum uint64) {
+	s.queueAndWait(secondaryWrite{evict: []uint64{fileNum}})
+}
+
+// retainFiles evicts the blocks of every file for which live returns false.
+func (s *SecondaryCache) retainFiles(live func(fileNum uint64) bool) {
+	var evict []uint64
+	s.mu.RLock()
+	for fileNum := range s.mu.files {
+		if !live(fileNum) {
+			evict = append(evict, fileNum)
+		}
+	}
+	s.mu.RUnlock()
+	if len(evict) > 0 {
+		s.queueAndWait(secondaryWrite{evict: evict})
+	}
+}
+
+// evictFiles removes the blocks of the specified files from the index, and
+// writes a tombstone for each file so that the blocks are not restored when
+// the secondary cache is reopened.
+func (s *SecondaryCache) evictFiles(fileNums []uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, fileNum := range fileNums {
+		if _, ok := s.mu.files[fileNum]; !ok {
+			continue
+		}
+		s.deleteFileLocked(fileNum)
+		s.appendLocked(key{fileNum: fileNum, offset: secondaryTombstone}, nil)
+	}
+}
+
+// Size returns the current space used by the secondary cache.
+func (s *SecondaryCache) Size() int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.mu.size
+}
+
+// Close waits for the queued blocks to be written and closes the secondary
+// cache. Blocks evicted from the Cache after Close are dropped.
+func (s *SecondaryCache) Close() error {
+	s.closeMu.Lock()
+	if s.closed {
+		s.closeMu.Unlock()
+		return errors.New("pebble/cache: secondary cache already closed")
+	}
+	s.closed = true
+	close(s.writeCh)
+	s.closeMu.Unlock()
+	s.wg.Wait()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.mu.err
+	if n := len(s.mu.segments); n > 0 && s.mu.segments[n-1].w != nil {
+		if err2 := s.mu.segments[n-1].w.Sync(); err == nil {
+			err = err2
+		}
+	}
+	if err2 := s.closeSegmentsLocked(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+func (s *SecondaryCache) closeSegments() {
+	s.mu.Lock()
+	_ = s.closeSegmentsLocked()
+	s.mu.Unlock()
+}
+
+func (s *SecondaryCache) closeSegmentsLocked() error {
+	var err error
+	for _, seg := range s.mu.segments {
+		if err2 := s.unrefSegment(seg); err == nil {
+			err = err2
+		}
+	}
+	s.mu.segments = nil
+	s.mu.index = nil
+	s.mu.files = nil
+	return err
+}
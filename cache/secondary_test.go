@@ -0,0 +1,275 @@
+// Copyright 2018. All rights reserved. Use of this source code is governed by
+// an MIT-style license that can be found in the LICENSE file.
+
+package cache
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/petermattis/pebble/internal/manual"
+	"github.com/petermattis/pebble/storage"
+)
+
+func TestSecondaryCache(t *testing.T) {
+	fs := storage.NewMem()
+	secondary, err := NewSecondaryCache(fs, "secondary", 8<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := NewWithSecondary(1000, secondary)
+	defer cache.Close()
+
+	// Fill the cache well beyond its capacity, evicting most of the blocks to
+	// the secondary cache.
+	for i := uint64(0); i < 100; i++ {
+		cache.Set(1, i, testValue(cache, fmt.Sprint(i%10), 100), DataBlock, LowPriority).Release()
+	}
+	secondary.flush()
+	if secondary.Size() == 0 {
+		t.Fatalf("expected blocks in the secondary cache")
+	}
+
+	var found int
+	for i := uint64(0); i < 100; i++ {
+		if testGet(cache, 1, i, DataBlock) != nil {
+			continue
+		}
+		h := cache.GetSecondary(1, i, DataBlock, LowPriority)
+		if v := h.Get(); v != nil {
+			if expected := bytes.Repeat([]byte(fmt.Sprint(i%10)), 100); !bytes.Equal(expected, v) {
+				t.Fatalf("%d: expected %s, but found %s", i, expected, v)
+			}
+			found++
+		}
+		h.Release()
+	}
+	if found == 0 {
+		t.Fatalf("expected blocks to be found in the secondary cache")
+	}
+	if s := cache.Stats(DataBlock); s.SecondaryHits != int64(found) {
+		t.Fatalf("expected %d secondary hits, but found %+v", found, s)
+	}
+
+	// Evicting the file removes its blocks from the secondary cache.
+	cache.EvictFile(1)
+	for i := uint64(0); i < 100; i++ {
+		if b := secondary.get(1, i); b != nil {
+			t.Fatalf("%d: expected nil, but found %s", i, b)
+		}
+	}
+	if err := secondary.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSecondaryCacheReopen(t *testing.T) {
+	fs := storage.NewMem()
+	secondary, err := NewSecondaryCache(fs, "secondary", 8<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := uint64(0); i < 10; i++ {
+		secondary.write(key{fileNum: 2, offset: i}, bytes.Repeat([]byte{byte('a' + i)}, 50))
+	}
+	if err := secondary.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A segment with a torn write is ignored beyond the last complete block.
+	f, err := fs.Create("secondary/000100.cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("torn write")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	secondary, err = NewSecondaryCache(fs, "secondary", 8<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := uint64(0); i < 10; i++ {
+		b := secondary.get(2, i)
+		if expected := bytes.Repeat([]byte{byte('a' + i)}, 50); !bytes.Equal(expected, b) {
+			t.Fatalf("%d: expected %s, but found %s", i, expected, b)
+		}
+		manual.Free(b)
+	}
+	if b := secondary.get(2, 10); b != nil {
+		t.Fatalf("expected nil, but found %s", b)
+	}
+
+	// New segments are numbered after the existing segments.
+	if n := len(secondary.mu.segments); secondary.mu.segments[n-1].num != 101 {
+		t.Fatalf("expected segment 101, but found %d", secondary.mu.segments[n-1].num)
+	}
+	if err := secondary.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSecondaryCacheBounded(t *testing.T) {
+	fs := storage.NewMem()
+	const size = 4 << 20
+	secondary, err := NewSecondaryCache(fs, "secondary", size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := make([]byte, 64<<10)
+	for i := uint64(0); i < 256; i++ {
+		secondary.write(key{fileNum: 3, offset: i}, block)
+		if s := secondary.Size(); s > size+secondary.segmentSize {
+			t.Fatalf("expected size <= %d, but found %d", size+secondary.segmentSize, s)
+		}
+	}
+	// The oldest blocks were discarded along with their segments.
+	if b := secondary.get(3, 0); b != nil {
+		t.Fatalf("expected nil, but found %d bytes", len(b))
+	}
+	b := secondary.get(3, 255)
+	if len(b) != len(block) {
+		t.Fatalf("expected %d bytes, but found %d", len(block), len(b))
+	}
+	manual.Free(b)
+	ls, err := fs.List("secondary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(secondary.mu.segments); len(ls) != n {
+		t.Fatalf("expected %d segments, but found %d: %v", n, len(ls), ls)
+	}
+	if err := secondary.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSecondaryCacheEvictReopen(t *testing.T) {
+	fs := storage.NewMem()
+	secondary, err := NewSecondaryCache(fs, "secondary", 8<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for fileNum := uint64(1); fileNum <= 3; fileNum++ {
+		for i := uint64(0); i < 10; i++ {
+			secondary.write(key{fileNum: fileNum, offset: i}, bytes.Repeat([]byte{'a'}, 50))
+		}
+	}
+	// File 1 is evicted and its file number reused, file 2 is evicted, and
+	// file 3 is evicted when the secondary cache is reopened as it is not live.
+	secondary.evictFile(1)
+	secondary.write(key{fileNum: 1, offset: 0}, bytes.Repeat([]byte{'b'}, 50))
+	secondary.evictFile(2)
+	if err := secondary.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	secondary, err = NewSecondaryCache(fs, "secondary", 8<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secondary.retainFiles(func(fileNum uint64) bool { return fileNum != 3 })
+	b := secondary.get(1, 0)
+	if expected := bytes.Repeat([]byte{'b'}, 50); !bytes.Equal(expected, b) {
+		t.Fatalf("expected %s, but found %s", expected, b)
+	}
+	manual.Free(b)
+	for fileNum := uint64(1); fileNum <= 3; fileNum++ {
+		for i := uint64(1); i < 10; i++ {
+			if b := secondary.get(fileNum, i); b != nil {
+				t.Fatalf("%d/%d: expected nil, but found %s", fileNum, i, b)
+			}
+		}
+	}
+	if err := secondary.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The eviction of file 3 was also persisted.
+	secondary, err = NewSecondaryCache(fs, "secondary", 8<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := secondary.get(3, 0); b != nil {
+		t.Fatalf("expected nil, but found %s", b)
+	}
+	if err := secondary.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSecondaryCacheReadDiscardedSegment(t *testing.T) {
+	fs := storage.NewMem()
+	const size = 4 << 20
+	secondary, err := NewSecondaryCache(fs, "secondary", size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := make([]byte, 64<<10)
+	secondary.write(key{fileNum: 1, offset: 0}, block)
+
+	// A read in progress holds a reference to the segment, which is not
+	// removed until the read completes even though the segment is discarded.
+	seg := secondary.mu.segments[0]
+	atomic.AddInt32(&seg.refs, 1)
+	for i := uint64(1); i < 256; i++ {
+		secondary.write(key{fileNum: 1, offset: i}, block)
+	}
+	if b := secondary.get(1, 0); b != nil {
+		t.Fatalf("expected nil, but found %d bytes", len(b))
+	}
+	path := secondary.segmentPath(seg.num)
+	if _, err := fs.Stat(path); err != nil {
+		t.Fatalf("expected segment to be retained: %v", err)
+	}
+	if _, err := seg.r.ReadAt(make([]byte, secondaryHeaderLen), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := secondary.unrefSegment(seg); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat(path); err == nil {
+		t.Fatalf("expected segment to be removed")
+	}
+	if err := secondary.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSecondaryCacheConcurrentReads(t *testing.T) {
+	// Reads do not hold the lock which writes wait for, and may read the
+	// segment being written.
+	fs := storage.NewMem()
+	secondary, err := NewSecondaryCache(fs, "secondary", 8<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := bytes.Repeat([]byte{'x'}, 1000)
+	secondary.write(key{fileNum: 1, offset: 0}, block)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := uint64(1); i < 1000; i++ {
+			secondary.write(key{fileNum: 1, offset: i}, block)
+		}
+	}()
+	for i := 0; i < 1000; i++ {
+		b := secondary.get(1, 0)
+		if !bytes.Equal(block, b) {
+			t.Fatalf("expected %d bytes, but found %d", len(block), len(b))
+		}
+		manual.Free(b)
+	}
+	wg.Wait()
+	if err := secondary.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright 2018. All rights reserved. Use of this source code is governed by
+// an MIT-style license that can be found in the LICENSE file.
+
+package cache
+
+import (
+	"sync/atomic"
+
+	"github.com/petermattis/pebble/internal/manual"
+)
+
+// value is a reference counted cache value. The buffer is allocated from
+// manually managed memory and is freed when the last reference is released.
+// The cache holds one reference while the value is cached, and each Handle
+// holds another.
+type value struct {
+	buf  []byte
+	refs int32
+}
+
+func newValue(b []byte) *value {
+	return &value{buf: b, refs: 1}
+}
+
+// acquire adds a reference to the value, returning false if the value has
+// already been freed. The value struct itself lives on the Go heap, so it is
+// safe to call acquire on a value whose buffer has been freed.
+func (v *value) acquire() bool {
+	for {
+		refs := atomic.LoadInt32(&v.refs)
+		if refs <= 0 {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&v.refs, refs, refs+1) {
+			return true
+		}
+	}
+}
+
+func (v *value) release() {
+	switch refs := atomic.AddInt32(&v.refs, -1); {
+	case refs == 0:
+		manual.Free(v.buf)
+	case refs < 0:
+		panic("pebble: cache value released too many times")
+	}
+}
+
+// Handle provides a strong reference to a value in the cache. The value is
+// guaranteed to remain valid until the handle is released, even if it is
+// evicted from the cache in the meantime. Every non-empty handle must be
+// released exactly once.
+type Handle struct {
+	entry *entry
+	value *value
+}
+
+// Get returns the value associated with the handle, or nil for an empty
+// handle. The returned slice must not be used after the handle is released.
+func (h Handle) Get() []byte {
+	if h.value == nil {
+		return nil
+	}
+	return h.value.buf
+}
+
+// Release releases the reference to the value. Release is a no-op for an
+// empty handle.
+func (h Handle) Release() {
+	if h.value != nil {
+		h.value.release()
+	}
+}
+
+// Weak returns a weak handle to the cache entry, or nil if the value was not
+// added to a cache.
+func (h Handle) Weak() WeakHandle {
+	if h.entry == nil {
+		return nil
+	}
+	return h.entry
+}
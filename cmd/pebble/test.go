@@ -190,8 +190,11 @@ func runTest(dir string, t test) {
 
 	fmt.Printf("dir %s\nconcurrency %d\n", dir, concurrency)
 
+	// The cache is not closed: the workers run until the process exits, which
+	// frees the cache's memory.
+	c := cache.New(1 << 30)
 	db, err := pebble.Open(dir, &db.Options{
-		Cache:                       cache.New(1 << 30),
+		Cache:                       c,
 		Comparer:                    mvccComparer,
 		MemTableSize:                64 << 20,
 		MemTableStopWritesThreshold: 4,
@@ -251,12 +251,9 @@ func (p *commitPipeline) syncLoop() {
 
 		s.Unlock()
 
-		if err := p.env.sync(); err != nil {
-			// TODO(peter): Handle error notification.
-			panic(err)
-		}
-
+		err := p.env.sync()
 		for _, b := range pending {
+			b.commitErr = err
 			b.commit.Done()
 		}
 
@@ -284,9 +281,7 @@ func (p *commitPipeline) Commit(b *Batch, syncWAL bool) error {
 	// WAL.
 	mem, err := p.prepare(b, true /* writeWAL */, syncWAL)
 	if err != nil {
-		// TODO(peter): what to do on error? the pipeline will be horked at this
-		// point.
-		panic(err)
+		return err
 	}
 
 	// Apply the batch to the memtable.
@@ -299,7 +294,7 @@ func (p *commitPipeline) Commit(b *Batch, syncWAL bool) error {
 	// Publish the batch sequence number.
 	p.publish(b)
 
-	return nil
+	return b.commitErr
 }
 
 // AllocateSeqNum allocates a sequence number, invokes the prepare callback,
@@ -307,9 +302,9 @@ func (p *commitPipeline) Commit(b *Batch, syncWAL bool) error {
 // number. AllocateSeqNum does not write to the WAL or add entries to the
 // memtable. AllocateSeqNum can be used to sequence an operation such as
 // sstable ingestion within the commit pipeline. The prepare callback is
-// invoked with commitEnv.mu held, making it suitable for flushing the memtable
-// if necessary.
-func (p *commitPipeline) AllocateSeqNum(prepare func(), apply func(seqNum uint64)) {
+// invoked with commitEnv.mu held and the allocated sequence number, making it
+// suitable for flushing the memtable if necessary.
+func (p *commitPipeline) AllocateSeqNum(prepare func(seqNum uint64), apply func(seqNum uint64)) {
 	// This method is similar to Commit and prepare. Be careful about trying to
 	// share additional code with those methods because Commit and prepare are
 	// performance critical code paths.
@@ -341,7 +336,7 @@ func (p *commitPipeline) AllocateSeqNum(prepare func(), apply func(seqNum uint64
 	// Invoke the prepare callback. Note the lack of error reporting. Even if the
 	// callback internally fails, the sequence number needs to be published in
 	// order to allow the commit pipeline to proceed.
-	prepare()
+	prepare(b.seqNum())
 
 	p.env.mu.Unlock()
 
@@ -363,7 +358,9 @@ func (p *commitPipeline) prepare(b *Batch, writeWAL, syncWAL bool) (*memTable, e
 	}
 	b.commit.Add(count)
 
-	// p.env.controller.WaitN(len(b.data))
+	// Apply back-pressure if the commit rate is being limited. See
+	// DB.updateWriteRate.
+	p.env.controller.WaitN(len(b.data))
 
 	p.env.mu.Lock()
 
@@ -384,6 +381,17 @@ func (p *commitPipeline) prepare(b *Batch, writeWAL, syncWAL bool) (*memTable, e
 
 	p.env.mu.Unlock()
 
+	if err != nil {
+		// The batch was not written to the WAL, and will not be applied to the
+		// memtable. Its sequence numbers must still be published so that the
+		// batches queued behind it can proceed.
+		if syncWAL {
+			b.commit.Done()
+		}
+		p.publish(b)
+		return nil, err
+	}
+
 	if syncWAL {
 		s := &p.syncer
 		s.Lock()
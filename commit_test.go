@@ -103,9 +103,14 @@ func TestCommitPipelineAllocateSeqNum(t *testing.T) {
 	for i := 0; i < n; i++ {
 		go func(i int) {
 			defer wg.Done()
-			p.AllocateSeqNum(func() {
+			var prepareSeqNum uint64
+			p.AllocateSeqNum(func(seqNum uint64) {
+				prepareSeqNum = seqNum
 				atomic.AddUint64(&prepareCount, 1)
 			}, func(seqNum uint64) {
+				if prepareSeqNum != seqNum {
+					t.Errorf("expected seqnum %d, but found %d", prepareSeqNum, seqNum)
+				}
 				atomic.AddUint64(&applyCount, 1)
 			})
 		}(i)
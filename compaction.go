@@ -11,6 +11,7 @@ import (
 	"os"
 	"path/filepath"
 	"sort"
+	"time"
 	"unsafe"
 
 	"github.com/petermattis/pebble/db"
@@ -20,6 +21,8 @@ import (
 
 var errEmptyTable = errors.New("pebble: empty table")
 
+var errNoSpaceForCompaction = errors.New("pebble: not enough space for compaction")
+
 // expandedCompactionByteSizeLimit is the maximum number of bytes in all
 // compacted files. We avoid expanding the lower level file set of a compaction
 // if it would make the total compaction cover more than this many bytes.
@@ -40,8 +43,19 @@ type compaction struct {
 	version *version
 
 	// level is the level that is being compacted. Inputs from level and
-	// level+1 will be merged to produce a set of level+1 files.
+	// outputLevel will be merged to produce a set of outputLevel files.
 	level int
+	// outputLevel is the level that the compaction outputs are written to. This
+	// is level+1, except for compactions of the last level which rewrite files
+	// within the last level.
+	outputLevel int
+	// allowIngestBehind is true if the last level is reserved for ingested
+	// sstables, in which case tombstones are never elided.
+	allowIngestBehind bool
+	// forced is true if the compaction was picked because its input was marked
+	// for compaction rather than because its level exceeded its size
+	// threshold. Forced compactions always rewrite their inputs.
+	forced bool
 
 	// maxOutputFileSize is the maximum size of an individual table created
 	// during compaction.
@@ -57,21 +71,47 @@ type compaction struct {
 	// inputs are the tables to be compacted.
 	inputs [2][]fileMetadata
 
+	// smallest and largest are the bounds of the keys spanned by inputs[0] and
+	// inputs[1]. Used to determine whether the compaction conflicts with other
+	// in-progress compactions.
+	smallest db.InternalKey
+	largest  db.InternalKey
+
 	// grandparents are the tables in level+2 that overlap with the files being
 	// compacted. Used to determine output table boundaries.
 	grandparents    []fileMetadata
 	overlappedBytes uint64 // bytes of overlap with grandparent tables
 	seenKey         bool   // some output key has been seen
+
+	// reservedBytes is the space reserved for the outputs of the compaction in
+	// the sstFileManager.
+	reservedBytes uint64
+}
+
+// numCompactionLevels returns the number of levels which flushes and
+// compactions may write to. If Options.AllowIngestBehind is set, the last
+// level is reserved for ingested sstables.
+func numCompactionLevels(opts *db.Options) int {
+	if opts.AllowIngestBehind {
+		return numLevels - 1
+	}
+	return numLevels
 }
 
 func newCompaction(opts *db.Options, cur *version, level int) *compaction {
+	outputLevel := level + 1
+	if outputLevel == numCompactionLevels(opts) {
+		outputLevel = level
+	}
 	c := &compaction{
 		cmp:               opts.Comparer.Compare,
 		version:           cur,
 		level:             level,
-		maxOutputFileSize: uint64(opts.Level(level + 1).TargetFileSize),
-		maxOverlapBytes:   maxGrandparentOverlapBytes(opts, level+1),
-		maxExpandedBytes:  expandedCompactionByteSizeLimit(opts, level+1),
+		outputLevel:       outputLevel,
+		allowIngestBehind: opts.AllowIngestBehind,
+		maxOutputFileSize: uint64(opts.Level(outputLevel).TargetFileSize),
+		maxOverlapBytes:   maxGrandparentOverlapBytes(opts, outputLevel),
+		maxExpandedBytes:  expandedCompactionByteSizeLimit(opts, outputLevel),
 	}
 	return c
 }
@@ -80,6 +120,11 @@ func newCompaction(opts *db.Options, cur *version, level int) *compaction {
 // whether the compaction was automatically scheduled or user initiated.
 func (c *compaction) setupOtherInputs() {
 	c.inputs[0] = c.expandInputs(c.inputs[0])
+	if c.outputLevel == c.level {
+		// A compaction within the last level only rewrites its inputs.
+		c.smallest, c.largest = ikeyRange(c.cmp, c.inputs[0], nil)
+		return
+	}
 	smallest0, largest0 := ikeyRange(c.cmp, c.inputs[0], nil)
 	c.inputs[1] = c.version.overlaps(c.level+1, c.cmp, smallest0.UserKey, largest0.UserKey)
 	smallest01, largest01 := ikeyRange(c.cmp, c.inputs[0], c.inputs[1])
@@ -88,6 +133,7 @@ func (c *compaction) setupOtherInputs() {
 	if c.grow(smallest01, largest01) {
 		smallest01, largest01 = ikeyRange(c.cmp, c.inputs[0], c.inputs[1])
 	}
+	c.smallest, c.largest = smallest01, largest01
 
 	// Compute the set of level+2 files that overlap this compaction.
 	if c.level+2 < numLevels {
@@ -163,6 +209,19 @@ func (c *compaction) grow(sm, la db.InternalKey) bool {
 	return true
 }
 
+// overlaps returns true if c and other both read or write the same level and
+// the key ranges they span within that level overlap. Overlapping compactions
+// cannot run concurrently: they might compact the same input file, or produce
+// outputs which overlap in the output level.
+func (c *compaction) overlaps(other *compaction) bool {
+	if c.level > other.outputLevel || other.level > c.outputLevel {
+		// The compactions do not share any levels.
+		return false
+	}
+	return c.cmp(c.smallest.UserKey, other.largest.UserKey) <= 0 &&
+		c.cmp(other.smallest.UserKey, c.largest.UserKey) <= 0
+}
+
 // shouldStopBefore returns true if the output to the current table should be
 // finished and a new table started before adding the specified key. This is
 // done in order to prevent a table at level N from overlapping too much data
@@ -197,10 +256,34 @@ func (c *compaction) shouldStopBefore(key db.InternalKey) bool {
 	return false
 }
 
+// isBottommost returns true if no tables in the levels below the output level
+// overlap the compaction, in which case the compaction output holds the oldest
+// data for its key range.
+func (c *compaction) isBottommost() bool {
+	for level := c.outputLevel + 1; level < numLevels; level++ {
+		if len(c.version.overlaps(level, c.cmp, c.smallest.UserKey, c.largest.UserKey)) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// trivialMove returns true if the compaction can be performed by moving its
+// single input table to the output level, without rewriting it.
+func (c *compaction) trivialMove(opts *db.Options) bool {
+	return !c.forced && c.outputLevel != c.level &&
+		len(c.inputs[0]) == 1 && len(c.inputs[1]) == 0 &&
+		totalSize(c.grandparents) <= maxGrandparentOverlapBytes(opts, c.outputLevel)
+}
+
 // elideTombstone returns true if it is ok to elide a tombstone for the
 // specified key. A return value of true guarantees that there are no key/value
 // pairs at c.level+2 or higher that possibly contain the specified user key.
 func (c *compaction) elideTombstone(key []byte) bool {
+	if c.allowIngestBehind {
+		// An sstable ingested behind may contain the key.
+		return false
+	}
 	// TODO(peter): this can be faster if ukey is always increasing between
 	// successive elideTombstones calls and we can keep some state in between
 	// calls.
@@ -223,6 +306,10 @@ func (c *compaction) elideTombstone(key []byte) bool {
 // tombstone. A return value of true guarantees that there are no key/value
 // pairs at c.level+2 or higher that possibly overlap the specified tombstone.
 func (c *compaction) elideRangeTombstone(start, end []byte) bool {
+	if c.allowIngestBehind {
+		// An sstable ingested behind may overlap the tombstone.
+		return false
+	}
 	for level := c.level + 2; level < numLevels; level++ {
 		overlaps := c.version.overlaps(level, c.cmp, start, end)
 		if len(overlaps) > 0 {
@@ -296,8 +383,11 @@ func (c *compaction) newInputIter(
 
 func (c *compaction) String() string {
 	var buf bytes.Buffer
-	for i := range c.inputs {
-		fmt.Fprintf(&buf, "%d:", i+c.level)
+	for i, level := range [2]int{c.level, c.outputLevel} {
+		if i > 0 && level == c.level {
+			break
+		}
+		fmt.Fprintf(&buf, "%d:", level)
 		for _, f := range c.inputs[i] {
 			fmt.Fprintf(&buf, " %d:%s-%s", f.fileNum, f.smallest, f.largest)
 		}
@@ -317,7 +407,7 @@ type manualCompaction struct {
 //
 // d.mu must be held when calling this.
 func (d *DB) maybeScheduleFlush() {
-	if d.mu.compact.flushing || d.mu.closed {
+	if d.mu.compact.flushing || d.mu.closed || d.mu.bgErr != nil {
 		return
 	}
 	if len(d.mu.mem.queue) <= 1 {
@@ -335,8 +425,12 @@ func (d *DB) flush() {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 	if err := d.flush1(); err != nil {
+		if isOutOfSpace(err) {
+			d.setBackgroundError(err)
+		} else if d.opts.EventListener != nil && d.opts.EventListener.BackgroundError != nil {
+			d.opts.EventListener.BackgroundError(err)
+		}
 		// TODO(peter): count consecutive compaction errors and backoff.
-		_ = err
 	}
 	d.mu.compact.flushing = false
 	// More flush work may have arrived while we were flushing, so schedule
@@ -361,11 +455,19 @@ func (d *DB) flush1() error {
 
 	var n int
 	for ; n < len(d.mu.mem.queue)-1; n++ {
+		if _, ok := d.mu.mem.queue[n].(*ingestedFlushable); ok {
+			// Ingested sstables are flushed separately from the memtables they
+			// are queued above.
+			break
+		}
 		if !d.mu.mem.queue[n].readyForFlush() {
 			break
 		}
 	}
 	if n == 0 {
+		if s, ok := d.mu.mem.queue[0].(*ingestedFlushable); ok {
+			return d.flushIngested(s)
+		}
 		// None of the immutable memtables are ready for flushing.
 		return nil
 	}
@@ -393,6 +495,10 @@ func (d *DB) flush1() error {
 		iter = newMergingIter(d.cmp, iters...)
 	}
 
+	if d.fileManager.maxAllowedSpaceReached() {
+		return ErrMaxAllowedSpaceReached
+	}
+
 	jobID := d.mu.nextJobID
 	d.mu.nextJobID++
 	if d.opts.EventListener != nil && d.opts.EventListener.FlushBegin != nil {
@@ -429,8 +535,12 @@ func (d *DB) flush1() error {
 		return err
 	}
 
+	// The WALs of the flushed memtables are obsolete once the table is added,
+	// but the WAL of the first flushable left in the queue is not. Flushables
+	// may have been queued while d.mu was dropped, but never ahead of the
+	// flushed prefix.
 	err = d.mu.versions.logAndApply(&versionEdit{
-		logNumber: d.mu.log.number,
+		logNumber: d.mu.mem.queue[n].logNumber(),
 		newFiles: []newFileEntry{
 			{level: 0, meta: meta},
 		},
@@ -460,6 +570,34 @@ func (d *DB) flush1() error {
 	return nil
 }
 
+// flushIngested adds the sstables of an ingestedFlushable at the head of the
+// flushable queue to L0. The sstables are already in the DB directory, so
+// unlike a memtable flush nothing needs to be written other than the MANIFEST.
+//
+// d.mu must be held when calling this.
+func (d *DB) flushIngested(s *ingestedFlushable) error {
+	// The WAL recording the ingestion is obsolete once the sstables are added,
+	// and the mutable memtable is always queued after s.
+	ve := &versionEdit{
+		logNumber: d.mu.mem.queue[1].logNumber(),
+		newFiles:  make([]newFileEntry, len(s.files)),
+	}
+	for i := range s.files {
+		ve.newFiles[i] = newFileEntry{level: 0, meta: s.files[i]}
+	}
+	if err := d.mu.versions.logAndApply(ve); err != nil {
+		return err
+	}
+	// Readers which captured the flushable queue before this point may still
+	// read the sstables through s rather than through a version. Each such
+	// reader holds a reference to one of the versions which are currently live,
+	// so those versions keep the sstables from being deleted.
+	d.mu.versions.pinFileNums(s.fileNums())
+	close(s.flushed())
+	d.mu.mem.queue = d.mu.mem.queue[1:]
+	return nil
+}
+
 // writeLevel0Table writes a memtable to a level-0 on-disk table.
 //
 // If no error is returned, it adds the file number of that on-disk table to
@@ -489,7 +627,7 @@ func (d *DB) writeLevel0Table(
 	defer d.mu.Lock()
 
 	elideRangeTombstone := func(start, end []byte) bool {
-		if !allowRangeTombstoneElision {
+		if !allowRangeTombstoneElision || d.opts.AllowIngestBehind {
 			return false
 		}
 		for level := 0; level < numLevels; level++ {
@@ -528,7 +666,11 @@ func (d *DB) writeLevel0Table(
 		return fileMetadata{}, err
 	}
 	file = newRateLimitedFile(file, d.flushController)
-	tw = sstable.NewWriter(file, d.opts, d.opts.Level(0))
+	// Flushed tables are soon compacted, and are not worth the memory and time
+	// spent training a compression dictionary.
+	lo := d.opts.Level(0)
+	lo.CompressionDictSize = 0
+	tw = sstable.NewWriter(file, d.opts, lo)
 
 	var count int
 	for valid := iter.First(); valid; valid = iter.Next() {
@@ -571,79 +713,225 @@ func (d *DB) writeLevel0Table(
 	meta.largest = writerMeta.Largest(d.cmp)
 	meta.smallestSeqNum = writerMeta.SmallestSeqNum
 	meta.largestSeqNum = writerMeta.LargestSeqNum
+	meta.numEntries = writerMeta.NumEntries
+	meta.numDeletions = writerMeta.NumDeletions
+	meta.markedForCompaction = writerMeta.MarkedForCompaction
+	meta.creationTime = uint64(time.Now().Unix())
+	meta.fileChecksum = writerMeta.FileChecksum
+	meta.hasFileChecksum = true
 	tw = nil
 
-	// TODO(peter): After a flush we set the commit rate to 110% of the flush
-	// rate. The rationale behind the 110% is to account for slack. Investigate a
-	// more principled way of setting this.
-	// d.commitController.limiter.SetLimit(rate.Limit(d.flushController.sensor.Rate()))
-	// if false {
-	// 	fmt.Printf("flush: %.1f MB/s\n", d.flushController.sensor.Rate()/float64(1<<20))
-	// }
+	if d.opts.ParanoidChecks {
+		if err := d.checkOutput(&meta, writerMeta); err != nil {
+			return fileMetadata{}, err
+		}
+	}
+
+	// Sync the directory so that the table is found after a crash. The table
+	// must be durable before the version edit which refers to it is logged.
+	if err := d.dataDir.Sync(); err != nil {
+		return fileMetadata{}, err
+	}
+	if err := d.fileManager.add(meta.fileNum); err != nil {
+		return fileMetadata{}, err
+	}
 
 	// TODO(peter): compaction stats.
 
 	return meta, nil
 }
 
-// maybeScheduleCompaction schedules a compaction if necessary.
+// periodicCompactionLoop periodically re-evaluates the compaction picker for
+// the current version so that tables which age past
+// Options.PeriodicCompactionSeconds are compacted even if no new version is
+// installed.
+func (d *DB) periodicCompactionLoop() {
+	interval := time.Duration(d.opts.PeriodicCompactionSeconds) * time.Second / 10
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.closedCh:
+			return
+		case <-ticker.C:
+			d.mu.Lock()
+			if !d.mu.closed && !d.mu.versions.picker.compactionNeeded() {
+				d.mu.versions.picker = newCompactionPicker(d.mu.versions.currentVersion(), d.opts)
+				d.maybeScheduleCompaction()
+			}
+			d.mu.Unlock()
+		}
+	}
+}
+
+// noSpaceLoop periodically retries an automatic compaction which was postponed
+// because its outputs would not fit in the space available, until it is
+// scheduled or the DB is closed. Writes may be stalled waiting for the
+// compaction, in which case no flush or compaction completes to retry it once
+// space is freed.
+func (d *DB) noSpaceLoop() {
+	ticker := time.NewTicker(resumeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.closedCh:
+			return
+		case <-ticker.C:
+		}
+
+		d.mu.Lock()
+		if d.mu.closed || !d.mu.compact.noSpace {
+			d.mu.Unlock()
+			return
+		}
+		d.maybeScheduleCompaction()
+		d.mu.Unlock()
+	}
+}
+
+// maybeScheduleCompaction schedules compactions if necessary. Up to
+// Options.MaxConcurrentCompactions automatic compactions are run concurrently
+// as long as they do not overlap. Manual compactions are run exclusively: no
+// automatic compactions are scheduled while a manual compaction is pending.
 //
 // d.mu must be held when calling this.
 func (d *DB) maybeScheduleCompaction() {
-	if d.mu.compact.compacting || d.mu.closed {
+	if d.mu.closed {
 		return
 	}
-
-	if len(d.mu.compact.manual) > 0 {
-		d.mu.compact.compacting = true
-		go d.compact()
+	if d.mu.compact.outOfSpace {
+		// A compaction ran out of space while the DB is read-only. Retrying
+		// immediately would most likely fail again, so no compactions are
+		// scheduled until the next attempt to resume the DB. Fail any manual
+		// compactions rather than leaving them waiting.
+		for _, manual := range d.mu.compact.manual {
+			manual.done <- d.mu.bgErr
+		}
+		d.mu.compact.manual = nil
 		return
 	}
 
-	if !d.mu.versions.picker.compactionNeeded() {
-		// There is no work to be done.
+	for len(d.mu.compact.manual) > 0 {
+		if d.mu.compact.compactingCount > 0 {
+			// Wait for the in-progress compactions to finish. The manual compaction
+			// will be scheduled when the last of them completes.
+			return
+		}
+		manual := d.mu.compact.manual[0]
+		d.mu.compact.manual = d.mu.compact.manual[1:]
+		c := d.mu.versions.picker.pickManual(d.opts, manual)
+		if c == nil {
+			// Nothing to compact.
+			manual.done <- nil
+			continue
+		}
+		if !d.reserveCompactionSpace(c) {
+			manual.done <- errNoSpaceForCompaction
+			continue
+		}
+		d.startCompaction(c, manual.done)
 		return
 	}
 
-	d.mu.compact.compacting = true
-	go d.compact()
+	for d.mu.compact.compactingCount < d.opts.MaxConcurrentCompactions {
+		c := d.mu.versions.picker.pickAuto(d.opts, d.mu.compact.inProgress)
+		if c == nil {
+			// There is no work to be done, or all of the available work conflicts
+			// with in-progress compactions.
+			d.mu.compact.noSpace = false
+			return
+		}
+		if !d.reserveCompactionSpace(c) {
+			if !d.mu.compact.noSpace {
+				d.mu.compact.noSpace = true
+				d.opts.Logger.Infof("pebble: compaction of L%d -> L%d postponed: %v",
+					c.level, c.outputLevel, errNoSpaceForCompaction)
+				go d.noSpaceLoop()
+			}
+			return
+		}
+		d.mu.compact.noSpace = false
+		d.startCompaction(c, nil)
+	}
+}
+
+// reserveCompactionSpace reserves space for the outputs of c, returning false
+// if they would not fit in the free space on the device or under
+// Options.MaxAllowedSpaceUsage. The outputs of a compaction are no larger than
+// its inputs, other than a trivial move which doesn't write any outputs.
+//
+// While the DB is read-only because it ran out of space, compacting is the
+// only way to reduce the space used by the sstables. A compaction's inputs
+// are deleted once it completes, so compactions are allowed to temporarily
+// exceed Options.MaxAllowedSpaceUsage, one at a time.
+//
+// d.mu must be held when calling this.
+func (d *DB) reserveCompactionSpace(c *compaction) bool {
+	if c.trivialMove(d.opts) {
+		return true
+	}
+	enforceLimit := d.mu.bgErr == nil
+	if !enforceLimit && d.mu.compact.compactingCount > 0 {
+		return false
+	}
+	size := totalSize(c.inputs[0]) + totalSize(c.inputs[1])
+	if !d.fileManager.reserve(size, enforceLimit) {
+		return false
+	}
+	c.reservedBytes = size
+	return true
 }
 
-// compact runs one compaction and maybe schedules another call to compact.
-func (d *DB) compact() {
+// startCompaction registers c as in-progress and runs it in a new goroutine.
+// If done is non-nil, the result of the compaction is sent on it.
+//
+// d.mu must be held when calling this.
+func (d *DB) startCompaction(c *compaction, done chan error) {
+	// Reference the input version to prevent the input files from being deleted
+	// by a concurrent compaction installing a new version.
+	c.version.ref()
+	d.mu.compact.compactingCount++
+	d.mu.compact.inProgress[c] = struct{}{}
+	go d.compact(c, done)
+}
+
+// compact runs one compaction and maybe schedules more compactions.
+func (d *DB) compact(c *compaction, done chan error) {
 	d.mu.Lock()
 	defer d.mu.Unlock()
-	if err := d.compact1(); err != nil {
+	err := d.compact1(c)
+	d.fileManager.release(c.reservedBytes)
+	if err != nil {
+		if isOutOfSpace(err) {
+			d.setBackgroundError(err)
+			d.mu.compact.outOfSpace = true
+		} else if d.opts.EventListener != nil && d.opts.EventListener.BackgroundError != nil {
+			d.opts.EventListener.BackgroundError(err)
+		}
 		// TODO(peter): count consecutive compaction errors and backoff.
-		_ = err
 	}
-	d.mu.compact.compacting = false
+	if done != nil {
+		done <- err
+	}
+	delete(d.mu.compact.inProgress, c)
+	d.mu.compact.compactingCount--
 	// The previous compaction may have produced too many files in a
 	// level, so reschedule another compaction if needed.
 	d.maybeScheduleCompaction()
 	d.mu.compact.cond.Broadcast()
 }
 
-// compact1 runs one compaction.
+// compact1 runs one compaction. Other compactions may be running
+// concurrently, but none of them overlap c.
 //
 // d.mu must be held when calling this, but the mutex may be dropped and
 // re-acquired during the course of this method.
-func (d *DB) compact1() (err error) {
-	var c *compaction
-	if len(d.mu.compact.manual) > 0 {
-		manual := d.mu.compact.manual[0]
-		d.mu.compact.manual = d.mu.compact.manual[1:]
-		c = d.mu.versions.picker.pickManual(d.opts, manual)
-		defer func() {
-			manual.done <- err
-		}()
-	} else {
-		c = d.mu.versions.picker.pickAuto(d.opts)
-	}
-	if c == nil {
-		return nil
-	}
-
+func (d *DB) compact1(c *compaction) (err error) {
 	jobID := d.mu.nextJobID
 	d.mu.nextJobID++
 	if d.opts.EventListener != nil && d.opts.EventListener.CompactionBegin != nil {
@@ -654,15 +942,19 @@ func (d *DB) compact1() (err error) {
 	}
 
 	ve, pendingOutputs, err := d.compactDiskTables(c)
+	// Release the reference on the input version taken in startCompaction now
+	// that the inputs have been read. The input files must not be kept alive
+	// past the call to deleteObsoleteFiles below.
+	c.version.unrefLocked()
 
 	if d.opts.EventListener != nil && d.opts.EventListener.CompactionEnd != nil {
 		info := db.CompactionInfo{
 			JobID: jobID,
 			Err:   err,
 		}
-		if err != nil {
+		if err == nil {
 			info.Input.Level = c.level
-			info.Output.Level = c.level + 1
+			info.Output.Level = c.outputLevel
 			for i := range c.inputs {
 				for j := range c.inputs[i] {
 					m := &c.inputs[i][j]
@@ -704,15 +996,14 @@ func (d *DB) compactDiskTables(c *compaction) (ve *versionEdit, pendingOutputs [
 	// such a move if there is lots of overlapping grandparent data. Otherwise,
 	// the move could create a parent file that will require a very expensive
 	// merge later on.
-	if len(c.inputs[0]) == 1 && len(c.inputs[1]) == 0 &&
-		totalSize(c.grandparents) <= maxGrandparentOverlapBytes(d.opts, c.level+1) {
+	if c.trivialMove(d.opts) {
 		meta := &c.inputs[0][0]
 		return &versionEdit{
 			deletedFiles: map[deletedFileEntry]bool{
 				deletedFileEntry{level: c.level, fileNum: meta.fileNum}: true,
 			},
 			newFiles: []newFileEntry{
-				{level: c.level + 1, meta: *meta},
+				{level: c.outputLevel, meta: *meta},
 			},
 		}, nil, nil
 	}
@@ -763,6 +1054,14 @@ func (d *DB) compactDiskTables(c *compaction) (ve *versionEdit, pendingOutputs [
 		deletedFiles: map[deletedFileEntry]bool{},
 	}
 
+	// As in RocksDB, compression dictionaries are only trained for tables
+	// written to the bottommost level, which hold the bulk of the data and are
+	// rarely rewritten.
+	outputOpts := d.opts.Level(c.outputLevel)
+	if !c.isBottommost() {
+		outputOpts.CompressionDictSize = 0
+	}
+
 	newOutput := func() error {
 		d.mu.Lock()
 		fileNum := d.mu.versions.nextFileNum()
@@ -776,12 +1075,14 @@ func (d *DB) compactDiskTables(c *compaction) (ve *versionEdit, pendingOutputs [
 			return err
 		}
 		filenames = append(filenames, filename)
-		tw = sstable.NewWriter(file, d.opts, d.opts.Level(c.level+1))
+		file = newRateLimitedFile(file, d.compactController)
+		tw = sstable.NewWriter(file, d.opts, outputOpts)
 
 		ve.newFiles = append(ve.newFiles, newFileEntry{
-			level: c.level + 1,
+			level: c.outputLevel,
 			meta: fileMetadata{
-				fileNum: fileNum,
+				fileNum:      fileNum,
+				creationTime: uint64(time.Now().Unix()),
 			},
 		})
 		return nil
@@ -815,6 +1116,11 @@ func (d *DB) compactDiskTables(c *compaction) (ve *versionEdit, pendingOutputs [
 		meta.size = writerMeta.Size
 		meta.smallestSeqNum = writerMeta.SmallestSeqNum
 		meta.largestSeqNum = writerMeta.LargestSeqNum
+		meta.numEntries = writerMeta.NumEntries
+		meta.numDeletions = writerMeta.NumDeletions
+		meta.markedForCompaction = writerMeta.MarkedForCompaction
+		meta.fileChecksum = writerMeta.FileChecksum
+		meta.hasFileChecksum = true
 
 		// The handling of range boundaries is a bit complicated.
 		if n := len(ve.newFiles); n > 1 {
@@ -841,6 +1147,9 @@ func (d *DB) compactDiskTables(c *compaction) (ve *versionEdit, pendingOutputs [
 		meta.smallest = writerMeta.Smallest(d.cmp)
 		meta.largest = writerMeta.Largest(d.cmp)
 
+		if d.opts.ParanoidChecks {
+			return d.checkOutput(meta, writerMeta)
+		}
 		return nil
 	}
 
@@ -866,13 +1175,24 @@ func (d *DB) compactDiskTables(c *compaction) (ve *versionEdit, pendingOutputs [
 	}
 
 	if err := finishOutput(db.InternalKey{}); err != nil {
-		return nil, pendingOutputs, nil
+		return nil, pendingOutputs, err
+	}
+	// Sync the directory so that the output tables are found after a crash.
+	if len(ve.newFiles) > 0 {
+		if err := d.dataDir.Sync(); err != nil {
+			return nil, pendingOutputs, err
+		}
+	}
+	for i := range ve.newFiles {
+		if err := d.fileManager.add(ve.newFiles[i].meta.fileNum); err != nil {
+			return nil, pendingOutputs, err
+		}
 	}
 
-	for i := range c.inputs {
+	for i, level := range [2]int{c.level, c.outputLevel} {
 		for _, f := range c.inputs[i] {
 			ve.deletedFiles[deletedFileEntry{
-				level:   c.level + i,
+				level:   level,
 				fileNum: f.fileNum,
 			}] = true
 		}
@@ -909,6 +1229,14 @@ func (d *DB) deleteObsoleteFiles(jobID int) {
 		liveFileNums[fileNum] = struct{}{}
 	}
 	d.mu.versions.addLiveFileNums(liveFileNums)
+	// Ingested sstables queued as flushables are not yet part of a version.
+	for _, mem := range d.mu.mem.queue {
+		if s, ok := mem.(*ingestedFlushable); ok {
+			for _, fileNum := range s.fileNums() {
+				liveFileNums[fileNum] = struct{}{}
+			}
+		}
+	}
 	logNumber := d.mu.versions.logNumber
 	manifestFileNumber := d.mu.versions.manifestFileNumber
 	d.mu.Unlock()
@@ -941,6 +1269,9 @@ func (d *DB) deleteObsoleteFiles(jobID int) {
 		}
 		path := filepath.Join(d.dirname, filename)
 		err := fs.Remove(path)
+		if fileType == fileTypeTable && (err == nil || os.IsNotExist(err)) {
+			d.fileManager.remove(fileNum)
+		}
 
 		if err != os.ErrNotExist && fileType == fileTypeTable {
 			if d.opts.EventListener != nil && d.opts.EventListener.TableDeleted != nil {
@@ -5,7 +5,10 @@
 package pebble
 
 import (
+	"fmt"
 	"math"
+	"sort"
+	"time"
 
 	"github.com/petermattis/pebble/db"
 )
@@ -30,17 +33,64 @@ type compactionPicker struct {
 	score float64
 	level int
 	file  int
+	// forced is true if the target file was selected because it was marked for
+	// compaction or is older than Options.PeriodicCompactionSeconds, rather
+	// than because its level exceeded its size threshold.
+	forced bool
+
+	// estimatedDebt is the estimated number of bytes which need to be compacted
+	// before the LSM is in a stable state.
+	estimatedDebt uint64
+
+	// periodicCutoff is the creation time, in seconds since the Unix epoch,
+	// before which tables are due for periodic compaction. Zero if periodic
+	// compaction is disabled.
+	periodicCutoff uint64
 }
 
 func newCompactionPicker(v *version, opts *db.Options) *compactionPicker {
 	p := &compactionPicker{
 		vers: v,
 	}
+	if opts.PeriodicCompactionSeconds > 0 {
+		now := time.Now().Unix()
+		if now > opts.PeriodicCompactionSeconds {
+			p.periodicCutoff = uint64(now - opts.PeriodicCompactionSeconds)
+		}
+	}
 	p.initLevelMaxBytes(v, opts)
 	p.initTarget(v, opts)
+	p.estimatedDebt = p.estimateCompactionDebt(opts)
 	return p
 }
 
+// estimateCompactionDebt estimates the number of bytes which need to be
+// compacted before the LSM is in a stable state: L0 is below its compaction
+// threshold and no other level exceeds its max bytes. The bytes that a level
+// exceeds its max bytes by are pushed to the next level, where they need to be
+// merged with the overlapping data in that level.
+func (p *compactionPicker) estimateCompactionDebt(opts *db.Options) uint64 {
+	var debt, bytesAddedToNextLevel uint64
+	if len(p.vers.files[0]) >= opts.L0CompactionThreshold {
+		bytesAddedToNextLevel = totalSize(p.vers.files[0])
+		debt = bytesAddedToNextLevel
+	}
+
+	n := numCompactionLevels(opts)
+	for level := p.baseLevel; level < n-1; level++ {
+		levelSize := totalSize(p.vers.files[level]) + bytesAddedToNextLevel
+		bytesAddedToNextLevel = 0
+		if levelSize <= uint64(p.levelMaxBytes[level]) {
+			continue
+		}
+		bytesAddedToNextLevel = levelSize - uint64(p.levelMaxBytes[level])
+		nextLevelSize := totalSize(p.vers.files[level+1])
+		ratio := float64(nextLevelSize) / float64(levelSize)
+		debt += uint64(float64(bytesAddedToNextLevel) * (ratio + 1))
+	}
+	return debt
+}
+
 func (p *compactionPicker) compactionNeeded() bool {
 	if p == nil {
 		return false
@@ -49,10 +99,13 @@ func (p *compactionPicker) compactionNeeded() bool {
 }
 
 func (p *compactionPicker) initLevelMaxBytes(v *version, opts *db.Options) {
+	// The last level is excluded if it is reserved for ingest-behind.
+	n := numCompactionLevels(opts)
+
 	// Determine the first non-empty level and the maximum size of any level.
 	firstNonEmptyLevel := -1
 	var maxLevelSize int64
-	for level := 1; level < numLevels; level++ {
+	for level := 1; level < n; level++ {
 		levelSize := int64(totalSize(v.files[level]))
 		if levelSize > 0 && firstNonEmptyLevel == -1 {
 			firstNonEmptyLevel = level
@@ -72,7 +125,7 @@ func (p *compactionPicker) initLevelMaxBytes(v *version, opts *db.Options) {
 	if maxLevelSize == 0 {
 		// No levels for L1 and up contain any data. Target L0 compactions for the
 		// last level.
-		p.baseLevel = numLevels - 1
+		p.baseLevel = n - 1
 		return
 	}
 
@@ -86,7 +139,7 @@ func (p *compactionPicker) initLevelMaxBytes(v *version, opts *db.Options) {
 	baseBytesMin := int64(float64(baseBytesMax) / levelMultiplier)
 
 	curLevelSize := maxLevelSize
-	for level := numLevels - 2; level >= firstNonEmptyLevel; level-- {
+	for level := n - 2; level >= firstNonEmptyLevel; level-- {
 		curLevelSize = int64(float64(curLevelSize) / levelMultiplier)
 	}
 
@@ -123,17 +176,17 @@ func (p *compactionPicker) initLevelMaxBytes(v *version, opts *db.Options) {
 		// We don't do this otherwise to keep the LSM-tree structure stable unless
 		// the L0 compaction is backlogged.
 		baseLevelSize = l0Size
-		if p.baseLevel == numLevels-1 {
+		if p.baseLevel == n-1 {
 			levelMultiplier = 1.0
 		} else {
 			levelMultiplier = math.Pow(
 				float64(maxLevelSize)/float64(baseLevelSize),
-				1.0/float64(numLevels-p.baseLevel-1))
+				1.0/float64(n-p.baseLevel-1))
 		}
 	}
 
 	levelSize := baseLevelSize
-	for level := p.baseLevel; level < numLevels; level++ {
+	for level := p.baseLevel; level < n; level++ {
 		if level > p.baseLevel {
 			if levelSize > 0 && float64(math.MaxInt64/levelSize) >= levelMultiplier {
 				levelSize = int64(float64(levelSize) * levelMultiplier)
@@ -160,11 +213,12 @@ func (p *compactionPicker) initTarget(v *version, opts *db.Options) {
 	// wish to avoid too many files when the individual file size is small
 	// (perhaps because of a small write-buffer setting, or very high
 	// compression ratios, or lots of overwrites/deletions).
-	p.score = float64(len(v.files[0])) / float64(opts.L0CompactionThreshold)
+	p.score = p.levelScore(opts, 0)
 	p.level = 0
 
-	for level := 1; level < numLevels-1; level++ {
-		score := float64(totalSize(v.files[level])) / float64(p.levelMaxBytes[level])
+	n := numCompactionLevels(opts)
+	for level := 1; level < n-1; level++ {
+		score := p.levelScore(opts, level)
 		if p.score < score {
 			p.score = score
 			p.level = level
@@ -172,49 +226,27 @@ func (p *compactionPicker) initTarget(v *version, opts *db.Options) {
 	}
 
 	if p.score >= 1 {
-		// TODO(peter): Select the file within the level to compact. See the
-		// kMinOverlappingRatio heuristic in RocksDB which chooses the file with the
-		// minimum overlapping ratio with the next level. This minimizes write
-		// amplification. We also want to computed a "compensated size" which adjusts
-		// the size of a table based on the number of deletions it contains.
-		//
 		// We want to minimize write amplification, but also ensure that deletes
 		// are propagated to the bottom level in a timely fashion so as to reclaim
-		// disk space. A table's smallest sequence number provides a measure of its
-		// age. The ratio of overlapping-bytes / table-size gives an indication of
-		// write amplification (a smaller ratio is preferrable).
-		//
-		// Simulate various workloads:
-		// - Uniform random write
-		// - Uniform random write+delete
-		// - Skewed random write
-		// - Skewed random write+delete
-		// - Sequential write
-		// - Sequential write+delete (queue)
-
-		// The current heuristic matches the RocksDB kOldestSmallestSeqFirst
-		// heuristic.
-		smallestSeqNum := uint64(math.MaxUint64)
-		files := v.files[p.level]
-		for i := range files {
-			f := &files[i]
-			if smallestSeqNum > f.smallestSeqNum {
-				smallestSeqNum = f.smallestSeqNum
-				p.file = i
-			}
-		}
+		// disk space. Options.CompactionPriority selects the trade-off. See
+		// filesByPriority.
+		p.file = p.filesByPriority(opts, p.level)[0]
 		return
 	}
 
-	// No levels exceeded their size threshold. Check for forced compactions.
-	for level := 0; level < numLevels-1; level++ {
-		files := v.files[p.level]
+	// No levels exceeded their size threshold. Check for forced compactions:
+	// files which were marked for compaction and files which have not been
+	// rewritten within the periodic compaction interval. The last level is
+	// included, in which case the file is rewritten within the level, unless
+	// it is reserved for ingest-behind.
+	for level := 0; level < n; level++ {
+		files := v.files[level]
 		for i := range files {
-			f := &files[i]
-			if f.markedForCompaction {
+			if p.needsForcedCompaction(&files[i]) {
 				p.score = 1.0
 				p.level = level
 				p.file = i
+				p.forced = true
 				return
 			}
 		}
@@ -225,15 +257,204 @@ func (p *compactionPicker) initTarget(v *version, opts *db.Options) {
 	// snapshot.
 }
 
-// pickAuto picks the best compaction, if any.
-func (p *compactionPicker) pickAuto(opts *db.Options) (c *compaction) {
+// needsForcedCompaction returns true if the file was marked for compaction, or
+// was created before the periodic compaction cutoff.
+func (p *compactionPicker) needsForcedCompaction(f *fileMetadata) bool {
+	if f.markedForCompaction {
+		return true
+	}
+	return f.creationTime != 0 && f.creationTime < p.periodicCutoff
+}
+
+// filesByPriority returns the indexes of the files in the specified level,
+// ordered from the most preferred file to compact to the least preferred
+// according to Options.CompactionPriority. Outside of L0, files which were
+// marked for compaction (e.g. because their deletion tombstones are dense)
+// are preferred over all other files.
+func (p *compactionPicker) filesByPriority(opts *db.Options, level int) []int {
+	files := p.vers.files[level]
+	order := make([]int, len(files))
+	for i := range order {
+		order[i] = i
+	}
+
+	var less func(a, b int) bool
+	switch prio := opts.CompactionPriority; {
+	case level == 0 || prio == db.OldestSmallestSeqFirst:
+		// L0 files are always compacted oldest first as the sequence numbers of
+		// the files in L0 overlap.
+		less = func(a, b int) bool {
+			return files[a].smallestSeqNum < files[b].smallestSeqNum
+		}
+
+	case prio == db.ByCompensatedSize:
+		less = func(a, b int) bool {
+			return files[a].compensatedSize() > files[b].compensatedSize()
+		}
+
+	case prio == db.OldestLargestSeqFirst:
+		less = func(a, b int) bool {
+			return files[a].largestSeqNum < files[b].largestSeqNum
+		}
+
+	case prio == db.MinOverlappingRatio:
+		// The overlapping ratio is the number of bytes in level+1 which overlap the
+		// file, relative to the compensated size of the file. A file with a small
+		// ratio is cheap to compact relative to the amount of data it moves down
+		// the LSM.
+		//
+		// The files in both levels are sorted and non-overlapping, so the
+		// overlapping files in level+1 are found with a single merge-walk of the
+		// two levels rather than a search per file.
+		cmp := opts.Comparer.Compare
+		next := p.vers.files[level+1]
+		// prefix[i] is the total size of next[:i].
+		prefix := make([]uint64, len(next)+1)
+		for i := range next {
+			prefix[i+1] = prefix[i] + next[i].size
+		}
+		ratios := make([]float64, len(files))
+		var lower, upper int
+		for i := range files {
+			f := &files[i]
+			// next[lower:upper] are the files which overlap f.
+			for lower < len(next) && cmp(next[lower].largest.UserKey, f.smallest.UserKey) < 0 {
+				lower++
+			}
+			if upper < lower {
+				upper = lower
+			}
+			for upper < len(next) && cmp(next[upper].smallest.UserKey, f.largest.UserKey) <= 0 {
+				upper++
+			}
+			overlapping := prefix[upper] - prefix[lower]
+			size := f.compensatedSize()
+			if size == 0 {
+				size = 1
+			}
+			ratios[i] = float64(overlapping) / float64(size)
+		}
+		less = func(a, b int) bool {
+			return ratios[a] < ratios[b]
+		}
+
+	default:
+		panic(fmt.Sprintf("pebble: unknown compaction priority: %s", prio))
+	}
+
+	sort.SliceStable(order, func(i, j int) bool {
+		a, b := order[i], order[j]
+		if level > 0 && files[a].markedForCompaction != files[b].markedForCompaction {
+			return files[a].markedForCompaction
+		}
+		return less(a, b)
+	})
+	return order
+}
+
+// pickAuto picks the best compaction, if any. Compactions which overlap any of
+// the inProgress compactions are not considered. If the best compaction
+// overlaps an in-progress compaction, other files in the level, and then other
+// levels which need compaction, are tried in turn. Similarly, other files which
+// need a forced compaction are tried if the preferred one conflicts.
+func (p *compactionPicker) pickAuto(
+	opts *db.Options, inProgress map[*compaction]struct{},
+) (c *compaction) {
 	if !p.compactionNeeded() {
 		return nil
 	}
 
+	if c := p.pickFile(opts, p.level, p.file, inProgress); c != nil {
+		c.forced = p.forced
+		return c
+	}
+	if len(inProgress) == 0 {
+		return nil
+	}
+
+	if p.forced {
+		// The preferred forced compaction conflicts with an in-progress
+		// compaction. Try the other files which need a forced compaction, in the
+		// same order as initTarget.
+		n := numCompactionLevels(opts)
+		for level := 0; level < n; level++ {
+			files := p.vers.files[level]
+			for i := range files {
+				if level == p.level && i == p.file {
+					// Already tried above.
+					continue
+				}
+				if !p.needsForcedCompaction(&files[i]) {
+					continue
+				}
+				if c := p.pickFile(opts, level, i, inProgress); c != nil {
+					c.forced = true
+					return c
+				}
+			}
+		}
+		return nil
+	}
+
+	// The preferred compaction conflicts with an in-progress compaction. Find
+	// the levels which need compaction and try each of them, from the highest
+	// score to the lowest.
+	type levelScore struct {
+		level int
+		score float64
+	}
+	var levels []levelScore
+	levels = append(levels, levelScore{0, p.levelScore(opts, 0)})
+	n := numCompactionLevels(opts)
+	for level := 1; level < n-1; level++ {
+		levels = append(levels, levelScore{level, p.levelScore(opts, level)})
+	}
+	sort.SliceStable(levels, func(i, j int) bool {
+		return levels[i].score > levels[j].score
+	})
+
+	for _, l := range levels {
+		if l.score < 1 {
+			break
+		}
+		for _, i := range p.filesByPriority(opts, l.level) {
+			if l.level == p.level && i == p.file {
+				// Already tried above.
+				continue
+			}
+			if c := p.pickFile(opts, l.level, i, inProgress); c != nil {
+				return c
+			}
+		}
+	}
+	return nil
+}
+
+// levelScore returns the compaction score for the specified level. A score >= 1
+// indicates the level needs compaction.
+func (p *compactionPicker) levelScore(opts *db.Options, level int) float64 {
+	if level == 0 {
+		return float64(len(p.vers.files[0])) / float64(opts.L0CompactionThreshold)
+	}
+	return float64(totalCompensatedSize(p.vers.files[level])) / float64(p.levelMaxBytes[level])
+}
+
+// pickFile constructs a compaction of the specified file within level,
+// returning nil if the file is already being compacted or the resulting
+// compaction overlaps any of the inProgress compactions.
+func (p *compactionPicker) pickFile(
+	opts *db.Options, level, file int, inProgress map[*compaction]struct{},
+) (c *compaction) {
 	vers := p.vers
-	c = newCompaction(opts, vers, p.level)
-	c.inputs[0] = vers.files[c.level][p.file : p.file+1]
+	if file >= len(vers.files[level]) {
+		return nil
+	}
+	if isCompacting(inProgress, vers.files[level][file].fileNum) {
+		return nil
+	}
+
+	c = newCompaction(opts, vers, level)
+	c.inputs[0] = vers.files[c.level][file : file+1]
 
 	// Files in level 0 may overlap each other, so pick up all overlapping ones.
 	if c.level == 0 {
@@ -246,14 +467,40 @@ func (p *compactionPicker) pickAuto(opts *db.Options) (c *compaction) {
 	}
 
 	c.setupOtherInputs()
+
+	for ic := range inProgress {
+		if c.overlaps(ic) {
+			return nil
+		}
+	}
 	return c
 }
 
+// isCompacting returns true if the specified file is an input to one of the
+// inProgress compactions.
+func isCompacting(inProgress map[*compaction]struct{}, fileNum uint64) bool {
+	for c := range inProgress {
+		for i := range c.inputs {
+			for j := range c.inputs[i] {
+				if c.inputs[i][j].fileNum == fileNum {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
 func (p *compactionPicker) pickManual(opts *db.Options, manual *manualCompaction) (c *compaction) {
 	if p == nil {
 		return nil
 	}
 
+	if manual.level >= numCompactionLevels(opts) {
+		// The last level is reserved for ingest-behind.
+		return nil
+	}
+
 	// TODO(peter): The logic here is untested and possibly incomplete.
 	cur := p.vers
 	c = newCompaction(opts, cur, manual.level)
@@ -10,6 +10,7 @@ import (
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/petermattis/pebble/db"
 	"github.com/petermattis/pebble/internal/datadriven"
@@ -134,3 +135,298 @@ func TestCompactionPickerTargetLevel(t *testing.T) {
 			}
 		})
 }
+
+func TestCompactionPickerPriority(t *testing.T) {
+	// L1 contains 3 files:
+	//   100: old data, large, overlaps most of L2
+	//   101: new data, small, overlaps nothing in L2
+	//   102: oldest most recent update, medium, overlaps a little of L2
+	vers := &version{
+		files: [numLevels][]fileMetadata{
+			1: []fileMetadata{
+				{
+					fileNum:        100,
+					size:           300,
+					smallest:       db.ParseInternalKey("a.SET.1"),
+					largest:        db.ParseInternalKey("c.SET.50"),
+					smallestSeqNum: 1,
+					largestSeqNum:  50,
+				},
+				{
+					fileNum:        101,
+					size:           100,
+					smallest:       db.ParseInternalKey("e.SET.60"),
+					largest:        db.ParseInternalKey("f.SET.70"),
+					smallestSeqNum: 60,
+					largestSeqNum:  70,
+				},
+				{
+					fileNum:        102,
+					size:           200,
+					smallest:       db.ParseInternalKey("x.SET.10"),
+					largest:        db.ParseInternalKey("y.SET.20"),
+					smallestSeqNum: 10,
+					largestSeqNum:  20,
+				},
+			},
+			2: []fileMetadata{
+				{
+					fileNum:  200,
+					size:     1000,
+					smallest: db.ParseInternalKey("a.SET.0"),
+					largest:  db.ParseInternalKey("b.SET.0"),
+				},
+				{
+					fileNum:  201,
+					size:     10,
+					smallest: db.ParseInternalKey("y.SET.0"),
+					largest:  db.ParseInternalKey("z.SET.0"),
+				},
+			},
+		},
+	}
+
+	testCases := []struct {
+		prio     db.CompactionPriority
+		expected string
+	}{
+		{db.DefaultCompactionPriority, "100,102,101"},
+		{db.OldestSmallestSeqFirst, "100,102,101"},
+		{db.ByCompensatedSize, "100,102,101"},
+		{db.OldestLargestSeqFirst, "102,100,101"},
+		{db.MinOverlappingRatio, "101,102,100"},
+	}
+	for _, c := range testCases {
+		t.Run(c.prio.String(), func(t *testing.T) {
+			opts := &db.Options{CompactionPriority: c.prio}
+			opts.EnsureDefaults()
+			p := &compactionPicker{vers: vers}
+			var fileNums []string
+			for _, i := range p.filesByPriority(opts, 1) {
+				fileNums = append(fileNums, strconv.Itoa(int(vers.files[1][i].fileNum)))
+			}
+			if v := strings.Join(fileNums, ","); c.expected != v {
+				t.Fatalf("expected %s, but found %s", c.expected, v)
+			}
+		})
+	}
+}
+
+func TestCompactionPickerMinOverlappingRatio(t *testing.T) {
+	newFile := func(fileNum, size uint64, smallest, largest string) fileMetadata {
+		return fileMetadata{
+			fileNum:  fileNum,
+			size:     size,
+			smallest: db.ParseInternalKey(smallest + ".SET.1"),
+			largest:  db.ParseInternalKey(largest + ".SET.1"),
+		}
+	}
+	// The L2 files 200 and 201 each overlap two of the L1 files, giving ratios
+	// of 0.5 for 100, 3.5 for 101 and 3.1 for 102.
+	vers := &version{
+		files: [numLevels][]fileMetadata{
+			1: []fileMetadata{
+				newFile(100, 100, "a", "c"),
+				newFile(101, 100, "d", "f"),
+				newFile(102, 100, "g", "h"),
+			},
+			2: []fileMetadata{
+				newFile(200, 50, "b", "e"),
+				newFile(201, 300, "f", "g"),
+				newFile(202, 10, "h", "i"),
+			},
+		},
+	}
+
+	opts := (&db.Options{CompactionPriority: db.MinOverlappingRatio}).EnsureDefaults()
+	p := &compactionPicker{vers: vers}
+	var fileNums []string
+	for _, i := range p.filesByPriority(opts, 1) {
+		fileNums = append(fileNums, strconv.Itoa(int(vers.files[1][i].fileNum)))
+	}
+	if v := strings.Join(fileNums, ","); v != "100,102,101" {
+		t.Fatalf("expected 100,102,101, but found %s", v)
+	}
+}
+
+func TestCompactionPickerForced(t *testing.T) {
+	now := uint64(time.Now().Unix())
+	newVersion := func(l1, l6 fileMetadata) *version {
+		l1.fileNum, l1.size = 100, 1
+		l1.smallest = db.ParseInternalKey("a.SET.2")
+		l1.largest = db.ParseInternalKey("b.SET.2")
+		l6.fileNum, l6.size = 600, 1
+		l6.smallest = db.ParseInternalKey("c.SET.1")
+		l6.largest = db.ParseInternalKey("d.SET.1")
+		return &version{
+			files: [numLevels][]fileMetadata{
+				1: []fileMetadata{l1},
+				6: []fileMetadata{l6},
+			},
+		}
+	}
+
+	testCases := []struct {
+		desc     string
+		periodic int64
+		l1, l6   fileMetadata
+		expected string
+	}{
+		{"none", 0,
+			fileMetadata{creationTime: now},
+			fileMetadata{creationTime: 1},
+			""},
+		{"marked", 0,
+			fileMetadata{creationTime: now, markedForCompaction: true},
+			fileMetadata{creationTime: now},
+			"1->2: 100"},
+		{"marked-last-level", 0,
+			fileMetadata{creationTime: now},
+			fileMetadata{creationTime: now, markedForCompaction: true},
+			"6->6: 600"},
+		{"periodic", 3600,
+			fileMetadata{creationTime: now},
+			fileMetadata{creationTime: now - 7200},
+			"6->6: 600"},
+		{"periodic-not-expired", 3600,
+			fileMetadata{creationTime: now},
+			fileMetadata{creationTime: now - 60},
+			""},
+		{"periodic-unknown-creation-time", 3600,
+			fileMetadata{},
+			fileMetadata{},
+			""},
+	}
+	for _, c := range testCases {
+		t.Run(c.desc, func(t *testing.T) {
+			opts := &db.Options{PeriodicCompactionSeconds: c.periodic}
+			opts.EnsureDefaults()
+			p := newCompactionPicker(newVersion(c.l1, c.l6), opts)
+			comp := p.pickAuto(opts, nil /* inProgress */)
+			var result string
+			if comp != nil {
+				if !comp.forced {
+					t.Fatalf("expected forced compaction")
+				}
+				var fileNums []string
+				for _, f := range comp.inputs[0] {
+					fileNums = append(fileNums, strconv.Itoa(int(f.fileNum)))
+				}
+				result = fmt.Sprintf("%d->%d: %s",
+					comp.level, comp.outputLevel, strings.Join(fileNums, ","))
+			}
+			if c.expected != result {
+				t.Fatalf("expected %q, but found %q", c.expected, result)
+			}
+		})
+	}
+}
+
+func TestCompactionPickerForcedConcurrent(t *testing.T) {
+	// L1 contains two files marked for compaction. Once the first is being
+	// compacted, the second is picked rather than nothing.
+	vers := &version{
+		files: [numLevels][]fileMetadata{
+			1: []fileMetadata{
+				{
+					fileNum:             100,
+					size:                1,
+					smallest:            db.ParseInternalKey("a.SET.1"),
+					largest:             db.ParseInternalKey("b.SET.1"),
+					markedForCompaction: true,
+				},
+				{
+					fileNum:             101,
+					size:                1,
+					smallest:            db.ParseInternalKey("c.SET.2"),
+					largest:             db.ParseInternalKey("d.SET.2"),
+					markedForCompaction: true,
+				},
+			},
+		},
+	}
+	opts := &db.Options{}
+	opts.EnsureDefaults()
+	p := newCompactionPicker(vers, opts)
+
+	inProgress := make(map[*compaction]struct{})
+	for _, expected := range []uint64{100, 101} {
+		c := p.pickAuto(opts, inProgress)
+		if c == nil {
+			t.Fatalf("expected compaction of %d, but found none", expected)
+		}
+		if !c.forced {
+			t.Fatalf("expected forced compaction")
+		}
+		if fileNum := c.inputs[0][0].fileNum; fileNum != expected {
+			t.Fatalf("expected compaction of %d, but found %d", expected, fileNum)
+		}
+		inProgress[c] = struct{}{}
+	}
+	if c := p.pickAuto(opts, inProgress); c != nil {
+		t.Fatalf("expected no compaction, but found %d", c.inputs[0][0].fileNum)
+	}
+}
+
+func TestCompactionPickerTombstoneDensity(t *testing.T) {
+	// L1 contains 3 equally sized files. File 101 is marked for compaction
+	// because its deletions are dense, and file 102 consists almost entirely
+	// of deletions.
+	vers := &version{
+		files: [numLevels][]fileMetadata{
+			1: []fileMetadata{
+				{
+					fileNum:        100,
+					size:           100,
+					smallest:       db.ParseInternalKey("a.SET.1"),
+					largest:        db.ParseInternalKey("b.SET.1"),
+					smallestSeqNum: 1,
+					largestSeqNum:  1,
+					numEntries:     10,
+				},
+				{
+					fileNum:             101,
+					size:                100,
+					smallest:            db.ParseInternalKey("c.SET.2"),
+					largest:             db.ParseInternalKey("d.SET.2"),
+					smallestSeqNum:      2,
+					largestSeqNum:       2,
+					numEntries:          10,
+					numDeletions:        4,
+					markedForCompaction: true,
+				},
+				{
+					fileNum:        102,
+					size:           100,
+					smallest:       db.ParseInternalKey("e.SET.3"),
+					largest:        db.ParseInternalKey("f.SET.3"),
+					smallestSeqNum: 3,
+					largestSeqNum:  3,
+					numEntries:     10,
+					numDeletions:   10,
+				},
+			},
+		},
+	}
+
+	opts := &db.Options{L1MaxBytes: 1000}
+	opts.EnsureDefaults()
+	p := &compactionPicker{vers: vers}
+	p.levelMaxBytes[1] = 1000
+
+	// The marked file is preferred, followed by the remaining files in priority
+	// order.
+	var fileNums []string
+	for _, i := range p.filesByPriority(opts, 1) {
+		fileNums = append(fileNums, strconv.Itoa(int(vers.files[1][i].fileNum)))
+	}
+	if v := strings.Join(fileNums, ","); v != "101,100,102" {
+		t.Fatalf("expected 101,100,102, but found %s", v)
+	}
+
+	// The level score includes the compensation for the deletions in file 102:
+	// 300 bytes of data plus 10*10*2 bytes of compensation.
+	if v := p.levelScore(opts, 1); v != 0.5 {
+		t.Fatalf("expected score 0.5, but found %f", v)
+	}
+}
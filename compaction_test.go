@@ -10,6 +10,8 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -422,7 +424,7 @@ func TestPickCompaction(t *testing.T) {
 		vs.picker = &tc.picker
 		vs.picker.vers = &tc.version
 
-		c, got := vs.picker.pickAuto(opts), ""
+		c, got := vs.picker.pickAuto(opts, nil /* inProgress */), ""
 		if c != nil {
 			got0 := fileNums(c.inputs[0])
 			got1 := fileNums(c.inputs[1])
@@ -435,6 +437,90 @@ func TestPickCompaction(t *testing.T) {
 	}
 }
 
+func TestPickCompactionInProgress(t *testing.T) {
+	opts := (*db.Options)(nil).EnsureDefaults()
+	cmp := db.DefaultComparer.Compare
+
+	vers := &version{
+		files: [numLevels][]fileMetadata{
+			1: []fileMetadata{
+				{
+					fileNum:        200,
+					size:           1,
+					smallest:       db.ParseInternalKey("a.SET.201"),
+					largest:        db.ParseInternalKey("b.SET.202"),
+					smallestSeqNum: 201,
+				},
+				{
+					fileNum:        210,
+					size:           1,
+					smallest:       db.ParseInternalKey("m.SET.211"),
+					largest:        db.ParseInternalKey("n.SET.212"),
+					smallestSeqNum: 211,
+				},
+			},
+			2: []fileMetadata{
+				{
+					fileNum:  300,
+					size:     1,
+					smallest: db.ParseInternalKey("a.SET.301"),
+					largest:  db.ParseInternalKey("c.SET.302"),
+				},
+			},
+		},
+	}
+	p := &compactionPicker{
+		vers:  vers,
+		score: 99,
+		level: 1,
+		file:  0,
+	}
+	for level := range p.levelMaxBytes {
+		p.levelMaxBytes[level] = 1
+	}
+
+	inProgress := make(map[*compaction]struct{})
+	c1 := p.pickAuto(opts, inProgress)
+	if c1 == nil || c1.inputs[0][0].fileNum != 200 || len(c1.inputs[1]) != 1 {
+		t.Fatalf("unexpected compaction: %v", c1)
+	}
+	inProgress[c1] = struct{}{}
+
+	// The preferred file is already being compacted, so the picker should fall
+	// back to the other file in L1 which does not overlap.
+	c2 := p.pickAuto(opts, inProgress)
+	if c2 == nil || c2.inputs[0][0].fileNum != 210 {
+		t.Fatalf("unexpected compaction: %v", c2)
+	}
+	if c1.overlaps(c2) || c2.overlaps(c1) {
+		t.Fatalf("expected non-overlapping compactions:\n%s%s", c1, c2)
+	}
+	inProgress[c2] = struct{}{}
+
+	// Every file in L1 is being compacted.
+	if c3 := p.pickAuto(opts, inProgress); c3 != nil {
+		t.Fatalf("expected no compaction, but found\n%s", c3)
+	}
+
+	// An L2->L3 compaction overlapping c1's key range conflicts with c1 as they
+	// share L2.
+	c4 := newCompaction(opts, vers, 2)
+	c4.inputs[0] = vers.files[2]
+	c4.setupOtherInputs()
+	if !c4.overlaps(c1) || !c1.overlaps(c4) {
+		t.Fatalf("expected overlapping compactions:\n%s%s", c1, c4)
+	}
+	if c4.overlaps(c2) {
+		t.Fatalf("expected non-overlapping compactions:\n%s%s", c2, c4)
+	}
+
+	// An L3->L4 compaction shares no levels with c1.
+	c5 := &compaction{cmp: cmp, level: 3, smallest: c1.smallest, largest: c1.largest}
+	if c5.overlaps(c1) {
+		t.Fatalf("expected non-overlapping compactions:\n%s%s", c1, c5)
+	}
+}
+
 func TestIsBaseLevelForUkey(t *testing.T) {
 	testCases := []struct {
 		desc    string
@@ -571,6 +657,52 @@ func TestIsBaseLevelForUkey(t *testing.T) {
 	}
 }
 
+func TestCompactionIsBottommost(t *testing.T) {
+	v := version{
+		files: [numLevels][]fileMetadata{
+			2: []fileMetadata{
+				{
+					smallest: db.ParseInternalKey("d.SET.601"),
+					largest:  db.ParseInternalKey("h.SET.600"),
+				},
+			},
+			4: []fileMetadata{
+				{
+					smallest: db.ParseInternalKey("r.SET.201"),
+					largest:  db.ParseInternalKey("t.SET.200"),
+				},
+			},
+		},
+	}
+	testCases := []struct {
+		outputLevel       int
+		smallest, largest string
+		want              bool
+	}{
+		{1, "a", "c", true},
+		{1, "a", "d", false},
+		{1, "i", "q", true},
+		{1, "s", "z", false},
+		{2, "d", "h", true},
+		{3, "s", "s", false},
+		{4, "r", "t", true},
+		{6, "a", "z", true},
+	}
+	for _, tc := range testCases {
+		c := compaction{
+			cmp:         db.DefaultComparer.Compare,
+			version:     &v,
+			outputLevel: tc.outputLevel,
+			smallest:    db.ParseInternalKey(tc.smallest + ".SET.0"),
+			largest:     db.ParseInternalKey(tc.largest + ".SET.0"),
+		}
+		if got := c.isBottommost(); got != tc.want {
+			t.Errorf("L%d [%s,%s]: got %v, want %v",
+				tc.outputLevel, tc.smallest, tc.largest, got, tc.want)
+		}
+	}
+}
+
 func TestCompaction(t *testing.T) {
 	const memTableSize = 10000
 	// Tuned so that 2 values can reside in the memtable before a flush, but a
@@ -685,6 +817,221 @@ func TestCompaction(t *testing.T) {
 	}
 }
 
+// slowSyncStorage delays syncing tables, so that compactions take long enough
+// to overlap with one another.
+type slowSyncStorage struct {
+	storage.Storage
+}
+
+func (fs slowSyncStorage) Create(name string) (storage.File, error) {
+	f, err := fs.Storage.Create(name)
+	if err != nil || !strings.HasSuffix(name, ".sst") {
+		return f, err
+	}
+	return slowSyncFile{f}, nil
+}
+
+type slowSyncFile struct {
+	storage.File
+}
+
+func (f slowSyncFile) Sync() error {
+	time.Sleep(5 * time.Millisecond)
+	return f.File.Sync()
+}
+
+func TestConcurrentCompactions(t *testing.T) {
+	// Track the compactions which run at the same time. The inputs of a
+	// compaction are only known once it ends.
+	var mu sync.Mutex
+	running := make(map[int]bool)
+	var concurrent [][2]int
+	var peak int
+	infos := make(map[int]db.CompactionInfo)
+	d, err := Open("", &db.Options{
+		Storage:                  slowSyncStorage{storage.NewMem()},
+		MemTableSize:             32 << 10,
+		L1MaxBytes:               64 << 10,
+		MaxConcurrentCompactions: 4,
+		Levels: []db.LevelOptions{{
+			TargetFileSize: 16 << 10,
+		}},
+		EventListener: &db.EventListener{
+			CompactionBegin: func(info db.CompactionInfo) {
+				mu.Lock()
+				defer mu.Unlock()
+				for jobID := range running {
+					concurrent = append(concurrent, [2]int{jobID, info.JobID})
+				}
+				running[info.JobID] = true
+				if peak < len(running) {
+					peak = len(running)
+				}
+			},
+			CompactionEnd: func(info db.CompactionInfo) {
+				mu.Lock()
+				defer mu.Unlock()
+				delete(running, info.JobID)
+				if info.Err == nil {
+					infos[info.JobID] = info
+				}
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 20000
+	value := bytes.Repeat([]byte("v"), 32)
+	for i := 0; i < n; i++ {
+		key := []byte(fmt.Sprintf("%08d", (i*7919)%n))
+		if err := d.Set(key, value, db.NoSync); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	iter := d.NewIter(nil)
+	var count int
+	for valid := iter.First(); valid; valid = iter.Next() {
+		if expected := fmt.Sprintf("%08d", count); expected != string(iter.Key()) {
+			t.Fatalf("expected %s, but found %s", expected, iter.Key())
+		}
+		count++
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if count != n {
+		t.Fatalf("expected %d keys, but found %d", n, count)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if peak < 2 {
+		t.Fatalf("expected concurrent compactions, but found at most %d at a time", peak)
+	}
+	keyRange := func(info db.CompactionInfo) (smallest, largest []byte) {
+		for _, tables := range info.Input.Tables {
+			for _, m := range tables {
+				if smallest == nil || bytes.Compare(m.Smallest.UserKey, smallest) < 0 {
+					smallest = m.Smallest.UserKey
+				}
+				if largest == nil || bytes.Compare(m.Largest.UserKey, largest) > 0 {
+					largest = m.Largest.UserKey
+				}
+			}
+		}
+		return smallest, largest
+	}
+	for _, pair := range concurrent {
+		a, okA := infos[pair[0]]
+		b, okB := infos[pair[1]]
+		if !okA || !okB {
+			continue
+		}
+		if a.Input.Level > b.Output.Level || b.Input.Level > a.Output.Level {
+			// The compactions do not share any levels.
+			continue
+		}
+		aSmallest, aLargest := keyRange(a)
+		bSmallest, bLargest := keyRange(b)
+		if bytes.Compare(aSmallest, bLargest) <= 0 && bytes.Compare(bSmallest, aLargest) <= 0 {
+			t.Fatalf("overlapping compactions ran concurrently: L%d->L%d [%s,%s] and L%d->L%d [%s,%s]",
+				a.Input.Level, a.Output.Level, aSmallest, aLargest,
+				b.Input.Level, b.Output.Level, bSmallest, bLargest)
+		}
+	}
+}
+
+// markingCollector marks the tables it builds for compaction while remaining
+// is positive.
+type markingCollector struct {
+	remaining *int32
+}
+
+func (c markingCollector) Add(key db.InternalKey, value []byte) error { return nil }
+
+func (c markingCollector) Finish(userProps map[string]string) error { return nil }
+
+func (c markingCollector) NeedCompact() bool {
+	return atomic.AddInt32(c.remaining, -1) >= 0
+}
+
+func (c markingCollector) Name() string { return "marking" }
+
+func TestMarkedForCompaction(t *testing.T) {
+	var remaining int32
+	d, err := Open("", &db.Options{
+		Storage: storage.NewMem(),
+		TablePropertyCollectors: []func() db.TablePropertyCollector{
+			func() db.TablePropertyCollector {
+				return markingCollector{remaining: &remaining}
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 100; i++ {
+		if err := d.Set([]byte(fmt.Sprintf("%03d", i)), nil, db.NoSync); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	lastLevelFile := func() fileMetadata {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		files := d.mu.versions.currentVersion().files[numLevels-1]
+		if len(files) != 1 {
+			return fileMetadata{}
+		}
+		return files[0]
+	}
+
+	// Each manual compaction moves the table down one level.
+	for i := 0; i < numLevels-1; i++ {
+		if err := d.Compact([]byte("000"), []byte("099")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f := lastLevelFile()
+	if f.fileNum == 0 || f.markedForCompaction {
+		t.Fatalf("expected an unmarked table in the last level, but found %+v", f)
+	}
+
+	// Compacting the last level rewrites the table in place. The rewritten
+	// table is marked for compaction which causes it to be rewritten again.
+	atomic.StoreInt32(&remaining, 1)
+	if err := d.Compact([]byte("000"), []byte("099")); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		g := lastLevelFile()
+		if g.fileNum > f.fileNum+1 && !g.markedForCompaction {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("marked table was not compacted: %+v", g)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestManualCompaction(t *testing.T) {
 	fs := storage.NewMem()
 	err := fs.MkdirAll("ext", 0755)
@@ -6,9 +6,11 @@ package pebble
 
 import (
 	"context"
+	"math"
 	"sync"
 	"time"
 
+	"github.com/petermattis/pebble/db"
 	"github.com/petermattis/pebble/internal/rate"
 )
 
@@ -104,5 +106,66 @@ func (r *rateCounter) Rate() float64 {
 	if elapsed >= int64(len(r.mu.buckets)) {
 		elapsed = int64(len(r.mu.buckets))
 	}
+	if elapsed == 0 {
+		return 0
+	}
 	return float64(sum) / (float64(elapsed*r.bucketWidth) / float64(time.Second))
 }
+
+const (
+	// minWriteRate is the lowest rate, in bytes/sec, that commits are slowed
+	// down to before writes are stopped entirely.
+	minWriteRate = 16 << 10 // 16 KB/sec
+	// defaultWriteRate is the rate, in bytes/sec, that commits are slowed down
+	// to when no flush or compaction throughput has been observed.
+	defaultWriteRate = 16 << 20 // 16 MB/sec
+)
+
+// writeRateLimit returns the limit on the rate of commits, in bytes/sec, given
+// the number of L0 files, the estimated number of bytes which need to be
+// compacted, and the observed rate at which flushes and compactions are
+// draining the LSM. Commits are not limited (rate.Inf is returned) until
+// either L0 or the compaction debt crosses its slowdown threshold. Beyond the
+// slowdown threshold, the limit is the drain rate scaled down linearly as the
+// corresponding stop threshold is approached. This provides smooth
+// back-pressure rather than letting writes run unimpeded until they hit the
+// stop thresholds and stall completely.
+func writeRateLimit(opts *db.Options, l0Files int, debt uint64, drainRate float64) rate.Limit {
+	factor := 1.0
+	slowdown := false
+	if l0Files > opts.L0SlowdownWritesThreshold {
+		slowdown = true
+		factor = math.Min(factor, remainingFraction(
+			float64(l0Files), float64(opts.L0SlowdownWritesThreshold),
+			float64(opts.L0StopWritesThreshold)))
+	}
+	if debt >= opts.PendingCompactionBytesSlowdownThreshold {
+		slowdown = true
+		factor = math.Min(factor, remainingFraction(
+			float64(debt), float64(opts.PendingCompactionBytesSlowdownThreshold),
+			float64(opts.PendingCompactionBytesStopThreshold)))
+	}
+	if !slowdown {
+		return rate.Inf
+	}
+	if drainRate <= 0 {
+		drainRate = defaultWriteRate
+	}
+	return rate.Limit(math.Max(drainRate*factor, minWriteRate))
+}
+
+// remainingFraction returns the fraction of the distance between the slowdown
+// and stop thresholds which remains before v reaches the stop threshold.
+func remainingFraction(v, slowdown, stop float64) float64 {
+	if stop <= slowdown {
+		return 1
+	}
+	f := (stop - v) / (stop - slowdown)
+	if f < 0 {
+		return 0
+	}
+	if f > 1 {
+		return 1
+	}
+	return f
+}
@@ -5,8 +5,13 @@
 package pebble
 
 import (
+	"fmt"
 	"testing"
 	"time"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/internal/rate"
+	"github.com/petermattis/pebble/storage"
 )
 
 func TestRateCounter(t *testing.T) {
@@ -43,3 +48,92 @@ func TestRateCounter(t *testing.T) {
 		}
 	}
 }
+
+func TestWriteRateLimit(t *testing.T) {
+	opts := &db.Options{
+		L0SlowdownWritesThreshold:               8,
+		L0StopWritesThreshold:                   12,
+		PendingCompactionBytesSlowdownThreshold: 100,
+		PendingCompactionBytesStopThreshold:     200,
+	}
+	opts.EnsureDefaults()
+
+	const mb = 1 << 20
+	testCases := []struct {
+		l0Files   int
+		debt      uint64
+		drainRate float64
+		expected  rate.Limit
+	}{
+		{0, 0, 10 * mb, rate.Inf},
+		{8, 99, 10 * mb, rate.Inf},
+		{9, 0, 10 * mb, 7.5 * mb},
+		{10, 0, 10 * mb, 5 * mb},
+		{11, 0, 10 * mb, 2.5 * mb},
+		{12, 0, 10 * mb, minWriteRate},
+		{0, 100, 10 * mb, 10 * mb},
+		{0, 150, 10 * mb, 5 * mb},
+		{0, 250, 10 * mb, minWriteRate},
+		// The most restrictive of the L0 and compaction debt limits is used.
+		{11, 150, 10 * mb, 2.5 * mb},
+		{10, 175, 10 * mb, 2.5 * mb},
+		// If no throughput has been observed, the default write rate is used.
+		{10, 0, 0, defaultWriteRate / 2},
+	}
+	for _, c := range testCases {
+		t.Run("", func(t *testing.T) {
+			if v := writeRateLimit(opts, c.l0Files, c.debt, c.drainRate); c.expected != v {
+				t.Fatalf("l0=%d debt=%d drain=%.0f: expected %.0f, but found %.0f",
+					c.l0Files, c.debt, c.drainRate, c.expected, v)
+			}
+		})
+	}
+}
+
+func TestWriteStall(t *testing.T) {
+	var buf syncedBuffer
+	d, err := Open("", &db.Options{
+		Storage:                                 storage.NewMem(),
+		PendingCompactionBytesSlowdownThreshold: 100,
+		PendingCompactionBytesStopThreshold:     200,
+		EventListener: &db.EventListener{
+			WriteStallBegin: func(info db.WriteStallBeginInfo) {
+				fmt.Fprintf(&buf, "write stall begin: %s\n", info.Reason)
+			},
+			WriteStallEnd: func() {
+				fmt.Fprintf(&buf, "write stall end\n")
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d.mu.Lock()
+	limiter := d.commitController.limiter
+	p := d.mu.versions.picker
+	for _, debt := range []uint64{0, 150, 200, 250, 0} {
+		p.estimatedDebt = debt
+		stalled := d.maybeStallWrites()
+		d.updateWriteRate()
+		fmt.Fprintf(&buf, "debt=%d: stalled=%t limited=%t\n",
+			debt, stalled, limiter.Limit() != rate.Inf)
+	}
+	d.mu.Unlock()
+
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `debt=0: stalled=false limited=false
+debt=150: stalled=false limited=true
+write stall begin: pending compaction bytes limit reached
+debt=200: stalled=true limited=true
+debt=250: stalled=true limited=true
+write stall end
+debt=0: stalled=false limited=false
+`
+	if v := buf.String(); expected != v {
+		t.Fatalf("expected\n%s\nbut found\n%s", expected, v)
+	}
+}
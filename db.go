@@ -6,15 +6,16 @@
 package pebble // import "github.com/petermattis/pebble"
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"sync"
 	"sync/atomic"
-	"time"
 
 	"github.com/petermattis/pebble/db"
 	"github.com/petermattis/pebble/internal/arenaskl"
+	"github.com/petermattis/pebble/internal/rate"
 	"github.com/petermattis/pebble/internal/record"
 	"github.com/petermattis/pebble/storage"
 )
@@ -32,6 +33,10 @@ type flushable interface {
 	newIter(o *db.IterOptions) internalIterator
 	newRangeDelIter(o *db.IterOptions) internalIterator
 	flushed() chan struct{}
+	// logNumber returns the number of the WAL containing the flushable's
+	// contents. The WALs numbered below that of the first flushable in the
+	// queue are obsolete.
+	logNumber() uint64
 	readyForFlush() bool
 }
 
@@ -128,25 +133,35 @@ type DB struct {
 	merge          db.Merge
 	abbreviatedKey db.AbbreviatedKey
 
-	tableCache tableCache
-	newIters   tableNewIters
+	tableCache  tableCache
+	newIters    tableNewIters
+	fileManager sstFileManager
 
 	commit   *commitPipeline
 	fileLock io.Closer
+	// The DB directory, which is synced after files are created in it so that
+	// their directory entries are durable.
+	dataDir storage.File
 
 	largeBatchThreshold int
 	optionsFileNum      uint64
 
 	// Rate limiter for how much bandwidth to allow for commits, compactions, and
-	// flushes.
-	//
-	// TODO(peter): Add a controller module that balances the limits so that
-	// commits cannot happen faster than flushes and the backlog of compaction
-	// work does not grow too large.
+	// flushes. The flush and compaction controllers measure the rate at which
+	// the LSM is being drained, and the commit rate is limited based on that
+	// rate when L0 or the compaction debt grows too large. See updateWriteRate.
 	commitController  *controller
 	compactController *controller
 	flushController   *controller
 
+	// closedCh is closed when the DB is closed, signalling background
+	// goroutines to exit.
+	closedCh chan struct{}
+
+	// scrubCancel cancels the context of the scrubber, if it is running,
+	// interrupting the verification of the current table.
+	scrubCancel context.CancelFunc
+
 	// TODO(peter): describe exactly what this mutex protects. So far: every
 	// field in the struct.
 	mu struct {
@@ -160,6 +175,9 @@ type DB struct {
 		log struct {
 			number uint64
 			*record.LogWriter
+			// failed is set if writing to or syncing the log ran out of space. The
+			// log is replaced when the DB resumes.
+			failed bool
 		}
 
 		mem struct {
@@ -177,15 +195,39 @@ type DB struct {
 		}
 
 		compact struct {
-			cond           sync.Cond
-			flushing       bool
-			compacting     bool
+			cond     sync.Cond
+			flushing bool
+			// The number of compactions currently running.
+			compactingCount int
+			// The set of compactions currently running. New compactions must not
+			// overlap any of these.
+			inProgress     map[*compaction]struct{}
 			pendingOutputs map[uint64]struct{}
 			manual         []*manualCompaction
+			// True if writes are currently stalled waiting for flushes or
+			// compactions to complete.
+			stalled bool
+			// True if the last automatic compaction picked was postponed because
+			// its outputs would not fit in the space available. It is retried
+			// periodically while set (see noSpaceLoop).
+			noSpace bool
+			// True if a compaction ran out of space since the last attempt to
+			// resume the DB. No compactions are scheduled while it is set.
+			outOfSpace bool
 		}
 
 		// The list of active snapshots.
 		snapshots snapshotList
+
+		// True while the scrubber holds a reference to a version in order to
+		// verify one of its tables.
+		scrubbing bool
+
+		// bgErr is set when a write, flush or compaction runs out of space. While
+		// it is set the DB is read-only. See setBackgroundError.
+		bgErr error
+		// True while an attempt to resume from bgErr is in progress.
+		resuming bool
 	}
 }
 
@@ -248,7 +290,9 @@ func (d *DB) getInternal(key []byte, b *Batch, s *Snapshot) ([]byte, error) {
 		}
 		return nil, db.ErrNotFound
 	}
-	return i.Value(), nil
+	// The value may refer to a block in the block cache which can be freed once
+	// the iterator is closed.
+	return append([]byte(nil), i.Value()...), nil
 }
 
 // Set sets the value for the given key. It overwrites any previous value
@@ -346,14 +390,29 @@ func (d *DB) commitSync() error {
 	// NB: The log might have been closed after we unlock d.mu. That's ok because
 	// it will have been synced and all we're guaranteeing is that the log that
 	// was open at the start of this call was synced by the end of it.
-	return log.Sync()
+	err := log.Sync()
+	if err != nil && isOutOfSpace(err) {
+		d.mu.Lock()
+		if d.mu.log.LogWriter == log {
+			d.mu.log.failed = true
+			d.setBackgroundError(err)
+		}
+		d.mu.Unlock()
+	}
+	return err
 }
 
 func (d *DB) commitWrite(b *Batch) (*memTable, error) {
 	// NB: commitWrite is called with d.mu locked.
 
-	// Throttle writes if there are too many L0 tables.
-	d.throttleWrite()
+	// Fail the write if the DB is read-only after running out of space.
+	if d.mu.bgErr != nil {
+		return nil, d.mu.bgErr
+	}
+
+	// Throttle writes if there are too many L0 tables or too many bytes
+	// awaiting compaction.
+	d.updateWriteRate()
 
 	if b.flushable != nil {
 		b.flushable.seqNum = b.seqNum()
@@ -371,9 +430,19 @@ func (d *DB) commitWrite(b *Batch) (*memTable, error) {
 
 	_, err := d.mu.log.WriteRecord(b.data)
 	if err != nil {
-		panic(err)
+		if !isOutOfSpace(err) {
+			panic(err)
+		}
+		if b.flushable == nil {
+			// Release the reference taken by makeRoomForWrite, as the batch will not
+			// be applied. Otherwise the memtable could never be flushed.
+			d.mu.mem.mutable.unref()
+		}
+		d.mu.log.failed = true
+		d.setBackgroundError(err)
+		return nil, err
 	}
-	return d.mu.mem.mutable, err
+	return d.mu.mem.mutable, nil
 }
 
 // newIterInternal constructs a new iterator, merging in batchIter as an extra
@@ -537,14 +606,19 @@ func (d *DB) Close() error {
 	if d.mu.closed {
 		return nil
 	}
-	for d.mu.compact.compacting || d.mu.compact.flushing {
+	if d.scrubCancel != nil {
+		d.scrubCancel()
+	}
+	for d.mu.compact.compactingCount > 0 || d.mu.compact.flushing || d.mu.scrubbing || d.mu.resuming {
 		d.mu.compact.cond.Wait()
 	}
 	err := d.tableCache.Close()
 	err = firstError(err, d.mu.log.Close())
+	err = firstError(err, d.dataDir.Close())
 	err = firstError(err, d.fileLock.Close())
 	d.commit.Close()
 	d.mu.closed = true
+	close(d.closedCh)
 
 	if err == nil {
 		current := d.mu.versions.currentVersion()
@@ -582,6 +656,11 @@ func (d *DB) Compact(start, end []byte /* CompactionOptions */) error {
 	// Determine if any memtable overlaps with the compaction range. We wait for
 	// any such overlap to flush (initiating a flush if necessary).
 	mem, err := func() (flushable, error) {
+		if d.mu.bgErr != nil {
+			// The memtables cannot be flushed while the DB is read-only, but
+			// compacting the sstables may reclaim the space needed to resume.
+			return nil, nil
+		}
 		if ingestMemtableOverlaps(d.cmp, d.mu.mem.mutable, meta) {
 			mem := d.mu.mem.mutable
 			return mem, d.makeRoomForWrite(nil)
@@ -652,25 +731,85 @@ func (d *DB) AsyncFlush() error {
 	return err
 }
 
-func (d *DB) throttleWrite() {
-	if len(d.mu.versions.currentVersion().files[0]) <= d.opts.L0SlowdownWritesThreshold {
+// updateWriteRate updates the limit on the rate of commits. We are getting
+// close to hitting a hard limit on the number of L0 files or the number of
+// bytes awaiting compaction. Rather than delaying a single write by several
+// seconds when we hit the hard limit, start delaying each commit in proportion
+// to the rate at which flushes and compactions are draining the LSM to reduce
+// latency variance. The delay itself is applied by the commit pipeline outside
+// of d.mu.
+//
+// d.mu must be held when calling this.
+func (d *DB) updateWriteRate() {
+	l0Files := len(d.mu.versions.currentVersion().files[0])
+	var debt uint64
+	if p := d.mu.versions.picker; p != nil {
+		debt = p.estimatedDebt
+	}
+	limiter := d.commitController.limiter
+	if l0Files <= d.opts.L0SlowdownWritesThreshold &&
+		debt < d.opts.PendingCompactionBytesSlowdownThreshold {
+		if limiter.Limit() != rate.Inf {
+			limiter.SetLimit(rate.Inf)
+		}
 		return
 	}
-	// fmt.Printf("L0 slowdown writes threshold\n")
-	// We are getting close to hitting a hard limit on the number of L0
-	// files. Rather than delaying a single write by several seconds when we hit
-	// the hard limit, start delaying each individual write by 1ms to reduce
-	// latency variance.
-	//
-	// TODO(peter): Use more sophisticated rate limiting.
-	d.mu.Unlock()
-	time.Sleep(1 * time.Millisecond)
-	d.mu.Lock()
+
+	// Writes can be sustained at the rate at which compactions drain the LSM.
+	// If no compactions are running, fall back to the flush rate.
+	drainRate := d.compactController.sensor.Rate()
+	if drainRate <= 0 {
+		drainRate = d.flushController.sensor.Rate()
+	}
+	limiter.SetLimit(writeRateLimit(d.opts, l0Files, debt, drainRate))
+}
+
+// maybeStallWrites returns true if writes must wait because there are too many
+// memtables, too many L0 tables, or too many bytes awaiting compaction, and
+// signals the beginning and end of such write stalls to the EventListener.
+//
+// d.mu must be held when calling this.
+func (d *DB) maybeStallWrites() bool {
+	var reason string
+	switch {
+	case len(d.mu.mem.queue) >= d.opts.MemTableStopWritesThreshold:
+		// We have filled up the current memtable, but the previous one is still
+		// being compacted, so we wait.
+		reason = "memtable count limit reached"
+	case len(d.mu.versions.currentVersion().files[0]) > d.opts.L0StopWritesThreshold:
+		// There are too many level-0 files, so we wait.
+		reason = "L0 file count limit exceeded"
+	case d.mu.versions.picker != nil &&
+		d.mu.versions.picker.estimatedDebt >= d.opts.PendingCompactionBytesStopThreshold:
+		// There are too many bytes awaiting compaction, so we wait.
+		reason = "pending compaction bytes limit reached"
+	}
+
+	el := d.opts.EventListener
+	if reason == "" {
+		if d.mu.compact.stalled {
+			d.mu.compact.stalled = false
+			if el != nil && el.WriteStallEnd != nil {
+				el.WriteStallEnd()
+			}
+		}
+		return false
+	}
+	if !d.mu.compact.stalled {
+		d.mu.compact.stalled = true
+		if el != nil && el.WriteStallBegin != nil {
+			el.WriteStallBegin(db.WriteStallBeginInfo{Reason: reason})
+		}
+	}
+	return true
 }
 
 func (d *DB) makeRoomForWrite(b *Batch) error {
 	force := b == nil || b.flushable != nil
 	for {
+		if d.mu.bgErr != nil {
+			return d.mu.bgErr
+		}
 		if d.mu.mem.switching {
 			d.mu.mem.cond.Wait()
 			continue
@@ -686,85 +825,103 @@ func (d *DB) makeRoomForWrite(b *Batch) error {
 		} else if !force {
 			return nil
 		}
-		if len(d.mu.mem.queue) >= d.opts.MemTableStopWritesThreshold {
-			// We have filled up the current memtable, but the previous one is still
-			// being compacted, so we wait.
-			// fmt.Printf("memtable stop writes threshold\n")
-			d.mu.compact.cond.Wait()
-			continue
-		}
-		if len(d.mu.versions.currentVersion().files[0]) > d.opts.L0StopWritesThreshold {
-			// There are too many level-0 files, so we wait.
-			// fmt.Printf("L0 stop writes threshold\n")
+		if d.maybeStallWrites() {
 			d.mu.compact.cond.Wait()
 			continue
 		}
 
-		var newLogNumber uint64
-		var newLogFile storage.File
-		var err error
-
-		if !d.opts.DisableWAL {
-			newLogNumber = d.mu.versions.nextFileNum()
-			d.mu.mem.switching = true
-			d.mu.Unlock()
-
-			newLogFile, err = d.opts.Storage.Create(dbFilename(d.dirname, fileTypeLog, newLogNumber))
-			if err == nil {
-				err = d.mu.log.Close()
-				if err != nil {
-					newLogFile.Close()
-				}
+		if err := d.switchMemTable(b); err != nil {
+			if !isOutOfSpace(err) {
+				// TODO(peter): avoid chewing through file numbers in a tight loop if
+				// there is an error here.
+				//
+				// What to do here? Stumbling on doesn't seem worthwhile. If we failed
+				// to close the previous log it is possible we lost a write.
+				panic(err)
 			}
-
-			d.mu.Lock()
-			d.mu.mem.switching = false
-			d.mu.mem.cond.Broadcast()
+			d.setBackgroundError(err)
+			return err
 		}
+		force = false
+	}
+}
 
-		if err != nil {
-			// TODO(peter): avoid chewing through file numbers in a tight loop if there
-			// is an error here.
-			//
-			// What to do here? Stumbling on doesn't seem worthwhile. If we failed to
-			// close the previous log it is possible we lost a write.
-			panic(err)
-		}
+// switchMemTable switches to a new WAL and memtable, queueing the current
+// memtable for flushing. If b is a large batch, it is queued for flushing
+// after the current memtable.
+//
+// d.mu must be held when calling this, but the mutex may be dropped and
+// re-acquired during the course of this method.
+func (d *DB) switchMemTable(b *Batch) error {
+	var newLogNumber uint64
+	var newLogFile storage.File
+	var err error
+
+	if !d.opts.DisableWAL {
+		newLogNumber = d.mu.versions.nextFileNum()
+		d.mu.mem.switching = true
+		d.mu.Unlock()
 
-		// NB: When the immutable memtable is flushed to disk it will apply a
-		// versionEdit to the manifest telling it that log files < d.mu.log.number
-		// have been applied.
-		if !d.opts.DisableWAL {
-			d.mu.log.number = newLogNumber
-			d.mu.log.LogWriter = record.NewLogWriter(newLogFile)
-		}
-		imm := d.mu.mem.mutable
-		if imm.empty() {
-			// If the mutable memtable is empty, then remove it from the queue. We'll
-			// reuse the memtable by leaving d.mu.mem.mutable non nil.
-			d.mu.mem.queue = d.mu.mem.queue[:len(d.mu.mem.queue)-1]
-			imm = nil
-		} else {
-			d.mu.mem.mutable = nil
-		}
-		var scheduleFlush bool
-		if b != nil && b.flushable != nil {
-			// The batch is too large to fit in the memtable so add it directly to
-			// the immutable queue.
-			d.mu.mem.queue = append(d.mu.mem.queue, b.flushable)
-			scheduleFlush = true
-		}
-		if d.mu.mem.mutable == nil {
-			// Create a new memtable if we are flushing the previous mutable
-			// memtable.
-			d.mu.mem.mutable = newMemTable(d.opts)
+		newLogFile, err = d.opts.Storage.Create(dbFilename(d.dirname, fileTypeLog, newLogNumber))
+		if err == nil {
+			// Sync the directory so that the new log file is found after a
+			// crash. Writes to the new log are only durable once it is.
+			err = d.dataDir.Sync()
+			if err != nil {
+				newLogFile.Close()
+			}
 		}
-		d.mu.mem.queue = append(d.mu.mem.queue, d.mu.mem.mutable)
-		if (imm != nil && imm.unref()) || scheduleFlush {
-			d.maybeScheduleFlush()
+		if err == nil {
+			err = d.mu.log.Close()
+			if err != nil {
+				newLogFile.Close()
+			}
 		}
-		force = false
+
+		d.mu.Lock()
+		d.mu.mem.switching = false
+		d.mu.mem.cond.Broadcast()
 	}
+
+	if err != nil {
+		return err
+	}
+
+	// NB: When the immutable memtable is flushed to disk it will apply a
+	// versionEdit to the manifest telling it that log files < d.mu.log.number
+	// have been applied.
+	if !d.opts.DisableWAL {
+		d.mu.log.number = newLogNumber
+		d.mu.log.LogWriter = record.NewLogWriter(newLogFile)
+	}
+	imm := d.mu.mem.mutable
+	if imm.empty() {
+		// If the mutable memtable is empty, then remove it from the queue. We'll
+		// reuse the memtable by leaving d.mu.mem.mutable non nil.
+		d.mu.mem.queue = d.mu.mem.queue[:len(d.mu.mem.queue)-1]
+		imm = nil
+	} else {
+		d.mu.mem.mutable = nil
+	}
+	var scheduleFlush bool
+	if b != nil && b.flushable != nil {
+		// The batch is too large to fit in the memtable so add it directly to
+		// the immutable queue. The batch is written to the new WAL.
+		b.flushable.logNum = d.mu.log.number
+		d.mu.mem.queue = append(d.mu.mem.queue, b.flushable)
+		scheduleFlush = true
+	}
+	if d.mu.mem.mutable == nil {
+		// Create a new memtable if we are flushing the previous mutable
+		// memtable.
+		d.mu.mem.mutable = newMemTable(d.opts)
+	}
+	d.mu.mem.mutable.logNum = d.mu.log.number
+	d.mu.mem.queue = append(d.mu.mem.queue, d.mu.mem.mutable)
+	if (imm != nil && imm.unref()) || scheduleFlush {
+		d.maybeScheduleFlush()
+	}
+	return nil
 }
 
 // firstError returns the first non-nil error of err0 and err1, or nil if both
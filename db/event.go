@@ -20,6 +20,9 @@ type TableInfo struct {
 	SmallestSeqNum uint64
 	// LargestSeqNum is the largest sequence number in the table.
 	LargestSeqNum uint64
+	// FileChecksum is the CRC32c of the entire file, as computed by
+	// sstable.FileChecksum. Zero if unknown.
+	FileChecksum uint32
 }
 
 // CompactionInfo contains the info for a compaction event.
@@ -79,6 +82,22 @@ type TableIngestInfo struct {
 	Err          error
 }
 
+// TableCorruptionInfo contains the info for a table corruption event.
+type TableCorruptionInfo struct {
+	// Level is the level of the LSM the table resides in.
+	Level int
+	// Table describes the corrupt table. The range of keys affected by the
+	// corruption is bounded by Table.Smallest and Table.Largest.
+	Table TableInfo
+	Err   error
+}
+
+// WriteStallBeginInfo contains the info for a write stall begin event.
+type WriteStallBeginInfo struct {
+	// Reason is the reason for the write stall.
+	Reason string
+}
+
 // EventListener contains a set of functions that will be invoked when various
 // significant DB events occur. Note that the functions should not run for an
 // excessive amount of time as they are invokved synchronously by the DB and
@@ -86,7 +105,10 @@ type TableIngestInfo struct {
 // perform any synchronous calls back into the DB.
 type EventListener struct {
 	// BackgroundError is invoked whenever an error occurs during a background
-	// operation such as flush or compaction.
+	// operation such as flush or compaction, and when a write fails because
+	// the DB ran out of space. A write, flush or compaction which runs out of
+	// space makes the DB read-only: writes fail until the DB resumes, which it
+	// does automatically once space has been freed.
 	BackgroundError func(error)
 
 	// CompactionBegin is invoked after the inputs to a compaction have been
@@ -105,10 +127,24 @@ type EventListener struct {
 	// installed.
 	FlushEnd func(FlushInfo)
 
+	// TableCorrupted is invoked when the scrubber enabled by
+	// Options.ScrubBytesPerSecond finds a corrupt table. A table remains live
+	// after corruption is found, and is reported again on each subsequent pass
+	// of the scrubber.
+	TableCorrupted func(TableCorruptionInfo)
+
 	// TableDeleted is invoked after a table has been deleted.
 	TableDeleted func(TableDeleteInfo)
 
 	// TableIngested is invoked after an externally created table has been
 	// ingested via a call to DB.Ingest().
 	TableIngested func(TableIngestInfo)
+
+	// WriteStallBegin is invoked when writes are stopped because there are too
+	// many memtables, too many L0 tables, or too many bytes awaiting
+	// compaction.
+	WriteStallBegin func(WriteStallBeginInfo)
+
+	// WriteStallEnd is invoked when a write stall ends.
+	WriteStallEnd func()
 }
@@ -37,6 +37,12 @@ const (
 	// InternalKeyKindColumnFamilyBlobIndex                    = 16
 	// InternalKeyKindBlobIndex                                = 17
 
+	// InternalKeyKindIngestSST is used in the WAL to record the ingestion of an
+	// sstable, whose file number is the user key. Keys of this kind never
+	// appear in a memtable or sstable, and so are not bounded by
+	// InternalKeyKindMax.
+	InternalKeyKindIngestSST = 22
+
 	// This maximum value isn't part of the file format. It's unlikely,
 	// but future extensions may increase this value.
 	//
@@ -72,6 +78,7 @@ var internalKeyKindNames = []string{
 	InternalKeyKindMerge:       "MERGE",
 	InternalKeyKindRangeDelete: "RANGEDEL",
 	InternalKeyKindMax:         "MAX",
+	InternalKeyKindIngestSST:   "INGESTSST",
 	InternalKeyKindInvalid:     "INVALID",
 }
 
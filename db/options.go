@@ -7,6 +7,7 @@ package db
 import (
 	"bytes"
 	"fmt"
+	"math"
 
 	"github.com/petermattis/pebble/cache"
 	"github.com/petermattis/pebble/storage"
@@ -19,6 +20,8 @@ const (
 	DefaultCompression Compression = iota
 	NoCompression
 	SnappyCompression
+	LZ4Compression
+	ZstdCompression
 	nCompression
 )
 
@@ -30,23 +33,138 @@ func (c Compression) String() string {
 		return "NoCompression"
 	case SnappyCompression:
 		return "Snappy"
+	case LZ4Compression:
+		return "LZ4"
+	case ZstdCompression:
+		return "ZSTD"
 	default:
 		return "Unknown"
 	}
 }
 
-// FilterType is the level at which to apply a filter: block or table.
+// ChecksumType is the algorithm used to checksum each block of a table.
+type ChecksumType int
+
+const (
+	DefaultChecksum ChecksumType = iota
+	CRC32cChecksum
+	XXHash32Checksum
+	XXHash64Checksum
+	nChecksum
+)
+
+func (c ChecksumType) String() string {
+	switch c {
+	case DefaultChecksum:
+		return "Default"
+	case CRC32cChecksum:
+		return "CRC32c"
+	case XXHash32Checksum:
+		return "xxHash"
+	case XXHash64Checksum:
+		return "xxHash64"
+	default:
+		return "Unknown"
+	}
+}
+
+// CompactionPriority is the heuristic used to pick the file to compact within
+// a level once the level has been chosen for compaction.
+type CompactionPriority int
+
+// The available compaction priorities. These mirror the RocksDB
+// CompactionPri settings.
+const (
+	DefaultCompactionPriority CompactionPriority = iota
+	// ByCompensatedSize picks the file with the largest compensated size
+	// first. The compensated size of a file is its size inflated by the
+	// deletions it contains, so that deletions are propagated to the bottom of
+	// the LSM more quickly.
+	ByCompensatedSize
+	// OldestLargestSeqFirst picks the file whose most recent update is the
+	// oldest first. Useful for workloads which update some key ranges much more
+	// frequently than others.
+	OldestLargestSeqFirst
+	// OldestSmallestSeqFirst picks the file containing the oldest data first.
+	OldestSmallestSeqFirst
+	// MinOverlappingRatio picks the file with the smallest ratio of overlapping
+	// bytes in the next level to its own size first. This minimizes write
+	// amplification.
+	MinOverlappingRatio
+	nCompactionPriority
+)
+
+func (p CompactionPriority) String() string {
+	switch p {
+	case DefaultCompactionPriority:
+		return "Default"
+	case ByCompensatedSize:
+		return "ByCompensatedSize"
+	case OldestLargestSeqFirst:
+		return "OldestLargestSeqFirst"
+	case OldestSmallestSeqFirst:
+		return "OldestSmallestSeqFirst"
+	case MinOverlappingRatio:
+		return "MinOverlappingRatio"
+	default:
+		return "Unknown"
+	}
+}
+
+// FilterType is the level at which to apply a filter: block, table, or
+// partitioned.
 type FilterType int
 
 // The available filter types.
 const (
+	// TableFilter is a single filter over all of the keys in a table.
 	TableFilter FilterType = iota
+	// BlockFilter is a filter per data block. Only the filter for the data
+	// block which may contain a key is consulted, after the key has been looked
+	// up in the index.
+	BlockFilter
+	// PartitionedFilter is a table filter split into partitions which are
+	// aligned with the partitions of a two-level index (see
+	// LevelOptions.IndexBlockSize). Each partition is loaded through the block
+	// cache on demand. A table whose index fits in a single block has a single
+	// filter partition.
+	PartitionedFilter
 )
 
 func (t FilterType) String() string {
 	switch t {
 	case TableFilter:
 		return "table"
+	case BlockFilter:
+		return "block"
+	case PartitionedFilter:
+		return "partitioned"
+	}
+	return "unknown"
+}
+
+// DataBlockIndexType is the type of index used to search for a key within a
+// data block.
+type DataBlockIndexType int
+
+// The available data block index types.
+const (
+	// DataBlockBinarySearch binary searches the restart points of a data block
+	// and then scans forward from the restart point found.
+	DataBlockBinarySearch DataBlockIndexType = iota
+	// DataBlockBinaryAndHash additionally appends a hash index to each data
+	// block which maps user keys to the restart interval containing them. Point
+	// lookups consult the hash index and only scan a single restart interval,
+	// avoiding the binary search. Iteration continues to use binary search.
+	DataBlockBinaryAndHash
+)
+
+func (t DataBlockIndexType) String() string {
+	switch t {
+	case DataBlockBinarySearch:
+		return "binary-search"
+	case DataBlockBinaryAndHash:
+		return "binary-and-hash"
 	}
 	return "unknown"
 }
@@ -95,6 +213,31 @@ func filterPolicyName(p FilterPolicy) string {
 	return p.Name()
 }
 
+// TablePropertyCollector provides a hook for collecting user-defined
+// properties based on the keys and values stored in an sstable. A new
+// TablePropertyCollector is created for each sstable written.
+type TablePropertyCollector interface {
+	// Add is called with each new entry added to the sstable. While the sstable
+	// is itself sorted by key, do not assume that the entries are added in any
+	// order. In particular, the ordering of point entries and range tombstones
+	// is unspecified.
+	Add(key InternalKey, value []byte) error
+
+	// Finish is called when all entries have been added to the sstable. The
+	// collected properties (if any) should be added to the specified map. Note
+	// that in case of an error during sstable construction, Finish may not be
+	// called.
+	Finish(userProps map[string]string) error
+
+	// NeedCompact is called after Finish and returns true if the sstable
+	// should be marked for compaction. Marked sstables are compacted at low
+	// priority when no level needs compaction.
+	NeedCompact() bool
+
+	// Name returns the name of the property collector.
+	Name() string
+}
+
 // TableFormat specifies the format version for sstables. The legacy LevelDB
 // format is format version 0.
 type TableFormat uint32
@@ -127,11 +270,56 @@ type LevelOptions struct {
 	// The default value is 90
 	BlockSizeThreshold int
 
-	// Compression defines the per-block compression to use.
+	// Checksum defines the algorithm used to checksum each block. The checksum
+	// type is recorded in the table footer, and tables written with any type
+	// can be read regardless of this setting. The xxHash checksums do not
+	// benefit from hardware acceleration, but are faster than CRC32c on
+	// platforms without it. TableFormatLevelDB only supports CRC32c.
+	//
+	// The default value (DefaultChecksum) uses CRC32c.
+	Checksum ChecksumType
+
+	// DataBlockIndexType defines the index used to search within data blocks.
+	// A hash index speeds up point lookups at the cost of roughly one byte per
+	// key divided by DataBlockHashUtilRatio. The hash index is not built for
+	// blocks larger than 64KB or with more than 253 restart points, nor for
+	// tables in the LevelDB format.
+	//
+	// The default value is DataBlockBinarySearch.
+	DataBlockIndexType DataBlockIndexType
+
+	// DataBlockHashUtilRatio is the target ratio of keys to buckets in the data
+	// block hash index. Lower values reduce hash collisions but use more space.
+	//
+	// The default value is 0.75.
+	DataBlockHashUtilRatio float64
+
+	// Compression defines the per-block compression to use. Zstd compresses
+	// considerably better than snappy or LZ4 at the cost of slower compression,
+	// making it a good choice for the bottom levels which hold most of the
+	// data. LZ4 and Zstd are not supported by TableFormatLevelDB, which uses
+	// snappy in their place.
 	//
 	// The default value (DefaultCompression) uses snappy compression.
 	Compression Compression
 
+	// CompressionDictSize is the maximum size in bytes of the compression
+	// dictionary trained for each table. Data blocks compressed against a
+	// dictionary sampled from the table's own contents compress considerably
+	// better when blocks are small. Dictionaries are only used for LZ4 and Zstd
+	// compression, and only by compactions into the bottommost level, as the
+	// writer must buffer the sampled data blocks in memory while training.
+	//
+	// The default value of 0 disables compression dictionaries.
+	CompressionDictSize int
+
+	// CompressionDictSampleSize is the amount of uncompressed data block content
+	// from which the compression dictionary is trained. The writer buffers data
+	// blocks until this much has been sampled, or the table is finished.
+	//
+	// The default value is 100 times CompressionDictSize.
+	CompressionDictSampleSize int
+
 	// FilterPolicy defines a filter algorithm (such as a Bloom filter) that can
 	// reduce disk reads for Get calls.
 	//
@@ -148,8 +336,19 @@ type LevelOptions struct {
 	// memory proportional to the number of keys in an sstable to create, but
 	// avoids the index lookup when determining if a key is present. Table-level
 	// filters should be preferred except under constrained memory situations.
+	// Partitioned filters are table-level filters which are split along the
+	// index partitions, allowing large filters to be cached piecemeal.
 	FilterType FilterType
 
+	// IndexBlockSize is the target uncompressed size in bytes of each index
+	// block. When the index block size is larger than this target, two-level
+	// indexes are automatically enabled: the index is split into partitions
+	// which are loaded on demand through the block cache, and a small top-level
+	// index points to the partitions.
+	//
+	// The default value (math.MaxInt32) disables two-level indexes.
+	IndexBlockSize int
+
 	// The target file size for the level.
 	TargetFileSize int64
 }
@@ -170,9 +369,21 @@ func (o *LevelOptions) EnsureDefaults() *LevelOptions {
 	if o.BlockSizeThreshold <= 0 {
 		o.BlockSizeThreshold = 90
 	}
+	if o.Checksum <= DefaultChecksum || o.Checksum >= nChecksum {
+		o.Checksum = CRC32cChecksum
+	}
+	if o.DataBlockHashUtilRatio <= 0 {
+		o.DataBlockHashUtilRatio = 0.75
+	}
+	if o.IndexBlockSize <= 0 {
+		o.IndexBlockSize = math.MaxInt32
+	}
 	if o.Compression <= DefaultCompression || o.Compression >= nCompression {
 		o.Compression = SnappyCompression
 	}
+	if o.CompressionDictSize > 0 && o.CompressionDictSampleSize <= 0 {
+		o.CompressionDictSampleSize = 100 * o.CompressionDictSize
+	}
 	if o.TargetFileSize <= 0 {
 		o.TargetFileSize = 2 << 20 // 2 MB
 	}
@@ -183,6 +394,13 @@ func (o *LevelOptions) EnsureDefaults() *LevelOptions {
 // apply to the DB at large; per-query options are defined by the ReadOptions
 // and WriteOptions types.
 type Options struct {
+	// AllowIngestBehind reserves the last level of the LSM for sstables
+	// ingested with IngestOptions.IngestBehind. Flushes and compactions never
+	// write to the last level, and deletion tombstones are never elided as an
+	// sstable may later be ingested beneath them. This option must be set when
+	// the DB is created and must remain set for the lifetime of the DB.
+	AllowIngestBehind bool
+
 	// Sync sstables and the WAL periodically in order to smooth out writes to
 	// disk. This option does not provide any persistency guarantee, but is used
 	// to avoid latency spikes if the OS automatically decides to write out a
@@ -191,9 +409,20 @@ type Options struct {
 	// The default value is 512KB.
 	BytesPerSync int
 
+	// Cache is used to cache uncompressed blocks from sstables. The cache is
+	// owned by the caller, which must close it once every DB using it has been
+	// closed.
+	//
 	// TODO(peter): provide a cache interface.
 	Cache *cache.Cache
 
+	// CompactionPriority is the heuristic used to choose which file to compact
+	// within a level that needs compaction.
+	//
+	// The default value (DefaultCompactionPriority) uses
+	// OldestSmallestSeqFirst.
+	CompactionPriority CompactionPriority
+
 	// Comparer defines a total ordering over the space of []byte keys: a 'less
 	// than' relationship. The same comparison algorithm must be used for reads
 	// and writes over the lifetime of the DB.
@@ -201,6 +430,20 @@ type Options struct {
 	// The default value uses the same ordering as bytes.Compare.
 	Comparer *Comparer
 
+	// DeletionWindowSize and DeletionWindowTrigger configure the detection of
+	// dense runs of deletion tombstones. An sstable is marked for compaction
+	// when any DeletionWindowSize consecutive point entries within it contain
+	// at least DeletionWindowTrigger deletions. Marked sstables are preferred
+	// when picking a compaction, which prevents iterators from repeatedly
+	// scanning long runs of tombstones (e.g. in a queue which deletes from the
+	// front).
+	//
+	// The default value for DeletionWindowSize is 0 which disables detection.
+	// If DeletionWindowSize is set, the default value for DeletionWindowTrigger
+	// is half of DeletionWindowSize.
+	DeletionWindowSize    int
+	DeletionWindowTrigger int
+
 	// Disable the write-ahead log (WAL). Disabling the write-ahead log prohibits
 	// crash recovery, but can improve performance if crash recovery is not
 	// needed (e.g. when only temporary state is being stored in the database).
@@ -242,6 +485,28 @@ type Options struct {
 	// The default logger uses the Go standard library log package.
 	Logger Logger
 
+	// MaxAllowedSpaceUsage is a limit on the total size of the sstables in the
+	// DB directory, including obsolete sstables which have not yet been
+	// deleted. WAL, MANIFEST and other files are not counted. Once the limit is
+	// reached flushes fail and the DB becomes read-only, until compactions
+	// reduce the size of the sstables below the limit or the limit is raised
+	// by reopening the DB. A compaction is only started if its outputs are
+	// guaranteed to fit under the limit, except while the DB is read-only,
+	// when compactions run one at a time and may temporarily exceed the limit
+	// before their inputs are deleted. Regardless of the limit, a compaction is
+	// only started if its outputs fit in the free space on the device (see
+	// storage.Storage.FreeSpace).
+	//
+	// The default value is 0 which places no limit on the space used.
+	MaxAllowedSpaceUsage uint64
+
+	// MaxConcurrentCompactions is the maximum number of compactions which may
+	// run concurrently. Compactions only run concurrently if their inputs and
+	// outputs do not overlap.
+	//
+	// The default value is 1.
+	MaxConcurrentCompactions int
+
 	// MaxOpenFiles is a soft limit on the number of open files that can be
 	// used by the DB.
 	//
@@ -266,11 +531,69 @@ type Options struct {
 	// The default merger concatenates values.
 	Merger *Merger
 
+	// ParanoidChecks enables verification of the tables written by flushes and
+	// compactions before they are installed. Each output table is reopened and
+	// iterated over in full, checking its block checksums, the ordering of its
+	// keys, the number of entries against the count recorded when the table
+	// was written, and that its keys lie within the table's bounds. A flush or
+	// compaction which fails verification is aborted and its output discarded.
+	// Note that the ordering of the tables in each new version is checked
+	// regardless of this option.
+	ParanoidChecks bool
+
+	// PendingCompactionBytesSlowdownThreshold is the estimated number of bytes
+	// which need to be compacted at which commits are slowed down. The commit
+	// rate is derived from the observed flush and compaction throughput, and is
+	// reduced further as the estimate approaches
+	// PendingCompactionBytesStopThreshold.
+	//
+	// The default value is 64 GB.
+	PendingCompactionBytesSlowdownThreshold uint64
+
+	// PendingCompactionBytesStopThreshold is the estimated number of bytes
+	// which need to be compacted at which writes are stopped.
+	//
+	// The default value is 256 GB.
+	PendingCompactionBytesStopThreshold uint64
+
+	// PeriodicCompactionSeconds is the age, in seconds, after which an sstable
+	// is compacted even if its level does not need compaction. Periodic
+	// compactions are performed at low priority and rewrite sstables in the
+	// last level in place. This can be used to push old data through a newly
+	// installed compaction filter or compression setting.
+	//
+	// The default value is 0 which disables periodic compactions.
+	PeriodicCompactionSeconds int64
+
+	// PinL0IndexAndFilterBlocks pins the index and filter blocks of level 0
+	// sstables in the block cache. Every read consults every level 0 sstable, so
+	// evicting their index and filter blocks is particularly costly. The blocks
+	// are unpinned when the sstable is evicted from the table cache or moves out
+	// of level 0. The index and filter blocks of other sstables are cached with
+	// high priority, which retains them in preference to data blocks but does
+	// not pin them. Pinned blocks are not limited by the capacity of the cache;
+	// see Cache.PinnedSize.
+	PinL0IndexAndFilterBlocks bool
+
+	// ScrubBytesPerSecond enables a background scrubber which continuously
+	// walks the live sstables, re-reading every block from disk and verifying
+	// its checksum. The scrubber bypasses the block cache, and its reads are
+	// limited to ScrubBytesPerSecond. Corrupt tables are reported via
+	// EventListener.TableCorrupted.
+	//
+	// The default value is 0 which disables scrubbing.
+	ScrubBytesPerSecond int64
+
 	// Storage maps file names to byte storage.
 	//
 	// The default value uses the underlying operating system's file system.
 	Storage storage.Storage
 
+	// TablePropertyCollectors is a list of TablePropertyCollector creation
+	// functions. A new TablePropertyCollector is created for each sstable built
+	// and lives for the lifetime of the table.
+	TablePropertyCollectors []func() TablePropertyCollector
+
 	// TableFormat specifies the format version for sstables. The default is
 	// TableFormatRocksDBv2 which creates RocksDB compatible sstables. Use
 	// TableFormatLevelDB to create LevelDB compatible sstable which can be used
@@ -287,9 +610,15 @@ func (o *Options) EnsureDefaults() *Options {
 	if o.BytesPerSync <= 0 {
 		o.BytesPerSync = 512 << 10
 	}
+	if o.CompactionPriority == DefaultCompactionPriority {
+		o.CompactionPriority = OldestSmallestSeqFirst
+	}
 	if o.Comparer == nil {
 		o.Comparer = DefaultComparer
 	}
+	if o.DeletionWindowSize > 0 && o.DeletionWindowTrigger <= 0 {
+		o.DeletionWindowTrigger = (o.DeletionWindowSize + 1) / 2
+	}
 	if o.L0CompactionThreshold <= 0 {
 		o.L0CompactionThreshold = 4
 	}
@@ -321,6 +650,9 @@ func (o *Options) EnsureDefaults() *Options {
 	if o.Logger == nil {
 		o.Logger = defaultLogger{}
 	}
+	if o.MaxConcurrentCompactions <= 0 {
+		o.MaxConcurrentCompactions = 1
+	}
 	if o.MaxOpenFiles == 0 {
 		o.MaxOpenFiles = 1000
 	}
@@ -333,12 +665,28 @@ func (o *Options) EnsureDefaults() *Options {
 	if o.Merger == nil {
 		o.Merger = DefaultMerger
 	}
+	if o.PendingCompactionBytesSlowdownThreshold == 0 {
+		o.PendingCompactionBytesSlowdownThreshold = 64 << 30 // 64 GB
+	}
+	if o.PendingCompactionBytesStopThreshold == 0 {
+		o.PendingCompactionBytesStopThreshold = 256 << 30 // 256 GB
+	}
 	if o.Storage == nil {
 		o.Storage = storage.Default
 	}
 	return o
 }
 
+// Validate returns an error if the options are invalid. Options with values
+// that EnsureDefaults would replace are not considered invalid.
+func (o *Options) Validate() error {
+	if o.CompactionPriority < DefaultCompactionPriority ||
+		o.CompactionPriority >= nCompactionPriority {
+		return fmt.Errorf("pebble: unknown compaction priority: %d", o.CompactionPriority)
+	}
+	return nil
+}
+
 // Level returns the LevelOptions for the specified level.
 func (o *Options) Level(level int) LevelOptions {
 	if level < len(o.Levels) {
@@ -359,18 +707,30 @@ func (o *Options) String() string {
 	fmt.Fprintf(&buf, "  pebble_version=0.1\n")
 	fmt.Fprintf(&buf, "\n")
 	fmt.Fprintf(&buf, "[Options]\n")
+	fmt.Fprintf(&buf, "  allow_ingest_behind=%t\n", o.AllowIngestBehind)
 	fmt.Fprintf(&buf, "  bytes_per_sync=%d\n", o.BytesPerSync)
 	fmt.Fprintf(&buf, "  cache_size=%d\n", o.Cache.MaxSize())
+	fmt.Fprintf(&buf, "  compaction_priority=%s\n", o.CompactionPriority)
 	fmt.Fprintf(&buf, "  comparer=%s\n", o.Comparer.Name)
+	fmt.Fprintf(&buf, "  deletion_window_size=%d\n", o.DeletionWindowSize)
+	fmt.Fprintf(&buf, "  deletion_window_trigger=%d\n", o.DeletionWindowTrigger)
 	fmt.Fprintf(&buf, "  disable_wal=%t\n", o.DisableWAL)
 	fmt.Fprintf(&buf, "  l0_compaction_threshold=%d\n", o.L0CompactionThreshold)
 	fmt.Fprintf(&buf, "  l0_slowdown_writes_threshold=%d\n", o.L0SlowdownWritesThreshold)
 	fmt.Fprintf(&buf, "  l0_stop_writes_threshold=%d\n", o.L0StopWritesThreshold)
 	fmt.Fprintf(&buf, "  l1_max_bytes=%d\n", o.L1MaxBytes)
+	fmt.Fprintf(&buf, "  max_allowed_space_usage=%d\n", o.MaxAllowedSpaceUsage)
+	fmt.Fprintf(&buf, "  max_concurrent_compactions=%d\n", o.MaxConcurrentCompactions)
 	fmt.Fprintf(&buf, "  max_open_files=%d\n", o.MaxOpenFiles)
 	fmt.Fprintf(&buf, "  mem_table_size=%d\n", o.MemTableSize)
 	fmt.Fprintf(&buf, "  mem_table_stop_writes_threshold=%d\n", o.MemTableStopWritesThreshold)
 	fmt.Fprintf(&buf, "  merger=%s\n", o.Merger.Name)
+	fmt.Fprintf(&buf, "  paranoid_checks=%t\n", o.ParanoidChecks)
+	fmt.Fprintf(&buf, "  pending_compaction_bytes_slowdown_threshold=%d\n", o.PendingCompactionBytesSlowdownThreshold)
+	fmt.Fprintf(&buf, "  pending_compaction_bytes_stop_threshold=%d\n", o.PendingCompactionBytesStopThreshold)
+	fmt.Fprintf(&buf, "  periodic_compaction_seconds=%d\n", o.PeriodicCompactionSeconds)
+	fmt.Fprintf(&buf, "  pin_l0_index_and_filter_blocks=%t\n", o.PinL0IndexAndFilterBlocks)
+	fmt.Fprintf(&buf, "  scrub_bytes_per_second=%d\n", o.ScrubBytesPerSecond)
 
 	for i := range o.Levels {
 		l := &o.Levels[i]
@@ -381,6 +741,7 @@ func (o *Options) String() string {
 		fmt.Fprintf(&buf, "  compression=%s\n", l.Compression)
 		fmt.Fprintf(&buf, "  filter_policy=%s\n", filterPolicyName(l.FilterPolicy))
 		fmt.Fprintf(&buf, "  filter_type=%s\n", l.FilterType)
+		fmt.Fprintf(&buf, "  index_block_size=%d\n", l.IndexBlockSize)
 		fmt.Fprintf(&buf, "  target_file_size=%d\n", l.TargetFileSize)
 	}
 
@@ -440,6 +801,140 @@ func (o *IterOptions) GetUpperBound() []byte {
 	return o.UpperBound
 }
 
+// IngestOptions hold the optional parameters for DB.Ingest.
+//
+// Like Options, a nil *IngestOptions is valid and means to use the default
+// values.
+type IngestOptions struct {
+	// IngestBehind places the ingested sstables in the last level of the LSM
+	// with a sequence number of 0, beneath all existing data. Existing keys
+	// shadow the ingested keys, making this suitable for backfilling historical
+	// data which must never overwrite newer values. Requires
+	// Options.AllowIngestBehind.
+	//
+	// The default value is false.
+	IngestBehind bool
+
+	// AllowFlushable permits sstables which overlap a memtable to be queued
+	// above the older memtables as a flushable, rather than forcing a flush of
+	// the memtables before the sstables are added to the LSM. Neither Ingest
+	// nor concurrent writes wait for the flush: the ingestion is recorded in
+	// the WAL, and the sstables are added to L0 once the memtables beneath them
+	// have been flushed. If the WAL is disabled, Ingest waits for the sstables
+	// to be added to L0. Ignored if IngestBehind is set.
+	//
+	// The default value is false.
+	AllowFlushable bool
+
+	// FallbackToCopy copies the sstables into the DB directory if they cannot
+	// be hard linked, such as when they reside on a different filesystem.
+	//
+	// The default value is false.
+	FallbackToCopy bool
+
+	// MoveFiles removes the sstables from their original location once they
+	// have been successfully ingested, rather than leaving a hard link (or copy)
+	// behind.
+	//
+	// The default value is false.
+	MoveFiles bool
+
+	// FileChecksums are the expected checksums of the sstables, in the same
+	// order as the paths passed to DB.Ingest, such as the TableInfo.FileChecksum
+	// values reported by pebble.SSTWriter. The checksum of each sstable is
+	// computed as it is ingested and recorded in the MANIFEST. If FileChecksums
+	// is set, ingestion fails if any checksum does not match.
+	//
+	// The default value (nil) does not verify the checksums.
+	FileChecksums []uint32
+}
+
+// GetIngestBehind returns the IngestBehind value or false if the receiver is
+// nil.
+func (o *IngestOptions) GetIngestBehind() bool {
+	return o != nil && o.IngestBehind
+}
+
+// GetAllowFlushable returns the AllowFlushable value or false if the receiver
+// is nil.
+func (o *IngestOptions) GetAllowFlushable() bool {
+	return o != nil && o.AllowFlushable
+}
+
+// GetFallbackToCopy returns the FallbackToCopy value or false if the receiver
+// is nil.
+func (o *IngestOptions) GetFallbackToCopy() bool {
+	return o != nil && o.FallbackToCopy
+}
+
+// GetMoveFiles returns the MoveFiles value or false if the receiver is nil.
+func (o *IngestOptions) GetMoveFiles() bool {
+	return o != nil && o.MoveFiles
+}
+
+// GetFileChecksums returns the FileChecksums value or nil if the receiver is
+// nil.
+func (o *IngestOptions) GetFileChecksums() []uint32 {
+	if o == nil {
+		return nil
+	}
+	return o.FileChecksums
+}
+
+// SSTWriterOptions hold the optional parameters for building sstables for
+// ingestion with pebble.SSTWriter.
+//
+// Like Options, a nil *SSTWriterOptions is valid and means to use the default
+// values.
+type SSTWriterOptions struct {
+	// Comparer defines the ordering of the keys added to the sstables. It must
+	// be the same Comparer used by the DB the sstables are ingested into.
+	//
+	// The default value uses the same ordering as bytes.Compare.
+	Comparer *Comparer
+
+	// Merger defines the associative merge operation for Merge entries. It must
+	// be the same Merger used by the DB the sstables are ingested into.
+	//
+	// The default value concatenates values.
+	Merger *Merger
+
+	// Level configures the block size, compression, filter policy and target
+	// file size of the sstables. Output is split into a new sstable once the
+	// current sstable reaches Level.TargetFileSize.
+	Level LevelOptions
+
+	// Storage maps file names to byte storage.
+	//
+	// The default value uses the underlying operating system's file system.
+	Storage storage.Storage
+
+	// TableFormat specifies the format version for the sstables.
+	//
+	// The default value is TableFormatRocksDBv2.
+	TableFormat TableFormat
+}
+
+// EnsureDefaults ensures that the default values for all of the options have
+// been initialized. It is valid to call EnsureDefaults on a nil receiver. A
+// non-nil result will always be returned.
+func (o *SSTWriterOptions) EnsureDefaults() *SSTWriterOptions {
+	if o == nil {
+		o = &SSTWriterOptions{}
+	}
+	if o.Comparer == nil {
+		o.Comparer = DefaultComparer
+	}
+	if o.Merger == nil {
+		o.Merger = DefaultMerger
+	}
+	o.Level.EnsureDefaults()
+	if o.Storage == nil {
+		o.Storage = storage.Default
+	}
+	return o
+}
+
 // WriteOptions hold the optional per-query parameters for Set and Delete
 // operations.
 //
@@ -38,18 +38,30 @@ func TestOptionsString(t *testing.T) {
   pebble_version=0.1
 
 [Options]
+  allow_ingest_behind=false
   bytes_per_sync=524288
   cache_size=0
+  compaction_priority=OldestSmallestSeqFirst
   comparer=leveldb.BytewiseComparator
+  deletion_window_size=0
+  deletion_window_trigger=0
   disable_wal=false
   l0_compaction_threshold=4
   l0_slowdown_writes_threshold=8
   l0_stop_writes_threshold=12
   l1_max_bytes=67108864
+  max_allowed_space_usage=0
+  max_concurrent_compactions=1
   max_open_files=1000
   mem_table_size=4194304
   mem_table_stop_writes_threshold=2
   merger=pebble.concatenate
+  paranoid_checks=false
+  pending_compaction_bytes_slowdown_threshold=68719476736
+  pending_compaction_bytes_stop_threshold=274877906944
+  periodic_compaction_seconds=0
+  pin_l0_index_and_filter_blocks=false
+  scrub_bytes_per_second=0
 
 [Level "0"]
   block_restart_interval=16
@@ -57,6 +69,7 @@ func TestOptionsString(t *testing.T) {
   compression=Snappy
   filter_policy=none
   filter_type=table
+  index_block_size=2147483647
   target_file_size=2097152
 `
 
@@ -66,3 +79,21 @@ func TestOptionsString(t *testing.T) {
 		t.Fatalf("expected\n%s\nbut found\n%s", expected, v)
 	}
 }
+
+func TestOptionsValidate(t *testing.T) {
+	testCases := []struct {
+		prio  CompactionPriority
+		valid bool
+	}{
+		{DefaultCompactionPriority, true},
+		{MinOverlappingRatio, true},
+		{-1, false},
+		{nCompactionPriority, false},
+	}
+	for _, c := range testCases {
+		opts := (&Options{CompactionPriority: c.prio}).EnsureDefaults()
+		if err := opts.Validate(); (err == nil) != c.valid {
+			t.Fatalf("%d: expected valid=%t, but found %v", c.prio, c.valid, err)
+		}
+	}
+}
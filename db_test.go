@@ -551,6 +551,7 @@ func TestIterLeak(t *testing.T) {
 
 func TestCacheEvict(t *testing.T) {
 	cache := cache.New(10 << 20)
+	defer cache.Close()
 	d, err := Open("", &db.Options{
 		Cache:   cache,
 		Storage: storage.NewMem(),
@@ -598,3 +599,193 @@ func TestCacheEvict(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestPinL0IndexAndFilterBlocks(t *testing.T) {
+	c := cache.New(10 << 20)
+	defer c.Close()
+	d, err := Open("", &db.Options{
+		Cache:                     c,
+		PinL0IndexAndFilterBlocks: true,
+		Storage:                   storage.NewMem(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.Set([]byte("a"), []byte("a"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Get([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if size := c.PinnedSize(); size == 0 {
+		t.Fatalf("expected pinned blocks")
+	}
+
+	// The table is trivially moved out of L0, unpinning its blocks even though
+	// it remains in the table cache.
+	if err := d.Compact([]byte("a"), []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	d.mu.Lock()
+	l0 := len(d.mu.versions.currentVersion().files[0])
+	d.mu.Unlock()
+	if l0 != 0 {
+		t.Fatalf("expected empty L0, but found %d tables", l0)
+	}
+	if size := c.PinnedSize(); size != 0 {
+		t.Fatalf("expected no pinned blocks, but found %d bytes", size)
+	}
+	if _, err := d.Get([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if size := c.PinnedSize(); size != 0 {
+		t.Fatalf("expected no pinned blocks, but found %d bytes", size)
+	}
+
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCacheEvictWhileIterating(t *testing.T) {
+	// A cache much smaller than the table, with small blocks, evicts the blocks
+	// referenced by the iterators. The evicted blocks must remain valid until
+	// the iterators have moved off of them.
+	c := cache.New(4 << 10)
+	defer c.Close()
+	d, err := Open("", &db.Options{
+		Cache: c,
+		Levels: []db.LevelOptions{{
+			BlockSize: 256,
+		}},
+		Storage: storage.NewMem(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 2000
+	for i := 0; i < n; i++ {
+		key := []byte(fmt.Sprintf("%04d", i))
+		if err := d.Set(key, bytes.Repeat(key, 4), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	iters := []*Iterator{d.NewIter(nil), d.NewIter(nil)}
+	iters[0].First()
+	iters[1].Last()
+	for i := 0; i < n; i++ {
+		for j, iter := range iters {
+			k := i
+			if j == 1 {
+				k = n - 1 - i
+			}
+			key := []byte(fmt.Sprintf("%04d", k))
+			if !iter.Valid() {
+				t.Fatalf("%d: expected %s, but iterator is exhausted", j, key)
+			}
+			if !bytes.Equal(key, iter.Key()) || !bytes.Equal(bytes.Repeat(key, 4), iter.Value()) {
+				t.Fatalf("%d: expected %s:%s, but found %s:%s",
+					j, key, bytes.Repeat(key, 4), iter.Key(), iter.Value())
+			}
+		}
+		iters[0].Next()
+		iters[1].Prev()
+	}
+	for _, iter := range iters {
+		if err := iter.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s := c.Stats(cache.DataBlock); s.Evictions == 0 {
+		t.Fatalf("expected data blocks to be evicted, but found %+v", s)
+	}
+
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSecondaryCache(t *testing.T) {
+	mem := storage.NewMem()
+	open := func() (*DB, *cache.Cache, *cache.SecondaryCache) {
+		secondary, err := cache.NewSecondaryCache(mem, "secondary", 8<<20)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := cache.NewWithSecondary(4<<10, secondary)
+		d, err := Open("db", &db.Options{
+			Cache: c,
+			Levels: []db.LevelOptions{{
+				BlockSize: 256,
+			}},
+			Storage: mem,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d, c, secondary
+	}
+	scan := func(d *DB) {
+		iter := d.NewIter(nil)
+		var n int
+		for iter.First(); iter.Valid(); iter.Next() {
+			if key := []byte(fmt.Sprintf("%04d", n)); !bytes.Equal(key, iter.Key()) {
+				t.Fatalf("expected %s, but found %s", key, iter.Key())
+			}
+			n++
+		}
+		if err := iter.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if n != 1000 {
+			t.Fatalf("expected 1000 keys, but found %d", n)
+		}
+	}
+
+	d, c, secondary := open()
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("%04d", i))
+		if err := d.Set(key, key, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	// Scanning a table much larger than the cache evicts its blocks to the
+	// secondary cache.
+	scan(d)
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if err := secondary.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if secondary.Size() == 0 {
+		t.Fatalf("expected blocks in the secondary cache")
+	}
+
+	// After reopening, the blocks are read from the secondary cache.
+	d, c, secondary = open()
+	scan(d)
+	if s := c.Stats(cache.DataBlock); s.SecondaryHits == 0 {
+		t.Fatalf("expected secondary cache hits, but found %+v", s)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if err := secondary.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -7,7 +7,9 @@ package pebble
 import (
 	"bytes"
 	"fmt"
+	"strings"
 	"sync"
+	"syscall"
 	"testing"
 
 	"github.com/petermattis/pebble/db"
@@ -97,3 +99,50 @@ func TestEventListener(t *testing.T) {
 		t.Fatalf("expected\n%s\nbut found\n%s", expected, v)
 	}
 }
+
+func TestEventListenerCompactionError(t *testing.T) {
+	// A failed compaction is reported to CompactionEnd with its error, and
+	// without any outputs.
+	fs := storage.NewFaultStorage(storage.NewMem(), false)
+	var infos []db.CompactionInfo
+	d, err := Open("", &db.Options{
+		Storage: fs,
+		EventListener: &db.EventListener{
+			CompactionEnd: func(info db.CompactionInfo) {
+				infos = append(infos, info)
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b"} {
+		if err := d.Set([]byte(key), []byte(key), nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fs.SetInjector(storage.InjectorFunc(func(op storage.Op, name string) error {
+		if op == storage.OpCreate && strings.HasSuffix(name, ".sst") {
+			return syscall.EIO
+		}
+		return nil
+	}))
+	if err := d.Compact([]byte("a"), []byte("b")); err == nil {
+		t.Fatalf("expected error")
+	}
+	fs.SetInjector(nil)
+
+	if len(infos) != 1 {
+		t.Fatalf("expected 1 compaction, but found %d", len(infos))
+	}
+	if info := infos[0]; info.Err == nil || len(info.Output.Tables) != 0 {
+		t.Fatalf("expected error and no outputs, but found %+v", info)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -95,8 +95,25 @@ func setCurrentFile(dirname string, fs storage.Storage, fileNum uint64) error {
 	if _, err := fmt.Fprintf(f, "MANIFEST-%06d\n", fileNum); err != nil {
 		return err
 	}
+	// The new CURRENT file must be durable before it replaces the old one.
+	if err := f.Sync(); err != nil {
+		return err
+	}
 	if err := f.Close(); err != nil {
 		return err
 	}
-	return fs.Rename(oldFilename, newFilename)
+	if err := fs.Rename(oldFilename, newFilename); err != nil {
+		return err
+	}
+	// Sync the directory so that the rename, and the creation of the MANIFEST
+	// it refers to, survive a crash.
+	dir, err := fs.OpenDir(dirname)
+	if err != nil {
+		return err
+	}
+	if err := dir.Sync(); err != nil {
+		dir.Close()
+		return err
+	}
+	return dir.Close()
 }
@@ -431,6 +431,58 @@ func TestGetIter(t *testing.T) {
 				},
 			},
 		},
+
+		{
+			description: "broken invariants 3: overlapping level 0 files with a shared seqnum",
+			badOrdering: true,
+			tables: []testTable{
+				{
+					level:   0,
+					fileNum: 11,
+					data: []string{
+						"bat.SET.101 xxx",
+						"dog.SET.101 xxx",
+					},
+				},
+				{
+					level:   0,
+					fileNum: 12,
+					data: []string{
+						"cow.SET.101 xxx",
+						"pig.SET.101 xxx",
+					},
+				},
+			},
+		},
+
+		{
+			description: "ingested level 0 files: non-overlapping files with a shared seqnum",
+			tables: []testTable{
+				{
+					level:   0,
+					fileNum: 11,
+					data: []string{
+						"cow.SET.101 c",
+						"pig.SET.101 p",
+					},
+				},
+				{
+					level:   0,
+					fileNum: 12,
+					data: []string{
+						"bat.SET.101 b",
+						"bee.SET.101 e",
+					},
+				},
+			},
+			queries: []string{
+				"bat.MAX.102 b",
+				"bat.MAX.100 ErrNotFound",
+				"bee.MAX.102 e",
+				"cow.MAX.102 c",
+				"pig.MAX.102 p",
+			},
+		},
 	}
 
 	cmp := db.DefaultComparer.Compare
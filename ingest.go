@@ -5,10 +5,15 @@
 package pebble
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"os"
 	"sort"
+	"time"
 
 	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/internal/record"
 	"github.com/petermattis/pebble/sstable"
 	"github.com/petermattis/pebble/storage"
 )
@@ -24,14 +29,30 @@ func ingestLoad1(opts *db.Options, path string, fileNum uint64) (*fileMetadata,
 		return nil, err
 	}
 
+	// The file checksum is computed before the sstable is opened, which takes
+	// ownership of the file.
+	checksum, err := sstable.FileChecksum(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
 	r := sstable.NewReader(f, fileNum, opts)
 	defer r.Close()
 
 	meta := &fileMetadata{}
 	meta.fileNum = fileNum
+	meta.fileChecksum = checksum
+	meta.hasFileChecksum = true
 	meta.size = uint64(stat.Size())
 	meta.smallest = db.InternalKey{}
 	meta.largest = db.InternalKey{}
+	meta.numEntries = r.Properties.NumEntries
+	meta.numDeletions = r.Properties.NumDeletions
+	meta.creationTime = r.Properties.CreationTime
+	if meta.creationTime == 0 {
+		meta.creationTime = uint64(time.Now().Unix())
+	}
 	smallestSet, largestSet := false, false
 
 	{
@@ -83,6 +104,59 @@ func ingestLoad(opts *db.Options, paths []string, pending []uint64) ([]*fileMeta
 	return meta, nil
 }
 
+// ingestVerifyZeroSeqNums verifies that every entry in the sstables has a
+// sequence number of 0. Sstables ingested behind are not assigned a global
+// sequence number, so the sequence numbers stored in the sstables are used
+// as-is and must not shadow existing data.
+func ingestVerifyZeroSeqNums(opts *db.Options, paths []string) error {
+	for _, path := range paths {
+		f, err := opts.Storage.Open(path)
+		if err != nil {
+			return err
+		}
+		r := sstable.NewReader(f, 0, opts)
+		err = func() error {
+			iters := []internalIterator{r.NewIter(nil)}
+			if iter := r.NewRangeDelIter(nil); iter != nil {
+				iters = append(iters, iter)
+			}
+			for _, iter := range iters {
+				for valid := iter.First(); valid; valid = iter.Next() {
+					if iter.Key().SeqNum() != 0 {
+						iter.Close()
+						return fmt.Errorf("pebble: %s: ingest-behind requires sequence number 0: %s",
+							path, iter.Key())
+					}
+				}
+				if err := iter.Close(); err != nil {
+					return err
+				}
+			}
+			return nil
+		}()
+		err = firstError(err, r.Close())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ingestVerifyChecksums verifies that the checksum of each sstable matches the
+// expected checksum. The metadata must be in the same order as the paths.
+func ingestVerifyChecksums(paths []string, meta []*fileMetadata, checksums []uint32) error {
+	if len(checksums) != len(paths) {
+		return fmt.Errorf("pebble: %d file checksums provided for %d files", len(checksums), len(paths))
+	}
+	for i := range paths {
+		if meta[i].fileChecksum != checksums[i] {
+			return fmt.Errorf("pebble: %s: file checksum mismatch: expected %08x, but found %08x",
+				paths[i], checksums[i], meta[i].fileChecksum)
+		}
+	}
+	return nil
+}
+
 func ingestSortAndVerify(cmp db.Compare, meta []*fileMetadata) error {
 	if len(meta) <= 1 {
 		return nil
@@ -93,7 +167,11 @@ func ingestSortAndVerify(cmp db.Compare, meta []*fileMetadata) error {
 	})
 
 	for i := 1; i < len(meta); i++ {
-		if cmp(meta[i-1].largest.UserKey, meta[i].smallest.UserKey) >= 0 {
+		// A range deletion sentinel largest key is exclusive, so the next file
+		// may start at the same user key.
+		prev := meta[i-1].largest
+		c := cmp(prev.UserKey, meta[i].smallest.UserKey)
+		if c > 0 || (c == 0 && prev.Trailer != db.InternalKeyRangeDeleteSentinel) {
 			return fmt.Errorf("files have overlapping ranges")
 		}
 	}
@@ -115,12 +193,39 @@ func ingestCleanup(
 	return firstErr
 }
 
+// ingestCopy copies the sstable at src to dst. It is used in place of a hard
+// link when src cannot be linked into the DB directory.
+func ingestCopy(fs storage.Storage, src, dst string) error {
+	in, err := fs.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := fs.Create(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	err = firstError(err, out.Close())
+	if err != nil {
+		fs.Remove(dst)
+	}
+	return err
+}
+
 func ingestLink(
-	opts *db.Options, dirname string, paths []string, meta []*fileMetadata,
+	opts *db.Options, dirname string, paths []string, meta []*fileMetadata, fallbackToCopy bool,
 ) error {
 	for i := range paths {
 		target := dbFilename(dirname, fileTypeTable, meta[i].fileNum)
 		err := opts.Storage.Link(paths[i], target)
+		if err != nil && fallbackToCopy {
+			err = ingestCopy(opts.Storage, paths[i], target)
+		}
 		if err != nil {
 			if err2 := ingestCleanup(opts.Storage, dirname, meta[:i]); err2 != nil {
 				opts.Logger.Infof("ingest cleanup failed: %v", err2)
@@ -180,7 +285,10 @@ func ingestUpdateSeqNum(
 ) error {
 	for _, m := range meta {
 		m.smallest = db.MakeInternalKey(m.smallest.UserKey, seqNum, m.smallest.Kind())
-		m.largest = db.MakeInternalKey(m.largest.UserKey, seqNum, m.largest.Kind())
+		// A range deletion sentinel is exclusive and carries no sequence number.
+		if m.largest.Trailer != db.InternalKeyRangeDeleteSentinel {
+			m.largest = db.MakeInternalKey(m.largest.UserKey, seqNum, m.largest.Kind())
+		}
 		// Setting smallestSeqNum == largestSeqNum triggers the setting of
 		// Properties.GlobalSeqNum when an sstable is loaded.
 		m.smallestSeqNum = seqNum
@@ -192,14 +300,17 @@ func ingestUpdateSeqNum(
 	return nil
 }
 
-func ingestTargetLevel(cmp db.Compare, v *version, meta *fileMetadata) int {
+// ingestTargetLevel returns the lowest level, less than levels, which does not
+// have any files which overlap meta. Levels at or beyond levels are reserved
+// for ingest-behind.
+func ingestTargetLevel(cmp db.Compare, v *version, levels int, meta *fileMetadata) int {
 	// Find the lowest level which does not have any files which overlap meta.
 	if len(v.overlaps(0, cmp, meta.smallest.UserKey, meta.largest.UserKey)) != 0 {
 		return 0
 	}
 
 	level := 1
-	for ; level < numLevels; level++ {
+	for ; level < levels; level++ {
 		if len(v.overlaps(level, cmp, meta.smallest.UserKey, meta.largest.UserKey)) != 0 {
 			break
 		}
@@ -210,16 +321,30 @@ func ingestTargetLevel(cmp db.Compare, v *version, meta *fileMetadata) int {
 // Ingest ingests a set of sstables into the DB. Ingestion of the files is
 // atomic and semantically equivalent to creating a single batch containing all
 // of the mutations in the sstables. Ingestion may require the memtable to be
-// flushed. The ingested sstable files are moved into the DB and must reside on
-// the same filesystem as the DB. Sstables can be created for ingestion using
-// sstable.Writer.
-func (d *DB) Ingest(paths []string) error {
+// flushed. The ingested sstable files are linked into the DB and must reside on
+// the same filesystem as the DB unless opts.FallbackToCopy is set. Sstables can
+// be created for ingestion using sstable.Writer.
+//
+// If opts.IngestBehind is set, the sstables are instead placed in the last
+// level beneath all existing data, and are shadowed by any existing keys. See
+// db.IngestOptions.
+func (d *DB) Ingest(paths []string, opts *db.IngestOptions) (err error) {
+	ingestBehind := opts.GetIngestBehind()
+	if ingestBehind && !d.opts.AllowIngestBehind {
+		return errors.New("pebble: ingest-behind requires Options.AllowIngestBehind")
+	}
+
 	// Allocate file numbers for all of the files being ingested and mark them as
 	// pending in order to prevent them from being deleted. Note that this causes
 	// the file number ordering to be out of alignment with sequence number
 	// ordering. The sorting of L0 tables by sequence number avoids relying on
 	// that (busted) invariant.
 	d.mu.Lock()
+	if err := d.mu.bgErr; err != nil {
+		// The DB is read-only after running out of space.
+		d.mu.Unlock()
+		return err
+	}
 	pendingOutputs := make([]uint64, len(paths))
 	for i := range paths {
 		pendingOutputs[i] = d.mu.versions.nextFileNum()
@@ -237,6 +362,13 @@ func (d *DB) Ingest(paths []string) error {
 			delete(d.mu.compact.pendingOutputs, fileNum)
 		}
 		d.mu.Unlock()
+		if err != nil {
+			// The sstables were read using the file numbers, which may be reused
+			// after a restart, so their blocks must not linger in the cache.
+			for _, fileNum := range pendingOutputs {
+				d.opts.Cache.EvictFile(fileNum)
+			}
+		}
 	}()
 
 	// Load the metadata for all of the files being ingested.
@@ -244,22 +376,72 @@ func (d *DB) Ingest(paths []string) error {
 	if err != nil {
 		return err
 	}
+	if checksums := opts.GetFileChecksums(); checksums != nil {
+		if err := ingestVerifyChecksums(paths, meta, checksums); err != nil {
+			return err
+		}
+	}
 
 	// Verify the sstables do not overlap.
 	if err := ingestSortAndVerify(d.cmp, meta); err != nil {
 		return err
 	}
+	if ingestBehind {
+		if err := ingestVerifyZeroSeqNums(d.opts, paths); err != nil {
+			return err
+		}
+	}
 
 	// Hard link the sstables into the DB directory. Since the sstables aren't
 	// referenced by a version, they won't be used. If the hard linking fails
-	// (e.g. because the files reside on a different filesystem) we undo our work
-	// and return an error.
-	if err := ingestLink(d.opts, d.dirname, paths, meta); err != nil {
+	// (e.g. because the files reside on a different filesystem) the sstables
+	// are copied if opts.FallbackToCopy is set, otherwise we undo our work and
+	// return an error.
+	if err := ingestLink(d.opts, d.dirname, paths, meta, opts.GetFallbackToCopy()); err != nil {
 		return err
 	}
+	// Sync the directory so that the links are durable before the sstables are
+	// referenced by the MANIFEST.
+	if err := d.dataDir.Sync(); err != nil {
+		if err2 := ingestCleanup(d.opts.Storage, d.dirname, meta); err2 != nil {
+			d.opts.Logger.Infof("ingest cleanup failed: %v", err2)
+		}
+		return err
+	}
+
+	var ve *versionEdit
+	if ingestBehind {
+		// Sstables ingested behind are shadowed by all existing data, so there is
+		// no need to flush the memtable or allocate a sequence number.
+		if err = ingestUpdateSeqNum(d.opts, d.dirname, 0, meta); err == nil {
+			ve, err = d.ingestApply(meta, true /* ingestBehind */)
+		}
+	} else {
+		ve, err = d.ingest(meta, opts.GetAllowFlushable())
+	}
+	err = d.ingestFinish(jobID, meta, ve, err)
+
+	if err == nil && opts.GetMoveFiles() {
+		// The sstables are now owned by the DB. Failing to remove the originals
+		// leaves an extra link (or copy) behind, but does not fail the ingestion.
+		for _, path := range paths {
+			if err := d.opts.Storage.Remove(path); err != nil {
+				d.opts.Logger.Infof("ingest %s: unable to remove: %v", path, err)
+			}
+		}
+	}
+	return err
+}
 
+// ingest assigns a sequence number to the sstables and adds them to the LSM.
+// If the sstables overlap a memtable, the memtable is flushed first, or if
+// allowFlushable is set the sstables are queued above the memtable as an
+// ingestedFlushable.
+func (d *DB) ingest(meta []*fileMetadata, allowFlushable bool) (*versionEdit, error) {
+	var err error
 	var mem flushable
-	prepareLocked := func() {
+	var queued *ingestedFlushable
+	prepareLocked := func(seqNum uint64) {
 		// NB: prepare is called with d.mu locked.
 
 		// If the mutable memtable contains keys which overlap any of the sstables
@@ -267,26 +449,34 @@ func (d *DB) Ingest(paths []string) error {
 		// finish.
 		if ingestMemtableOverlaps(d.cmp, d.mu.mem.mutable, meta) {
 			mem = d.mu.mem.mutable
-			err = d.makeRoomForWrite(nil)
-			return
+		} else {
+			// Check to see if any files overlap with any of the immutable
+			// memtables. The queue is ordered from oldest to newest. We want to wait
+			// for the newest table that overlaps.
+			for i := len(d.mu.mem.queue) - 1; i >= 0; i-- {
+				m := d.mu.mem.queue[i]
+				if ingestMemtableOverlaps(d.cmp, m, meta) {
+					mem = m
+					break
+				}
+			}
 		}
 
-		// Check to see if any files overlap with any of the immutable
-		// memtables. The queue is ordered from oldest to newest. We want to wait
-		// for the newest table that overlaps.
-		for i := len(d.mu.mem.queue) - 1; i >= 0; i-- {
-			m := d.mu.mem.queue[i]
-			if ingestMemtableOverlaps(d.cmp, m, meta) {
-				mem = m
-				return
-			}
+		switch {
+		case mem == nil:
+		case allowFlushable:
+			mem = nil
+			queued, err = d.ingestQueueFlushable(seqNum, meta)
+		case mem == d.mu.mem.mutable:
+			err = d.makeRoomForWrite(nil)
 		}
 	}
 
 	var ve *versionEdit
 	apply := func(seqNum uint64) {
-		if err != nil {
-			// An error occurred during prepareLocked.
+		if err != nil || queued != nil {
+			// An error occurred during prepareLocked, or the sstables were queued
+			// as a flushable.
 			return
 		}
 
@@ -304,15 +494,129 @@ func (d *DB) Ingest(paths []string) error {
 
 		// Assign the sstables to the correct level in the LSM and apply the
 		// version edit.
-		ve, err = d.ingestApply(meta)
+		ve, err = d.ingestApply(meta, false /* ingestBehind */)
 	}
 
 	d.commit.AllocateSeqNum(prepareLocked, apply)
 
+	if queued != nil {
+		// The ingestion is durable once it is recorded in the WAL, and the
+		// sstables will be added to L0 when they are flushed. Without a WAL the
+		// ingestion is only durable once they are.
+		if d.opts.DisableWAL {
+			<-queued.flushed()
+		}
+		ve = &versionEdit{
+			newFiles: make([]newFileEntry, len(queued.files)),
+		}
+		for i := range queued.files {
+			ve.newFiles[i] = newFileEntry{level: 0, meta: queued.files[i]}
+		}
+	}
+	return ve, err
+}
+
+// ingestQueueFlushable queues the sstables as an ingestedFlushable above the
+// memtables in the flushable queue. The ingestion is recorded in a WAL of its
+// own, and the mutable memtable is then rotated so that writes sequenced after
+// the ingestion are added to a memtable above the sstables, and to a WAL
+// after the ingestion's.
+//
+// d.mu must be held when calling this, but the mutex may be dropped and
+// re-acquired during the course of this method.
+func (d *DB) ingestQueueFlushable(seqNum uint64, meta []*fileMetadata) (*ingestedFlushable, error) {
+	if err := ingestUpdateSeqNum(d.opts, d.dirname, seqNum, meta); err != nil {
+		return nil, err
+	}
+	logNum := d.mu.log.number
+	if !d.opts.DisableWAL {
+		logNum = d.mu.versions.nextFileNum()
+		if err := d.ingestLog(logNum, seqNum, meta); err != nil {
+			return nil, err
+		}
+	}
+	if err := d.makeRoomForWrite(nil); err != nil {
+		if !d.opts.DisableWAL {
+			d.ingestRemoveLog(logNum)
+		}
+		return nil, err
+	}
+
+	s := newIngestedFlushable(d.cmp, d.newIters, logNum, meta)
+	// Concurrent readers may hold a reference to the queue, so build a new one
+	// rather than inserting s in place.
+	n := len(d.mu.mem.queue)
+	queue := make([]flushable, 0, n+1)
+	queue = append(queue, d.mu.mem.queue[:n-1]...)
+	queue = append(queue, s, d.mu.mem.mutable)
+	d.mu.mem.queue = queue
+	d.maybeScheduleFlush()
+	return s, nil
+}
+
+// ingestLog writes and syncs a new WAL containing a single batch which records
+// the ingestion of the sstables at the specified sequence number. Writes to
+// the current WAL are held up until the ingestion is durable.
+//
+// d.mu must be held when calling this, but the mutex may be dropped and
+// re-acquired during the course of this method.
+func (d *DB) ingestLog(logNum, seqNum uint64, meta []*fileMetadata) error {
+	var b Batch
+	for _, m := range meta {
+		if err := b.ingestSST(m.fileNum); err != nil {
+			return err
+		}
+	}
+	b.setSeqNum(seqNum)
+
+	d.mu.mem.switching = true
+	d.mu.Unlock()
+
+	logFile, err := d.opts.Storage.Create(dbFilename(d.dirname, fileTypeLog, logNum))
+	if err == nil {
+		w := record.NewLogWriter(logFile)
+		_, err = w.WriteRecord(b.data)
+		// Closing the writer syncs the log.
+		err = firstError(err, w.Close())
+		if err == nil {
+			err = d.dataDir.Sync()
+		}
+	}
+
+	d.mu.Lock()
+	d.mu.mem.switching = false
+	d.mu.mem.cond.Broadcast()
+
+	if err != nil {
+		d.ingestRemoveLog(logNum)
+	}
+	return err
+}
+
+// ingestRemoveLog removes the WAL recording an ingestion which failed, so
+// that it is not replayed when the DB is next opened.
+func (d *DB) ingestRemoveLog(logNum uint64) {
+	path := dbFilename(d.dirname, fileTypeLog, logNum)
+	if err := d.opts.Storage.Remove(path); err != nil && !os.IsNotExist(err) {
+		d.opts.Logger.Infof("ingest %s: unable to remove: %v", path, err)
+	}
+}
+
+// ingestFinish cleans up after a failed ingestion and notifies the
+// EventListener of the ingestion, returning err.
+func (d *DB) ingestFinish(
+	jobID int, meta []*fileMetadata, ve *versionEdit, err error,
+) error {
 	if err != nil {
 		if err2 := ingestCleanup(d.opts.Storage, d.dirname, meta); err2 != nil {
 			d.opts.Logger.Infof("ingest cleanup failed: %v", err2)
 		}
+	} else {
+		for i := range meta {
+			if err2 := d.fileManager.add(meta[i].fileNum); err2 != nil {
+				d.opts.Logger.Infof("ingest %06d: unable to track size: %v", meta[i].fileNum, err2)
+			}
+		}
 	}
 
 	if d.opts.EventListener != nil && d.opts.EventListener.TableIngested != nil {
@@ -338,7 +642,7 @@ func (d *DB) Ingest(paths []string) error {
 	return err
 }
 
-func (d *DB) ingestApply(meta []*fileMetadata) (*versionEdit, error) {
+func (d *DB) ingestApply(meta []*fileMetadata, ingestBehind bool) (*versionEdit, error) {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
@@ -347,10 +651,22 @@ func (d *DB) ingestApply(meta []*fileMetadata) (*versionEdit, error) {
 	}
 	current := d.mu.versions.currentVersion()
 	for i := range meta {
-		// Determine the lowest level in the LSM for which the sstable doesn't
-		// overlap any existing files in the level.
 		m := meta[i]
-		ve.newFiles[i].level = ingestTargetLevel(d.cmp, current, m)
+		if ingestBehind {
+			// Sstables ingested behind are placed in the reserved last level, which
+			// must not already contain overlapping sstables.
+			level := numLevels - 1
+			if len(current.overlaps(level, d.cmp, m.smallest.UserKey, m.largest.UserKey)) != 0 {
+				return nil, fmt.Errorf("pebble: ingest-behind sstable %s overlaps existing sstable in L%d",
+					m, level)
+			}
+			ve.newFiles[i].level = level
+		} else {
+			// Determine the lowest level in the LSM for which the sstable doesn't
+			// overlap any existing files in the level.
+			ve.newFiles[i].level = ingestTargetLevel(
+				d.cmp, current, numCompactionLevels(d.opts), m)
+		}
 		ve.newFiles[i].meta = *m
 	}
 	if err := d.mu.versions.logAndApply(ve); err != nil {
@@ -358,3 +674,88 @@ func (d *DB) ingestApply(meta []*fileMetadata) (*versionEdit, error) {
 	}
 	return ve, nil
 }
+
+// ingestedFlushable is a set of ingested sstables queued in the flushable
+// queue above the memtables they overlap. Flushing an ingestedFlushable does
+// not rewrite the sstables: they are added to L0 as-is. See DB.flushIngested.
+//
+// The sstables are not referenced by a version until they are flushed. Until
+// then DB.deleteObsoleteFiles treats the sstables in the queue as live, and
+// afterwards the versions held by readers of the queue keep them live (see
+// versionSet.pinFileNums).
+type ingestedFlushable struct {
+	cmp      db.Compare
+	newIters tableNewIters
+	files    []fileMetadata
+	// The number of the WAL recording the ingestion. It sits between the WALs
+	// of the memtables queued beneath and above the sstables.
+	logNum    uint64
+	flushedCh chan struct{}
+}
+
+var _ flushable = (*ingestedFlushable)(nil)
+
+func newIngestedFlushable(
+	cmp db.Compare, newIters tableNewIters, logNum uint64, meta []*fileMetadata,
+) *ingestedFlushable {
+	s := &ingestedFlushable{
+		cmp:       cmp,
+		newIters:  newIters,
+		files:     make([]fileMetadata, len(meta)),
+		logNum:    logNum,
+		flushedCh: make(chan struct{}),
+	}
+	for i := range meta {
+		s.files[i] = *meta[i]
+	}
+	return s
+}
+
+func (s *ingestedFlushable) newIter(o *db.IterOptions) internalIterator {
+	// The sstables are sorted and do not overlap (see ingestSortAndVerify), so
+	// they can be iterated over as a level.
+	return newLevelIter(o, s.cmp, s.newIters, s.files)
+}
+
+func (s *ingestedFlushable) newRangeDelIter(o *db.IterOptions) internalIterator {
+	var iters []internalIterator
+	for i := range s.files {
+		iter, rangeDelIter, err := s.newIters(&s.files[i])
+		if err != nil {
+			return newErrorIter(err)
+		}
+		iter.Close()
+		if rangeDelIter != nil {
+			iters = append(iters, rangeDelIter)
+		}
+	}
+	switch len(iters) {
+	case 0:
+		return nil
+	case 1:
+		return iters[0]
+	}
+	// The tombstones in different sstables do not overlap, so merging them
+	// preserves their fragmentation.
+	return newMergingIter(s.cmp, iters...)
+}
+
+func (s *ingestedFlushable) flushed() chan struct{} {
+	return s.flushedCh
+}
+
+func (s *ingestedFlushable) logNumber() uint64 {
+	return s.logNum
+}
+
+func (s *ingestedFlushable) fileNums() []uint64 {
+	fileNums := make([]uint64, len(s.files))
+	for i := range s.files {
+		fileNums[i] = s.files[i].fileNum
+	}
+	return fileNums
+}
+
+func (s *ingestedFlushable) readyForFlush() bool {
+	return true
+}
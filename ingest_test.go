@@ -6,6 +6,7 @@ package pebble
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
@@ -124,6 +125,9 @@ func TestIngestLoadRand(t *testing.T) {
 				t.Fatal(err)
 			}
 			expected[i].size = meta.Size
+			expected[i].numEntries = uint64(len(keys))
+			expected[i].fileChecksum = meta.FileChecksum
+			expected[i].hasFileChecksum = true
 		}()
 	}
 
@@ -135,6 +139,14 @@ func TestIngestLoadRand(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	for i := range meta {
+		// The tables do not record a creation time so the time of ingestion is
+		// used.
+		if meta[i].creationTime == 0 {
+			t.Fatalf("%d: expected non-zero creation time", i)
+		}
+		expected[i].creationTime = meta[i].creationTime
+	}
 	if diff := pretty.Diff(expected, meta); diff != nil {
 		t.Fatalf("%s", strings.Join(diff, "\n"))
 	}
@@ -192,6 +204,9 @@ func TestIngestSortAndVerify(t *testing.T) {
 		{"c-d a-b e-f", ""},
 		{"a-b b-d e-f", "files have overlapping ranges"},
 		{"c-d d-e a-b", "files have overlapping ranges"},
+		// A "*" suffix marks the largest key as a range deletion sentinel.
+		{"a-b* b-c*", ""},
+		{"a-c* b-d*", "files have overlapping ranges"},
 	}
 
 	comparers := []struct {
@@ -213,13 +228,19 @@ func TestIngestSortAndVerify(t *testing.T) {
 						if len(parts) != 2 {
 							t.Fatalf("malformed test case: %s", c.input)
 						}
+						sentinel := strings.HasSuffix(parts[1], "*")
+						parts[1] = strings.TrimSuffix(parts[1], "*")
 						if cmp([]byte(parts[0]), []byte(parts[1])) > 0 {
 							parts[0], parts[1] = parts[1], parts[0]
 						}
-						meta = append(meta, &fileMetadata{
+						m := &fileMetadata{
 							smallest: db.InternalKey{UserKey: []byte(parts[0])},
 							largest:  db.InternalKey{UserKey: []byte(parts[1])},
-						})
+						}
+						if sentinel {
+							m.largest = db.MakeRangeDeleteSentinelKey(m.largest.UserKey)
+						}
+						meta = append(meta, m)
 					}
 					if err := ingestSortAndVerify(cmp, meta); !isError(err, c.expected) {
 						t.Fatalf("expected %s, but found %v", c.expected, err)
@@ -273,7 +294,7 @@ func TestIngestLink(t *testing.T) {
 				mem.Remove(paths[i])
 			}
 
-			err := ingestLink(opts, dir, paths, meta)
+			err := ingestLink(opts, dir, paths, meta, false /* fallbackToCopy */)
 			if i < count {
 				if err == nil {
 					t.Fatalf("expected error, but found success")
@@ -326,6 +347,57 @@ func TestIngestLink(t *testing.T) {
 	}
 }
 
+// noLinkStorage is a storage.Storage which does not support hard links, such
+// as when the source and destination reside on different filesystems.
+type noLinkStorage struct {
+	storage.Storage
+}
+
+func (noLinkStorage) Link(oldname, newname string) error {
+	return fmt.Errorf("link %s %s: cross-device link", oldname, newname)
+}
+
+func TestIngestLinkFallbackToCopy(t *testing.T) {
+	const dir = "db"
+	mem := storage.NewMem()
+	opts := &db.Options{Storage: noLinkStorage{mem}}
+	opts.EnsureDefaults()
+	if err := mem.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := mem.Create("external")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	paths := []string{"external"}
+	meta := []*fileMetadata{{fileNum: 1}}
+	if err := ingestLink(opts, dir, paths, meta, false /* fallbackToCopy */); err == nil {
+		t.Fatalf("expected error, but found success")
+	}
+	if err := ingestLink(opts, dir, paths, meta, true /* fallbackToCopy */); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err = mem.Open(dbFilename(dir, fileTypeTable, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if string(data) != "data" {
+		t.Fatalf("expected data, but found %s", data)
+	}
+}
+
 func TestIngestMemtableOverlaps(t *testing.T) {
 	comparers := []db.Comparer{
 		{Name: "default", Compare: db.DefaultComparer.Compare},
@@ -454,7 +526,7 @@ func TestIngestTargetLevel(t *testing.T) {
 			var buf bytes.Buffer
 			for _, target := range strings.Split(d.Input, "\n") {
 				meta := parseMeta(target)
-				level := ingestTargetLevel(cmp, vers, &meta)
+				level := ingestTargetLevel(cmp, vers, numLevels, &meta)
 				fmt.Fprintf(&buf, "%d\n", level)
 			}
 			return buf.String()
@@ -518,7 +590,7 @@ func TestIngest(t *testing.T) {
 					return err.Error()
 				}
 
-				if err := d.Ingest([]string{"ext/0"}); err != nil {
+				if err := d.Ingest([]string{"ext/0"}, nil); err != nil {
 					return err.Error()
 				}
 				if err := fs.Remove("ext/0"); err != nil {
@@ -592,3 +664,536 @@ func TestIngest(t *testing.T) {
 		}
 	})
 }
+
+func TestIngestBehind(t *testing.T) {
+	fs := storage.NewMem()
+	if err := fs.MkdirAll("ext", 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeTable := func(path string, seqNum uint64, keys ...string) {
+		f, err := fs.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := sstable.NewWriter(f, nil, db.LevelOptions{})
+		for _, k := range keys {
+			key := db.MakeInternalKey([]byte(k), seqNum, db.InternalKeyKindSet)
+			if err := w.Add(key, []byte("old")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	behind := &db.IngestOptions{IngestBehind: true}
+
+	{
+		d, err := Open("no-behind", &db.Options{Storage: fs})
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeTable("ext/0", 0, "a")
+		if err := d.Ingest([]string{"ext/0"}, behind); err == nil {
+			t.Fatalf("expected error without AllowIngestBehind")
+		}
+		if err := d.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	d, err := Open("", &db.Options{
+		Storage:           fs,
+		AllowIngestBehind: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	compactAll := func() {
+		for i := 0; i < numLevels; i++ {
+			if err := d.Compact([]byte("a"), []byte("z")); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if err := d.Set([]byte("a"), []byte("new"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Set([]byte("b"), []byte("new"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Delete([]byte("b"), nil); err != nil {
+		t.Fatal(err)
+	}
+	compactAll()
+
+	// Keys with a non-zero sequence number are rejected.
+	writeTable("ext/1", 1, "a", "b", "c")
+	if err := d.Ingest([]string{"ext/1"}, behind); err == nil {
+		t.Fatalf("expected error for non-zero sequence number")
+	}
+
+	writeTable("ext/2", 0, "a", "b", "c")
+	if err := d.Ingest([]string{"ext/2"}, behind); err != nil {
+		t.Fatal(err)
+	}
+
+	// An overlapping sstable cannot be ingested behind.
+	writeTable("ext/3", 0, "c", "d")
+	if err := d.Ingest([]string{"ext/3"}, behind); err == nil {
+		t.Fatalf("expected error for overlapping sstable")
+	}
+
+	// Existing keys and tombstones shadow the ingested keys, even after the
+	// data above the last level is compacted.
+	compactAll()
+	if err := d.Set([]byte("d"), []byte("new"), nil); err != nil {
+		t.Fatal(err)
+	}
+	compactAll()
+
+	var buf bytes.Buffer
+	iter := d.NewIter(nil)
+	for valid := iter.First(); valid; valid = iter.Next() {
+		fmt.Fprintf(&buf, "%s:%s ", iter.Key(), iter.Value())
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "a:new c:old d:new "; expected != buf.String() {
+		t.Fatalf("expected %q, but found %q", expected, buf.String())
+	}
+
+	d.mu.Lock()
+	files := d.mu.versions.currentVersion().files[numLevels-1]
+	if len(files) != 1 || files[0].smallestSeqNum != 0 || files[0].largestSeqNum != 0 {
+		t.Fatalf("expected only the ingested sstable in the last level, but found %v", files)
+	}
+	d.mu.Unlock()
+
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIngestFlushable(t *testing.T) {
+	mem := storage.NewMem()
+	if err := mem.MkdirAll("ext", 0755); err != nil {
+		t.Fatal(err)
+	}
+	// The ingested sstables are copied into the DB as hard links are not
+	// supported.
+	fs := noLinkStorage{mem}
+	writeTable := func(path string, keys ...string) {
+		f, err := fs.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := sstable.NewWriter(f, nil, db.LevelOptions{})
+		for _, k := range keys {
+			var key db.InternalKey
+			var value []byte
+			if j := strings.Index(k, "-"); j >= 0 {
+				key = db.MakeInternalKey([]byte(k[:j]), 0, db.InternalKeyKindRangeDelete)
+				value = []byte(k[j+1:])
+			} else {
+				key = db.MakeInternalKey([]byte(k), 0, db.InternalKeyKindSet)
+				value = []byte("ingested")
+			}
+			if err := w.Add(key, value); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	scan := func(iter internalIterator) string {
+		var buf bytes.Buffer
+		for valid := iter.First(); valid; valid = iter.Next() {
+			fmt.Fprintf(&buf, "%s:%s ", iter.Key().UserKey, iter.Value())
+		}
+		if err := iter.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.String()
+	}
+
+	d, err := Open("", &db.Options{
+		Storage:               fs,
+		L0CompactionThreshold: 100,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"a", "c", "e"} {
+		if err := d.Set([]byte(k), []byte("memtable"), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeTable("ext/0", "a", "b", "c-e")
+	opts := &db.IngestOptions{
+		AllowFlushable: true,
+		FallbackToCopy: true,
+		MoveFiles:      true,
+	}
+	if err := d.Ingest([]string{"ext/0"}, opts); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat("ext/0"); err == nil {
+		t.Fatalf("expected ext/0 to be removed")
+	}
+
+	// The overlapping memtable was flushed beneath the ingested sstable.
+	waitForIngestedFlushables(d)
+	d.mu.Lock()
+	files := d.mu.versions.currentVersion().files[0]
+	if len(files) != 2 {
+		t.Fatalf("expected 2 L0 tables, but found %d", len(files))
+	}
+	if files[0].largestSeqNum >= files[1].smallestSeqNum {
+		t.Fatalf("expected the memtable below the ingested sstable:\n%s",
+			d.mu.versions.currentVersion())
+	}
+	ingested := files[1]
+	d.mu.Unlock()
+
+	var buf bytes.Buffer
+	iter := d.NewIter(nil)
+	for valid := iter.First(); valid; valid = iter.Next() {
+		fmt.Fprintf(&buf, "%s:%s ", iter.Key(), iter.Value())
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "a:ingested b:ingested e:memtable "; expected != buf.String() {
+		t.Fatalf("expected %q, but found %q", expected, buf.String())
+	}
+
+	// The ingested sstable can be read while it is queued as a flushable.
+	s := newIngestedFlushable(d.cmp, d.newIters, 0, []*fileMetadata{&ingested})
+	if expected, got := "a:ingested b:ingested ", scan(s.newIter(nil)); expected != got {
+		t.Fatalf("expected %q, but found %q", expected, got)
+	}
+	if expected, got := "c:e ", scan(s.newRangeDelIter(nil)); expected != got {
+		t.Fatalf("expected %q, but found %q", expected, got)
+	}
+
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitForIngestedFlushables waits until there are no ingested sstables queued
+// as flushables.
+func waitForIngestedFlushables(d *DB) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for {
+		var queued bool
+		for _, mem := range d.mu.mem.queue {
+			if _, ok := mem.(*ingestedFlushable); ok {
+				queued = true
+			}
+		}
+		if !queued {
+			return
+		}
+		d.mu.compact.cond.Wait()
+	}
+}
+
+// holdMemTable prevents the mutable memtable from being flushed until the
+// returned function is called.
+func holdMemTable(d *DB) func() {
+	d.mu.Lock()
+	mem := d.mu.mem.mutable
+	mem.ref()
+	d.mu.Unlock()
+	return func() {
+		if mem.unref() {
+			d.mu.Lock()
+			d.maybeScheduleFlush()
+			d.mu.Unlock()
+		}
+	}
+}
+
+func TestIngestFlushableReopen(t *testing.T) {
+	// An ingestion queued as a flushable is durable once Ingest returns.
+	fs := storage.NewMem()
+	d, err := Open("", &db.Options{Storage: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Set([]byte("a"), []byte("memtable"), nil); err != nil {
+		t.Fatal(err)
+	}
+	release := holdMemTable(d)
+
+	f, err := fs.Create("ext")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := sstable.NewWriter(f, nil, db.LevelOptions{})
+	for _, k := range []string{"a", "b"} {
+		if err := w.Add(db.MakeInternalKey([]byte(k), 0, db.InternalKeyKindSet), []byte("ingested")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	opts := &db.IngestOptions{AllowFlushable: true, MoveFiles: true}
+	if err := d.Ingest([]string{"ext"}, opts); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Set([]byte("b"), []byte("memtable"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// The DB is closed while the ingested sstable is still queued.
+	d.mu.Lock()
+	if len(d.mu.mem.queue) != 3 {
+		t.Fatalf("expected 3 flushables, but found %d", len(d.mu.mem.queue))
+	}
+	d.mu.Unlock()
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	release()
+
+	d, err = Open("", &db.Options{Storage: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	iter := d.NewIter(nil)
+	for valid := iter.First(); valid; valid = iter.Next() {
+		fmt.Fprintf(&buf, "%s:%s ", iter.Key(), iter.Value())
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "a:ingested b:memtable "; expected != buf.String() {
+		t.Fatalf("expected %q, but found %q", expected, buf.String())
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIngestFlushableLogNumber(t *testing.T) {
+	// Flushing the memtable beneath an ingested sstable must not make the WAL
+	// of a memtable queued above the sstable obsolete.
+	fs := storage.NewMem()
+	d, err := Open("", &db.Options{
+		Storage:                     fs,
+		MemTableStopWritesThreshold: 4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Set([]byte("a"), []byte("mem0"), nil); err != nil {
+		t.Fatal(err)
+	}
+	release0 := holdMemTable(d)
+
+	f, err := fs.Create("ext")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := sstable.NewWriter(f, nil, db.LevelOptions{})
+	if err := w.Add(db.MakeInternalKey([]byte("a"), 0, db.InternalKeyKindSet), []byte("ingested")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Ingest([]string{"ext"}, &db.IngestOptions{AllowFlushable: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Switch memtables while the ingested sstable is queued, leaving the queue
+	// as [mem0, ingested, mem1, mutable].
+	if err := d.Set([]byte("b"), []byte("mem1"), nil); err != nil {
+		t.Fatal(err)
+	}
+	release1 := holdMemTable(d)
+	d.mu.Lock()
+	if err := d.makeRoomForWrite(nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(d.mu.mem.queue) != 4 {
+		t.Fatalf("expected 4 flushables, but found %d", len(d.mu.mem.queue))
+	}
+	d.mu.Unlock()
+
+	// Flush mem0 and the ingested sstable, but not mem1.
+	release0()
+	waitForIngestedFlushables(d)
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	release1()
+
+	d, err = Open("", &db.Options{Storage: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, expected := range map[string]string{"a": "ingested", "b": "mem1"} {
+		v, err := d.Get([]byte(key))
+		if err != nil {
+			t.Fatalf("%s: %v", key, err)
+		}
+		if string(v) != expected {
+			t.Fatalf("%s: expected %s, but found %s", key, expected, v)
+		}
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIngestFlushableIterator(t *testing.T) {
+	// An iterator which reads an ingested sstable from the flushable queue
+	// keeps the sstable from being deleted after it is flushed and compacted.
+	fs := storage.NewMem()
+	d, err := Open("", &db.Options{Storage: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Set([]byte("a"), []byte("memtable"), nil); err != nil {
+		t.Fatal(err)
+	}
+	release := holdMemTable(d)
+
+	f, err := fs.Create("ext")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := sstable.NewWriter(f, nil, db.LevelOptions{})
+	for _, k := range []string{"a", "b"} {
+		if err := w.Add(db.MakeInternalKey([]byte(k), 0, db.InternalKeyKindSet), []byte("ingested")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Ingest([]string{"ext"}, &db.IngestOptions{AllowFlushable: true}); err != nil {
+		t.Fatal(err)
+	}
+	var ingested uint64
+	d.mu.Lock()
+	ingested = d.mu.mem.queue[1].(*ingestedFlushable).files[0].fileNum
+	d.mu.Unlock()
+
+	iter := d.NewIter(nil)
+	release()
+	waitForIngestedFlushables(d)
+	if err := d.Compact([]byte("a"), []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	d.mu.Lock()
+	for level, files := range d.mu.versions.currentVersion().files {
+		for _, f := range files {
+			if f.fileNum == ingested {
+				t.Fatalf("expected ingested sstable to be compacted, but found it in L%d", level)
+			}
+		}
+	}
+	d.mu.Unlock()
+	if _, err := fs.Stat(dbFilename("", fileTypeTable, ingested)); err != nil {
+		t.Fatalf("expected ingested sstable to be retained: %v", err)
+	}
+
+	var buf bytes.Buffer
+	for valid := iter.First(); valid; valid = iter.Next() {
+		fmt.Fprintf(&buf, "%s:%s ", iter.Key(), iter.Value())
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "a:ingested b:ingested "; expected != buf.String() {
+		t.Fatalf("expected %q, but found %q", expected, buf.String())
+	}
+
+	// Once the iterator is closed, the sstable is deleted.
+	d.mu.Lock()
+	jobID := d.mu.nextJobID
+	d.mu.nextJobID++
+	d.deleteObsoleteFiles(jobID)
+	d.mu.Unlock()
+	if _, err := fs.Stat(dbFilename("", fileTypeTable, ingested)); err == nil {
+		t.Fatalf("expected ingested sstable to be deleted")
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIngestFileChecksums(t *testing.T) {
+	fs := storage.NewMem()
+	d, err := Open("", &db.Options{Storage: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	build := func(dir string, keys ...string) []db.TableInfo {
+		w := NewSSTWriter(dir, &db.SSTWriterOptions{Storage: fs})
+		for _, k := range keys {
+			if err := w.Set([]byte(k), []byte(k)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		tables, err := w.Finish()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tables
+	}
+
+	tables := build("ext0", "a", "b")
+	if len(tables) != 1 {
+		t.Fatalf("expected 1 table, but found %d", len(tables))
+	}
+	opts := &db.IngestOptions{FileChecksums: []uint32{tables[0].FileChecksum + 1}}
+	err = d.Ingest([]string{tables[0].Path}, opts)
+	if err == nil || !strings.Contains(err.Error(), "file checksum mismatch") {
+		t.Fatalf("expected file checksum mismatch, but found %v", err)
+	}
+
+	opts.FileChecksums[0] = tables[0].FileChecksum
+	if err := d.Ingest([]string{tables[0].Path}, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	// Ingesting without expected checksums still records them in the MANIFEST.
+	tables = build("ext1", "c", "d")
+	if err := d.Ingest([]string{tables[0].Path}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	d.mu.Lock()
+	current := d.mu.versions.currentVersion()
+	d.mu.Unlock()
+	var n int
+	for _, files := range current.files {
+		for _, m := range files {
+			if !m.hasFileChecksum {
+				t.Fatalf("expected %06d to have a file checksum", m.fileNum)
+			}
+			n++
+		}
+	}
+	if n != 2 {
+		t.Fatalf("expected 2 tables, but found %d", n)
+	}
+	if err := d.VerifyChecksums(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
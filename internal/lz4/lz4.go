@@ -0,0 +1,242 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+// Package lz4 implements the LZ4 block format.
+//
+// Only raw blocks are supported, not the LZ4 frame format: the length of the
+// decoded data must be recorded separately by the caller. The encoder is a
+// simple greedy encoder which produces blocks that can be decoded by the
+// reference implementation (LZ4_decompress_safe), and the decoder can decode
+// blocks produced by any conforming encoder.
+package lz4 // import "github.com/petermattis/pebble/internal/lz4"
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	minMatch = 4
+	// The last lastLiterals bytes of a block are always literals, and the last
+	// match must start at least mfLimit bytes before the end of the block.
+	lastLiterals = 5
+	mfLimit      = 12
+	maxOffset    = 1<<16 - 1
+	hashLog      = 14
+	// skipTrigger controls how quickly the encoder accelerates through
+	// incompressible data: the step between match attempts grows by one for
+	// every 1<<skipTrigger bytes without a match.
+	skipTrigger = 6
+)
+
+// ErrCorrupt reports that the input is invalid.
+var ErrCorrupt = errors.New("lz4: corrupt input")
+
+// MaxEncodedLen returns the maximum length of the encoding of a block of n
+// bytes.
+func MaxEncodedLen(n int) int {
+	return n + n/255 + 16
+}
+
+func hash(u uint32) uint32 {
+	return (u * 2654435761) >> (32 - hashLog)
+}
+
+// Encode returns the encoded form of src. The returned slice may be a
+// sub-slice of dst if dst was large enough to hold the entire encoded block.
+func Encode(dst, src []byte) []byte {
+	return EncodeDict(dst, src, nil)
+}
+
+// EncodeDict returns the encoded form of src, using dict as a prefix of
+// src: matches may refer to the final 64KB of dict. The same dictionary must
+// be passed to DecodeDict to decode the block.
+func EncodeDict(dst, src, dict []byte) []byte {
+	if n := MaxEncodedLen(len(src)); cap(dst) < n {
+		dst = make([]byte, 0, n)
+	} else {
+		dst = dst[:0]
+	}
+	if len(dict) > maxOffset {
+		dict = dict[len(dict)-maxOffset:]
+	}
+
+	// buf holds the dictionary followed by src. Matches are found for the
+	// bytes in buf[start:].
+	buf, start := src, 0
+	if len(dict) > 0 && len(src) > mfLimit {
+		buf = make([]byte, len(dict)+len(src))
+		start = copy(buf, dict)
+		copy(buf[start:], src)
+	}
+
+	anchor := start
+	if len(src) > mfLimit {
+		// table maps the hash of 4 bytes to the position at which they were last
+		// seen, plus one.
+		var table [1 << hashLog]int32
+		for i := 0; i+minMatch <= start; i++ {
+			table[hash(binary.LittleEndian.Uint32(buf[i:]))] = int32(i + 1)
+		}
+		limit := len(buf) - mfLimit
+		matchLimit := len(buf) - lastLiterals
+		for i := start; i < limit; {
+			seq := binary.LittleEndian.Uint32(buf[i:])
+			h := hash(seq)
+			ref := int(table[h]) - 1
+			table[h] = int32(i + 1)
+			if ref < 0 || i-ref > maxOffset || binary.LittleEndian.Uint32(buf[ref:]) != seq {
+				i += 1 + (i-anchor)>>skipTrigger
+				continue
+			}
+
+			// Extend the match backwards over any pending literals, and then
+			// forwards.
+			for i > anchor && ref > 0 && buf[i-1] == buf[ref-1] {
+				i--
+				ref--
+			}
+			n := minMatch
+			for i+n < matchLimit && buf[i+n] == buf[ref+n] {
+				n++
+			}
+
+			dst = emitSequence(dst, buf[anchor:i], i-ref, n)
+			i += n
+			anchor = i
+		}
+	}
+	return emitLiterals(dst, buf[anchor:])
+}
+
+// lengthNibble returns the 4-bit token field for a length, where 15 indicates
+// that the length is continued in subsequent bytes.
+func lengthNibble(n int) byte {
+	if n >= 15 {
+		return 15
+	}
+	return byte(n)
+}
+
+func appendLength(dst []byte, n int) []byte {
+	for n >= 255 {
+		dst = append(dst, 255)
+		n -= 255
+	}
+	return append(dst, byte(n))
+}
+
+func emitSequence(dst, lits []byte, offset, length int) []byte {
+	token := lengthNibble(len(lits))<<4 | lengthNibble(length-minMatch)
+	dst = append(dst, token)
+	if len(lits) >= 15 {
+		dst = appendLength(dst, len(lits)-15)
+	}
+	dst = append(dst, lits...)
+	dst = append(dst, byte(offset), byte(offset>>8))
+	if length-minMatch >= 15 {
+		dst = appendLength(dst, length-minMatch-15)
+	}
+	return dst
+}
+
+// emitLiterals emits the final sequence of a block, which consists only of
+// literals.
+func emitLiterals(dst, lits []byte) []byte {
+	dst = append(dst, lengthNibble(len(lits))<<4)
+	if len(lits) >= 15 {
+		dst = appendLength(dst, len(lits)-15)
+	}
+	return append(dst, lits...)
+}
+
+// Decode decodes the block src into dst, returning the number of bytes
+// decoded. The length of dst must be at least the decoded length of the block.
+func Decode(dst, src []byte) (int, error) {
+	return DecodeDict(dst, src, nil)
+}
+
+// DecodeDict decodes a block encoded by EncodeDict using the same dictionary.
+func DecodeDict(dst, src, dict []byte) (int, error) {
+	var i, d int
+	for {
+		if i >= len(src) {
+			return 0, ErrCorrupt
+		}
+		token := src[i]
+		i++
+
+		lits := int(token >> 4)
+		if lits == 15 {
+			var ok bool
+			if lits, i, ok = readLength(src, i, lits); !ok {
+				return 0, ErrCorrupt
+			}
+		}
+		if lits > len(src)-i || lits > len(dst)-d {
+			return 0, ErrCorrupt
+		}
+		copy(dst[d:], src[i:i+lits])
+		i += lits
+		d += lits
+		if i == len(src) {
+			// The final sequence has no match.
+			return d, nil
+		}
+
+		if i+2 > len(src) {
+			return 0, ErrCorrupt
+		}
+		offset := int(src[i]) | int(src[i+1])<<8
+		i += 2
+		if offset == 0 || offset > d+len(dict) {
+			return 0, ErrCorrupt
+		}
+		length := int(token & 15)
+		if length == 15 {
+			var ok bool
+			if length, i, ok = readLength(src, i, length); !ok {
+				return 0, ErrCorrupt
+			}
+		}
+		length += minMatch
+		if length > len(dst)-d {
+			return 0, ErrCorrupt
+		}
+		if offset > d {
+			// The match starts within the dictionary.
+			k := offset - d
+			n := copy(dst[d:d+length], dict[len(dict)-k:])
+			d += n
+			length -= n
+		}
+		if length == 0 {
+			continue
+		}
+		if offset >= length {
+			copy(dst[d:d+length], dst[d-offset:])
+		} else {
+			// The match overlaps the bytes being written.
+			for j := d; j < d+length; j++ {
+				dst[j] = dst[j-offset]
+			}
+		}
+		d += length
+	}
+}
+
+// readLength reads the continuation bytes of a literal or match length.
+func readLength(src []byte, i, n int) (int, int, bool) {
+	for {
+		if i >= len(src) {
+			return 0, 0, false
+		}
+		b := src[i]
+		i++
+		n += int(b)
+		if b != 255 {
+			return n, i, true
+		}
+	}
+}
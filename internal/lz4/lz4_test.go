@@ -0,0 +1,165 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package lz4
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+)
+
+func testInputs(t testing.TB) [][]byte {
+	records, err := ioutil.ReadFile("testdata/records.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rng := rand.New(rand.NewSource(1))
+	inputs := [][]byte{nil, []byte("a"), []byte("abcdabcdabcdabcdabcd"), records}
+	for _, n := range []int{12, 13, 100, 1000, 70000} {
+		text := make([]byte, n)
+		random := make([]byte, n)
+		for i := range text {
+			text[i] = "abcdefgh  \n{}\":,0123"[rng.Intn(20)]
+		}
+		rng.Read(random)
+		inputs = append(inputs, text, random, make([]byte, n), records[:n%len(records)])
+	}
+	return inputs
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, src := range testInputs(t) {
+		enc := Encode(nil, src)
+		if len(enc) > MaxEncodedLen(len(src)) {
+			t.Fatalf("len=%d: encoded length %d exceeds %d", len(src), len(enc), MaxEncodedLen(len(src)))
+		}
+		dst := make([]byte, len(src))
+		n, err := Decode(dst, enc)
+		if err != nil {
+			t.Fatalf("len=%d: %v", len(src), err)
+		}
+		if !bytes.Equal(src, dst[:n]) {
+			t.Fatalf("len=%d: round trip mismatch", len(src))
+		}
+	}
+}
+
+func TestDecodeReference(t *testing.T) {
+	want, err := ioutil.ReadFile("testdata/records.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The files were produced by the reference implementation, using the
+	// default and high compression encoders.
+	for _, name := range []string{"records.json.lz4", "records.json.lz4hc"} {
+		src, err := ioutil.ReadFile("testdata/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dst := make([]byte, len(want))
+		n, err := Decode(dst, src)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !bytes.Equal(want, dst[:n]) {
+			t.Fatalf("%s: decoded contents differ", name)
+		}
+	}
+}
+
+func TestDict(t *testing.T) {
+	records, err := ioutil.ReadFile("testdata/records.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		dict, src []byte
+	}{
+		{records[:8000], records[8000:12000]},
+		{records[:20], records[100:140]},
+		{records[:100], records[:10]},
+		// Only the final 64KB of the dictionary is used.
+		{bytes.Repeat(records, 4), records[3000:7000]},
+	} {
+		enc := EncodeDict(nil, c.src, c.dict)
+		dst := make([]byte, len(c.src))
+		n, err := DecodeDict(dst, enc, c.dict)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(c.src, dst[:n]) {
+			t.Fatalf("round trip mismatch")
+		}
+		if len(c.src) > 1000 && len(enc) >= len(Encode(nil, c.src)) {
+			t.Fatalf("expected the dictionary to improve compression: %d vs %d",
+				len(enc), len(Encode(nil, c.src)))
+		}
+		// The block cannot be decoded without the dictionary.
+		if len(c.src) > 1000 {
+			if _, err := Decode(dst, enc); err != ErrCorrupt {
+				t.Fatalf("expected %v, but found %v", ErrCorrupt, err)
+			}
+		}
+	}
+
+	// The file was produced by the reference implementation, using the first
+	// 8000 bytes of the records as the dictionary.
+	src, err := ioutil.ReadFile("testdata/records.json.dict.lz4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := make([]byte, 4000)
+	n, err := DecodeDict(dst, src, records[:8000])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(records[8000:12000], dst[:n]) {
+		t.Fatalf("decoded contents differ")
+	}
+}
+
+func TestDecodeCorrupt(t *testing.T) {
+	src := []byte("hello hello hello hello hello hello")
+	enc := Encode(nil, src)
+	dst := make([]byte, len(src))
+	// A truncated input must not decode to the full contents. Truncation at a
+	// sequence boundary leaves a valid, shorter block.
+	for i := 0; i < len(enc); i++ {
+		if n, err := Decode(dst, enc[:i]); err == nil && n == len(src) {
+			t.Fatalf("truncated to %d: expected error", i)
+		}
+	}
+	if _, err := Decode(dst[:len(dst)-1], enc); err != ErrCorrupt {
+		t.Fatalf("expected %v, but found %v", ErrCorrupt, err)
+	}
+	// An offset pointing before the start of the output is corrupt.
+	if _, err := Decode(dst, []byte{0x00, 0x01, 0x00}); err != ErrCorrupt {
+		t.Fatalf("expected %v, but found %v", ErrCorrupt, err)
+	}
+}
+
+func BenchmarkEncode(b *testing.B) {
+	src := testInputs(b)[3]
+	dst := make([]byte, MaxEncodedLen(len(src)))
+	b.SetBytes(int64(len(src)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		Encode(dst, src)
+	}
+}
+
+func BenchmarkDecode(b *testing.B) {
+	src := testInputs(b)[3]
+	enc := Encode(nil, src)
+	dst := make([]byte, len(src))
+	b.SetBytes(int64(len(src)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := Decode(dst, enc); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
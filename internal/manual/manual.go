@@ -0,0 +1,42 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+// +build cgo
+
+// Package manual provides byte slices whose memory is allocated and freed
+// explicitly, outside of the Go heap. Memory allocated with New is invisible
+// to the garbage collector: it does not count towards the heap size which
+// triggers a collection and it is never scanned. The memory must not contain
+// Go pointers, and must be released with Free once it is no longer
+// referenced.
+package manual // import "github.com/petermattis/pebble/internal/manual"
+
+// #include <stdlib.h>
+import "C"
+import "unsafe"
+
+// maxArrayLen is a safe maximum length for slices on this architecture.
+const maxArrayLen = 1<<31 - 1
+
+// New allocates a slice of size n. The returned slice is zeroed.
+func New(n int) []byte {
+	if n == 0 {
+		return make([]byte, 0)
+	}
+	ptr := C.calloc(C.size_t(n), 1)
+	if ptr == nil {
+		// Mirror the behavior of the Go runtime, which treats failing to
+		// allocate memory as fatal.
+		panic("pebble: out of memory")
+	}
+	return (*[maxArrayLen]byte)(ptr)[:n:n]
+}
+
+// Free frees the specified slice, which must have been allocated by New.
+func Free(b []byte) {
+	if cap(b) != 0 {
+		// The slice may have been truncated, so free the start of its capacity.
+		C.free(unsafe.Pointer(&b[:cap(b)][0]))
+	}
+}
@@ -0,0 +1,18 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+// +build !cgo
+
+package manual // import "github.com/petermattis/pebble/internal/manual"
+
+// Without cgo there is no way to allocate memory outside of the Go heap, so
+// the allocations are left to the garbage collector.
+
+// New allocates a slice of size n. The returned slice is zeroed.
+func New(n int) []byte {
+	return make([]byte, n)
+}
+
+// Free frees the specified slice, which must have been allocated by New.
+func Free(b []byte) {}
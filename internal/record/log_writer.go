@@ -107,21 +107,24 @@ func (w *LogWriter) flushLoop() {
 		pending := f.pending
 		f.pending = nil
 		f.flushing = true
+		err := f.err
 
 		f.Unlock()
 
-		var err error
 		for _, b := range pending {
-			if err = w.flushBlock(b); err != nil {
-				break
+			if err == nil {
+				err = w.flushBlock(b)
+			}
+			if err != nil {
+				// The block cannot be written after an earlier error. Return it to
+				// the free list so that writers do not block waiting for a block;
+				// they will see the error instead.
+				w.releaseBlock(b)
 			}
 		}
 
 		f.Lock()
 		f.err = err
-		if f.err != nil {
-			return
-		}
 		f.flushing = false
 		f.done.Signal()
 	}
@@ -131,10 +134,15 @@ func (w *LogWriter) flushBlock(b *block) error {
 	if _, err := w.w.Write(b.buf[b.flushed:]); err != nil {
 		return err
 	}
+	w.releaseBlock(b)
+	return nil
+}
+
+// releaseBlock resets b and returns it to the free list.
+func (w *LogWriter) releaseBlock(b *block) {
 	b.written = 0
 	b.flushed = 0
 	w.free <- b
-	return nil
 }
 
 // queueBlock queues the current block for writing to the underlying writer,
@@ -202,6 +210,13 @@ func (w *LogWriter) flushLocked() error {
 	for w.flusher.flushing {
 		w.flusher.done.Wait()
 	}
+	if err := w.flusher.err; err != nil {
+		// A block failed to be written by the flush loop. Don't write anything
+		// further, which would leave a gap in the log.
+		w.err = err
+		w.flusher.Unlock()
+		return err
+	}
 	// Block any new flushing from starting.
 	w.flusher.flushing = true
 	// Grab the list of pending blocks to be flushed.
@@ -776,6 +776,30 @@ func TestNoLastRecordOffset(t *testing.T) {
 	}
 }
 
+// failingWriter fails every write.
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("write failed")
+}
+
+func TestLogWriterError(t *testing.T) {
+	// The flush loop fails to write the first block. Later records must fail
+	// rather than block waiting for the unwritten blocks to be freed.
+	w := NewLogWriter(failingWriter{})
+	buf := make([]byte, 1024)
+	var err error
+	for i := 0; i < 1000 && err == nil; i++ {
+		_, err = w.WriteRecord(buf)
+	}
+	if err == nil || err.Error() != "write failed" {
+		t.Fatalf("expected write failed, but found %v", err)
+	}
+	if err := w.Sync(); err == nil || err.Error() != "write failed" {
+		t.Fatalf("expected write failed, but found %v", err)
+	}
+}
+
 func BenchmarkRecordWrite(b *testing.B) {
 	for _, size := range []int{8, 16, 32, 64, 128} {
 		b.Run(fmt.Sprintf("size=%d", size), func(b *testing.B) {
@@ -0,0 +1,238 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+// Package xxhash implements the 32-bit and 64-bit variants of the xxHash
+// non-cryptographic hash algorithm, with a seed of zero.
+//
+// The hashes can be computed in one call, or incrementally using a Digest32
+// or Digest64. The zero value of a digest is ready to use. For example, to
+// compute the xxHash64 of two slices as if they were concatenated:
+//
+//	var d xxhash.Digest64
+//	d.Write(a)
+//	d.Write(b)
+//	h := d.Sum64()
+package xxhash // import "github.com/petermattis/pebble/internal/xxhash"
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+const (
+	prime32_1 = 2654435761
+	prime32_2 = 2246822519
+	prime32_3 = 3266489917
+	prime32_4 = 668265263
+	prime32_5 = 374761393
+
+	prime64_1 = 11400714785074694791
+	prime64_2 = 14029467366897019727
+	prime64_3 = 1609587929392839161
+	prime64_4 = 9650029242287828579
+	prime64_5 = 2870177450012600261
+)
+
+// Sum32 returns the xxHash32 of b.
+func Sum32(b []byte) uint32 {
+	var d Digest32
+	d.Write(b)
+	return d.Sum32()
+}
+
+// Sum64 returns the xxHash64 of b.
+func Sum64(b []byte) uint64 {
+	var d Digest64
+	d.Write(b)
+	return d.Sum64()
+}
+
+// Digest32 incrementally computes the xxHash32 of the data written to it.
+type Digest32 struct {
+	v       [4]uint32
+	total   uint64
+	mem     [16]byte
+	n       int
+	started bool
+}
+
+// Reset resets the digest to the hash of no data.
+func (d *Digest32) Reset() {
+	*d = Digest32{}
+}
+
+func round32(acc, in uint32) uint32 {
+	acc += in * prime32_2
+	acc = bits.RotateLeft32(acc, 13)
+	return acc * prime32_1
+}
+
+// stripes processes the whole 16 byte stripes at the start of b, returning
+// the number of bytes processed.
+func (d *Digest32) stripes(b []byte) int {
+	if !d.started {
+		d.v = [4]uint32{(prime32_1 + prime32_2) & (1<<32 - 1), prime32_2, 0, -prime32_1 & (1<<32 - 1)}
+		d.started = true
+	}
+	v0, v1, v2, v3 := d.v[0], d.v[1], d.v[2], d.v[3]
+	n := 0
+	for ; len(b)-n >= 16; n += 16 {
+		s := b[n : n+16]
+		v0 = round32(v0, binary.LittleEndian.Uint32(s[0:4]))
+		v1 = round32(v1, binary.LittleEndian.Uint32(s[4:8]))
+		v2 = round32(v2, binary.LittleEndian.Uint32(s[8:12]))
+		v3 = round32(v3, binary.LittleEndian.Uint32(s[12:16]))
+	}
+	d.v = [4]uint32{v0, v1, v2, v3}
+	return n
+}
+
+// Write adds b to the data hashed by the digest. It never returns an error.
+func (d *Digest32) Write(b []byte) (int, error) {
+	n := len(b)
+	d.total += uint64(n)
+	if d.n+len(b) < len(d.mem) {
+		d.n += copy(d.mem[d.n:], b)
+		return n, nil
+	}
+	if d.n > 0 {
+		b = b[copy(d.mem[d.n:], b):]
+		d.stripes(d.mem[:])
+		d.n = 0
+	}
+	b = b[d.stripes(b):]
+	d.n = copy(d.mem[:], b)
+	return n, nil
+}
+
+// Sum32 returns the hash of the data written to the digest.
+func (d *Digest32) Sum32() uint32 {
+	var h uint32
+	if d.started {
+		h = bits.RotateLeft32(d.v[0], 1) + bits.RotateLeft32(d.v[1], 7) +
+			bits.RotateLeft32(d.v[2], 12) + bits.RotateLeft32(d.v[3], 18)
+	} else {
+		h = prime32_5
+	}
+	h += uint32(d.total)
+
+	b := d.mem[:d.n]
+	for ; len(b) >= 4; b = b[4:] {
+		h += binary.LittleEndian.Uint32(b) * prime32_3
+		h = bits.RotateLeft32(h, 17) * prime32_4
+	}
+	for _, c := range b {
+		h += uint32(c) * prime32_5
+		h = bits.RotateLeft32(h, 11) * prime32_1
+	}
+
+	h ^= h >> 15
+	h *= prime32_2
+	h ^= h >> 13
+	h *= prime32_3
+	h ^= h >> 16
+	return h
+}
+
+// Digest64 incrementally computes the xxHash64 of the data written to it.
+type Digest64 struct {
+	v       [4]uint64
+	total   uint64
+	mem     [32]byte
+	n       int
+	started bool
+}
+
+// Reset resets the digest to the hash of no data.
+func (d *Digest64) Reset() {
+	*d = Digest64{}
+}
+
+func round64(acc, in uint64) uint64 {
+	acc += in * prime64_2
+	acc = bits.RotateLeft64(acc, 31)
+	return acc * prime64_1
+}
+
+func mergeRound64(acc, v uint64) uint64 {
+	acc ^= round64(0, v)
+	return acc*prime64_1 + prime64_4
+}
+
+// stripes processes the whole 32 byte stripes at the start of b, returning
+// the number of bytes processed.
+func (d *Digest64) stripes(b []byte) int {
+	if !d.started {
+		d.v = [4]uint64{(prime64_1 + prime64_2) & (1<<64 - 1), prime64_2, 0, -prime64_1 & (1<<64 - 1)}
+		d.started = true
+	}
+	v0, v1, v2, v3 := d.v[0], d.v[1], d.v[2], d.v[3]
+	n := 0
+	for ; len(b)-n >= 32; n += 32 {
+		s := b[n : n+32]
+		v0 = round64(v0, binary.LittleEndian.Uint64(s[0:8]))
+		v1 = round64(v1, binary.LittleEndian.Uint64(s[8:16]))
+		v2 = round64(v2, binary.LittleEndian.Uint64(s[16:24]))
+		v3 = round64(v3, binary.LittleEndian.Uint64(s[24:32]))
+	}
+	d.v = [4]uint64{v0, v1, v2, v3}
+	return n
+}
+
+// Write adds b to the data hashed by the digest. It never returns an error.
+func (d *Digest64) Write(b []byte) (int, error) {
+	n := len(b)
+	d.total += uint64(n)
+	if d.n+len(b) < len(d.mem) {
+		d.n += copy(d.mem[d.n:], b)
+		return n, nil
+	}
+	if d.n > 0 {
+		b = b[copy(d.mem[d.n:], b):]
+		d.stripes(d.mem[:])
+		d.n = 0
+	}
+	b = b[d.stripes(b):]
+	d.n = copy(d.mem[:], b)
+	return n, nil
+}
+
+// Sum64 returns the hash of the data written to the digest.
+func (d *Digest64) Sum64() uint64 {
+	var h uint64
+	if d.started {
+		v0, v1, v2, v3 := d.v[0], d.v[1], d.v[2], d.v[3]
+		h = bits.RotateLeft64(v0, 1) + bits.RotateLeft64(v1, 7) +
+			bits.RotateLeft64(v2, 12) + bits.RotateLeft64(v3, 18)
+		h = mergeRound64(h, v0)
+		h = mergeRound64(h, v1)
+		h = mergeRound64(h, v2)
+		h = mergeRound64(h, v3)
+	} else {
+		h = prime64_5
+	}
+	h += d.total
+
+	b := d.mem[:d.n]
+	for ; len(b) >= 8; b = b[8:] {
+		h ^= round64(0, binary.LittleEndian.Uint64(b))
+		h = bits.RotateLeft64(h, 27)*prime64_1 + prime64_4
+	}
+	if len(b) >= 4 {
+		h ^= uint64(binary.LittleEndian.Uint32(b)) * prime64_1
+		h = bits.RotateLeft64(h, 23)*prime64_2 + prime64_3
+		b = b[4:]
+	}
+	for _, c := range b {
+		h ^= uint64(c) * prime64_5
+		h = bits.RotateLeft64(h, 11) * prime64_1
+	}
+
+	h ^= h >> 33
+	h *= prime64_2
+	h ^= h >> 29
+	h *= prime64_3
+	h ^= h >> 32
+	return h
+}
@@ -0,0 +1,109 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package xxhash
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func testInput(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte((i*31 + 7) % 251)
+	}
+	return b
+}
+
+// The expected hashes of prefixes of testInput were computed using the
+// reference implementation (XXH32 and XXH64 with a seed of zero).
+var testCases = []struct {
+	n     int
+	sum32 uint32
+	sum64 uint64
+}{
+	{0, 0x02cc5d05, 0xef46db3751d8e999},
+	{1, 0x002e0d32, 0xa96c7f0ce858bbb7},
+	{3, 0xaca17380, 0x56e6957632a487f9},
+	{4, 0x073faa82, 0xc60d15b1e3ff8f04},
+	{7, 0xa9a7eebf, 0xafbefc3d6c6f9a8e},
+	{8, 0xb9893c6c, 0x3da5c7aa269683e0},
+	{15, 0x60cd6a0a, 0xdee89d8a065a6233},
+	{16, 0xcfb54e08, 0x1330489a77679c80},
+	{17, 0x3dc8d13e, 0x0bbe879c6150fef5},
+	{31, 0xd60eb594, 0x3391303d485e846e},
+	{32, 0xd183959f, 0x40b7aff75d45bbc8},
+	{33, 0xdc85a102, 0x4997cae4951c17a5},
+	{63, 0x308a6c35, 0x2944b4dafc69b206},
+	{64, 0x77e62c7f, 0xbb76f6ef19bd5a1b},
+	{100, 0x0f7bcf5d, 0xf0b29a915621716d},
+	{1000, 0x4d3c755f, 0x9e3300c1cde3c58d},
+}
+
+func TestSum(t *testing.T) {
+	for _, c := range testCases {
+		b := testInput(c.n)
+		if s := Sum32(b); s != c.sum32 {
+			t.Errorf("Sum32(%d): got %#08x, want %#08x", c.n, s, c.sum32)
+		}
+		if s := Sum64(b); s != c.sum64 {
+			t.Errorf("Sum64(%d): got %#016x, want %#016x", c.n, s, c.sum64)
+		}
+	}
+}
+
+func TestDigest(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for _, c := range testCases {
+		t.Run(fmt.Sprint(c.n), func(t *testing.T) {
+			b := testInput(c.n)
+			for i := 0; i < 20; i++ {
+				// Write the input in randomly sized pieces.
+				var d32 Digest32
+				var d64 Digest64
+				for p := b; ; {
+					k := rng.Intn(40)
+					if k > len(p) {
+						k = len(p)
+					}
+					d32.Write(p[:k])
+					d64.Write(p[:k])
+					p = p[k:]
+					if len(p) == 0 {
+						break
+					}
+				}
+				if s := d32.Sum32(); s != c.sum32 {
+					t.Fatalf("Digest32: got %#08x, want %#08x", s, c.sum32)
+				}
+				if s := d64.Sum64(); s != c.sum64 {
+					t.Fatalf("Digest64: got %#016x, want %#016x", s, c.sum64)
+				}
+				d64.Reset()
+				if s := d64.Sum64(); s != testCases[0].sum64 {
+					t.Fatalf("Digest64 after Reset: got %#016x, want %#016x", s, testCases[0].sum64)
+				}
+			}
+		})
+	}
+}
+
+func benchmarkSum(b *testing.B, n int, sum func([]byte)) {
+	data := testInput(n)
+	b.SetBytes(int64(n))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sum(data)
+	}
+}
+
+func BenchmarkSum32(b *testing.B) {
+	benchmarkSum(b, 4096, func(data []byte) { Sum32(data) })
+}
+
+func BenchmarkSum64(b *testing.B) {
+	benchmarkSum(b, 4096, func(data []byte) { Sum64(data) })
+}
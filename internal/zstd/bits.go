@@ -0,0 +1,139 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package zstd
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// forwardBitReader reads bits starting from the least significant bit of the
+// first byte, as used by FSE table descriptions. Bits beyond the end of the
+// input read as zero.
+type forwardBitReader struct {
+	b   []byte
+	off int
+}
+
+func (r *forwardBitReader) peek() uint64 {
+	i := r.off >> 3
+	var v uint64
+	if i+8 <= len(r.b) {
+		v = binary.LittleEndian.Uint64(r.b[i:])
+	} else {
+		for k := 0; i+k < len(r.b); k++ {
+			v |= uint64(r.b[i+k]) << uint(8*k)
+		}
+	}
+	return v >> uint(r.off&7)
+}
+
+func (r *forwardBitReader) skip(n int) {
+	r.off += n
+}
+
+func (r *forwardBitReader) read(n int) uint32 {
+	v := uint32(r.peek() & (1<<uint(n) - 1))
+	r.off += n
+	return v
+}
+
+// bytesRead returns the number of bytes containing the bits read so far.
+func (r *forwardBitReader) bytesRead() int {
+	return (r.off + 7) >> 3
+}
+
+// backwardBitReader reads a bitstream from its end towards its start, as used
+// by Huffman-coded literals and FSE-coded sequences. The final byte of the
+// stream contains a marker: its highest set bit precedes the last bit
+// written. Bits before the start of the stream read as zero.
+type backwardBitReader struct {
+	b []byte
+	// pos is the number of unread bits.
+	pos int
+}
+
+func (r *backwardBitReader) init(b []byte) error {
+	if len(b) == 0 || b[len(b)-1] == 0 {
+		return errCorrupt
+	}
+	r.b = b
+	r.pos = 8*(len(b)-1) + bits.Len8(b[len(b)-1]) - 1
+	return nil
+}
+
+// get returns the n bits starting at bit offset lo. The caller must ensure
+// that lo >= 0 and n <= 56.
+func (r *backwardBitReader) get(lo, n int) uint64 {
+	i := lo >> 3
+	var v uint64
+	if i+8 <= len(r.b) {
+		v = binary.LittleEndian.Uint64(r.b[i:])
+	} else {
+		for k := 0; i+k < len(r.b); k++ {
+			v |= uint64(r.b[i+k]) << uint(8*k)
+		}
+	}
+	return (v >> uint(lo&7)) & (1<<uint(n) - 1)
+}
+
+// peek returns the next n bits without consuming them.
+func (r *backwardBitReader) peek(n int) uint64 {
+	if r.pos >= n {
+		return r.get(r.pos-n, n)
+	}
+	if r.pos <= 0 {
+		return 0
+	}
+	return r.get(0, r.pos) << uint(n-r.pos)
+}
+
+func (r *backwardBitReader) read(n int) uint64 {
+	if n == 0 {
+		return 0
+	}
+	v := r.peek(n)
+	r.pos -= n
+	return v
+}
+
+// overflow returns true if more bits have been read than the stream holds.
+func (r *backwardBitReader) overflow() bool {
+	return r.pos < 0
+}
+
+// backwardBitWriter writes a bitstream which is read by backwardBitReader: the
+// last bits written are the first bits read.
+type backwardBitWriter struct {
+	buf []byte
+	acc uint64
+	n   uint
+}
+
+// add appends the low nb bits of v. nb must be at most 32.
+func (w *backwardBitWriter) add(v uint64, nb uint) {
+	w.acc |= (v & (1<<nb - 1)) << w.n
+	w.n += nb
+	if w.n >= 32 {
+		w.buf = append(w.buf, byte(w.acc), byte(w.acc>>8), byte(w.acc>>16), byte(w.acc>>24))
+		w.acc >>= 32
+		w.n -= 32
+	}
+}
+
+// close writes the end-of-stream marker and returns the buffer.
+func (w *backwardBitWriter) close() []byte {
+	w.add(1, 1)
+	for w.n > 0 {
+		w.buf = append(w.buf, byte(w.acc))
+		w.acc >>= 8
+		if w.n < 8 {
+			break
+		}
+		w.n -= 8
+	}
+	w.acc, w.n = 0, 0
+	return w.buf
+}
@@ -0,0 +1,544 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package zstd
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// decoder holds the state which is carried between the blocks of a frame.
+type decoder struct {
+	huff    huffTable
+	hasHuff bool
+	// The tables used by the previous block, for the repeat mode.
+	tables   [3]*fseTable
+	fse      [3]fseTable
+	reps     [3]int
+	literals []byte
+	dict     *Dict
+}
+
+// Decode decodes the zstd frames in src into dst, returning the number of
+// bytes decoded. The length of dst must be at least the decoded length.
+func Decode(dst, src []byte) (int, error) {
+	return DecodeDict(dst, src, nil)
+}
+
+// DecodeDict decodes the zstd frames in src, which were compressed using a
+// dictionary, into dst. A nil dictionary is equivalent to calling Decode.
+func DecodeDict(dst, src []byte, dict *Dict) (int, error) {
+	d := decoder{dict: dict}
+	n := 0
+	for len(src) > 0 {
+		if len(src) < 4 {
+			return 0, errCorrupt
+		}
+		magic := binary.LittleEndian.Uint32(src)
+		if magic&skippableMagicMask == skippableMagic {
+			if len(src) < 8 {
+				return 0, errCorrupt
+			}
+			size := int(binary.LittleEndian.Uint32(src[4:]))
+			if size > len(src)-8 {
+				return 0, errCorrupt
+			}
+			src = src[8+size:]
+			continue
+		}
+		if magic != frameMagic {
+			return 0, errors.New("zstd: invalid magic number")
+		}
+		m, consumed, err := d.decodeFrame(dst[n:], src[4:])
+		if err != nil {
+			return 0, err
+		}
+		n += m
+		src = src[4+consumed:]
+	}
+	return n, nil
+}
+
+// DecodedLen returns the decoded length of the first frame in src, if it is
+// recorded in the frame header, or -1 if it is not.
+func DecodedLen(src []byte) (int, error) {
+	if len(src) < 5 || binary.LittleEndian.Uint32(src) != frameMagic {
+		return 0, errCorrupt
+	}
+	h, _, err := readFrameHeader(src[4:])
+	if err != nil {
+		return 0, err
+	}
+	return h.contentSize, nil
+}
+
+type frameHeader struct {
+	contentSize int
+	checksum    bool
+	dictID      uint32
+}
+
+func readFrameHeader(src []byte) (frameHeader, int, error) {
+	var h frameHeader
+	if len(src) < 1 {
+		return h, 0, errCorrupt
+	}
+	desc := src[0]
+	if desc&0x08 != 0 {
+		return h, 0, errCorrupt
+	}
+	singleSegment := desc&0x20 != 0
+	h.checksum = desc&0x04 != 0
+	n := 1
+	if !singleSegment {
+		// The window size is not needed as the entire output is retained.
+		n++
+	}
+	dictIDSize := [4]int{0, 1, 2, 4}[desc&3]
+	if n+dictIDSize > len(src) {
+		return h, 0, errCorrupt
+	}
+	for i := 0; i < dictIDSize; i++ {
+		h.dictID |= uint32(src[n+i]) << uint(8*i)
+	}
+	n += dictIDSize
+
+	h.contentSize = -1
+	switch desc >> 6 {
+	case 0:
+		if singleSegment {
+			if n+1 > len(src) {
+				return h, 0, errCorrupt
+			}
+			h.contentSize = int(src[n])
+			n++
+		}
+	case 1:
+		if n+2 > len(src) {
+			return h, 0, errCorrupt
+		}
+		h.contentSize = int(binary.LittleEndian.Uint16(src[n:])) + 256
+		n += 2
+	case 2:
+		if n+4 > len(src) {
+			return h, 0, errCorrupt
+		}
+		h.contentSize = int(binary.LittleEndian.Uint32(src[n:]))
+		n += 4
+	case 3:
+		if n+8 > len(src) {
+			return h, 0, errCorrupt
+		}
+		size := binary.LittleEndian.Uint64(src[n:])
+		if size > 1<<62 {
+			return h, 0, errCorrupt
+		}
+		h.contentSize = int(size)
+		n += 8
+	}
+	return h, n, nil
+}
+
+// decodeFrame decodes a single frame, following its magic number, into dst. It
+// returns the number of bytes decoded and the number of bytes of src consumed.
+func (d *decoder) decodeFrame(dst, src []byte) (int, int, error) {
+	h, n, err := readFrameHeader(src)
+	if err != nil {
+		return 0, 0, err
+	}
+	d.hasHuff = false
+	d.tables = [3]*fseTable{}
+	d.reps = [3]int{1, 4, 8}
+	if h.dictID != 0 && (d.dict == nil || d.dict.id != h.dictID) {
+		return 0, 0, fmt.Errorf("zstd: frame requires dictionary %d", h.dictID)
+	}
+	if d.dict != nil {
+		d.reps = d.dict.reps
+		d.tables = d.dict.tables
+		if d.dict.huff != nil {
+			// The table is copied, as it is overwritten by the next table
+			// read from the frame.
+			d.huff.maxBits = d.dict.huff.maxBits
+			d.huff.entries = append(d.huff.entries[:0], d.dict.huff.entries...)
+			d.hasHuff = true
+		}
+	}
+
+	out := 0
+	for {
+		if n+3 > len(src) {
+			return 0, 0, errCorrupt
+		}
+		header := int(src[n]) | int(src[n+1])<<8 | int(src[n+2])<<16
+		n += 3
+		last := header&1 != 0
+		size := header >> 3
+		switch (header >> 1) & 3 {
+		case rawBlock:
+			if size > len(src)-n || size > len(dst)-out {
+				return 0, 0, errCorrupt
+			}
+			copy(dst[out:], src[n:n+size])
+			out += size
+			n += size
+		case rleBlock:
+			if n >= len(src) || size > len(dst)-out {
+				return 0, 0, errCorrupt
+			}
+			b := src[n]
+			for i := out; i < out+size; i++ {
+				dst[i] = b
+			}
+			out += size
+			n++
+		case compressedBlock:
+			if size > maxBlockSize || size > len(src)-n {
+				return 0, 0, errCorrupt
+			}
+			m, err := d.decodeBlock(dst, out, src[n:n+size])
+			if err != nil {
+				return 0, 0, err
+			}
+			out = m
+			n += size
+		default:
+			return 0, 0, errCorrupt
+		}
+		if last {
+			break
+		}
+	}
+	if h.checksum {
+		// The checksum of the content is not verified: the callers of this
+		// package verify the checksums of the blocks containing frames.
+		if n+4 > len(src) {
+			return 0, 0, errCorrupt
+		}
+		n += 4
+	}
+	if h.contentSize >= 0 && h.contentSize != out {
+		return 0, 0, errCorrupt
+	}
+	return out, n, nil
+}
+
+// decodeBlock decodes a compressed block into dst[out:], where dst[:out] holds
+// the preceding output of the frame. It returns the new length of the output.
+func (d *decoder) decodeBlock(dst []byte, out int, src []byte) (int, error) {
+	lits, n, err := d.decodeLiterals(src)
+	if err != nil {
+		return 0, err
+	}
+	return d.decodeSequences(dst, out, lits, src[n:])
+}
+
+func (d *decoder) decodeLiterals(src []byte) ([]byte, int, error) {
+	if len(src) == 0 {
+		return nil, 0, errCorrupt
+	}
+	litType := src[0] & 3
+	sizeFormat := (src[0] >> 2) & 3
+
+	if litType == rawLiterals || litType == rleLiterals {
+		var size, n int
+		switch sizeFormat {
+		case 0, 2:
+			size, n = int(src[0]>>3), 1
+		case 1:
+			if len(src) < 2 {
+				return nil, 0, errCorrupt
+			}
+			size, n = int(src[0]>>4)|int(src[1])<<4, 2
+		case 3:
+			if len(src) < 3 {
+				return nil, 0, errCorrupt
+			}
+			size, n = int(src[0]>>4)|int(src[1])<<4|int(src[2])<<12, 3
+		}
+		if size > maxBlockSize {
+			return nil, 0, errCorrupt
+		}
+		if litType == rawLiterals {
+			if size > len(src)-n {
+				return nil, 0, errCorrupt
+			}
+			return src[n : n+size], n + size, nil
+		}
+		if n >= len(src) {
+			return nil, 0, errCorrupt
+		}
+		lits := d.literalsBuf(size)
+		for i := range lits {
+			lits[i] = src[n]
+		}
+		return lits, n + 1, nil
+	}
+
+	// The literals are Huffman coded.
+	var regenSize, compSize, n int
+	streams := 4
+	switch sizeFormat {
+	case 0, 1:
+		if len(src) < 3 {
+			return nil, 0, errCorrupt
+		}
+		v := int(src[0]) | int(src[1])<<8 | int(src[2])<<16
+		regenSize, compSize, n = (v>>4)&0x3ff, (v>>14)&0x3ff, 3
+		if sizeFormat == 0 {
+			streams = 1
+		}
+	case 2:
+		if len(src) < 4 {
+			return nil, 0, errCorrupt
+		}
+		v := int(binary.LittleEndian.Uint32(src))
+		regenSize, compSize, n = (v>>4)&0x3fff, (v>>18)&0x3fff, 4
+	case 3:
+		if len(src) < 5 {
+			return nil, 0, errCorrupt
+		}
+		v := int(binary.LittleEndian.Uint32(src))
+		regenSize, compSize, n = (v>>4)&0x3ffff, v>>22|int(src[4])<<10, 5
+	}
+	if regenSize > maxBlockSize || compSize > len(src)-n {
+		return nil, 0, errCorrupt
+	}
+	data := src[n : n+compSize]
+	if litType == compressedLiterals {
+		m, err := readHuffTable(&d.huff, data)
+		if err != nil {
+			return nil, 0, err
+		}
+		d.hasHuff = true
+		data = data[m:]
+	} else if !d.hasHuff {
+		return nil, 0, errCorrupt
+	}
+
+	lits := d.literalsBuf(regenSize)
+	if streams == 1 {
+		if err := d.huff.decodeStream(lits, data); err != nil {
+			return nil, 0, err
+		}
+		return lits, n + compSize, nil
+	}
+	if len(data) < 6 {
+		return nil, 0, errCorrupt
+	}
+	var sizes [4]int
+	sizes[0] = int(binary.LittleEndian.Uint16(data[0:]))
+	sizes[1] = int(binary.LittleEndian.Uint16(data[2:]))
+	sizes[2] = int(binary.LittleEndian.Uint16(data[4:]))
+	sizes[3] = len(data) - 6 - sizes[0] - sizes[1] - sizes[2]
+	segment := (regenSize + 3) / 4
+	if sizes[3] < 0 || 3*segment > regenSize {
+		return nil, 0, errCorrupt
+	}
+	data = data[6:]
+	for i, size := range sizes {
+		end := segment * (i + 1)
+		if i == 3 {
+			end = regenSize
+		}
+		if err := d.huff.decodeStream(lits[segment*i:end], data[:size]); err != nil {
+			return nil, 0, err
+		}
+		data = data[size:]
+	}
+	return lits, n + compSize, nil
+}
+
+func (d *decoder) literalsBuf(n int) []byte {
+	if cap(d.literals) < n {
+		d.literals = make([]byte, n)
+	}
+	return d.literals[:n]
+}
+
+func (d *decoder) decodeSequences(dst []byte, out int, lits, src []byte) (int, error) {
+	if len(src) == 0 {
+		return 0, errCorrupt
+	}
+	count := int(src[0])
+	n := 1
+	switch {
+	case count == 0:
+		if len(src) != 1 {
+			return 0, errCorrupt
+		}
+	case count < 128:
+	case count < 255:
+		if len(src) < 2 {
+			return 0, errCorrupt
+		}
+		count = (count-128)<<8 | int(src[1])
+		n = 2
+	default:
+		if len(src) < 3 {
+			return 0, errCorrupt
+		}
+		count = int(src[1]) | int(src[2])<<8 + 0x7f00
+		n = 3
+	}
+
+	if count > 0 {
+		if n >= len(src) {
+			return 0, errCorrupt
+		}
+		modes := src[n]
+		n++
+		if modes&3 != 0 {
+			return 0, errCorrupt
+		}
+		// The tables are described in the order: literal lengths, offsets and
+		// match lengths.
+		for i, k := range [3]int{litLenKind, offsetKind, matchLenKind} {
+			m, err := d.readTable(k, int(modes>>uint(6-2*i))&3, src[n:])
+			if err != nil {
+				return 0, err
+			}
+			n += m
+		}
+	}
+
+	var r backwardBitReader
+	if count > 0 {
+		if err := r.init(src[n:]); err != nil {
+			return 0, err
+		}
+	}
+	llTable := d.tables[litLenKind]
+	ofTable := d.tables[offsetKind]
+	mlTable := d.tables[matchLenKind]
+	var llState, ofState, mlState uint64
+	if count > 0 {
+		llState = r.read(llTable.accuracyLog)
+		ofState = r.read(ofTable.accuracyLog)
+		mlState = r.read(mlTable.accuracyLog)
+	}
+
+	for i := 0; i < count; i++ {
+		ll := llTable.entries[llState]
+		of := ofTable.entries[ofState]
+		ml := mlTable.entries[mlState]
+		if int(ll.symbol) >= len(litLenCodes) || int(ml.symbol) >= len(matchLenCodes) ||
+			of.symbol > maxOffsetCode {
+			return 0, errCorrupt
+		}
+
+		offsetValue := 1<<of.symbol + int(r.read(int(of.symbol)))
+		mlCode := matchLenCodes[ml.symbol]
+		matchLen := int(mlCode.baseline) + int(r.read(int(mlCode.bits)))
+		llCode := litLenCodes[ll.symbol]
+		litLen := int(llCode.baseline) + int(r.read(int(llCode.bits)))
+
+		var offset int
+		if offsetValue > 3 {
+			offset = offsetValue - 3
+			d.reps[2], d.reps[1], d.reps[0] = d.reps[1], d.reps[0], offset
+		} else {
+			// A repeated offset. If there are no literals, the repeated offsets
+			// are shifted by one.
+			idx := offsetValue - 1
+			if litLen == 0 {
+				idx++
+			}
+			switch idx {
+			case 0:
+				offset = d.reps[0]
+			case 1:
+				offset = d.reps[1]
+				d.reps[1], d.reps[0] = d.reps[0], offset
+			case 2:
+				offset = d.reps[2]
+				d.reps[2], d.reps[1], d.reps[0] = d.reps[1], d.reps[0], offset
+			case 3:
+				offset = d.reps[0] - 1
+				d.reps[2], d.reps[1], d.reps[0] = d.reps[1], d.reps[0], offset
+			}
+		}
+
+		if i < count-1 {
+			llState = uint64(ll.baseline) + r.read(int(ll.nbBits))
+			mlState = uint64(ml.baseline) + r.read(int(ml.nbBits))
+			ofState = uint64(of.baseline) + r.read(int(of.nbBits))
+		}
+		if r.overflow() {
+			return 0, errCorrupt
+		}
+
+		if litLen > len(lits) || litLen+matchLen > len(dst)-out {
+			return 0, errCorrupt
+		}
+		copy(dst[out:], lits[:litLen])
+		lits = lits[litLen:]
+		out += litLen
+		if offset <= 0 {
+			return 0, errCorrupt
+		}
+		if offset > out {
+			// The match starts within the dictionary.
+			if d.dict == nil || offset-out > len(d.dict.content) {
+				return 0, errCorrupt
+			}
+			content := d.dict.content
+			n := copy(dst[out:out+matchLen], content[len(content)-(offset-out):])
+			out += n
+			matchLen -= n
+		}
+		if matchLen == 0 {
+			continue
+		}
+		if offset >= matchLen {
+			copy(dst[out:out+matchLen], dst[out-offset:])
+		} else {
+			// The match overlaps the bytes being written.
+			for j := out; j < out+matchLen; j++ {
+				dst[j] = dst[j-offset]
+			}
+		}
+		out += matchLen
+	}
+	if count > 0 && r.pos != 0 {
+		return 0, errCorrupt
+	}
+
+	// Copy the literals which follow the last sequence.
+	if len(lits) > len(dst)-out {
+		return 0, errCorrupt
+	}
+	copy(dst[out:], lits)
+	return out + len(lits), nil
+}
+
+// readTable reads the table for the specified kind of symbol, returning the
+// number of bytes read.
+func (d *decoder) readTable(kind, mode int, src []byte) (int, error) {
+	switch mode {
+	case predefinedMode:
+		d.tables[kind] = predefinedTables[kind]
+		return 0, nil
+	case rleMode:
+		if len(src) < 1 {
+			return 0, errCorrupt
+		}
+		buildRLETable(&d.fse[kind], src[0])
+		d.tables[kind] = &d.fse[kind]
+		return 1, nil
+	case fseMode:
+		n, err := readFSETable(&d.fse[kind], src, maxSymbols[kind], maxAccuracyLogs[kind])
+		if err != nil {
+			return 0, err
+		}
+		d.tables[kind] = &d.fse[kind]
+		return n, nil
+	default:
+		if d.tables[kind] == nil {
+			return 0, errCorrupt
+		}
+		return 0, nil
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package zstd
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+const dictMagic = 0xec30a437
+
+// Dict is a dictionary prepared for compressing and decompressing frames. A
+// dictionary is either raw content, which acts as a prefix of the data of
+// each frame, or is in the format produced by the dictionary builder of the
+// reference implementation. The latter also provides the initial entropy
+// tables and repeated offsets of each frame. A Dict is safe for concurrent use.
+type Dict struct {
+	id      uint32
+	content []byte
+	reps    [3]int
+	// huff and tables are the initial entropy tables, which are nil for a raw
+	// content dictionary.
+	huff   *huffTable
+	tables [3]*fseTable
+	// table is the hash table of the content used by the encoder.
+	table   []int32
+	hashLog int
+}
+
+// NewDict prepares a dictionary. The dictionary retains a copy of b.
+func NewDict(b []byte) (*Dict, error) {
+	b = append([]byte(nil), b...)
+	d := &Dict{reps: [3]int{1, 4, 8}}
+	if len(b) < 8 || binary.LittleEndian.Uint32(b) != dictMagic {
+		d.content = b
+	} else if err := d.load(b); err != nil {
+		return nil, err
+	}
+
+	d.hashLog = bits.Len(uint(len(d.content))) + 1
+	if d.hashLog > maxHashLog {
+		d.hashLog = maxHashLog
+	} else if d.hashLog < minHashLog {
+		d.hashLog = minHashLog
+	}
+	d.table = make([]int32, 1<<uint(d.hashLog))
+	shift := uint(32 - d.hashLog)
+	for i := 0; i+minMatch <= len(d.content); i++ {
+		h := (binary.LittleEndian.Uint32(d.content[i:]) * 2654435761) >> shift
+		d.table[h] = int32(i + 1)
+	}
+	return d, nil
+}
+
+// load parses a dictionary in the format produced by the dictionary builder.
+func (d *Dict) load(b []byte) error {
+	d.id = binary.LittleEndian.Uint32(b[4:])
+	b = b[8:]
+	d.huff = &huffTable{}
+	n, err := readHuffTable(d.huff, b)
+	if err != nil {
+		return err
+	}
+	b = b[n:]
+	for _, kind := range []int{offsetKind, matchLenKind, litLenKind} {
+		t := &fseTable{}
+		n, err := readFSETable(t, b, maxSymbols[kind], maxAccuracyLogs[kind])
+		if err != nil {
+			return err
+		}
+		d.tables[kind] = t
+		b = b[n:]
+	}
+	if len(b) < 12 {
+		return errCorrupt
+	}
+	d.content = b[12:]
+	for i := range d.reps {
+		r := int(binary.LittleEndian.Uint32(b[4*i:]))
+		if r == 0 || r > len(d.content) {
+			return errCorrupt
+		}
+		d.reps[i] = r
+	}
+	return nil
+}
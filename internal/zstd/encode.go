@@ -0,0 +1,538 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package zstd
+
+import (
+	"encoding/binary"
+	"math"
+	"math/bits"
+	"sort"
+	"sync"
+)
+
+const (
+	minMatch = 4
+	// maxMatchOffset is the largest offset which can be coded using the
+	// predefined offset table.
+	maxMatchOffset = 1<<28 - 3
+	// maxHashLog is the log of the size of the hash table used for large
+	// inputs. Smaller inputs use a smaller table, which is cheaper to clear.
+	maxHashLog = 15
+	minHashLog = 8
+	// skipTrigger controls how quickly the encoder accelerates through
+	// incompressible data: the step between match attempts grows by one for
+	// every 1<<skipTrigger bytes without a match.
+	skipTrigger = 6
+	// minHuffLiterals is the minimum number of literals worth Huffman coding.
+	minHuffLiterals = 32
+	// maxFrameHeaderLen is the length of the magic number and the largest
+	// frame header written by the encoder.
+	maxFrameHeaderLen = 4 + 1 + 4 + 8
+)
+
+// MaxEncodedLen returns the maximum length of the encoding of n bytes.
+func MaxEncodedLen(n int) int {
+	return maxFrameHeaderLen + n + 3*(n/maxBlockSize+1)
+}
+
+type sequence struct {
+	litLen   uint32
+	matchLen uint32
+	// offsetValue is the coded offset: either the offset plus 3, or the index
+	// of a repeated offset.
+	offsetValue uint32
+}
+
+// encoder holds the buffers used while encoding a block.
+type encoder struct {
+	table     []int32
+	hashShift uint32
+	reps      [3]uint32
+	seqs      []sequence
+	literals  []byte
+	huff      huffEncoder
+	llCodes   []uint8
+	mlCodes   []uint8
+	ofCodes   []uint8
+	blockBuf  []byte
+	streamBuf []byte
+	// histBuf holds the dictionary content followed by the data, when
+	// encoding using a dictionary.
+	histBuf []byte
+}
+
+func (e *encoder) hash(u uint32) uint32 {
+	return (u * 2654435761) >> e.hashShift
+}
+
+var encoderPool = sync.Pool{
+	New: func() interface{} { return &encoder{} },
+}
+
+// reset prepares the encoder to encode n bytes, using an optional
+// dictionary.
+func (e *encoder) reset(n int, d *Dict) {
+	if d != nil {
+		e.table = append(e.table[:0], d.table...)
+		e.hashShift = uint32(32 - d.hashLog)
+		for i, r := range d.reps {
+			e.reps[i] = uint32(r)
+		}
+		return
+	}
+	hashLog := bits.Len(uint(n))
+	if hashLog > maxHashLog {
+		hashLog = maxHashLog
+	} else if hashLog < minHashLog {
+		hashLog = minHashLog
+	}
+	if cap(e.table) < 1<<uint(hashLog) {
+		e.table = make([]int32, 1<<uint(hashLog))
+	} else {
+		e.table = e.table[:1<<uint(hashLog)]
+		for i := range e.table {
+			e.table[i] = 0
+		}
+	}
+	e.hashShift = uint32(32 - hashLog)
+	e.reps = [3]uint32{1, 4, 8}
+}
+
+// Encode returns the encoding of src as a single zstd frame. The returned
+// slice may be a sub-slice of dst if dst was large enough to hold the entire
+// frame.
+func Encode(dst, src []byte) []byte {
+	return EncodeDict(dst, src, nil)
+}
+
+// EncodeDict returns the encoding of src as a single zstd frame, compressed
+// using a dictionary. The frame can only be decoded using the same
+// dictionary. A nil dictionary is equivalent to calling Encode.
+func EncodeDict(dst, src []byte, d *Dict) []byte {
+	if n := MaxEncodedLen(len(src)); cap(dst) < n {
+		dst = make([]byte, 0, n)
+	} else {
+		dst = dst[:0]
+	}
+	e := encoderPool.Get().(*encoder)
+	defer encoderPool.Put(e)
+	e.reset(len(src), d)
+
+	// The frame is a single segment, so the window size is the content size
+	// and matches may refer to any preceding data in the frame, as well as to
+	// the dictionary.
+	var tmp [8]byte
+	binary.LittleEndian.PutUint32(tmp[:], frameMagic)
+	dst = append(dst, tmp[:4]...)
+	desc := len(dst)
+	dst = append(dst, 0x20)
+	if d != nil && d.id != 0 {
+		dst[desc] |= 3
+		binary.LittleEndian.PutUint32(tmp[:], d.id)
+		dst = append(dst, tmp[:4]...)
+	}
+	switch n := len(src); {
+	case n < 256:
+		dst = append(dst, byte(n))
+	case n < 1<<16+256:
+		binary.LittleEndian.PutUint16(tmp[:], uint16(n-256))
+		dst[desc] |= 0x40
+		dst = append(dst, tmp[:2]...)
+	case uint64(n) < 1<<32:
+		binary.LittleEndian.PutUint32(tmp[:], uint32(n))
+		dst[desc] |= 0x80
+		dst = append(dst, tmp[:4]...)
+	default:
+		binary.LittleEndian.PutUint64(tmp[:], uint64(n))
+		dst[desc] |= 0xc0
+		dst = append(dst, tmp[:8]...)
+	}
+
+	if len(src) == 0 {
+		return appendBlockHeader(dst, true, rawBlock, 0)
+	}
+	// The dictionary content is a prefix of the data.
+	buf, offset := src, 0
+	if d != nil && len(d.content) > 0 {
+		e.histBuf = append(append(e.histBuf[:0], d.content...), src...)
+		buf, offset = e.histBuf, len(d.content)
+	}
+	for start := offset; start < len(buf); start += maxBlockSize {
+		end := start + maxBlockSize
+		if end > len(buf) {
+			end = len(buf)
+		}
+		dst = e.appendBlock(dst, buf, start, end, end == len(buf))
+	}
+	return dst
+}
+
+func appendBlockHeader(dst []byte, last bool, blockType, size int) []byte {
+	h := blockType<<1 | size<<3
+	if last {
+		h |= 1
+	}
+	return append(dst, byte(h), byte(h>>8), byte(h>>16))
+}
+
+// appendBlock appends the block for src[start:end]. Matches may refer to any
+// data in src before start.
+func (e *encoder) appendBlock(dst, src []byte, start, end int, last bool) []byte {
+	block := src[start:end]
+	rle := true
+	for _, b := range block[1:] {
+		if b != block[0] {
+			rle = false
+			break
+		}
+	}
+	if rle && len(block) > 1 {
+		dst = appendBlockHeader(dst, last, rleBlock, len(block))
+		return append(dst, block[0])
+	}
+
+	// The repeated offsets are only updated by compressed blocks.
+	reps := e.reps
+	e.findSequences(src, start, end)
+	e.blockBuf = e.appendLiterals(e.blockBuf[:0])
+	e.blockBuf = e.appendSequences(e.blockBuf)
+	if len(e.blockBuf) >= len(block) {
+		e.reps = reps
+		dst = appendBlockHeader(dst, last, rawBlock, len(block))
+		return append(dst, block...)
+	}
+	dst = appendBlockHeader(dst, last, compressedBlock, len(e.blockBuf))
+	return append(dst, e.blockBuf...)
+}
+
+// findSequences greedily finds matches within src[start:end], recording the
+// sequences and the literals which are not covered by matches. A match at the
+// most recent offset is preferred, as it is cheap to code.
+func (e *encoder) findSequences(src []byte, start, end int) {
+	e.seqs = e.seqs[:0]
+	e.literals = e.literals[:0]
+	anchor := start
+	limit := end - minMatch
+	for i := start; i <= limit; {
+		seq := binary.LittleEndian.Uint32(src[i:])
+		h := e.hash(seq)
+		ref := int(e.table[h]) - 1
+		e.table[h] = int32(i + 1)
+		if r := i - int(e.reps[0]); i > anchor && r >= 0 && binary.LittleEndian.Uint32(src[r:]) == seq {
+			ref = r
+		} else if ref < 0 || i-ref > maxMatchOffset || binary.LittleEndian.Uint32(src[ref:]) != seq {
+			i += 1 + (i-anchor)>>skipTrigger
+			continue
+		}
+
+		// Extend the match backwards over any pending literals, and then
+		// forwards.
+		for i > anchor && ref > 0 && src[i-1] == src[ref-1] {
+			i--
+			ref--
+		}
+		n := minMatch
+		for i+n < end && src[i+n] == src[ref+n] {
+			n++
+		}
+
+		e.literals = append(e.literals, src[anchor:i]...)
+		e.seqs = append(e.seqs, sequence{
+			litLen:      uint32(i - anchor),
+			matchLen:    uint32(n),
+			offsetValue: e.offsetValue(uint32(i-ref), uint32(i-anchor)),
+		})
+		i += n
+		anchor = i
+	}
+	e.literals = append(e.literals, src[anchor:end]...)
+}
+
+// offsetValue returns the coded value of an offset, updating the repeated
+// offsets as the decoder will.
+func (e *encoder) offsetValue(offset, litLen uint32) uint32 {
+	reps := &e.reps
+	if litLen == 0 {
+		// Without literals the repeated offsets are shifted by one, with the
+		// last standing for the most recent offset minus one.
+		switch offset {
+		case reps[1]:
+			reps[1], reps[0] = reps[0], offset
+			return 1
+		case reps[2]:
+			reps[2], reps[1], reps[0] = reps[1], reps[0], offset
+			return 2
+		case reps[0] - 1:
+			reps[2], reps[1], reps[0] = reps[1], reps[0], offset
+			return 3
+		}
+	} else {
+		switch offset {
+		case reps[0]:
+			return 1
+		case reps[1]:
+			reps[1], reps[0] = reps[0], offset
+			return 2
+		case reps[2]:
+			reps[2], reps[1], reps[0] = reps[1], reps[0], offset
+			return 3
+		}
+	}
+	reps[2], reps[1], reps[0] = reps[1], reps[0], offset
+	return offset + 3
+}
+
+// appendLiterals appends the literals section of a block.
+func (e *encoder) appendLiterals(dst []byte) []byte {
+	lits := e.literals
+	if len(lits) >= minHuffLiterals {
+		var counts [256]int
+		for _, b := range lits {
+			counts[b]++
+		}
+		if counts[lits[0]] == len(lits) {
+			dst = appendLiteralsHeader(dst, rleLiterals, len(lits))
+			return append(dst, lits[0])
+		}
+		if e.huff.build(&counts) {
+			if b, ok := e.appendHuffLiterals(dst); ok {
+				return b
+			}
+		}
+	}
+	dst = appendLiteralsHeader(dst, rawLiterals, len(lits))
+	return append(dst, lits...)
+}
+
+// appendLiteralsHeader appends the header of a raw or RLE literals section.
+func appendLiteralsHeader(dst []byte, litType, size int) []byte {
+	switch {
+	case size < 1<<5:
+		return append(dst, byte(litType|size<<3))
+	case size < 1<<12:
+		return append(dst, byte(litType|1<<2|size<<4), byte(size>>4))
+	default:
+		return append(dst, byte(litType|3<<2|size<<4), byte(size>>4), byte(size>>12))
+	}
+}
+
+// appendHuffLiterals appends a Huffman coded literals section, returning
+// false if it would not be smaller than the raw literals.
+func (e *encoder) appendHuffLiterals(dst []byte) ([]byte, bool) {
+	lits := e.literals
+	buf, ok := e.huff.appendTable(e.streamBuf[:0])
+	if !ok {
+		return dst, false
+	}
+	streams := 4
+	if len(lits) < 256 {
+		streams = 1
+	}
+	if streams == 1 {
+		buf = e.huff.appendStream(buf, lits)
+	} else {
+		jump := len(buf)
+		buf = append(buf, 0, 0, 0, 0, 0, 0)
+		segment := (len(lits) + 3) / 4
+		for i := 0; i < 4; i++ {
+			streamStart := len(buf)
+			end := segment * (i + 1)
+			if i == 3 {
+				end = len(lits)
+			}
+			buf = e.huff.appendStream(buf, lits[segment*i:end])
+			if i < 3 {
+				size := len(buf) - streamStart
+				if size > 1<<16-1 {
+					return dst, false
+				}
+				binary.LittleEndian.PutUint16(buf[jump+2*i:], uint16(size))
+			}
+		}
+	}
+	e.streamBuf = buf
+
+	regenSize, compSize := len(lits), len(buf)
+	if compSize >= regenSize {
+		return dst, false
+	}
+	const litType = compressedLiterals
+	switch {
+	case streams == 1:
+		v := litType | regenSize<<4 | compSize<<14
+		dst = append(dst, byte(v), byte(v>>8), byte(v>>16))
+	case regenSize < 1<<10 && compSize < 1<<10:
+		v := litType | 1<<2 | regenSize<<4 | compSize<<14
+		dst = append(dst, byte(v), byte(v>>8), byte(v>>16))
+	case regenSize < 1<<14 && compSize < 1<<14:
+		v := litType | 2<<2 | regenSize<<4 | compSize<<18
+		dst = append(dst, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+	default:
+		v := uint64(litType | 3<<2 | regenSize<<4 | compSize<<22)
+		dst = append(dst, byte(v), byte(v>>8), byte(v>>16), byte(v>>24), byte(v>>32))
+	}
+	return append(dst, buf...), true
+}
+
+// findCode returns the code whose baseline is the largest which is <= v.
+func findCode(codes []seqCode, v uint32) uint8 {
+	i := sort.Search(len(codes), func(i int) bool {
+		return codes[i].baseline > v
+	})
+	return uint8(i - 1)
+}
+
+// Lookup tables for the codes of small lengths. Larger lengths have a code for
+// each power of two.
+var litLenCodeTable [64]uint8
+var matchLenCodeTable [128]uint8
+
+func init() {
+	for v := range litLenCodeTable {
+		litLenCodeTable[v] = findCode(litLenCodes[:], uint32(v))
+	}
+	for v := range matchLenCodeTable {
+		matchLenCodeTable[v] = findCode(matchLenCodes[:], uint32(v+3))
+	}
+}
+
+func litLenCode(litLen uint32) uint8 {
+	if litLen < 64 {
+		return litLenCodeTable[litLen]
+	}
+	return uint8(bits.Len32(litLen)) + 18
+}
+
+func matchLenCode(matchLen uint32) uint8 {
+	if v := matchLen - 3; v < 128 {
+		return matchLenCodeTable[v]
+	}
+	return uint8(bits.Len32(matchLen-3)) + 35
+}
+
+// appendSequences appends the sequences section of a block.
+func (e *encoder) appendSequences(dst []byte) []byte {
+	n := len(e.seqs)
+	switch {
+	case n < 128:
+		dst = append(dst, byte(n))
+	case n < 0x7f00:
+		dst = append(dst, byte(n>>8+128), byte(n))
+	default:
+		dst = append(dst, 255, byte(n-0x7f00), byte((n-0x7f00)>>8))
+	}
+	if n == 0 {
+		return dst
+	}
+
+	e.llCodes, e.mlCodes, e.ofCodes = e.llCodes[:0], e.mlCodes[:0], e.ofCodes[:0]
+	for _, s := range e.seqs {
+		e.llCodes = append(e.llCodes, litLenCode(s.litLen))
+		e.mlCodes = append(e.mlCodes, matchLenCode(s.matchLen))
+		e.ofCodes = append(e.ofCodes, uint8(bits.Len32(s.offsetValue)-1))
+	}
+
+	modes := len(dst)
+	dst = append(dst, 0)
+	var tables [3]*fseEncTable
+	for kind, codes := range [3][]uint8{e.llCodes, e.ofCodes, e.mlCodes} {
+		var mode int
+		mode, tables[kind], dst = appendSeqTable(dst, kind, codes)
+		dst[modes] |= byte(mode << uint(6-2*kind))
+	}
+
+	w := backwardBitWriter{buf: dst}
+	var ll, of, ml fseEncoder
+	addExtra := func(i int) {
+		s := e.seqs[i]
+		llCode := litLenCodes[e.llCodes[i]]
+		w.add(uint64(s.litLen-llCode.baseline), uint(llCode.bits))
+		mlCode := matchLenCodes[e.mlCodes[i]]
+		w.add(uint64(s.matchLen-mlCode.baseline), uint(mlCode.bits))
+		w.add(uint64(s.offsetValue), uint(e.ofCodes[i]))
+	}
+	// The sequences are encoded in reverse, as they are decoded starting from
+	// the end of the bitstream.
+	ml.init(tables[matchLenKind], e.mlCodes[n-1])
+	of.init(tables[offsetKind], e.ofCodes[n-1])
+	ll.init(tables[litLenKind], e.llCodes[n-1])
+	addExtra(n - 1)
+	for i := n - 2; i >= 0; i-- {
+		of.encode(&w, e.ofCodes[i])
+		ml.encode(&w, e.mlCodes[i])
+		ll.encode(&w, e.llCodes[i])
+		addExtra(i)
+	}
+	ml.flush(&w)
+	of.flush(&w)
+	ll.flush(&w)
+	return w.close()
+}
+
+// appendSeqTable chooses the table used to code the sequence codes of a kind,
+// appending its description. A table fitted to the codes is used if it is
+// estimated to be cheaper than the predefined table, including the cost of its
+// description.
+func appendSeqTable(dst []byte, kind int, codes []uint8) (int, *fseEncTable, []byte) {
+	counts := make([]int, maxSymbols[kind]+1)
+	maxCode, distinct := 0, 0
+	for _, c := range codes {
+		if counts[c] == 0 {
+			distinct++
+		}
+		counts[c]++
+		if int(c) > maxCode {
+			maxCode = int(c)
+		}
+	}
+	counts = counts[:maxCode+1]
+	if distinct == 1 {
+		// A single distinct code is coded using no bits.
+		norm := make([]int16, maxCode+1)
+		norm[maxCode] = 1
+		t, _ := buildFSEEncTable(norm, 0)
+		return rleMode, t, append(dst, byte(maxCode))
+	}
+
+	// cost estimates the number of bits used to code the codes using a table.
+	cost := func(norm []int16, accuracyLog int) float64 {
+		var bits float64
+		for c, n := range counts {
+			if n == 0 {
+				continue
+			}
+			if c >= len(norm) || norm[c] == 0 {
+				return math.Inf(1)
+			}
+			p := float64(norm[c])
+			if p < 0 {
+				p = 1
+			}
+			bits += float64(n) * (float64(accuracyLog) - math.Log2(p))
+		}
+		return bits
+	}
+
+	accuracyLog := bits.Len(uint(len(codes))) - 1
+	if accuracyLog < 5 {
+		accuracyLog = 5
+	}
+	for accuracyLog < maxAccuracyLogs[kind] && 1<<uint(accuracyLog) < 2*distinct {
+		accuracyLog++
+	}
+	if accuracyLog > maxAccuracyLogs[kind] {
+		accuracyLog = maxAccuracyLogs[kind]
+	}
+	norm := normalizeCounts(counts, accuracyLog)
+	start := len(dst)
+	dst = appendFSETable(dst, norm, accuracyLog)
+	customCost := float64(8*(len(dst)-start)) + cost(norm, accuracyLog)
+	if customCost < cost(predefinedNorms[kind], predefinedAccuracyLogs[kind]) {
+		if t, err := buildFSEEncTable(norm, accuracyLog); err == nil {
+			return fseMode, t, dst
+		}
+	}
+	return predefinedMode, predefinedEncTables[kind], dst[:start]
+}
@@ -0,0 +1,362 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package zstd
+
+import "math/bits"
+
+// An FSE (finite state entropy) table is described by the normalized
+// probability of each symbol, which sum to 1<<accuracyLog. A probability of -1
+// denotes a "less than 1" probability: the symbol occupies a single state.
+
+// fseEntry is a state of an FSE decoding table. Decoding a state yields its
+// symbol; the next state is baseline plus the next nbBits bits.
+type fseEntry struct {
+	symbol   uint8
+	nbBits   uint8
+	baseline uint16
+}
+
+type fseTable struct {
+	accuracyLog int
+	entries     []fseEntry
+}
+
+// spreadSymbols distributes the symbols across the states of a table.
+func spreadSymbols(norm []int16, accuracyLog int) ([]uint8, error) {
+	tableSize := 1 << uint(accuracyLog)
+	symbols := make([]uint8, tableSize)
+	highThreshold := tableSize - 1
+	var total int
+	for s, p := range norm {
+		if p == -1 {
+			symbols[highThreshold] = uint8(s)
+			highThreshold--
+			total++
+		} else {
+			total += int(p)
+		}
+	}
+	if total != tableSize {
+		return nil, errCorrupt
+	}
+
+	mask := tableSize - 1
+	step := tableSize>>1 + tableSize>>3 + 3
+	pos := 0
+	for s, p := range norm {
+		for i := 0; i < int(p); i++ {
+			symbols[pos] = uint8(s)
+			pos = (pos + step) & mask
+			for pos > highThreshold {
+				pos = (pos + step) & mask
+			}
+		}
+	}
+	if pos != 0 {
+		return nil, errCorrupt
+	}
+	return symbols, nil
+}
+
+func buildFSETable(t *fseTable, norm []int16, accuracyLog int) error {
+	symbols, err := spreadSymbols(norm, accuracyLog)
+	if err != nil {
+		return err
+	}
+	tableSize := 1 << uint(accuracyLog)
+	next := make([]uint16, len(norm))
+	for s, p := range norm {
+		if p == -1 {
+			next[s] = 1
+		} else {
+			next[s] = uint16(p)
+		}
+	}
+	t.accuracyLog = accuracyLog
+	if cap(t.entries) < tableSize {
+		t.entries = make([]fseEntry, tableSize)
+	}
+	t.entries = t.entries[:tableSize]
+	for i, s := range symbols {
+		n := next[s]
+		next[s]++
+		nbBits := accuracyLog - (bits.Len16(n) - 1)
+		t.entries[i] = fseEntry{
+			symbol:   s,
+			nbBits:   uint8(nbBits),
+			baseline: uint16(int(n)<<uint(nbBits) - tableSize),
+		}
+	}
+	return nil
+}
+
+// buildRLETable builds a table which always decodes the same symbol.
+func buildRLETable(t *fseTable, symbol uint8) {
+	t.accuracyLog = 0
+	t.entries = append(t.entries[:0], fseEntry{symbol: symbol})
+}
+
+// readFSETable reads an FSE table description from the start of src,
+// returning the number of bytes read.
+func readFSETable(t *fseTable, src []byte, maxSymbol, maxAccuracyLog int) (int, error) {
+	r := forwardBitReader{b: src}
+	accuracyLog := int(r.read(4)) + 5
+	if accuracyLog > maxAccuracyLog {
+		return 0, errCorrupt
+	}
+	remaining := 1<<uint(accuracyLog) + 1
+	threshold := 1 << uint(accuracyLog)
+	nbBits := accuracyLog + 1
+	var norm [256]int16
+	symbol := 0
+	for remaining > 1 && symbol <= maxSymbol {
+		max := 2*threshold - 1 - remaining
+		var count int
+		if v := int(r.peek()) & (threshold - 1); v < max {
+			count = v
+			r.skip(nbBits - 1)
+		} else {
+			count = int(r.peek()) & (2*threshold - 1)
+			if count >= threshold {
+				count -= max
+			}
+			r.skip(nbBits)
+		}
+		count--
+		if count < 0 {
+			remaining += count
+		} else {
+			remaining -= count
+		}
+		norm[symbol] = int16(count)
+		symbol++
+
+		if count == 0 {
+			// A zero probability is followed by 2-bit repeat flags giving the
+			// number of additional zero probabilities.
+			for {
+				repeat := int(r.read(2))
+				symbol += repeat
+				if repeat != 3 {
+					break
+				}
+			}
+		}
+		for remaining < threshold {
+			nbBits--
+			threshold >>= 1
+		}
+		if r.bytesRead() > len(src) {
+			return 0, errCorrupt
+		}
+	}
+	if remaining != 1 || symbol > maxSymbol+1 {
+		return 0, errCorrupt
+	}
+	if err := buildFSETable(t, norm[:symbol], accuracyLog); err != nil {
+		return 0, err
+	}
+	return r.bytesRead(), nil
+}
+
+// fseSymbolTransform holds the parameters for encoding a symbol.
+type fseSymbolTransform struct {
+	deltaFindState int32
+	deltaNbBits    uint32
+}
+
+// fseEncTable is an FSE encoding table. Encoder states are offset by the table
+// size, so a state occupies accuracyLog+1 bits.
+type fseEncTable struct {
+	accuracyLog int
+	states      []uint16
+	symbols     []fseSymbolTransform
+}
+
+func buildFSEEncTable(norm []int16, accuracyLog int) (*fseEncTable, error) {
+	symbols, err := spreadSymbols(norm, accuracyLog)
+	if err != nil {
+		return nil, err
+	}
+	tableSize := 1 << uint(accuracyLog)
+	cumul := make([]int, len(norm)+1)
+	for s, p := range norm {
+		if p == -1 {
+			cumul[s+1] = cumul[s] + 1
+		} else {
+			cumul[s+1] = cumul[s] + int(p)
+		}
+	}
+	t := &fseEncTable{
+		accuracyLog: accuracyLog,
+		states:      make([]uint16, tableSize),
+		symbols:     make([]fseSymbolTransform, len(norm)),
+	}
+	for i, s := range symbols {
+		t.states[cumul[s]] = uint16(tableSize + i)
+		cumul[s]++
+	}
+	total := 0
+	for s, p := range norm {
+		tt := &t.symbols[s]
+		switch p {
+		case 0:
+			tt.deltaNbBits = uint32((accuracyLog+1)<<16 - tableSize)
+		case -1, 1:
+			tt.deltaNbBits = uint32(accuracyLog<<16 - tableSize)
+			tt.deltaFindState = int32(total - 1)
+			total++
+		default:
+			maxBitsOut := accuracyLog - (bits.Len16(uint16(p-1)) - 1)
+			minStatePlus := int(p) << uint(maxBitsOut)
+			tt.deltaNbBits = uint32(maxBitsOut<<16 - minStatePlus)
+			tt.deltaFindState = int32(total - int(p))
+			total += int(p)
+		}
+	}
+	return t, nil
+}
+
+// fseEncoder encodes symbols in reverse order using an fseEncTable.
+type fseEncoder struct {
+	t     *fseEncTable
+	state uint32
+}
+
+// init initializes the encoder with the last symbol to be decoded.
+func (e *fseEncoder) init(t *fseEncTable, symbol uint8) {
+	e.t = t
+	tt := t.symbols[symbol]
+	nbBitsOut := (tt.deltaNbBits + 1<<15) >> 16
+	value := nbBitsOut<<16 - tt.deltaNbBits
+	e.state = uint32(t.states[int32(value>>nbBitsOut)+tt.deltaFindState])
+}
+
+// encode writes the bits which lead from the state of symbol to the current
+// state.
+func (e *fseEncoder) encode(w *backwardBitWriter, symbol uint8) {
+	tt := e.t.symbols[symbol]
+	nbBitsOut := (e.state + tt.deltaNbBits) >> 16
+	w.add(uint64(e.state), uint(nbBitsOut))
+	e.state = uint32(e.t.states[int32(e.state>>nbBitsOut)+tt.deltaFindState])
+}
+
+// flush writes the initial state for the decoder.
+func (e *fseEncoder) flush(w *backwardBitWriter) {
+	w.add(uint64(e.state), uint(e.t.accuracyLog))
+}
+
+// normalizeCounts scales the symbol counts to probabilities which sum to
+// 1<<accuracyLog. Every symbol which occurs is given a probability of at least
+// one.
+func normalizeCounts(counts []int, accuracyLog int) []int16 {
+	tableSize := 1 << uint(accuracyLog)
+	total := 0
+	for _, c := range counts {
+		total += c
+	}
+	norm := make([]int16, len(counts))
+	sum := 0
+	largest := 0
+	for s, c := range counts {
+		if c == 0 {
+			continue
+		}
+		p := (c*tableSize + total/2) / total
+		if p < 1 {
+			p = 1
+		}
+		norm[s] = int16(p)
+		sum += p
+		if c > counts[largest] {
+			largest = s
+		}
+	}
+	// Correct the rounding error using the largest probabilities, which are
+	// least affected by it.
+	for sum != tableSize {
+		if sum < tableSize {
+			norm[largest] += int16(tableSize - sum)
+			sum = tableSize
+			break
+		}
+		best := -1
+		for s, p := range norm {
+			if p > 1 && (best < 0 || p > norm[best]) {
+				best = s
+			}
+		}
+		d := sum - tableSize
+		if d > int(norm[best])-1 {
+			d = int(norm[best]) - 1
+		}
+		norm[best] -= int16(d)
+		sum -= d
+	}
+	return norm
+}
+
+// appendFSETable appends the description of an FSE table. It is the inverse
+// of readFSETable.
+func appendFSETable(dst []byte, norm []int16, accuracyLog int) []byte {
+	var acc uint64
+	var n uint
+	add := func(v int, nb int) {
+		acc |= uint64(v) << n
+		n += uint(nb)
+		for n >= 8 {
+			dst = append(dst, byte(acc))
+			acc >>= 8
+			n -= 8
+		}
+	}
+	add(accuracyLog-5, 4)
+
+	tableSize := 1 << uint(accuracyLog)
+	remaining := tableSize + 1
+	threshold := tableSize
+	nbBits := accuracyLog + 1
+	symbol := 0
+	previous0 := false
+	for remaining > 1 {
+		if previous0 {
+			start := symbol
+			for norm[symbol] == 0 {
+				symbol++
+			}
+			for symbol >= start+3 {
+				start += 3
+				add(3, 2)
+			}
+			add(symbol-start, 2)
+		}
+		count := int(norm[symbol])
+		symbol++
+		max := 2*threshold - 1 - remaining
+		if count < 0 {
+			remaining += count
+		} else {
+			remaining -= count
+		}
+		count++
+		if count >= threshold {
+			count += max
+		}
+		if count < max {
+			add(count, nbBits-1)
+		} else {
+			add(count, nbBits)
+		}
+		previous0 = count == 1
+		for remaining < threshold {
+			nbBits--
+			threshold >>= 1
+		}
+	}
+	if n > 0 {
+		dst = append(dst, byte(acc))
+	}
+	return dst
+}
@@ -0,0 +1,403 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package zstd
+
+import (
+	"math/bits"
+	"sort"
+)
+
+// maxHuffBits is the maximum length of a Huffman code.
+const maxHuffBits = 11
+
+type huffEntry struct {
+	symbol uint8
+	nbBits uint8
+}
+
+// huffTable is a Huffman decoding table, indexed by the next maxBits bits of
+// the stream.
+type huffTable struct {
+	maxBits int
+	entries []huffEntry
+}
+
+// huffStarts returns the index of the first decoding table entry of each
+// symbol, given the symbol weights. Symbols with higher weights (shorter
+// codes) are placed after symbols with lower weights, and symbols of the same
+// weight are placed in increasing order.
+func huffStarts(weights []uint8, maxBits int) []int {
+	var rankStart [maxHuffBits + 2]int
+	for _, w := range weights {
+		if w > 0 {
+			rankStart[w+1] += 1 << (w - 1)
+		}
+	}
+	for w := 1; w < len(rankStart); w++ {
+		rankStart[w] += rankStart[w-1]
+	}
+	starts := make([]int, len(weights))
+	for s, w := range weights {
+		if w > 0 {
+			starts[s] = rankStart[w]
+			rankStart[w] += 1 << (w - 1)
+		}
+	}
+	return starts
+}
+
+// buildHuffTable builds the decoding table for a complete set of weights.
+func buildHuffTable(t *huffTable, weights []uint8, maxBits int) {
+	t.maxBits = maxBits
+	n := 1 << uint(maxBits)
+	if cap(t.entries) < n {
+		t.entries = make([]huffEntry, n)
+	}
+	t.entries = t.entries[:n]
+	for s, start := range huffStarts(weights, maxBits) {
+		w := weights[s]
+		if w == 0 {
+			continue
+		}
+		e := huffEntry{symbol: uint8(s), nbBits: uint8(maxBits + 1 - int(w))}
+		for i := start; i < start+1<<(w-1); i++ {
+			t.entries[i] = e
+		}
+	}
+}
+
+// readHuffTable reads a Huffman tree description from the start of src,
+// returning the number of bytes read.
+func readHuffTable(t *huffTable, src []byte) (int, error) {
+	weights, n, err := readHuffWeights(src)
+	if err != nil {
+		return 0, err
+	}
+	if len(weights) > 255 {
+		return 0, errCorrupt
+	}
+
+	// The weight of the last symbol is implied by the others, as the code must
+	// be complete.
+	var total uint32
+	for _, w := range weights {
+		if w > maxHuffBits {
+			return 0, errCorrupt
+		}
+		if w > 0 {
+			total += 1 << (w - 1)
+		}
+	}
+	if total == 0 {
+		return 0, errCorrupt
+	}
+	maxBits := bits.Len32(total)
+	if maxBits > maxHuffBits {
+		return 0, errCorrupt
+	}
+	rest := uint32(1)<<uint(maxBits) - total
+	if rest&(rest-1) != 0 {
+		return 0, errCorrupt
+	}
+	weights = append(weights, uint8(bits.Len32(rest)))
+	buildHuffTable(t, weights, maxBits)
+	return n, nil
+}
+
+// readHuffWeights reads the explicit symbol weights of a Huffman tree
+// description from the start of src, returning the number of bytes read.
+func readHuffWeights(src []byte) ([]uint8, int, error) {
+	if len(src) == 0 {
+		return nil, 0, errCorrupt
+	}
+	var weights []uint8
+	header := int(src[0])
+	n := 1
+	if header < 128 {
+		// The weights are FSE compressed, using two interleaved states.
+		n += header
+		if n > len(src) {
+			return nil, 0, errCorrupt
+		}
+		var ft fseTable
+		m, err := readFSETable(&ft, src[1:n], 255, 6)
+		if err != nil {
+			return nil, 0, err
+		}
+		var r backwardBitReader
+		if err := r.init(src[1+m : n]); err != nil {
+			return nil, 0, err
+		}
+		s1 := r.read(ft.accuracyLog)
+		s2 := r.read(ft.accuracyLog)
+		decode := func(state *uint64) {
+			e := ft.entries[*state]
+			weights = append(weights, e.symbol)
+			*state = uint64(e.baseline) + r.read(int(e.nbBits))
+		}
+		for len(weights) < 255 {
+			decode(&s1)
+			if r.overflow() {
+				weights = append(weights, ft.entries[s2].symbol)
+				break
+			}
+			decode(&s2)
+			if r.overflow() {
+				weights = append(weights, ft.entries[s1].symbol)
+				break
+			}
+		}
+	} else {
+		// The weights are stored directly as 4-bit values.
+		count := header - 127
+		n += (count + 1) / 2
+		if n > len(src) {
+			return nil, 0, errCorrupt
+		}
+		weights = make([]uint8, count)
+		for i := range weights {
+			b := src[1+i/2]
+			if i%2 == 0 {
+				weights[i] = b >> 4
+			} else {
+				weights[i] = b & 0xf
+			}
+		}
+	}
+	return weights, n, nil
+}
+
+// decodeStream decodes len(dst) symbols from a single Huffman coded stream.
+func (t *huffTable) decodeStream(dst, src []byte) error {
+	var r backwardBitReader
+	if err := r.init(src); err != nil {
+		return err
+	}
+	for i := range dst {
+		e := t.entries[r.peek(t.maxBits)]
+		dst[i] = e.symbol
+		r.pos -= int(e.nbBits)
+	}
+	if r.pos != 0 {
+		return errCorrupt
+	}
+	return nil
+}
+
+// huffEncoder holds a Huffman code for the literals of a block.
+type huffEncoder struct {
+	maxBits int
+	codes   [256]uint16
+	lengths [256]uint8
+	// weights holds the weights of symbols up to and including the last
+	// symbol which occurs in the literals.
+	weights []uint8
+}
+
+// build computes a length-limited Huffman code from the symbol counts. It
+// returns false if the literals do not contain at least two distinct symbols.
+func (e *huffEncoder) build(counts *[256]int) bool {
+	var syms []int
+	for s, c := range counts {
+		if c > 0 {
+			syms = append(syms, s)
+		}
+	}
+	if len(syms) < 2 {
+		return false
+	}
+	sort.SliceStable(syms, func(i, j int) bool {
+		return counts[syms[i]] < counts[syms[j]]
+	})
+
+	// Build the tree using two queues: the sorted leaves, and the internal
+	// nodes, which are created in increasing order of count.
+	type node struct {
+		count  int
+		parent int
+	}
+	n := len(syms)
+	nodes := make([]node, n, 2*n-1)
+	for i, s := range syms {
+		nodes[i] = node{count: counts[s]}
+	}
+	leaf, internal := 0, n
+	pop := func() int {
+		if leaf < n && (internal >= len(nodes) || nodes[leaf].count <= nodes[internal].count) {
+			leaf++
+			return leaf - 1
+		}
+		internal++
+		return internal - 1
+	}
+	for len(nodes) < 2*n-1 {
+		a, b := pop(), pop()
+		nodes = append(nodes, node{count: nodes[a].count + nodes[b].count})
+		nodes[a].parent = len(nodes) - 1
+		nodes[b].parent = len(nodes) - 1
+	}
+	depth := make([]int, len(nodes))
+	for i := len(nodes) - 2; i >= 0; i-- {
+		depth[i] = depth[nodes[i].parent] + 1
+	}
+
+	// Limit the code lengths. Codes which are too long are shortened, and the
+	// resulting overflow of the Kraft sum is repaid by lengthening the longest
+	// codes which can still be lengthened. Symbols are ordered by increasing
+	// count, so the least frequent symbols are lengthened first.
+	lengths := depth[:n]
+	const one = 1 << maxHuffBits
+	kraft := 0
+	for i := range lengths {
+		if lengths[i] > maxHuffBits {
+			lengths[i] = maxHuffBits
+		}
+		kraft += one >> uint(lengths[i])
+	}
+	for kraft > one {
+		best := -1
+		for i := range lengths {
+			if lengths[i] < maxHuffBits && (best < 0 || lengths[i] > lengths[best]) {
+				best = i
+			}
+		}
+		lengths[best]++
+		kraft -= one >> uint(lengths[best])
+	}
+	// Shorten codes to make the code complete, as required by the implied
+	// weight of the last symbol. The Kraft sum is a multiple of the unit of the
+	// longest code, so shortening the longest codes always succeeds.
+	for kraft < one {
+		best := -1
+		for i := n - 1; i >= 0; i-- {
+			if lengths[i] > 1 && kraft+one>>uint(lengths[i]) <= one &&
+				(best < 0 || lengths[i] > lengths[best]) {
+				best = i
+			}
+		}
+		kraft += one >> uint(lengths[best])
+		lengths[best]--
+	}
+
+	e.maxBits = 0
+	for _, l := range lengths {
+		if l > e.maxBits {
+			e.maxBits = l
+		}
+	}
+	maxSymbol := 0
+	e.lengths = [256]uint8{}
+	for i, s := range syms {
+		e.lengths[s] = uint8(lengths[i])
+		if s > maxSymbol {
+			maxSymbol = s
+		}
+	}
+	e.weights = e.weights[:0]
+	for s := 0; s <= maxSymbol; s++ {
+		var w uint8
+		if l := e.lengths[s]; l > 0 {
+			w = uint8(e.maxBits + 1 - int(l))
+		}
+		e.weights = append(e.weights, w)
+	}
+	for s, start := range huffStarts(e.weights, e.maxBits) {
+		if l := e.lengths[s]; l > 0 {
+			e.codes[s] = uint16(start >> uint(e.maxBits-int(l)))
+		}
+	}
+	return true
+}
+
+// appendTable appends the Huffman tree description, using whichever of the
+// direct and FSE compressed representations of the weights is smaller. It
+// returns false if the weights cannot be represented.
+func (e *huffEncoder) appendTable(dst []byte) ([]byte, bool) {
+	// The weight of the last symbol is implied.
+	weights := e.weights[:len(e.weights)-1]
+	start := len(dst)
+	dst, ok := appendFSEWeights(dst, weights)
+	if len(weights) > 128 || (ok && len(dst)-start <= 1+(len(weights)+1)/2) {
+		return dst, ok
+	}
+	dst = append(dst[:start], byte(127+len(weights)))
+	for i := 0; i < len(weights); i += 2 {
+		b := weights[i] << 4
+		if i+1 < len(weights) {
+			b |= weights[i+1]
+		}
+		dst = append(dst, b)
+	}
+	return dst, true
+}
+
+// appendFSEWeights appends the weights compressed using an FSE table, as two
+// interleaved states. It returns false if the weights cannot be compressed.
+func appendFSEWeights(dst []byte, weights []uint8) ([]byte, bool) {
+	const accuracyLog = 6
+	n := len(weights)
+	var counts [maxHuffBits + 1]int
+	maxWeight := 0
+	for _, w := range weights {
+		counts[w]++
+		if int(w) > maxWeight {
+			maxWeight = int(w)
+		}
+	}
+	if n < 2 || counts[weights[0]] == n {
+		return dst, false
+	}
+	norm := normalizeCounts(counts[:maxWeight+1], accuracyLog)
+	t, err := buildFSEEncTable(norm, accuracyLog)
+	if err != nil {
+		return dst, false
+	}
+
+	start := len(dst)
+	dst = appendFSETable(append(dst, 0), norm, accuracyLog)
+	w := backwardBitWriter{buf: dst}
+	// The decoder alternates between the states, starting with the first, so
+	// the weights at even indexes are coded by the first state. The last
+	// weight of each state determines its final state.
+	var s1, s2 fseEncoder
+	for i := n - 1; i >= 0; i-- {
+		s := &s1
+		if i%2 == 1 {
+			s = &s2
+		}
+		if i >= n-2 {
+			s.init(t, weights[i])
+		} else {
+			s.encode(&w, weights[i])
+		}
+	}
+	s2.flush(&w)
+	s1.flush(&w)
+	dst = w.close()
+	size := len(dst) - start - 1
+	if size >= 128 {
+		return dst[:start], false
+	}
+	dst[start] = byte(size)
+
+	// The decoder detects the end of the weights when it reads past the end
+	// of the bitstream, which fails to happen if the final state transitions
+	// read no bits. Verify that the weights decode correctly.
+	decoded, _, err := readHuffWeights(dst[start:])
+	if err != nil || string(decoded) != string(weights) {
+		return dst[:start], false
+	}
+	return dst, true
+}
+
+// appendStream appends a single Huffman coded stream of the literals.
+func (e *huffEncoder) appendStream(dst, lits []byte) []byte {
+	w := backwardBitWriter{buf: dst}
+	for i := len(lits) - 1; i >= 0; i-- {
+		s := lits[i]
+		w.add(uint64(e.codes[s]), uint(e.lengths[s]))
+	}
+	return w.close()
+}
@@ -0,0 +1,119 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+// Package zstd implements the Zstandard compression format, as specified by
+// RFC 8478.
+//
+// The decoder supports the complete format, including dictionaries, with the
+// exception of verification of the optional content checksum. The encoder is a
+// simple greedy encoder which favors repeated offsets. Literals are Huffman
+// coded, and sequences are coded using either the predefined FSE tables or
+// tables fitted to the block. Its output is decodable by the reference
+// implementation. Both raw content dictionaries and those built by the
+// reference implementation may be used for compression, though the encoder
+// only makes use of their content and repeated offsets.
+package zstd // import "github.com/petermattis/pebble/internal/zstd"
+
+import "errors"
+
+const (
+	frameMagic         = 0xfd2fb528
+	skippableMagic     = 0x184d2a50
+	skippableMagicMask = 0xfffffff0
+
+	// maxBlockSize is the maximum size of the decoded contents of a block.
+	maxBlockSize = 128 << 10
+
+	// Block types.
+	rawBlock        = 0
+	rleBlock        = 1
+	compressedBlock = 2
+
+	// Literals section types.
+	rawLiterals        = 0
+	rleLiterals        = 1
+	compressedLiterals = 2
+	treelessLiterals   = 3
+
+	// Sequence table modes.
+	predefinedMode = 0
+	rleMode        = 1
+	fseMode        = 2
+	repeatMode     = 3
+
+	// The kinds of symbol in a sequence.
+	litLenKind   = 0
+	offsetKind   = 1
+	matchLenKind = 2
+
+	maxOffsetCode = 31
+)
+
+var errCorrupt = errors.New("zstd: corrupt input")
+
+// seqCode is the baseline value of a literal length or match length code, and
+// the number of additional bits which are added to the baseline.
+type seqCode struct {
+	baseline uint32
+	bits     uint8
+}
+
+var litLenCodes = [36]seqCode{
+	{0, 0}, {1, 0}, {2, 0}, {3, 0}, {4, 0}, {5, 0}, {6, 0}, {7, 0},
+	{8, 0}, {9, 0}, {10, 0}, {11, 0}, {12, 0}, {13, 0}, {14, 0}, {15, 0},
+	{16, 1}, {18, 1}, {20, 1}, {22, 1}, {24, 2}, {28, 2}, {32, 3}, {40, 3},
+	{48, 4}, {64, 6}, {128, 7}, {256, 8}, {512, 9}, {1024, 10}, {2048, 11},
+	{4096, 12}, {8192, 13}, {16384, 14}, {32768, 15}, {65536, 16},
+}
+
+var matchLenCodes = [53]seqCode{
+	{3, 0}, {4, 0}, {5, 0}, {6, 0}, {7, 0}, {8, 0}, {9, 0}, {10, 0},
+	{11, 0}, {12, 0}, {13, 0}, {14, 0}, {15, 0}, {16, 0}, {17, 0}, {18, 0},
+	{19, 0}, {20, 0}, {21, 0}, {22, 0}, {23, 0}, {24, 0}, {25, 0}, {26, 0},
+	{27, 0}, {28, 0}, {29, 0}, {30, 0}, {31, 0}, {32, 0}, {33, 0}, {34, 0},
+	{35, 1}, {37, 1}, {39, 1}, {41, 1}, {43, 2}, {47, 2}, {51, 3}, {59, 3},
+	{67, 4}, {83, 4}, {99, 5}, {131, 7}, {259, 8}, {515, 9}, {1027, 10},
+	{2051, 11}, {4099, 12}, {8195, 13}, {16387, 14}, {32771, 15}, {65539, 16},
+}
+
+var maxSymbols = [3]int{35, maxOffsetCode, 52}
+var maxAccuracyLogs = [3]int{9, 8, 9}
+
+// The predefined distributions of the sequence codes.
+var predefinedNorms = [3][]int16{
+	litLenKind: {
+		4, 3, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 1, 1, 1,
+		2, 2, 2, 2, 2, 2, 2, 2, 2, 3, 2, 1, 1, 1, 1, 1,
+		-1, -1, -1, -1,
+	},
+	offsetKind: {
+		1, 1, 1, 1, 1, 1, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1,
+	},
+	matchLenKind: {
+		1, 4, 3, 2, 2, 2, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, -1, -1,
+		-1, -1, -1, -1, -1,
+	},
+}
+var predefinedAccuracyLogs = [3]int{6, 5, 6}
+
+var predefinedTables [3]*fseTable
+var predefinedEncTables [3]*fseEncTable
+
+func init() {
+	for k := range predefinedNorms {
+		t := &fseTable{}
+		if err := buildFSETable(t, predefinedNorms[k], predefinedAccuracyLogs[k]); err != nil {
+			panic(err)
+		}
+		predefinedTables[k] = t
+		et, err := buildFSEEncTable(predefinedNorms[k], predefinedAccuracyLogs[k])
+		if err != nil {
+			panic(err)
+		}
+		predefinedEncTables[k] = et
+	}
+}
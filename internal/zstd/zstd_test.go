@@ -0,0 +1,256 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package zstd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+)
+
+func testInputs(t testing.TB) [][]byte {
+	records, err := ioutil.ReadFile("testdata/records.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rng := rand.New(rand.NewSource(1))
+	inputs := [][]byte{nil, []byte("a"), []byte("abcdabcdabcdabcdabcd"), records}
+	for _, n := range []int{12, 100, 255, 256, 1000, 4096, 131072, 131073, 300000} {
+		text := make([]byte, n)
+		random := make([]byte, n)
+		high := make([]byte, n)
+		for i := range text {
+			text[i] = "abcdefgh  \n{}\":,0123"[rng.Intn(20)]
+			high[i] = byte(128 + rng.Intn(3)*rng.Intn(40))
+		}
+		rng.Read(random)
+		repeated := bytes.Repeat(records, n/len(records)+1)[:n]
+		inputs = append(inputs, text, random, high, make([]byte, n), repeated)
+	}
+	return inputs
+}
+
+func TestRoundTrip(t *testing.T) {
+	for i, src := range testInputs(t) {
+		enc := Encode(nil, src)
+		if len(enc) > MaxEncodedLen(len(src)) {
+			t.Fatalf("%d: encoded length %d exceeds %d", i, len(enc), MaxEncodedLen(len(src)))
+		}
+		if n, err := DecodedLen(enc); err != nil || n != len(src) {
+			t.Fatalf("%d: expected decoded length %d, but found %d (%v)", i, len(src), n, err)
+		}
+		dst := make([]byte, len(src))
+		n, err := Decode(dst, enc)
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if !bytes.Equal(src, dst[:n]) {
+			t.Fatalf("%d: round trip mismatch", i)
+		}
+	}
+}
+
+func TestCompressionRatio(t *testing.T) {
+	src, err := ioutil.ReadFile("testdata/records.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The reference implementation compresses the records to 5378 bytes at
+	// its fastest level.
+	if n := len(Encode(nil, src)); n > 6500 {
+		t.Fatalf("expected at most 6500 bytes, but found %d", n)
+	}
+}
+
+func TestDecodeReference(t *testing.T) {
+	want, err := ioutil.ReadFile("testdata/records.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The files were produced by the reference implementation at its fastest
+	// and strongest levels, which between them use compressed Huffman weights,
+	// FSE sequence tables and repeated offsets.
+	for _, name := range []string{"records.json.1.zst", "records.json.19.zst"} {
+		src, err := ioutil.ReadFile("testdata/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n, err := DecodedLen(src); err != nil || n != len(want) {
+			t.Fatalf("%s: expected decoded length %d, but found %d (%v)", name, len(want), n, err)
+		}
+		dst := make([]byte, len(want))
+		n, err := Decode(dst, src)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !bytes.Equal(want, dst[:n]) {
+			t.Fatalf("%s: decoded contents differ", name)
+		}
+	}
+}
+
+func TestDecodeSkippableFrame(t *testing.T) {
+	src := []byte("hello hello hello hello")
+	enc := append([]byte{0x50, 0x2a, 0x4d, 0x18, 3, 0, 0, 0, 1, 2, 3}, Encode(nil, src)...)
+	enc = append(enc, Encode(nil, src)...)
+	dst := make([]byte, 2*len(src))
+	n, err := Decode(dst, enc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := append(append([]byte(nil), src...), src...); !bytes.Equal(want, dst[:n]) {
+		t.Fatalf("expected %q, but found %q", want, dst[:n])
+	}
+}
+
+func TestDecodeCorrupt(t *testing.T) {
+	src, err := ioutil.ReadFile("testdata/records.json.19.zst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := make([]byte, 32<<10)
+	// Truncated or modified inputs must not decode successfully to the
+	// original contents, nor panic.
+	for i := 4; i < len(src); i += 7 {
+		if n, err := Decode(dst, src[:i]); err == nil && n == 28903 {
+			t.Fatalf("truncated to %d: expected error", i)
+		}
+	}
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		b := append([]byte(nil), src...)
+		b[4+rng.Intn(len(b)-4)] ^= byte(1 + rng.Intn(255))
+		_, _ = Decode(dst, b)
+	}
+}
+
+func BenchmarkEncode(b *testing.B) {
+	src := testInputs(b)[3]
+	dst := make([]byte, MaxEncodedLen(len(src)))
+	b.SetBytes(int64(len(src)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		Encode(dst, src)
+	}
+}
+
+func BenchmarkDecode(b *testing.B) {
+	src := testInputs(b)[3]
+	enc := Encode(nil, src)
+	dst := make([]byte, len(src))
+	b.SetBytes(int64(len(src)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := Decode(dst, enc); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestLengthCodes(t *testing.T) {
+	for v := uint32(0); v < 1<<17; v++ {
+		if c, want := litLenCode(v), findCode(litLenCodes[:], v); c != want {
+			t.Fatalf("literal length %d: expected code %d, but found %d", v, want, c)
+		}
+		if v < 3 {
+			continue
+		}
+		if c, want := matchLenCode(v), findCode(matchLenCodes[:], v); c != want {
+			t.Fatalf("match length %d: expected code %d, but found %d", v, want, c)
+		}
+	}
+}
+
+// dictTestInputs returns the records, and two groups of records which follow
+// those used to build testdata/records.dict.
+func dictTestInputs(t *testing.T) (records, src0, src1 []byte) {
+	records, err := ioutil.ReadFile("testdata/records.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := bytes.Split(records, []byte("\n"))
+	src0 = bytes.Join(lines[250:260], []byte("\n"))
+	src1 = bytes.Join(lines[260:300], []byte("\n"))
+	return records, src0, src1
+}
+
+func TestDict(t *testing.T) {
+	records, src0, src1 := dictTestInputs(t)
+	formal, err := ioutil.ReadFile("testdata/records.dict")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range [][]byte{records[:6000], formal} {
+		d, err := NewDict(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, src := range [][]byte{nil, []byte("x"), src0, src1, records[:3000]} {
+			enc := EncodeDict(nil, src, d)
+			dst := make([]byte, len(src))
+			n, err := DecodeDict(dst, enc, d)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(src, dst[:n]) {
+				t.Fatalf("round trip mismatch")
+			}
+			if len(src) > 1000 && len(enc) >= len(Encode(nil, src)) {
+				t.Fatalf("expected the dictionary to improve compression: %d vs %d",
+					len(enc), len(Encode(nil, src)))
+			}
+		}
+	}
+
+	// A frame which records the ID of a dictionary cannot be decoded without
+	// it.
+	d, err := NewDict(formal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := make([]byte, len(src0))
+	if _, err := Decode(dst, EncodeDict(nil, src0, d)); err == nil {
+		t.Fatalf("expected error decoding without the dictionary")
+	}
+}
+
+func TestDecodeDictReference(t *testing.T) {
+	records, src0, src1 := dictTestInputs(t)
+	formal, err := ioutil.ReadFile("testdata/records.dict")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The dictionary was built by the reference implementation from the first
+	// 250 records, and the frames were produced by it using either that
+	// dictionary, or the first 6000 bytes of the records as a raw content
+	// dictionary.
+	for _, c := range []struct {
+		name string
+		dict []byte
+		want []byte
+	}{
+		{"records.dict.1.zst", formal, src0},
+		{"records.dict.19.zst", formal, src1},
+		{"records.raw-dict.3.zst", records[:6000], src1},
+	} {
+		src, err := ioutil.ReadFile("testdata/" + c.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d, err := NewDict(c.dict)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dst := make([]byte, len(c.want))
+		n, err := DecodeDict(dst, src, d)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if !bytes.Equal(c.want, dst[:n]) {
+			t.Fatalf("%s: decoded contents differ", c.name)
+		}
+	}
+}
@@ -139,9 +139,12 @@ func (i *Iterator) findPrevEntry() bool {
 			continue
 
 		case db.InternalKeyKindSet:
+			// The value is copied as the underlying iterator is stepped past it,
+			// which may release the block containing it.
 			i.keyBuf = append(i.keyBuf[:0], key.UserKey...)
 			i.key = i.keyBuf
-			i.value = i.iter.Value()
+			i.valueBuf2 = append(i.valueBuf2[:0], i.iter.Value()...)
+			i.value = i.valueBuf2
 			i.valid = true
 			i.iterValid = i.iter.Prev()
 			continue
@@ -150,14 +153,15 @@ func (i *Iterator) findPrevEntry() bool {
 			if !i.valid {
 				i.keyBuf = append(i.keyBuf[:0], key.UserKey...)
 				i.key = i.keyBuf
-				i.value = i.iter.Value()
+				i.valueBuf2 = append(i.valueBuf2[:0], i.iter.Value()...)
+				i.value = i.valueBuf2
 				i.valid = true
 			} else {
-				// The existing value is either stored in valueBuf2 or the underlying
-				// iterators value. We append the new value to valueBuf in order to
-				// merge(valueBuf, valueBuf2). Then we swap valueBuf and valueBuf2 in
-				// order to maintain the invariant that the existing value points to
-				// valueBuf2 (in preparation for handling th next merge value).
+				// The existing value is stored in valueBuf2. We append the new value
+				// to valueBuf in order to merge(valueBuf, valueBuf2). Then we swap
+				// valueBuf and valueBuf2 in order to maintain the invariant that the
+				// existing value points to valueBuf2 (in preparation for handling th
+				// next merge value).
 				i.valueBuf = append(i.valueBuf[:0], i.iter.Value()...)
 				i.valueBuf = i.merge(i.key, i.valueBuf, i.value, nil)
 				i.valueBuf, i.valueBuf2 = i.valueBuf2, i.valueBuf
@@ -210,6 +210,8 @@ func buildLevelIterTables(
 	}
 
 	cache := cache.New(128 << 20)
+
+	defer cache.Close()
 	readers := make([]*sstable.Reader, len(files))
 	for i := range files {
 		f, err := mem.Open(fmt.Sprintf("bench%d", i))
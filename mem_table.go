@@ -34,6 +34,8 @@ type memTable struct {
 	reserved    uint32
 	refs        int32
 	flushedCh   chan struct{}
+	// The number of the WAL the memtable's contents are written to.
+	logNum uint64
 
 	tombstones struct {
 		count uint32
@@ -77,6 +79,10 @@ func (m *memTable) flushed() chan struct{} {
 	return m.flushedCh
 }
 
+func (m *memTable) logNumber() uint64 {
+	return m.logNum
+}
+
 func (m *memTable) readyForFlush() bool {
 	return atomic.LoadInt32(&m.refs) == 0
 }
@@ -6,6 +6,8 @@ package pebble
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"os"
@@ -50,6 +52,9 @@ func createDB(dirname string, opts *db.Options) (retErr error) {
 	if err != nil {
 		return err
 	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
 	return setCurrentFile(dirname, opts.Storage, manifestFileNum)
 }
 
@@ -59,6 +64,9 @@ func Open(dirname string, opts *db.Options) (*DB, error) {
 	const defaultBurst = 1 << 20                  // 1 MB
 
 	opts = opts.EnsureDefaults()
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
 	d := &DB{
 		dirname:           dirname,
 		opts:              opts,
@@ -66,9 +74,10 @@ func Open(dirname string, opts *db.Options) (*DB, error) {
 		equal:             opts.Comparer.Equal,
 		merge:             opts.Merger.Merge,
 		abbreviatedKey:    opts.Comparer.AbbreviatedKey,
-		commitController:  newController(rate.NewLimiter(defaultRateLimit, defaultBurst)),
+		commitController:  newController(rate.NewLimiter(rate.Inf, defaultBurst)),
 		compactController: newController(rate.NewLimiter(defaultRateLimit, defaultBurst)),
 		flushController:   newController(rate.NewLimiter(rate.Inf, defaultBurst)),
+		closedCh:          make(chan struct{}),
 	}
 	if d.equal == nil {
 		d.equal = bytes.Equal
@@ -78,7 +87,12 @@ func Open(dirname string, opts *db.Options) (*DB, error) {
 		tableCacheSize = minTableCacheSize
 	}
 	d.tableCache.init(dirname, opts.Storage, d.opts, tableCacheSize)
+	d.fileManager.init(dirname, opts.Storage, opts.MaxAllowedSpaceUsage)
 	d.newIters = d.tableCache.newIters
+	if opts.PinL0IndexAndFilterBlocks {
+		d.tableCache.pinIndexAndFilter = d.mu.versions.isL0
+		d.mu.versions.unpinIndexAndFilter = d.tableCache.unpinIndexAndFilter
+	}
 	d.commit = newCommitPipeline(commitEnv{
 		mu:            &d.mu.Mutex,
 		logSeqNum:     &d.mu.versions.logSeqNum,
@@ -93,6 +107,7 @@ func Open(dirname string, opts *db.Options) (*DB, error) {
 	d.mu.mem.mutable = newMemTable(d.opts)
 	d.mu.mem.queue = append(d.mu.mem.queue, d.mu.mem.mutable)
 	d.mu.compact.cond.L = &d.mu.Mutex
+	d.mu.compact.inProgress = make(map[*compaction]struct{})
 	d.mu.compact.pendingOutputs = make(map[uint64]struct{})
 	d.mu.snapshots.init()
 	d.largeBatchThreshold = (d.opts.MemTableSize - int(d.mu.mem.mutable.emptySize)) / 2
@@ -115,6 +130,16 @@ func Open(dirname string, opts *db.Options) (*DB, error) {
 			fileLock.Close()
 		}
 	}()
+	dataDir, err := fs.OpenDir(dirname)
+	if err != nil {
+		return nil, err
+	}
+	d.dataDir = dataDir
+	defer func() {
+		if dataDir != nil {
+			dataDir.Close()
+		}
+	}()
 
 	if _, err := fs.Stat(dbFilename(dirname, fileTypeCurrent, 0)); os.IsNotExist(err) {
 		// Create the DB if it did not already exist.
@@ -147,8 +172,22 @@ func Open(dirname string, opts *db.Options) (*DB, error) {
 	var logFiles []fileNumAndName
 	for _, filename := range ls {
 		ft, fn, ok := parseDBFilename(filename)
-		if ok && ft == fileTypeLog && (fn >= d.mu.versions.logNumber || fn == d.mu.versions.prevLogNumber) {
+		if !ok {
+			continue
+		}
+		// Replaying the logs allocates file numbers, which must not collide
+		// with those of files created after the MANIFEST was last written, such
+		// as sstables ingested as flushables.
+		d.mu.versions.markFileNumUsed(fn)
+		switch {
+		case ft == fileTypeLog && (fn >= d.mu.versions.logNumber || fn == d.mu.versions.prevLogNumber):
 			logFiles = append(logFiles, fileNumAndName{fn, filename})
+		case ft == fileTypeTable:
+			// Track the space used by both live and obsolete tables. Obsolete
+			// tables are no longer tracked once they are deleted below.
+			if err := d.fileManager.add(fn); err != nil {
+				return nil, err
+			}
 		}
 	}
 	sort.Slice(logFiles, func(i, j int) bool {
@@ -159,7 +198,6 @@ func Open(dirname string, opts *db.Options) (*DB, error) {
 		if err != nil {
 			return nil, err
 		}
-		d.mu.versions.markFileNumUsed(lf.num)
 		if d.mu.versions.logSeqNum < maxSeqNum {
 			d.mu.versions.logSeqNum = maxSeqNum
 		}
@@ -169,13 +207,15 @@ func Open(dirname string, opts *db.Options) (*DB, error) {
 	// Create an empty .log file.
 	ve.logNumber = d.mu.versions.nextFileNum()
 	d.mu.log.number = ve.logNumber
+	d.mu.mem.mutable.logNum = ve.logNumber
 	logFile, err := fs.Create(dbFilename(dirname, fileTypeLog, ve.logNumber))
 	if err != nil {
 		return nil, err
 	}
 	d.mu.log.LogWriter = record.NewLogWriter(logFile)
 
-	// Write a new manifest to disk.
+	// Write a new manifest to disk. Creating the manifest syncs the DB
+	// directory, which also makes the new log file's directory entry durable.
 	if err := d.mu.versions.logAndApply(&ve); err != nil {
 		return nil, err
 	}
@@ -194,13 +234,66 @@ func Open(dirname string, opts *db.Options) (*DB, error) {
 	jobID := d.mu.nextJobID
 	d.mu.nextJobID++
 	d.deleteObsoleteFiles(jobID)
+	// A secondary cache may hold the blocks of tables which no longer exist,
+	// and whose file numbers may be reused.
+	live := make(map[uint64]struct{})
+	d.mu.versions.addLiveFileNums(live)
+	d.opts.Cache.RetainFiles(func(fileNum uint64) bool {
+		_, ok := live[fileNum]
+		return ok
+	})
 	d.maybeScheduleFlush()
 	d.maybeScheduleCompaction()
+	if d.opts.PeriodicCompactionSeconds > 0 {
+		go d.periodicCompactionLoop()
+	}
+	if d.opts.ScrubBytesPerSecond > 0 {
+		var ctx context.Context
+		ctx, d.scrubCancel = context.WithCancel(context.Background())
+		go d.scrubLoop(ctx)
+	}
 
 	d.fileLock, fileLock = fileLock, nil
+	dataDir = nil
 	return d, nil
 }
 
+// replayIngest adds the sstables whose ingestion is recorded in the batch to
+// L0. See DB.ingestLog.
+//
+// d.mu must be held when calling this.
+func (d *DB) replayIngest(ve *versionEdit, b *Batch) error {
+	var meta []*fileMetadata
+	for iter := b.iter(); len(iter) > 0; {
+		kind, key, _, ok := iter.next()
+		if !ok || kind != db.InternalKeyKindIngestSST {
+			return fmt.Errorf("pebble: corrupt ingestion record")
+		}
+		fileNum, n := binary.Uvarint(key)
+		if n != len(key) {
+			return fmt.Errorf("pebble: corrupt ingestion record")
+		}
+		m, err := ingestLoad1(d.opts, dbFilename(d.dirname, fileTypeTable, fileNum), fileNum)
+		if err != nil {
+			if os.IsNotExist(err) {
+				// The ingestion failed and its sstables were removed, but the
+				// removal of its WAL did not persist.
+				return nil
+			}
+			return err
+		}
+		meta = append(meta, m)
+	}
+	if err := ingestUpdateSeqNum(d.opts, d.dirname, b.seqNum(), meta); err != nil {
+		return err
+	}
+	for _, m := range meta {
+		d.mu.versions.markFileNumUsed(m.fileNum)
+		ve.newFiles = append(ve.newFiles, newFileEntry{level: 0, meta: *m})
+	}
+	return nil
+}
+
 // replayWAL replays the edits in the specified log file.
 //
 // d.mu must be held when calling this, but the mutex may be dropped and
@@ -243,8 +336,18 @@ func (d *DB) replayWAL(
 		// existing memtable and write the batch as a separate L0 table.
 		b = Batch{}
 		b.data = buf.Bytes()
-		b.refreshMemTableSize()
 		seqNum := b.seqNum()
+		if iter := b.iter(); len(iter) > 0 && db.InternalKeyKind(iter[0]) == db.InternalKeyKindIngestSST {
+			// The ingestion used a single sequence number, regardless of the
+			// number of sstables.
+			if err := d.replayIngest(ve, &b); err != nil {
+				return 0, err
+			}
+			maxSeqNum = seqNum + 1
+			buf.Reset()
+			continue
+		}
+		b.refreshMemTableSize()
 		maxSeqNum = seqNum + uint64(b.count())
 
 		if mem == nil {
@@ -5,11 +5,16 @@
 package pebble
 
 import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
 	"path/filepath"
 	"reflect"
 	"sort"
 	"strconv"
 	"strings"
+	"syscall"
 	"testing"
 
 	"github.com/petermattis/pebble/db"
@@ -163,3 +168,270 @@ func TestOpenCloseOpenClose(t *testing.T) {
 		}
 	}
 }
+
+func TestOpenTableStats(t *testing.T) {
+	mem := storage.NewMem()
+	d, err := Open("", &db.Options{Storage: mem})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		key := []byte(strconv.Itoa(i))
+		if i%2 == 0 {
+			err = d.Set(key, nil, nil)
+		} else {
+			err = d.Delete(key, nil)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err = Open("", &db.Options{Storage: mem})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.mu.Lock()
+	files := d.mu.versions.currentVersion().files[0]
+	if len(files) != 1 {
+		t.Fatalf("expected 1 table, but found %d", len(files))
+	}
+	if files[0].numEntries != 10 || files[0].numDeletions != 5 {
+		t.Fatalf("expected 10 entries and 5 deletions, but found %d and %d",
+			files[0].numEntries, files[0].numDeletions)
+	}
+	d.mu.Unlock()
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOpenEncrypted(t *testing.T) {
+	mem := storage.NewMem()
+	fs, err := storage.NewEncryptedStorage(mem, 1, bytes.Repeat([]byte{1}, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(d *DB, key string) string {
+		v, err := d.Get([]byte(key))
+		if err != nil {
+			t.Fatalf("%s: %v", key, err)
+		}
+		return string(v)
+	}
+
+	// Write one key to an sstable, and another which remains in the WAL.
+	d, err := Open("", &db.Options{Storage: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Set([]byte("a"), []byte("secret-a"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Set([]byte("b"), []byte("secret-b"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// None of the files contain the plaintext.
+	ls, err := mem.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range ls {
+		f, err := mem.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(data, []byte("secret")) || bytes.Contains(data, []byte("MANIFEST")) {
+			t.Fatalf("%s: found plaintext", name)
+		}
+	}
+
+	// Rotate the key. The DB is readable from the files written with the old
+	// key, and files written subsequently use the new key.
+	if err := fs.AddKey(2, bytes.Repeat([]byte{2}, 16)); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.SetCurrentKey(2); err != nil {
+		t.Fatal(err)
+	}
+	d, err = Open("", &db.Options{Storage: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := get(d, "a"); v != "secret-a" {
+		t.Fatalf("expected secret-a, but found %s", v)
+	}
+	if v := get(d, "b"); v != "secret-b" {
+		t.Fatalf("expected secret-b, but found %s", v)
+	}
+	if err := d.Compact([]byte("a"), []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The old key is no longer needed once all of the files written with it
+	// have been rewritten or deleted.
+	fs2, err := storage.NewEncryptedStorage(mem, 2, bytes.Repeat([]byte{2}, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err = Open("", &db.Options{Storage: fs2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := get(d, "a"); v != "secret-a" {
+		t.Fatalf("expected secret-a, but found %s", v)
+	}
+	if v := get(d, "b"); v != "secret-b" {
+		t.Fatalf("expected secret-b, but found %s", v)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOpenCrashRecovery(t *testing.T) {
+	// Writes which were synced survive a crash, regardless of whether they were
+	// flushed or compacted, while unsynced writes are discarded. Files are only
+	// durable once their directory entries have been synced. An encrypted
+	// storage recovers in the same way, including from files whose encryption
+	// header was lost.
+	for _, encrypted := range []bool{false, true} {
+		t.Run(fmt.Sprintf("encrypted=%t", encrypted), func(t *testing.T) {
+			testOpenCrashRecovery(t, encrypted)
+		})
+	}
+}
+
+func testOpenCrashRecovery(t *testing.T, encrypted bool) {
+	for seed := int64(0); seed < 20; seed++ {
+		rng := rand.New(rand.NewSource(seed))
+		fs := storage.NewFaultStorage(storage.NewMem(), true /* strictDirs */)
+		var dbfs storage.Storage = fs
+		if encrypted {
+			var err error
+			dbfs, err = storage.NewEncryptedStorage(fs, 1, bytes.Repeat([]byte{1}, 16))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		expected := make(map[string]string)
+
+		for round := 0; round < 5; round++ {
+			d, err := Open("", &db.Options{Storage: dbfs})
+			if err != nil {
+				t.Fatalf("seed %d, round %d: %v", seed, round, err)
+			}
+			for key, value := range expected {
+				v, err := d.Get([]byte(key))
+				if err != nil {
+					t.Fatalf("seed %d, round %d: %s: %v", seed, round, key, err)
+				}
+				if string(v) != value {
+					t.Fatalf("seed %d, round %d: %s: expected %s, but found %s",
+						seed, round, key, value, v)
+				}
+			}
+
+			for i := 0; i < 50; i++ {
+				key := fmt.Sprintf("%02d", rng.Intn(100))
+				value := fmt.Sprintf("%d-%d", round, i)
+				if err := d.Set([]byte(key), []byte(value), db.Sync); err != nil {
+					t.Fatal(err)
+				}
+				expected[key] = value
+
+				switch rng.Intn(20) {
+				case 0:
+					if err := d.Flush(); err != nil {
+						t.Fatal(err)
+					}
+				case 1:
+					if err := d.Compact([]byte("00"), []byte("99")); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			// Unsynced writes to other keys may or may not survive, but must not
+			// prevent recovery.
+			for i := 0; i < 10; i++ {
+				key := fmt.Sprintf("u%02d", rng.Intn(100))
+				if err := d.Set([]byte(key), []byte("unsynced"), db.NoSync); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// Abandon the DB without closing it, once background work is done.
+			d.mu.Lock()
+			for d.mu.compact.compactingCount > 0 || d.mu.compact.flushing {
+				d.mu.compact.cond.Wait()
+			}
+			d.mu.Unlock()
+			if err := fs.Crash(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestOpenInjectedErrors(t *testing.T) {
+	// An error injected into any of the first operations of each type while
+	// opening a DB causes Open to fail cleanly, after which the DB can be
+	// opened once the errors stop.
+	for op := storage.OpCreate; op <= storage.OpStat; op++ {
+		for index := int32(0); index < 3; index++ {
+			fs := storage.NewFaultStorage(storage.NewMem(), false)
+			d, err := Open("", &db.Options{Storage: fs})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := d.Set([]byte("a"), []byte("b"), db.Sync); err != nil {
+				t.Fatal(err)
+			}
+			if err := fs.Crash(); err != nil {
+				t.Fatal(err)
+			}
+
+			fs.SetInjector(storage.OnIndex(op, index, syscall.EIO))
+			if d, err := Open("", &db.Options{Storage: fs}); err == nil {
+				// The operation may not have been performed index times.
+				if err := d.Close(); err != nil {
+					t.Fatalf("%s %d: %v", op, index, err)
+				}
+			}
+			fs.SetInjector(nil)
+
+			d, err = Open("", &db.Options{Storage: fs})
+			if err != nil {
+				t.Fatalf("%s %d: %v", op, index, err)
+			}
+			if v, err := d.Get([]byte("a")); err != nil || string(v) != "b" {
+				t.Fatalf("%s %d: expected b, but found %s (%v)", op, index, v, err)
+			}
+			if err := d.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
@@ -244,8 +244,13 @@ func (r *Reader) NewIter() *Iter {
 }
 
 // readBlock reads and decompresses a block from disk into memory.
+//
+// TODO(peter): Iter has no Close method with which to release a cache handle,
+// so blocks are copied out of the cache onto the Go heap.
 func (r *Reader) readBlock(bh blockHandle) ([]byte, error) {
-	if b := r.cache.Get(r.fileNum, bh.offset); b != nil {
+	if h := r.cache.Get(r.fileNum, bh.offset, cache.DataBlock); h.Get() != nil {
+		b := append([]byte(nil), h.Get()...)
+		h.Release()
 		return b, nil
 	}
 
@@ -261,15 +266,25 @@ func (r *Reader) readBlock(bh blockHandle) ([]byte, error) {
 	switch b[bh.length] {
 	case noCompressionBlockType:
 		b = b[:bh.length]
-		r.cache.Set(r.fileNum, bh.offset, b)
+		r.cacheBlock(bh, b)
 		return b, nil
 	case snappyCompressionBlockType:
 		b, err := snappy.Decode(nil, b[:bh.length])
 		if err != nil {
 			return nil, err
 		}
-		r.cache.Set(r.fileNum, bh.offset, b)
+		r.cacheBlock(bh, b)
 		return b, nil
 	}
 	return nil, fmt.Errorf("pebble/table: unknown block compression: %d", b[bh.length])
 }
+
+// cacheBlock adds a copy of the block to the cache.
+func (r *Reader) cacheBlock(bh blockHandle, b []byte) {
+	if r.cache == nil {
+		return
+	}
+	v := r.cache.Alloc(len(b))
+	copy(v, b)
+	r.cache.Set(r.fileNum, bh.offset, v, cache.DataBlock, cache.LowPriority).Release()
+}
@@ -192,8 +192,10 @@ func buildBenchmarkTable(b *testing.B, blockSize int, nullValues bool) (*Reader,
 	if err != nil {
 		b.Fatal(err)
 	}
+	c := cache.New(128 << 20)
+	b.Cleanup(c.Close)
 	return NewReader(f1, 0, &db.Options{
-		Cache: cache.New(128 << 20),
+		Cache: c,
 	}), keys
 }
 
@@ -238,8 +238,10 @@ func BenchmarkRangeDelIterate(b *testing.B) {
 			for _, deleted := range []int{entries, entries - 1} {
 				b.Run(fmt.Sprintf("deleted=%d", deleted), func(b *testing.B) {
 					fs := storage.NewMem()
+					c := cache.New(128 << 20) // 128 MB
+					defer c.Close()
 					d, err := Open("", &db.Options{
-						Cache:   cache.New(128 << 20), // 128 MB
+						Cache:   c,
 						Storage: fs,
 					})
 					if err != nil {
@@ -269,7 +271,7 @@ func BenchmarkRangeDelIterate(b *testing.B) {
 					if err := w.Close(); err != nil {
 						b.Fatal(err)
 					}
-					if err := d.Ingest([]string{"ext"}); err != nil {
+					if err := d.Ingest([]string{"ext"}, nil); err != nil {
 						b.Fatal(err)
 					}
 					if err := fs.Remove("ext"); err != nil {
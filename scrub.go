@@ -0,0 +1,121 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"context"
+	"time"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/internal/rate"
+)
+
+// scrubLoop repeatedly walks the live tables, verifying the checksums of every
+// block at the rate specified by Options.ScrubBytesPerSecond, until ctx is
+// cancelled when the DB is closed.
+func (d *DB) scrubLoop(ctx context.Context) {
+	limit := d.opts.ScrubBytesPerSecond
+	burst := int(limit)
+	if burst > 1<<20 {
+		burst = 1 << 20 // 1 MB
+	}
+	limiter := rate.NewLimiter(rate.Limit(limit), burst)
+
+	for {
+		n, err := d.scrubPass(ctx, limiter)
+		if err != nil {
+			return
+		}
+		if n == 0 {
+			// There were no tables to verify. Wait a bit before checking again
+			// rather than spinning.
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Second):
+			}
+		}
+	}
+}
+
+// scrubPass verifies each of the tables that were live at the start of the
+// pass and are still live when their turn comes, reporting corrupt tables via
+// EventListener.TableCorrupted. Returns the number of tables verified.
+func (d *DB) scrubPass(ctx context.Context, limiter *rate.Limiter) (int, error) {
+	type tableRef struct {
+		level   int
+		fileNum uint64
+	}
+	var tables []tableRef
+	d.mu.Lock()
+	current := d.mu.versions.currentVersion()
+	for level := range current.files {
+		for i := range current.files[level] {
+			tables = append(tables, tableRef{level, current.files[level][i].fileNum})
+		}
+	}
+	d.mu.Unlock()
+
+	var n int
+	for _, t := range tables {
+		if err := ctx.Err(); err != nil {
+			return n, err
+		}
+
+		// Only verify the table if it is still live. The reference to the
+		// current version prevents the table from being deleted while it is
+		// being verified.
+		d.mu.Lock()
+		if err := ctx.Err(); err != nil || d.mu.closed {
+			// Close cancels the scrubber while holding d.mu, and then waits for
+			// d.mu.scrubbing to be false. Checking again here ensures that a
+			// table of a closed DB is never opened.
+			d.mu.Unlock()
+			if err == nil {
+				err = context.Canceled
+			}
+			return n, err
+		}
+		v := d.mu.versions.currentVersion()
+		var meta *fileMetadata
+		for i := range v.files[t.level] {
+			if v.files[t.level][i].fileNum == t.fileNum {
+				meta = &v.files[t.level][i]
+				break
+			}
+		}
+		if meta == nil {
+			d.mu.Unlock()
+			continue
+		}
+		v.ref()
+		d.mu.scrubbing = true
+		d.mu.Unlock()
+
+		err := d.verifyTable(ctx, meta, limiter)
+		info := db.TableCorruptionInfo{
+			Level: t.level,
+			Table: meta.tableInfo(d.dirname),
+			Err:   err,
+		}
+
+		d.mu.Lock()
+		d.mu.scrubbing = false
+		v.unrefLocked()
+		d.mu.compact.cond.Broadcast()
+		d.mu.Unlock()
+
+		if err := ctx.Err(); err != nil {
+			// The error, if any, is due to verification being interrupted.
+			return n, err
+		}
+		n++
+		if err != nil && d.opts.EventListener != nil &&
+			d.opts.EventListener.TableCorrupted != nil {
+			d.opts.EventListener.TableCorrupted(info)
+		}
+	}
+	return n, nil
+}
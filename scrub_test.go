@@ -0,0 +1,167 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/internal/rate"
+	"github.com/petermattis/pebble/storage"
+)
+
+func TestScrub(t *testing.T) {
+	fs := storage.NewMem()
+	d, err := Open("", &db.Options{Storage: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		for j := 0; j < 100; j++ {
+			key := []byte(fmt.Sprintf("%c%03d", 'a'+i, j))
+			if err := d.Set(key, key, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := d.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	d.mu.Lock()
+	corrupt := d.mu.versions.currentVersion().files[0][1]
+	d.mu.Unlock()
+
+	// Flip a bit in the data block of one of the tables.
+	filename := dbFilename("", fileTypeTable, corrupt.fileNum)
+	f, err := fs.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	contents[10] ^= 1
+	if f, err = fs.Create(filename); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(contents); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reopen the DB with the scrubber enabled. The corruption is not found when
+	// reopening as only the table's footer and meta blocks are read.
+	corruptCh := make(chan db.TableCorruptionInfo, 10)
+	d, err = Open("", &db.Options{
+		Storage:             fs,
+		ScrubBytesPerSecond: 1 << 30,
+		EventListener: &db.EventListener{
+			TableCorrupted: func(info db.TableCorruptionInfo) {
+				select {
+				case corruptCh <- info:
+				default:
+				}
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	select {
+	case info := <-corruptCh:
+		if info.Level != 0 || info.Table.FileNum != corrupt.fileNum {
+			t.Fatalf("expected L0 %06d to be corrupt, but found L%d %06d",
+				corrupt.fileNum, info.Level, info.Table.FileNum)
+		}
+		if s := fmt.Sprintf("%s-%s", info.Table.Smallest.UserKey, info.Table.Largest.UserKey); s != "b000-b099" {
+			t.Fatalf("expected key range b000-b099, but found %s", s)
+		}
+		if info.Err == nil {
+			t.Fatalf("expected error")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("timed out waiting for corruption to be reported")
+	}
+}
+
+func TestScrubClose(t *testing.T) {
+	fs := storage.NewMem()
+	d, err := Open("", &db.Options{
+		Storage: fs,
+		// Scrub so slowly that the scrubber is certain to be in the middle of
+		// verifying the table when the DB is closed.
+		ScrubBytesPerSecond: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Set([]byte("a"), []byte("a"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	// Wait for the scrubber to start verifying the table.
+	for {
+		d.mu.Lock()
+		scrubbing := d.mu.scrubbing
+		d.mu.Unlock()
+		if scrubbing {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Closing the DB interrupts the scrubber, which releases its reference to
+	// the current version.
+	errCh := make(chan error, 1)
+	go func() { errCh <- d.Close() }()
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("timed out waiting for close")
+	}
+}
+
+func TestScrubAfterClose(t *testing.T) {
+	d, err := Open("", &db.Options{
+		Storage: storage.NewMem(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Set([]byte("a"), []byte("a"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A scrub pass which races with Close must not open the tables of the
+	// closed DB.
+	limiter := rate.NewLimiter(rate.Inf, 1)
+	if n, err := d.scrubPass(context.Background(), limiter); err == nil || n != 0 {
+		t.Fatalf("expected error, but found %d tables verified (%v)", n, err)
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"math"
+	"sync"
+
+	"github.com/petermattis/pebble/storage"
+)
+
+// sstFileManager tracks the space used by the sstables in the DB directory and
+// enforces Options.MaxAllowedSpaceUsage. Both live sstables and obsolete
+// sstables which have not yet been deleted are tracked: a table is added once
+// it has been written (or ingested), and removed once it has been deleted. The
+// size of each table is determined by Storage.Stat, and so reflects the space
+// used on disk rather than the size recorded in the MANIFEST.
+//
+// Compactions reserve space for their outputs before they start, which
+// prevents concurrent compactions from together exceeding the limit or the
+// free space on the device holding the DB.
+type sstFileManager struct {
+	dirname string
+	fs      storage.Storage
+	// The maximum number of bytes the tables may occupy, or 0 for no limit.
+	maxAllowedSpace uint64
+
+	mu struct {
+		sync.Mutex
+		// The size of each tracked table, indexed by file number.
+		sizes map[uint64]uint64
+		// The total size of the tracked tables.
+		totalSize uint64
+		// The number of bytes reserved by in-progress compactions.
+		reserved uint64
+	}
+}
+
+func (m *sstFileManager) init(dirname string, fs storage.Storage, maxAllowedSpace uint64) {
+	m.dirname = dirname
+	m.fs = fs
+	m.maxAllowedSpace = maxAllowedSpace
+	m.mu.sizes = make(map[uint64]uint64)
+}
+
+// add starts tracking the table with the specified file number.
+func (m *sstFileManager) add(fileNum uint64) error {
+	stat, err := m.fs.Stat(dbFilename(m.dirname, fileTypeTable, fileNum))
+	if err != nil {
+		return err
+	}
+	size := uint64(stat.Size())
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.mu.totalSize += size - m.mu.sizes[fileNum]
+	m.mu.sizes[fileNum] = size
+	return nil
+}
+
+// remove stops tracking the table with the specified file number after it has
+// been deleted. Removing a table which is not tracked is a no-op.
+func (m *sstFileManager) remove(fileNum uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if size, ok := m.mu.sizes[fileNum]; ok {
+		m.mu.totalSize -= size
+		delete(m.mu.sizes, fileNum)
+	}
+}
+
+// totalSize returns the total size of the tracked tables.
+func (m *sstFileManager) totalSize() uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.mu.totalSize
+}
+
+// maxAllowedSpaceReached returns true if the tracked tables have reached
+// Options.MaxAllowedSpaceUsage.
+func (m *sstFileManager) maxAllowedSpaceReached() bool {
+	if m.maxAllowedSpace == 0 {
+		return false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.mu.totalSize >= m.maxAllowedSpace
+}
+
+// reserve reserves size bytes for the outputs of a compaction, returning
+// false if the outputs would not fit in the free space on the device, less
+// the space already reserved, or, if enforceLimit is true, in the space
+// remaining under Options.MaxAllowedSpaceUsage. A successful reservation must
+// be released when the compaction completes.
+func (m *sstFileManager) reserve(size uint64, enforceLimit bool) bool {
+	// An error determining the free space is ignored, leaving the compaction
+	// to fail if it does run out of space.
+	free, err := m.fs.FreeSpace(m.dirname)
+	if err != nil {
+		free = math.MaxUint64
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if enforceLimit && m.maxAllowedSpace != 0 &&
+		m.mu.totalSize+m.mu.reserved+size > m.maxAllowedSpace {
+		return false
+	}
+	// The outputs of in-progress compactions may already occupy some of the
+	// space they reserved, so this is conservative.
+	if m.mu.reserved+size > free {
+		return false
+	}
+	m.mu.reserved += size
+	return true
+}
+
+// release releases space reserved by a call to reserve.
+func (m *sstFileManager) release(size uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.mu.reserved -= size
+}
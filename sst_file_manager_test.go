@@ -0,0 +1,102 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"github.com/petermattis/pebble/storage"
+)
+
+// freeSpaceStorage is a storage.Storage which reports a fixed amount of free
+// space. The free space is accessed atomically.
+type freeSpaceStorage struct {
+	storage.Storage
+	free uint64
+}
+
+func (fs *freeSpaceStorage) FreeSpace(dir string) (uint64, error) {
+	return atomic.LoadUint64(&fs.free), nil
+}
+
+func TestSSTFileManager(t *testing.T) {
+	fs := storage.NewMem()
+	write := func(fileNum uint64, size int) {
+		f, err := fs.Create(dbFilename("", fileTypeTable, fileNum))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write(make([]byte, size)); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var m sstFileManager
+	m.init("", fs, 100)
+	write(1, 30)
+	write(2, 40)
+	for _, fileNum := range []uint64{1, 2, 2} {
+		if err := m.add(fileNum); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s := m.totalSize(); s != 70 {
+		t.Fatalf("expected 70 bytes, but found %d", s)
+	}
+	if err := m.add(3); err == nil {
+		t.Fatalf("expected error adding missing table")
+	}
+
+	if m.reserve(31, true) {
+		t.Fatalf("expected reservation of 31 bytes to fail")
+	}
+	if !m.reserve(20, true) {
+		t.Fatalf("expected reservation of 20 bytes to succeed")
+	}
+	if m.reserve(20, true) {
+		t.Fatalf("expected reservation of 20 bytes to fail")
+	}
+	m.release(20)
+	if !m.reserve(30, true) {
+		t.Fatalf("expected reservation of 30 bytes to succeed")
+	}
+	m.release(30)
+
+	// The limit is not enforced if enforceLimit is false, but the free space
+	// on the device is.
+	if !m.reserve(1000, false) {
+		t.Fatalf("expected reservation of 1000 bytes to succeed")
+	}
+	m.release(1000)
+	m.fs = &freeSpaceStorage{fs, 50}
+	if !m.reserve(50, false) {
+		t.Fatalf("expected reservation of 50 bytes to succeed")
+	}
+	if m.reserve(1, false) {
+		t.Fatalf("expected reservation of 1 byte to fail")
+	}
+	m.release(50)
+	m.fs = fs
+
+	write(3, 30)
+	if err := m.add(3); err != nil {
+		t.Fatal(err)
+	}
+	if !m.maxAllowedSpaceReached() {
+		t.Fatalf("expected max allowed space to be reached")
+	}
+	m.remove(1)
+	m.remove(1)
+	if m.maxAllowedSpaceReached() {
+		t.Fatalf("expected max allowed space not to be reached")
+	}
+	if s := m.totalSize(); s != 70 {
+		t.Fatalf("expected 70 bytes, but found %d", s)
+	}
+}
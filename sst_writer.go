@@ -0,0 +1,250 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/sstable"
+)
+
+// SSTWriter builds a sequence of sstables for ingestion with DB.Ingest. Keys
+// must be added in strictly increasing order, with a DeleteRange ordered by
+// its start key. Overlapping range deletions are merged, and a range deletion
+// which straddles an sstable boundary is split between the sstables, so the
+// output always passes the overlap checks performed by DB.Ingest. The output
+// is split into a new sstable once the current sstable reaches the target file
+// size.
+//
+// All of the entries are written with a sequence number of 0, the sequence
+// number being assigned by DB.Ingest. An entry does not shadow an entry added
+// earlier, so a range deletion does not delete the point entries added within
+// its range.
+type SSTWriter struct {
+	dir  string
+	opts *db.SSTWriterOptions
+	cmp  db.Compare
+	w    *sstable.Writer
+	// The tables which have been finished.
+	tables []db.TableInfo
+	// The last key added, either the user key of a point entry or the start key
+	// of a range deletion.
+	lastKey []byte
+	hasLast bool
+	// The pending range deletion, which is extended by any subsequent range
+	// deletion that overlaps or abuts it.
+	pending struct {
+		start, end []byte
+	}
+	hasPending bool
+	err        error
+}
+
+// NewSSTWriter returns a new SSTWriter which creates sstables in dir. The
+// sstables are named 000001.sst, 000002.sst and so on.
+func NewSSTWriter(dir string, opts *db.SSTWriterOptions) *SSTWriter {
+	opts = opts.EnsureDefaults()
+	return &SSTWriter{
+		dir:  dir,
+		opts: opts,
+		cmp:  opts.Comparer.Compare,
+	}
+}
+
+// Set sets the value for the given key.
+func (w *SSTWriter) Set(key, value []byte) error {
+	return w.addPoint(db.MakeInternalKey(key, 0, db.InternalKeyKindSet), value)
+}
+
+// Delete deletes the value for the given key.
+func (w *SSTWriter) Delete(key []byte) error {
+	return w.addPoint(db.MakeInternalKey(key, 0, db.InternalKeyKindDelete), nil)
+}
+
+// Merge merges the value for the given key. The details of the merge are
+// dependent upon the configured merge operator.
+func (w *SSTWriter) Merge(key, value []byte) error {
+	return w.addPoint(db.MakeInternalKey(key, 0, db.InternalKeyKindMerge), value)
+}
+
+// DeleteRange deletes all of the keys (and values) in the range [start,end)
+// (inclusive on start, exclusive on end).
+func (w *SSTWriter) DeleteRange(start, end []byte) error {
+	if w.err != nil {
+		return w.err
+	}
+	if w.cmp(start, end) >= 0 {
+		w.err = fmt.Errorf("pebble: empty range deletion: [%q,%q)", start, end)
+		return w.err
+	}
+	if err := w.checkOrder(start); err != nil {
+		return err
+	}
+
+	if w.hasPending && w.cmp(start, w.pending.end) <= 0 {
+		// The range deletion overlaps or abuts the pending range deletion. All of
+		// the entries share the same sequence number, so the union of the two
+		// deletes the same keys as the pair.
+		if w.cmp(end, w.pending.end) > 0 {
+			w.pending.end = append(w.pending.end[:0], end...)
+		}
+		return nil
+	}
+
+	if err := w.maybeSplit(start); err != nil {
+		return err
+	}
+	if w.hasPending {
+		if err := w.flushPending(); err != nil {
+			return err
+		}
+	}
+	w.pending.start = append(w.pending.start[:0], start...)
+	w.pending.end = append(w.pending.end[:0], end...)
+	w.hasPending = true
+	return nil
+}
+
+// Finish finishes the last sstable and returns the metadata for all of the
+// sstables, in key order. The paths of the returned tables can be passed
+// directly to DB.Ingest. No further entries may be added after Finish.
+func (w *SSTWriter) Finish() ([]db.TableInfo, error) {
+	if w.err != nil {
+		return nil, w.err
+	}
+	if w.hasPending {
+		if err := w.flushPending(); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.finishTable(); err != nil {
+		return nil, err
+	}
+	w.err = fmt.Errorf("pebble: SSTWriter is finished")
+	return w.tables, nil
+}
+
+func (w *SSTWriter) addPoint(key db.InternalKey, value []byte) error {
+	if w.err != nil {
+		return w.err
+	}
+	if err := w.checkOrder(key.UserKey); err != nil {
+		return err
+	}
+	if err := w.maybeSplit(key.UserKey); err != nil {
+		return err
+	}
+	if w.w == nil {
+		if err := w.newTable(); err != nil {
+			return err
+		}
+	}
+	if err := w.w.Add(key, value); err != nil {
+		w.err = err
+		return err
+	}
+	return nil
+}
+
+// checkOrder verifies that key is greater than the last key added.
+func (w *SSTWriter) checkOrder(key []byte) error {
+	if w.hasLast && w.cmp(w.lastKey, key) >= 0 {
+		w.err = fmt.Errorf("pebble: keys must be added in strictly increasing order: %q, %q",
+			w.lastKey, key)
+		return w.err
+	}
+	w.lastKey = append(w.lastKey[:0], key...)
+	w.hasLast = true
+	return nil
+}
+
+// maybeSplit finishes the current sstable if it has reached the target file
+// size, so that the next sstable begins at key. The part of the pending range
+// deletion before key remains in the current sstable.
+func (w *SSTWriter) maybeSplit(key []byte) error {
+	if w.w == nil || w.w.EstimatedSize() < uint64(w.opts.Level.TargetFileSize) {
+		return nil
+	}
+	if w.hasPending {
+		if w.cmp(w.pending.end, key) <= 0 {
+			if err := w.flushPending(); err != nil {
+				return err
+			}
+		} else {
+			// The pending range deletion straddles the boundary. Truncating it at
+			// key gives the current sstable an exclusive largest key of key.
+			if err := w.w.Add(db.MakeInternalKey(w.pending.start, 0, db.InternalKeyKindRangeDelete),
+				append([]byte(nil), key...)); err != nil {
+				w.err = err
+				return err
+			}
+			w.pending.start = append(w.pending.start[:0], key...)
+		}
+	}
+	return w.finishTable()
+}
+
+// flushPending adds the pending range deletion to the current sstable.
+func (w *SSTWriter) flushPending() error {
+	if w.w == nil {
+		if err := w.newTable(); err != nil {
+			return err
+		}
+	}
+	w.hasPending = false
+	key := db.MakeInternalKey(w.pending.start, 0, db.InternalKeyKindRangeDelete)
+	if err := w.w.Add(key, w.pending.end); err != nil {
+		w.err = err
+		return err
+	}
+	return nil
+}
+
+func (w *SSTWriter) newTable() error {
+	if len(w.tables) == 0 {
+		if err := w.opts.Storage.MkdirAll(w.dir, 0755); err != nil {
+			w.err = err
+			return err
+		}
+	}
+	path := filepath.Join(w.dir, fmt.Sprintf("%06d.sst", len(w.tables)+1))
+	f, err := w.opts.Storage.Create(path)
+	if err != nil {
+		w.err = err
+		return err
+	}
+	w.w = sstable.NewWriter(f, &db.Options{
+		Comparer:    w.opts.Comparer,
+		Merger:      w.opts.Merger,
+		TableFormat: w.opts.TableFormat,
+	}, w.opts.Level)
+	w.tables = append(w.tables, db.TableInfo{Path: path})
+	return nil
+}
+
+func (w *SSTWriter) finishTable() error {
+	if w.w == nil {
+		return nil
+	}
+	tw := w.w
+	w.w = nil
+	if err := tw.Close(); err != nil {
+		w.err = err
+		return err
+	}
+	meta, err := tw.Metadata()
+	if err != nil {
+		w.err = err
+		return err
+	}
+	info := &w.tables[len(w.tables)-1]
+	info.Size = meta.Size
+	info.Smallest = meta.Smallest(w.cmp).Clone()
+	info.Largest = meta.Largest(w.cmp).Clone()
+	info.FileChecksum = meta.FileChecksum
+	return nil
+}
@@ -0,0 +1,146 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/internal/datadriven"
+	"github.com/petermattis/pebble/sstable"
+	"github.com/petermattis/pebble/storage"
+)
+
+func TestSSTWriter(t *testing.T) {
+	fs := storage.NewMem()
+	d, err := Open("db", &db.Options{Storage: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	var tables []db.TableInfo
+	var dirNum int
+
+	datadriven.RunTest(t, "testdata/sst_writer", func(td *datadriven.TestData) string {
+		switch td.Cmd {
+		case "build":
+			opts := &db.SSTWriterOptions{Storage: fs}
+			for _, arg := range td.CmdArgs {
+				switch arg.Key {
+				case "target-size":
+					v, err := strconv.Atoi(arg.Vals[0])
+					if err != nil {
+						return err.Error()
+					}
+					opts.Level.TargetFileSize = int64(v)
+				default:
+					return fmt.Sprintf("unknown arg: %s", arg.Key)
+				}
+			}
+
+			dirNum++
+			w := NewSSTWriter(fmt.Sprintf("ext%d", dirNum), opts)
+			for _, line := range strings.Split(td.Input, "\n") {
+				parts := strings.Fields(line)
+				if len(parts) == 0 {
+					continue
+				}
+				var err error
+				switch {
+				case parts[0] == "set" && len(parts) == 3:
+					err = w.Set([]byte(parts[1]), []byte(parts[2]))
+				case parts[0] == "del" && len(parts) == 2:
+					err = w.Delete([]byte(parts[1]))
+				case parts[0] == "merge" && len(parts) == 3:
+					err = w.Merge([]byte(parts[1]), []byte(parts[2]))
+				case parts[0] == "del-range" && len(parts) == 3:
+					err = w.DeleteRange([]byte(parts[1]), []byte(parts[2]))
+				default:
+					return fmt.Sprintf("malformed op: %s", line)
+				}
+				if err != nil {
+					return err.Error()
+				}
+			}
+			tables, err = w.Finish()
+			if err != nil {
+				return err.Error()
+			}
+
+			var buf bytes.Buffer
+			for _, info := range tables {
+				fmt.Fprintf(&buf, "%s: %s-%s\n", info.Path, info.Smallest, info.Largest)
+				f, err := fs.Open(info.Path)
+				if err != nil {
+					return err.Error()
+				}
+				r := sstable.NewReader(f, 0, nil)
+				iters := []internalIterator{r.NewIter(nil)}
+				if iter := r.NewRangeDelIter(nil); iter != nil {
+					iters = append(iters, iter)
+				}
+				for _, iter := range iters {
+					for valid := iter.First(); valid; valid = iter.Next() {
+						fmt.Fprintf(&buf, "  %s:%s\n", iter.Key(), iter.Value())
+					}
+					if err := iter.Close(); err != nil {
+						return err.Error()
+					}
+				}
+				if err := r.Close(); err != nil {
+					return err.Error()
+				}
+			}
+			return buf.String()
+
+		case "ingest":
+			paths := make([]string, len(tables))
+			for i := range tables {
+				paths[i] = tables[i].Path
+			}
+			if err := d.Ingest(paths, nil); err != nil {
+				return err.Error()
+			}
+			return ""
+
+		case "set":
+			for _, line := range strings.Split(td.Input, "\n") {
+				parts := strings.Fields(line)
+				if len(parts) != 2 {
+					return fmt.Sprintf("malformed set: %s", line)
+				}
+				if err := d.Set([]byte(parts[0]), []byte(parts[1]), nil); err != nil {
+					return err.Error()
+				}
+			}
+			return ""
+
+		case "lsm":
+			d.mu.Lock()
+			s := d.mu.versions.currentVersion().String()
+			d.mu.Unlock()
+			return s
+
+		case "iter":
+			iter := d.NewIter(nil)
+			var buf bytes.Buffer
+			for valid := iter.First(); valid; valid = iter.Next() {
+				fmt.Fprintf(&buf, "%s:%s\n", iter.Key(), iter.Value())
+			}
+			if err := iter.Close(); err != nil {
+				return err.Error()
+			}
+			return buf.String()
+
+		default:
+			return fmt.Sprintf("unknown command: %s", td.Cmd)
+		}
+	})
+}
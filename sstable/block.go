@@ -9,6 +9,7 @@ import (
 	"errors"
 	"unsafe"
 
+	"github.com/petermattis/pebble/cache"
 	"github.com/petermattis/pebble/db"
 )
 
@@ -29,7 +30,10 @@ type blockWriter struct {
 	curKey          []byte
 	curValue        []byte
 	prevKey         []byte
-	tmp             [50]byte
+	// hashIndex, if non-nil, accumulates a hash index over the user keys in the
+	// block which is appended to the block when it is finished.
+	hashIndex *hashIndexWriter
+	tmp       [50]byte
 }
 
 func (w *blockWriter) store(keySize int, value []byte) {
@@ -62,6 +66,9 @@ func (w *blockWriter) add(key db.InternalKey, value []byte) {
 	key.Encode(w.curKey)
 
 	w.store(size, value)
+	if w.hashIndex != nil {
+		w.hashIndex.add(key.UserKey, len(w.restarts)-1)
+	}
 }
 
 func (w *blockWriter) finish() []byte {
@@ -80,7 +87,15 @@ func (w *blockWriter) finish() []byte {
 		binary.LittleEndian.PutUint32(tmp4, x)
 		w.buf = append(w.buf, tmp4...)
 	}
-	binary.LittleEndian.PutUint32(tmp4, uint32(len(w.restarts)))
+	// The hash index, if any, follows the restart points. Its presence is
+	// indicated by the high bit of the number of restart points.
+	footer := uint32(len(w.restarts))
+	if w.hashIndex != nil && w.hashIndex.valid &&
+		len(w.buf)+w.hashIndex.estimatedSize()+4 <= hashIndexMaxBlockSize {
+		w.buf = w.hashIndex.finish(w.buf)
+		footer |= hashIndexFlag
+	}
+	binary.LittleEndian.PutUint32(tmp4, footer)
 	w.buf = append(w.buf, tmp4...)
 	return w.buf
 }
@@ -89,10 +104,17 @@ func (w *blockWriter) reset() {
 	w.nEntries = 0
 	w.buf = w.buf[:0]
 	w.restarts = w.restarts[:0]
+	if w.hashIndex != nil {
+		w.hashIndex.reset()
+	}
 }
 
 func (w *blockWriter) estimatedSize() int {
-	return len(w.buf) + 4*(len(w.restarts)+1)
+	size := len(w.buf) + 4*(len(w.restarts)+1)
+	if w.hashIndex != nil {
+		size += w.hashIndex.estimatedSize()
+	}
+	return size
 }
 
 type blockEntry struct {
@@ -111,11 +133,17 @@ type blockIter struct {
 	globalSeqNum uint64
 	ptr          unsafe.Pointer
 	data         []byte
-	key, val     []byte
-	ikey         db.InternalKey
-	cached       []blockEntry
-	cachedBuf    []byte
-	err          error
+	// hashIndex holds the buckets of the block's hash index, or is nil if the
+	// block does not have a hash index.
+	hashIndex []byte
+	key, val  []byte
+	ikey      db.InternalKey
+	cached    []blockEntry
+	cachedBuf []byte
+	// cacheHandle holds a reference to the block in the block cache, preventing
+	// its memory from being freed while the iterator is in use.
+	cacheHandle cache.Handle
+	err         error
 }
 
 func newBlockIter(cmp db.Compare, block block) (*blockIter, error) {
@@ -124,12 +152,21 @@ func newBlockIter(cmp db.Compare, block block) (*blockIter, error) {
 }
 
 func (i *blockIter) init(cmp db.Compare, block block, globalSeqNum uint64) error {
-	numRestarts := int(binary.LittleEndian.Uint32(block[len(block)-4:]))
+	footer := binary.LittleEndian.Uint32(block[len(block)-4:])
+	numRestarts := int(footer &^ hashIndexFlag)
 	if numRestarts == 0 {
 		return errors.New("pebble/table: invalid table (block has no restart points)")
 	}
 	i.cmp = cmp
 	i.restarts = len(block) - 4*(1+numRestarts)
+	i.hashIndex = nil
+	if footer&hashIndexFlag != 0 {
+		// The hash index buckets are followed by a uint16 bucket count.
+		end := len(block) - 4 - 2
+		numBuckets := int(binary.LittleEndian.Uint16(block[end:]))
+		i.hashIndex = block[end-numBuckets : end]
+		i.restarts -= 2 + numBuckets
+	}
 	i.numRestarts = numRestarts
 	i.globalSeqNum = globalSeqNum
 	i.ptr = unsafe.Pointer(&block[0])
@@ -144,6 +181,14 @@ func (i *blockIter) init(cmp db.Compare, block block, globalSeqNum uint64) error
 	return nil
 }
 
+// initHandle initializes the iterator for the block referred to by h, taking
+// ownership of the handle. The reference to any previous block is released.
+func (i *blockIter) initHandle(cmp db.Compare, h cache.Handle, globalSeqNum uint64) error {
+	i.cacheHandle.Release()
+	i.cacheHandle = h
+	return i.init(cmp, h.Get(), globalSeqNum)
+}
+
 func (i *blockIter) readEntry() {
 	ptr := unsafe.Pointer(uintptr(i.ptr) + uintptr(i.offset))
 	shared, ptr := decodeVarint(ptr)
@@ -238,6 +283,50 @@ func (i *blockIter) SeekGE(key []byte) bool {
 	return i.Valid()
 }
 
+// seekForGet is a variant of SeekGE for point lookups of the user key. If the
+// block has a hash index, the restart interval containing the key is found
+// using the hash index rather than a binary search. Unlike SeekGE, if the key
+// is not present in the block the iterator may be left exhausted rather than
+// positioned at the next larger key.
+func (i *blockIter) seekForGet(key []byte) bool {
+	if i.hashIndex == nil {
+		return i.SeekGE(key)
+	}
+	var restart int
+	switch b := i.hashIndex[hashIndexHash(key)%uint32(len(i.hashIndex))]; b {
+	case hashIndexCollision:
+		return i.SeekGE(key)
+	case hashIndexNoEntry:
+		// Every key in the block was added to the hash index, so the key is not
+		// present.
+		i.offset = i.restarts
+		i.nextOffset = i.restarts
+		return false
+	default:
+		restart = int(b)
+	}
+	if restart >= i.numRestarts {
+		i.err = errors.New("pebble/table: invalid table (corrupt hash index)")
+		i.offset = i.restarts
+		i.nextOffset = i.restarts
+		return false
+	}
+
+	ikey := db.MakeSearchKey(key)
+	i.offset = int(binary.LittleEndian.Uint32(i.data[i.restarts+4*restart:]))
+	i.loadEntry()
+
+	// Iterate from that restart point to somewhere >= the key sought. A hash
+	// collision with a key in another restart interval may leave the iterator
+	// positioned at a different user key, which the caller must check for.
+	for valid := i.Valid(); valid; valid = i.Next() {
+		if db.InternalCompare(i.cmp, i.ikey, ikey) >= 0 {
+			break
+		}
+	}
+	return i.Valid()
+}
+
 // SeekLT implements internalIterator.SeekLT, as documented in the pebble
 // package.
 func (i *blockIter) SeekLT(key []byte) bool {
@@ -445,6 +534,8 @@ func (i *blockIter) Error() error {
 // Close implements internalIterator.Close, as documented in the pebble
 // package.
 func (i *blockIter) Close() error {
+	i.cacheHandle.Release()
+	i.cacheHandle = cache.Handle{}
 	i.val = nil
 	return i.err
 }
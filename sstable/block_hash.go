@@ -0,0 +1,141 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import "encoding/binary"
+
+// A data block may optionally be followed by a hash index which maps user
+// keys to the restart interval containing them. The hash index is compatible
+// with RocksDB's data block hash index. See the comment in table.go for a
+// description of the layout.
+const (
+	// hashIndexNoEntry marks a bucket which no key hashes to.
+	hashIndexNoEntry = 255
+	// hashIndexCollision marks a bucket which keys from multiple restart
+	// intervals hash to.
+	hashIndexCollision = 254
+	// hashIndexMaxRestarts is the largest restart index that can be stored in a
+	// bucket.
+	hashIndexMaxRestarts = 253
+	// hashIndexMaxBlockSize is the size above which a data block is not given a
+	// hash index.
+	hashIndexMaxBlockSize = 1 << 16
+	// hashIndexMaxBuckets is the maximum number of buckets, which is limited by
+	// the uint16 encoding of the bucket count.
+	hashIndexMaxBuckets = 1<<16 - 1
+	// hashIndexFlag is set in the trailing restart count of a block which has a
+	// hash index.
+	hashIndexFlag = 1 << 31
+	// hashIndexSeed is the seed used to hash user keys.
+	hashIndexSeed = 397
+)
+
+// hashIndexHash implements a hashing algorithm similar to the Murmur hash. It
+// is the same algorithm used by bloom filters, but with a different seed.
+func hashIndexHash(b []byte) uint32 {
+	const m = 0xc6a4a793
+	h := uint32(hashIndexSeed) ^ uint32(len(b)*m)
+	for ; len(b) >= 4; b = b[4:] {
+		h += uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16 | uint32(b[3])<<24
+		h *= m
+		h ^= h >> 16
+	}
+	switch len(b) {
+	case 3:
+		h += uint32(b[2]) << 16
+		fallthrough
+	case 2:
+		h += uint32(b[1]) << 8
+		fallthrough
+	case 1:
+		h += uint32(b[0])
+		h *= m
+		h ^= h >> 24
+	}
+	return h
+}
+
+type hashIndexEntry struct {
+	hash    uint32
+	restart uint8
+}
+
+// hashIndexWriter accumulates the hash index for a data block.
+type hashIndexWriter struct {
+	bucketsPerKey float64
+	numBuckets    float64
+	entries       []hashIndexEntry
+	// valid is false if the block has too many restart points to be indexed.
+	valid bool
+}
+
+func newHashIndexWriter(utilRatio float64) *hashIndexWriter {
+	return &hashIndexWriter{
+		bucketsPerKey: 1 / utilRatio,
+		valid:         true,
+	}
+}
+
+// add records that the user key is located in the restart interval with the
+// specified index.
+func (w *hashIndexWriter) add(key []byte, restart int) {
+	if restart > hashIndexMaxRestarts {
+		w.valid = false
+		return
+	}
+	if !w.valid {
+		return
+	}
+	w.entries = append(w.entries, hashIndexEntry{
+		hash:    hashIndexHash(key),
+		restart: uint8(restart),
+	})
+	w.numBuckets += w.bucketsPerKey
+}
+
+func (w *hashIndexWriter) buckets() int {
+	n := int(w.numBuckets)
+	if n > hashIndexMaxBuckets {
+		n = hashIndexMaxBuckets
+	}
+	// An odd number of buckets distributes the hashes more evenly.
+	return n | 1
+}
+
+// estimatedSize returns the size of the encoded hash index, including the
+// bucket count.
+func (w *hashIndexWriter) estimatedSize() int {
+	if !w.valid {
+		return 0
+	}
+	return w.buckets() + 2
+}
+
+// finish appends the encoded hash index to buf.
+func (w *hashIndexWriter) finish(buf []byte) []byte {
+	n := w.buckets()
+	start := len(buf)
+	for j := 0; j < n; j++ {
+		buf = append(buf, hashIndexNoEntry)
+	}
+	buckets := buf[start:]
+	for _, e := range w.entries {
+		b := &buckets[e.hash%uint32(n)]
+		if *b == hashIndexNoEntry {
+			*b = e.restart
+		} else if *b != e.restart {
+			*b = hashIndexCollision
+		}
+	}
+	var tmp [2]byte
+	binary.LittleEndian.PutUint16(tmp[:], uint16(n))
+	return append(buf, tmp[:]...)
+}
+
+func (w *hashIndexWriter) reset() {
+	w.numBuckets = 0
+	w.entries = w.entries[:0]
+	w.valid = true
+}
@@ -126,84 +126,167 @@ func TestBlockIter2(t *testing.T) {
 	var block []byte
 
 	for _, r := range []int{1, 2, 3, 4} {
-		t.Run(fmt.Sprintf("restart=%d", r), func(t *testing.T) {
-			datadriven.RunTest(t, "testdata/block", func(d *datadriven.TestData) string {
-				switch d.Cmd {
-				case "build":
-					w := &blockWriter{restartInterval: r}
-					for _, e := range strings.Split(strings.TrimSpace(d.Input), ",") {
-						w.add(makeIkey(e), nil)
-					}
-					block = w.finish()
-					return ""
+		for _, hash := range []bool{false, true} {
+			t.Run(fmt.Sprintf("restart=%d,hash=%t", r, hash), func(t *testing.T) {
+				datadriven.RunTest(t, "testdata/block", func(d *datadriven.TestData) string {
+					switch d.Cmd {
+					case "build":
+						w := &blockWriter{restartInterval: r}
+						if hash {
+							w.hashIndex = newHashIndexWriter(0.75)
+						}
+						for _, e := range strings.Split(strings.TrimSpace(d.Input), ",") {
+							w.add(makeIkey(e), nil)
+						}
+						block = w.finish()
+						return ""
 
-				case "iter":
-					iter, err := newBlockIter(bytes.Compare, block)
-					if err != nil {
-						return err.Error()
-					}
+					case "iter":
+						iter, err := newBlockIter(bytes.Compare, block)
+						if err != nil {
+							return err.Error()
+						}
 
-					for _, arg := range d.CmdArgs {
-						switch arg.Key {
-						case "globalSeqNum":
-							if len(arg.Vals) != 1 {
-								return fmt.Sprintf("%s: arg %s expects 1 value", d.Cmd, arg.Key)
+						for _, arg := range d.CmdArgs {
+							switch arg.Key {
+							case "globalSeqNum":
+								if len(arg.Vals) != 1 {
+									return fmt.Sprintf("%s: arg %s expects 1 value", d.Cmd, arg.Key)
+								}
+								v, err := strconv.Atoi(arg.Vals[0])
+								if err != nil {
+									return err.Error()
+								}
+								iter.globalSeqNum = uint64(v)
+							default:
+								return fmt.Sprintf("%s: unknown arg: %s", d.Cmd, arg.Key)
 							}
-							v, err := strconv.Atoi(arg.Vals[0])
-							if err != nil {
-								return err.Error()
-							}
-							iter.globalSeqNum = uint64(v)
-						default:
-							return fmt.Sprintf("%s: unknown arg: %s", d.Cmd, arg.Key)
 						}
-					}
 
-					var b bytes.Buffer
-					for _, line := range strings.Split(d.Input, "\n") {
-						parts := strings.Fields(line)
-						if len(parts) == 0 {
-							continue
-						}
-						switch parts[0] {
-						case "seek-ge":
-							if len(parts) != 2 {
-								return fmt.Sprintf("seek-ge <key>\n")
+						var b bytes.Buffer
+						for _, line := range strings.Split(d.Input, "\n") {
+							parts := strings.Fields(line)
+							if len(parts) == 0 {
+								continue
 							}
-							iter.SeekGE([]byte(strings.TrimSpace(parts[1])))
-						case "seek-lt":
-							if len(parts) != 2 {
-								return fmt.Sprintf("seek-lt <key>\n")
+							switch parts[0] {
+							case "seek-ge":
+								if len(parts) != 2 {
+									return fmt.Sprintf("seek-ge <key>\n")
+								}
+								iter.SeekGE([]byte(strings.TrimSpace(parts[1])))
+							case "seek-lt":
+								if len(parts) != 2 {
+									return fmt.Sprintf("seek-lt <key>\n")
+								}
+								iter.SeekLT([]byte(strings.TrimSpace(parts[1])))
+							case "first":
+								iter.First()
+							case "last":
+								iter.Last()
+							case "next":
+								iter.Next()
+							case "prev":
+								iter.Prev()
+							}
+							if iter.Valid() {
+								fmt.Fprintf(&b, "<%s:%d>", iter.Key().UserKey, iter.Key().SeqNum())
+							} else if err := iter.Error(); err != nil {
+								fmt.Fprintf(&b, "<err=%v>", err)
+							} else {
+								fmt.Fprintf(&b, ".")
 							}
-							iter.SeekLT([]byte(strings.TrimSpace(parts[1])))
-						case "first":
-							iter.First()
-						case "last":
-							iter.Last()
-						case "next":
-							iter.Next()
-						case "prev":
-							iter.Prev()
-						}
-						if iter.Valid() {
-							fmt.Fprintf(&b, "<%s:%d>", iter.Key().UserKey, iter.Key().SeqNum())
-						} else if err := iter.Error(); err != nil {
-							fmt.Fprintf(&b, "<err=%v>", err)
-						} else {
-							fmt.Fprintf(&b, ".")
 						}
+						b.WriteString("\n")
+						return b.String()
+
+					default:
+						return fmt.Sprintf("unknown command: %s", d.Cmd)
 					}
-					b.WriteString("\n")
-					return b.String()
+				})
+			})
+		}
+	}
+}
+
+func TestBlockHashIndex(t *testing.T) {
+	for _, restartInterval := range []int{3, 4, 16} {
+		t.Run(fmt.Sprintf("restart=%d", restartInterval), func(t *testing.T) {
+			w := &blockWriter{
+				restartInterval: restartInterval,
+				hashIndex:       newHashIndexWriter(0.75),
+			}
+			// Each user key has two versions, which may straddle a restart point.
+			var keys []string
+			for i := 0; i < 200; i++ {
+				key := fmt.Sprintf("%05d", 2*i)
+				keys = append(keys, key)
+				w.add(db.MakeInternalKey([]byte(key), 2, db.InternalKeyKindSet), []byte("new"))
+				w.add(db.MakeInternalKey([]byte(key), 1, db.InternalKeyKindSet), []byte("old"))
+			}
+			it, err := newBlockIter(bytes.Compare, w.finish())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if it.hashIndex == nil {
+				t.Fatalf("expected hash index")
+			}
 
-				default:
-					return fmt.Sprintf("unknown command: %s", d.Cmd)
+			for _, key := range keys {
+				if !it.seekForGet([]byte(key)) {
+					t.Fatalf("%s: expected to find key", key)
 				}
-			})
+				if got := string(it.Key().UserKey); got != key {
+					t.Fatalf("expected %s, but found %s", key, got)
+				}
+				if got := string(it.Value()); got != "new" {
+					t.Fatalf("%s: expected new, but found %s", key, got)
+				}
+			}
+			for i := 0; i < 200; i++ {
+				key := fmt.Sprintf("%05d", 2*i+1)
+				if it.seekForGet([]byte(key)) && string(it.Key().UserKey) == key {
+					t.Fatalf("%s: unexpectedly found key", key)
+				}
+			}
+
+			// Iteration is unaffected by the hash index.
+			var n int
+			for valid := it.First(); valid; valid = it.Next() {
+				n++
+			}
+			if n != 2*len(keys) {
+				t.Fatalf("expected %d entries, but found %d", 2*len(keys), n)
+			}
+			if err := it.Close(); err != nil {
+				t.Fatal(err)
+			}
 		})
 	}
 }
 
+func TestBlockHashIndexTooManyRestarts(t *testing.T) {
+	w := &blockWriter{
+		restartInterval: 1,
+		hashIndex:       newHashIndexWriter(0.75),
+	}
+	var ikey db.InternalKey
+	for i := 0; i <= hashIndexMaxRestarts+1; i++ {
+		ikey.UserKey = []byte(fmt.Sprintf("%05d", i))
+		w.add(ikey, nil)
+	}
+	it, err := newBlockIter(bytes.Compare, w.finish())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if it.hashIndex != nil {
+		t.Fatalf("expected no hash index")
+	}
+	if !it.seekForGet([]byte("00100")) || string(it.Key().UserKey) != "00100" {
+		t.Fatalf("expected to find key")
+	}
+}
+
 func BenchmarkBlockIterSeekGE(b *testing.B) {
 	const blockSize = 32 << 10
 
@@ -358,3 +441,50 @@ func BenchmarkBlockIterPrev(b *testing.B) {
 			})
 	}
 }
+
+func BenchmarkBlockIterSeekForGet(b *testing.B) {
+	const blockSize = 32 << 10
+
+	for _, restartInterval := range []int{16} {
+		for _, hash := range []bool{false, true} {
+			b.Run(fmt.Sprintf("restart=%d,hash=%t", restartInterval, hash),
+				func(b *testing.B) {
+					w := &blockWriter{
+						restartInterval: restartInterval,
+					}
+					if hash {
+						w.hashIndex = newHashIndexWriter(0.75)
+					}
+
+					var ikey db.InternalKey
+					var keys [][]byte
+					for i := 0; w.estimatedSize() < blockSize; i++ {
+						key := []byte(fmt.Sprintf("%05d", i))
+						keys = append(keys, key)
+						ikey.UserKey = key
+						w.add(ikey, nil)
+					}
+
+					it, err := newBlockIter(bytes.Compare, w.finish())
+					if err != nil {
+						b.Fatal(err)
+					}
+					rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+					b.ResetTimer()
+					for i := 0; i < b.N; i++ {
+						k := keys[rng.Intn(len(keys))]
+						it.seekForGet(k)
+						if testing.Verbose() {
+							if !it.Valid() {
+								b.Fatal("expected to find key")
+							}
+							if !bytes.Equal(k, it.Key().UserKey) {
+								b.Fatalf("expected %s, but found %s", k, it.Key().UserKey)
+							}
+						}
+					}
+				})
+		}
+	}
+}
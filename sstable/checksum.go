@@ -0,0 +1,188 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/internal/crc"
+	"github.com/petermattis/pebble/internal/xxhash"
+	"github.com/petermattis/pebble/storage"
+)
+
+// checksumTypeFor returns the checksum type recorded in the footer of tables
+// whose blocks are checksummed using c.
+func checksumTypeFor(c db.ChecksumType) uint8 {
+	switch c {
+	case db.XXHash32Checksum:
+		return checksumXXHash
+	case db.XXHash64Checksum:
+		return checksumXXHash64
+	default:
+		return checksumCRC32c
+	}
+}
+
+// blockChecksum returns the checksum stored in the trailer of a block, which
+// covers the block contents followed by the block type byte. The CRC32c
+// checksum is masked, while the xxHash checksums are stored as is, with the
+// xxHash64 checksum truncated to its low 32 bits.
+func blockChecksum(checksumType uint8, b []byte, blockType byte) uint32 {
+	switch checksumType {
+	case checksumXXHash:
+		var d xxhash.Digest32
+		d.Write(b)
+		d.Write([]byte{blockType})
+		return d.Sum32()
+	case checksumXXHash64:
+		var d xxhash.Digest64
+		d.Write(b)
+		d.Write([]byte{blockType})
+		return uint32(d.Sum64())
+	default:
+		return crc.New(b).Update([]byte{blockType}).Value()
+	}
+}
+
+// verifyBlockChecksum verifies the checksum in the trailer of a block read
+// from disk, which is the block contents followed by the trailer.
+func (r *Reader) verifyBlockChecksum(b []byte) error {
+	if r.checksumType == noChecksum {
+		return nil
+	}
+	n := len(b) - blockTrailerLen
+	checksum0 := binary.LittleEndian.Uint32(b[n+1:])
+	checksum1 := blockChecksum(r.checksumType, b[:n], b[n])
+	if checksum0 != checksum1 {
+		return errors.New("pebble/table: invalid table (checksum mismatch)")
+	}
+	return nil
+}
+
+// readBlockUncached reads a block from disk and verifies its checksum without
+// consulting or populating the cache. The block is decompressed if decompress
+// is true, which is not possible for data blocks compressed using a
+// dictionary.
+func (r *Reader) readBlockUncached(bh blockHandle, decompress bool) ([]byte, error) {
+	b := make([]byte, bh.length+blockTrailerLen)
+	if _, err := r.file.ReadAt(b, int64(bh.offset)); err != nil {
+		return nil, err
+	}
+	if err := r.verifyBlockChecksum(b); err != nil {
+		return nil, err
+	}
+	blockType := b[bh.length]
+	if !decompress || blockType == noCompressionBlockType {
+		return b[:bh.length], nil
+	}
+	return decompressBlock(compressors[blockType], blockType, b[:bh.length],
+		func(n int) []byte { return make([]byte, n) }, func([]byte) {})
+}
+
+// VerifyBlockChecksums reads every block of the table from disk, bypassing the
+// block cache, and verifies its checksum. The blocks are found by walking the
+// metaindex and index blocks, including the partitions of a two-level index or
+// a partitioned filter.
+func (r *Reader) VerifyBlockChecksums() error {
+	if r.err != nil {
+		return r.err
+	}
+	// forEachHandle calls fn with the block handle in each entry of the index
+	// block, or the metaindex block if raw is true.
+	forEachHandle := func(b []byte, raw bool, fn func(key []byte, bh blockHandle) error) error {
+		var iter interface {
+			First() bool
+			Next() bool
+			Key() db.InternalKey
+			Value() []byte
+			Close() error
+		}
+		var err error
+		if raw {
+			iter, err = newRawBlockIter(bytes.Compare, b)
+		} else {
+			iter, err = newBlockIter(r.compare, b)
+		}
+		if err != nil {
+			return err
+		}
+		for valid := iter.First(); valid; valid = iter.Next() {
+			bh, n := decodeBlockHandle(iter.Value())
+			if n == 0 || n != len(iter.Value()) {
+				iter.Close()
+				return errors.New("pebble/table: corrupt index entry")
+			}
+			if err := fn(iter.Key().UserKey, bh); err != nil {
+				iter.Close()
+				return err
+			}
+		}
+		return iter.Close()
+	}
+	verify := func(_ []byte, bh blockHandle) error {
+		_, err := r.readBlockUncached(bh, false)
+		return err
+	}
+
+	metaindex, err := r.readBlockUncached(r.metaindexBH, true)
+	if err != nil {
+		return err
+	}
+	err = forEachHandle(metaindex, true, func(key []byte, bh blockHandle) error {
+		if !bytes.HasPrefix(key, []byte("partitionedfilter.")) {
+			return verify(key, bh)
+		}
+		// The block is the index of a partitioned filter.
+		b, err := r.readBlockUncached(bh, true)
+		if err != nil {
+			return err
+		}
+		return forEachHandle(b, false, verify)
+	})
+	if err != nil {
+		return err
+	}
+
+	index, err := r.readBlockUncached(r.index.bh, true)
+	if err != nil {
+		return err
+	}
+	if r.Properties.IndexType != twoLevelIndex {
+		return forEachHandle(index, false, verify)
+	}
+	return forEachHandle(index, false, func(_ []byte, bh blockHandle) error {
+		b, err := r.readBlockUncached(bh, true)
+		if err != nil {
+			return err
+		}
+		return forEachHandle(b, false, verify)
+	})
+}
+
+// FileChecksum returns the CRC32c of the entire contents of the file, which
+// for a table is the checksum computed by the Writer.
+func FileChecksum(f storage.File) (uint32, error) {
+	stat, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	var c crc.CRC
+	buf := make([]byte, 256<<10)
+	for off, size := int64(0), stat.Size(); off < size; {
+		n := int64(len(buf))
+		if n > size-off {
+			n = size - off
+		}
+		if _, err := f.ReadAt(buf[:n], off); err != nil {
+			return 0, err
+		}
+		c = c.Update(buf[:n])
+		off += n
+	}
+	return uint32(c), nil
+}
@@ -0,0 +1,279 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/golang/snappy"
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/internal/lz4"
+	"github.com/petermattis/pebble/internal/zstd"
+)
+
+// Compressor compresses and decompresses the contents of blocks. A compressor
+// is registered for the block type byte it is identified by in the block
+// trailer.
+type Compressor interface {
+	// Compress returns the compressed form of src. The returned slice may be a
+	// sub-slice of dst if dst has sufficient capacity.
+	Compress(dst, src []byte) []byte
+	// DecodedLen returns the length of the decompressed form of src.
+	DecodedLen(src []byte) (int, error)
+	// Decompress decompresses src into dst, whose length is the decompressed
+	// length returned by DecodedLen.
+	Decompress(dst, src []byte) error
+}
+
+// DictCompressor is implemented by compressors which support compression
+// dictionaries. A block compressed using a dictionary can only be decompressed
+// using the same dictionary.
+type DictCompressor interface {
+	Compressor
+	// WithDict returns a compressor which compresses and decompresses blocks
+	// using the dictionary. The compressor does not retain dict.
+	WithDict(dict []byte) (Compressor, error)
+}
+
+// compressors is indexed by block type.
+var compressors [256]Compressor
+
+// RegisterCompressor registers the compressor for a block type, replacing any
+// compressor previously registered for it. It is not safe to call
+// concurrently with the reading or writing of tables, and is intended to be
+// called from an init function.
+func RegisterCompressor(blockType byte, c Compressor) {
+	if blockType == noCompressionBlockType {
+		panic("pebble/table: cannot register a compressor for uncompressed blocks")
+	}
+	compressors[blockType] = c
+}
+
+func init() {
+	RegisterCompressor(snappyCompressionBlockType, snappyCompressor{})
+	RegisterCompressor(lz4CompressionBlockType, lz4Compressor{})
+	// LZ4HC produces blocks in the same format as LZ4, using a slower search
+	// for matches.
+	RegisterCompressor(lz4hcCompressionBlockType, lz4Compressor{})
+	RegisterCompressor(zstdCompressionBlockType, zstdCompressor{})
+	RegisterCompressor(zstdNotFinalCompressionBlockType, zstdCompressor{})
+}
+
+// compressionBlockType returns the block type used for blocks compressed
+// using c.
+func compressionBlockType(c db.Compression) byte {
+	switch c {
+	case db.SnappyCompression:
+		return snappyCompressionBlockType
+	case db.LZ4Compression:
+		return lz4CompressionBlockType
+	case db.ZstdCompression:
+		return zstdCompressionBlockType
+	default:
+		return noCompressionBlockType
+	}
+}
+
+// decompressBlock decompresses a block of the given type using c into a
+// buffer obtained from alloc. The compressor is usually that registered for
+// the block type, unless the block was compressed using a dictionary.
+func decompressBlock(
+	c Compressor, blockType byte, b []byte, alloc func(n int) []byte, free func([]byte),
+) ([]byte, error) {
+	if c == nil {
+		return nil, fmt.Errorf("pebble/table: unknown block compression: %d", blockType)
+	}
+	n, err := c.DecodedLen(b)
+	if err != nil {
+		return nil, err
+	}
+	decoded := alloc(n)
+	if err := c.Decompress(decoded, b); err != nil {
+		free(decoded)
+		return nil, err
+	}
+	return decoded, nil
+}
+
+var errCorruptCompressedBlock = errors.New("pebble/table: corrupt compressed block")
+
+type snappyCompressor struct{}
+
+func (snappyCompressor) Compress(dst, src []byte) []byte {
+	return snappy.Encode(dst[:cap(dst)], src)
+}
+
+func (snappyCompressor) DecodedLen(src []byte) (int, error) {
+	return snappy.DecodedLen(src)
+}
+
+func (snappyCompressor) Decompress(dst, src []byte) error {
+	decoded, err := snappy.Decode(dst, src)
+	if err != nil {
+		return err
+	}
+	if len(decoded) != len(dst) {
+		return errCorruptCompressedBlock
+	}
+	return nil
+}
+
+// The LZ4 and Zstd block contents are prefixed by the varint32 encoded length
+// of the decompressed data, as written by RocksDB for format version 2 and
+// above.
+
+// appendDecodedLen returns dst with room for at least n bytes, prefixed by the
+// varint encoded decompressed length, and the length of the prefix.
+func appendDecodedLen(dst []byte, decodedLen, n int) ([]byte, int) {
+	n += binary.MaxVarintLen32
+	if cap(dst) < n {
+		dst = make([]byte, n)
+	}
+	k := binary.PutUvarint(dst[:cap(dst)], uint64(decodedLen))
+	return dst, k
+}
+
+func readDecodedLen(src []byte) (int, int, error) {
+	v, k := binary.Uvarint(src)
+	if k <= 0 || v > 1<<32-1 {
+		return 0, 0, errCorruptCompressedBlock
+	}
+	return int(v), k, nil
+}
+
+type lz4Compressor struct{}
+
+func (lz4Compressor) Compress(dst, src []byte) []byte {
+	dst, k := appendDecodedLen(dst, len(src), lz4.MaxEncodedLen(len(src)))
+	encoded := lz4.Encode(dst[k:k], src)
+	return dst[:k+len(encoded)]
+}
+
+func (lz4Compressor) DecodedLen(src []byte) (int, error) {
+	n, _, err := readDecodedLen(src)
+	return n, err
+}
+
+func (lz4Compressor) Decompress(dst, src []byte) error {
+	_, k, err := readDecodedLen(src)
+	if err != nil {
+		return err
+	}
+	n, err := lz4.Decode(dst, src[k:])
+	if err != nil {
+		return err
+	}
+	if n != len(dst) {
+		return errCorruptCompressedBlock
+	}
+	return nil
+}
+
+func (lz4Compressor) WithDict(dict []byte) (Compressor, error) {
+	// Matches may only reach back 64KB, so only the end of a larger dictionary
+	// is of use.
+	if len(dict) > 1<<16 {
+		dict = dict[len(dict)-1<<16:]
+	}
+	return lz4DictCompressor{dict: append([]byte(nil), dict...)}, nil
+}
+
+type lz4DictCompressor struct {
+	dict []byte
+}
+
+func (c lz4DictCompressor) Compress(dst, src []byte) []byte {
+	dst, k := appendDecodedLen(dst, len(src), lz4.MaxEncodedLen(len(src)))
+	encoded := lz4.EncodeDict(dst[k:k], src, c.dict)
+	return dst[:k+len(encoded)]
+}
+
+func (lz4DictCompressor) DecodedLen(src []byte) (int, error) {
+	n, _, err := readDecodedLen(src)
+	return n, err
+}
+
+func (c lz4DictCompressor) Decompress(dst, src []byte) error {
+	_, k, err := readDecodedLen(src)
+	if err != nil {
+		return err
+	}
+	n, err := lz4.DecodeDict(dst, src[k:], c.dict)
+	if err != nil {
+		return err
+	}
+	if n != len(dst) {
+		return errCorruptCompressedBlock
+	}
+	return nil
+}
+
+type zstdCompressor struct{}
+
+func (zstdCompressor) Compress(dst, src []byte) []byte {
+	dst, k := appendDecodedLen(dst, len(src), zstd.MaxEncodedLen(len(src)))
+	encoded := zstd.Encode(dst[k:k], src)
+	return dst[:k+len(encoded)]
+}
+
+func (zstdCompressor) DecodedLen(src []byte) (int, error) {
+	n, _, err := readDecodedLen(src)
+	return n, err
+}
+
+func (zstdCompressor) Decompress(dst, src []byte) error {
+	_, k, err := readDecodedLen(src)
+	if err != nil {
+		return err
+	}
+	n, err := zstd.Decode(dst, src[k:])
+	if err != nil {
+		return err
+	}
+	if n != len(dst) {
+		return errCorruptCompressedBlock
+	}
+	return nil
+}
+
+func (zstdCompressor) WithDict(dict []byte) (Compressor, error) {
+	d, err := zstd.NewDict(dict)
+	if err != nil {
+		return nil, err
+	}
+	return zstdDictCompressor{dict: d}, nil
+}
+
+type zstdDictCompressor struct {
+	dict *zstd.Dict
+}
+
+func (c zstdDictCompressor) Compress(dst, src []byte) []byte {
+	dst, k := appendDecodedLen(dst, len(src), zstd.MaxEncodedLen(len(src)))
+	encoded := zstd.EncodeDict(dst[k:k], src, c.dict)
+	return dst[:k+len(encoded)]
+}
+
+func (zstdDictCompressor) DecodedLen(src []byte) (int, error) {
+	n, _, err := readDecodedLen(src)
+	return n, err
+}
+
+func (c zstdDictCompressor) Decompress(dst, src []byte) error {
+	_, k, err := readDecodedLen(src)
+	if err != nil {
+		return err
+	}
+	n, err := zstd.DecodeDict(dst, src[k:], c.dict)
+	if err != nil {
+		return err
+	}
+	if n != len(dst) {
+		return errCorruptCompressedBlock
+	}
+	return nil
+}
@@ -5,17 +5,140 @@
 package sstable
 
 import (
+	"encoding/binary"
+
 	"github.com/petermattis/pebble/db"
 )
 
+// filterBaseLog is the log2 of the range of data block offsets covered by each
+// filter in a block-based filter block. A new filter is started every 2KB.
+const filterBaseLog = 11
+
 type filterWriter interface {
 	addKey(key []byte)
 	finishBlock(blockOffset uint64) error
+	// finishPartition is called when an index partition is finished. The given
+	// key is the last key in the partition.
+	finishPartition(sep db.InternalKey)
 	finish() ([]byte, error)
 	metaName() string
 	policyName() string
 }
 
+type blockFilterReader struct {
+	policy db.FilterPolicy
+}
+
+func newBlockFilterReader(policy db.FilterPolicy) *blockFilterReader {
+	return &blockFilterReader{
+		policy: policy,
+	}
+}
+
+// mayContain returns whether the filter for the data block at the given offset
+// may contain the key. The data is the entire filter block: the per-block
+// filters, followed by the uint32 offset of each filter, the uint32 offset of
+// those offsets, and the base log.
+func (f *blockFilterReader) mayContain(data []byte, blockOffset uint64, key []byte) bool {
+	n := len(data)
+	if n < 5 {
+		return true
+	}
+	shift := uint(data[n-1])
+	offsets := binary.LittleEndian.Uint32(data[n-5:])
+	if uint64(offsets) > uint64(n-5) {
+		return true
+	}
+	num := uint64(n-5-int(offsets)) / 4
+	index := blockOffset >> shift
+	if index >= num {
+		// Errors are treated as potential matches.
+		return true
+	}
+	start := binary.LittleEndian.Uint32(data[uint64(offsets)+4*index:])
+	// NB: the limit of the last filter is the offset of the offsets.
+	limit := binary.LittleEndian.Uint32(data[uint64(offsets)+4*index+4:])
+	if start > limit || limit > offsets {
+		return true
+	}
+	if start == limit {
+		// Empty filters do not match any keys.
+		return false
+	}
+	return f.policy.MayContain(db.BlockFilter, data[start:limit], key)
+}
+
+type blockFilterWriter struct {
+	policy db.FilterPolicy
+	writer db.FilterWriter
+	// numKeys is the number of keys added to the current filter.
+	numKeys int
+	// data and offsets are the per-block filters for the overall table.
+	data    []byte
+	offsets []uint32
+}
+
+func newBlockFilterWriter(policy db.FilterPolicy) *blockFilterWriter {
+	return &blockFilterWriter{
+		policy: policy,
+		writer: policy.NewWriter(db.BlockFilter),
+	}
+}
+
+func (f *blockFilterWriter) addKey(key []byte) {
+	f.numKeys++
+	f.writer.AddKey(key)
+}
+
+func (f *blockFilterWriter) emit() {
+	f.offsets = append(f.offsets, uint32(len(f.data)))
+	if f.numKeys == 0 {
+		return
+	}
+	f.data = f.writer.Finish(f.data)
+	f.numKeys = 0
+}
+
+func (f *blockFilterWriter) finishBlock(blockOffset uint64) error {
+	// The filter for the keys of a data block is keyed by the offset of the
+	// block. The given offset is that of the next block, so emit filters until
+	// the filter covering that offset is the current one.
+	for i := blockOffset >> filterBaseLog; i > uint64(len(f.offsets)); {
+		f.emit()
+	}
+	return nil
+}
+
+func (f *blockFilterWriter) finishPartition(sep db.InternalKey) {
+	// NB: block filters have nothing to do when an index partition is finished.
+}
+
+func (f *blockFilterWriter) finish() ([]byte, error) {
+	if f.numKeys != 0 {
+		f.emit()
+	}
+	// Append the offsets of the per-block filters, followed by the offset of
+	// the offsets and the base log.
+	n := len(f.data)
+	var tmp [4]byte
+	for _, x := range f.offsets {
+		binary.LittleEndian.PutUint32(tmp[:], x)
+		f.data = append(f.data, tmp[:]...)
+	}
+	binary.LittleEndian.PutUint32(tmp[:], uint32(n))
+	f.data = append(f.data, tmp[:]...)
+	f.data = append(f.data, filterBaseLog)
+	return f.data, nil
+}
+
+func (f *blockFilterWriter) metaName() string {
+	return "filter." + f.policy.Name()
+}
+
+func (f *blockFilterWriter) policyName() string {
+	return f.policy.Name()
+}
+
 type tableFilterReader struct {
 	policy db.FilterPolicy
 }
@@ -54,6 +177,11 @@ func (f *tableFilterWriter) finishBlock(blockOffset uint64) error {
 	return nil
 }
 
+func (f *tableFilterWriter) finishPartition(sep db.InternalKey) {
+	// NB: table-level filters have nothing to do when an index partition is
+	// finished.
+}
+
 func (f *tableFilterWriter) finish() ([]byte, error) {
 	if f.count == 0 {
 		return nil, nil
@@ -68,3 +196,89 @@ func (f *tableFilterWriter) metaName() string {
 func (f *tableFilterWriter) policyName() string {
 	return f.policy.Name()
 }
+
+// partitionedFilterReader reads a partitioned filter. The filter block is a
+// top-level index mapping the last key of each partition to the block handle
+// of the partition, which is a table-level filter.
+type partitionedFilterReader struct {
+	policy db.FilterPolicy
+}
+
+func newPartitionedFilterReader(policy db.FilterPolicy) *partitionedFilterReader {
+	return &partitionedFilterReader{
+		policy: policy,
+	}
+}
+
+func (f *partitionedFilterReader) mayContain(data, key []byte) bool {
+	return f.policy.MayContain(db.TableFilter, data, key)
+}
+
+type filterPartition struct {
+	sep  db.InternalKey
+	data []byte
+}
+
+type partitionedFilterWriter struct {
+	policy     db.FilterPolicy
+	writer     db.FilterWriter
+	partitions []filterPartition
+	// writeBlock writes a finished partition to the table.
+	writeBlock func(b []byte) (blockHandle, error)
+}
+
+func newPartitionedFilterWriter(
+	policy db.FilterPolicy, writeBlock func(b []byte) (blockHandle, error),
+) *partitionedFilterWriter {
+	return &partitionedFilterWriter{
+		policy:     policy,
+		writer:     policy.NewWriter(db.TableFilter),
+		writeBlock: writeBlock,
+	}
+}
+
+func (f *partitionedFilterWriter) addKey(key []byte) {
+	f.writer.AddKey(key)
+}
+
+func (f *partitionedFilterWriter) finishBlock(blockOffset uint64) error {
+	// NB: partitioned filters are only cut when an index partition is finished.
+	return nil
+}
+
+func (f *partitionedFilterWriter) finishPartition(sep db.InternalKey) {
+	// NB: an empty partition is encoded as a valid filter which does not
+	// contain any keys.
+	f.partitions = append(f.partitions, filterPartition{
+		sep:  sep.Clone(),
+		data: f.writer.Finish(nil),
+	})
+}
+
+func (f *partitionedFilterWriter) finish() ([]byte, error) {
+	// Write the partitions, and return the top-level index of the partitions
+	// as the filter block.
+	index := blockWriter{
+		restartInterval: 1,
+	}
+	var tmp [blockHandleMaxLen]byte
+	for i := range f.partitions {
+		p := &f.partitions[i]
+		bh, err := f.writeBlock(p.data)
+		if err != nil {
+			return nil, err
+		}
+		n := encodeBlockHandle(tmp[:], bh)
+		index.add(p.sep, tmp[:n])
+	}
+	f.partitions = nil
+	return index.finish(), nil
+}
+
+func (f *partitionedFilterWriter) metaName() string {
+	return "partitionedfilter." + f.policy.Name()
+}
+
+func (f *partitionedFilterWriter) policyName() string {
+	return f.policy.Name()
+}
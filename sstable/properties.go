@@ -84,7 +84,9 @@ type Properties struct {
 	IndexPartitions uint64 `prop:"rocksdb.index.partitions"`
 	// The size of index block.
 	IndexSize uint64 `prop:"rocksdb.index.size"`
-	// The index type. TODO(peter): add a more detailed description.
+	// The index type: 0 for a single binary-searched index block, or 2 for a
+	// two-level index of partitions (kTwoLevelIndexSearch). The hash index (1)
+	// is not supported.
 	IndexType uint32 `prop:"rocksdb.block.based.table.index.type"`
 	// The name of the merge operator used in this table. Empty if no merge
 	// operator is used.
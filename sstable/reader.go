@@ -10,11 +10,10 @@ import (
 	"errors"
 	"fmt"
 	"sync"
+	"sync/atomic"
 
-	"github.com/golang/snappy"
 	"github.com/petermattis/pebble/cache"
 	"github.com/petermattis/pebble/db"
-	"github.com/petermattis/pebble/internal/crc"
 	"github.com/petermattis/pebble/storage"
 )
 
@@ -47,32 +46,175 @@ type block []byte
 
 // Iterator iterates over an entire table of data. It is a two-level iterator:
 // to seek for a given key, it first looks in the index for the block that
-// contains that key, and then looks inside that block.
+// contains that key, and then looks inside that block. If the table has a
+// two-level index, the index is itself partitioned: the top-level index is
+// searched for the partition containing the key, and that partition is then
+// searched for the data block.
 type Iterator struct {
-	reader    *Reader
-	index     blockIter
-	data      blockIter
-	err       error
-	closeHook func() error
+	reader *Reader
+	// topLevelIndex is only used if the table has a two-level index, in which
+	// case index iterates over the current index partition.
+	topLevelIndex blockIter
+	index         blockIter
+	data          blockIter
+	twoLevel      bool
+	err           error
+	closeHook     func() error
 }
 
 func (i *Iterator) init(r *Reader) error {
 	i.reader = r
-	var index block
-	index, i.err = r.readIndex()
+	i.twoLevel = r.Properties.IndexType == twoLevelIndex
+	var h cache.Handle
+	h, i.err = r.readIndex()
 	if i.err != nil {
 		return i.err
 	}
-	i.err = i.index.init(r.compare, index, r.Properties.GlobalSeqNum)
+	if i.twoLevel {
+		i.err = i.topLevelIndex.initHandle(r.compare, h, r.Properties.GlobalSeqNum)
+	} else {
+		i.err = i.index.initHandle(r.compare, h, r.Properties.GlobalSeqNum)
+	}
 	return i.err
 }
 
+// loadIndex loads the index partition at the current top-level index position
+// and leaves i.index unpositioned. If unsuccessful, it sets i.err to any error
+// encountered, which may be nil if we have simply exhausted the entire table.
+func (i *Iterator) loadIndex() bool {
+	if !i.topLevelIndex.Valid() {
+		if i.topLevelIndex.err != nil {
+			i.err = i.topLevelIndex.err
+		}
+		i.index.offset = 0
+		i.index.restarts = 0
+		return false
+	}
+	v := i.topLevelIndex.Value()
+	h, n := decodeBlockHandle(v)
+	if n == 0 || n != len(v) {
+		i.err = errors.New("pebble/table: corrupt top-level index entry")
+		return false
+	}
+	// Index partitions are loaded on demand and cached with the same high
+	// priority as other index blocks. Only the top-level index is pinned.
+	block, err := i.reader.readBlock(h, cache.IndexBlock, cache.HighPriority)
+	if err != nil {
+		i.err = err
+		return false
+	}
+	i.err = i.index.initHandle(i.reader.compare, block, i.reader.Properties.GlobalSeqNum)
+	return i.err == nil
+}
+
+// indexSeekGE positions the index at the first entry whose key is >= the given
+// key, loading the index partition containing that entry if necessary.
+func (i *Iterator) indexSeekGE(key []byte) bool {
+	if !i.twoLevel {
+		return i.index.SeekGE(key)
+	}
+	if !i.topLevelIndex.SeekGE(key) {
+		i.index.offset = 0
+		i.index.restarts = 0
+		return false
+	}
+	if !i.loadIndex() {
+		return false
+	}
+	if i.index.SeekGE(key) {
+		return true
+	}
+	return i.indexNextPartition()
+}
+
+// indexFirst positions the index at its first entry.
+func (i *Iterator) indexFirst() bool {
+	if !i.twoLevel {
+		return i.index.First()
+	}
+	if !i.topLevelIndex.First() || !i.loadIndex() {
+		return false
+	}
+	if i.index.First() {
+		return true
+	}
+	return i.indexNextPartition()
+}
+
+// indexLast positions the index at its last entry.
+func (i *Iterator) indexLast() bool {
+	if !i.twoLevel {
+		return i.index.Last()
+	}
+	if !i.topLevelIndex.Last() || !i.loadIndex() {
+		return false
+	}
+	if i.index.Last() {
+		return true
+	}
+	return i.indexPrevPartition()
+}
+
+// indexNext advances the index to its next entry, moving on to the next index
+// partition if the current one is exhausted.
+func (i *Iterator) indexNext() bool {
+	if i.index.Next() {
+		return true
+	}
+	if !i.twoLevel {
+		return false
+	}
+	return i.indexNextPartition()
+}
+
+// indexPrev moves the index to its previous entry, moving back to the previous
+// index partition if the current one is exhausted.
+func (i *Iterator) indexPrev() bool {
+	if i.index.Prev() {
+		return true
+	}
+	if !i.twoLevel {
+		return false
+	}
+	return i.indexPrevPartition()
+}
+
+// indexNextPartition positions the index at the first entry of the next
+// non-empty index partition.
+func (i *Iterator) indexNextPartition() bool {
+	for i.err == nil {
+		if !i.topLevelIndex.Next() || !i.loadIndex() {
+			return false
+		}
+		if i.index.First() {
+			return true
+		}
+	}
+	return false
+}
+
+// indexPrevPartition positions the index at the last entry of the previous
+// non-empty index partition.
+func (i *Iterator) indexPrevPartition() bool {
+	for i.err == nil {
+		if !i.topLevelIndex.Prev() || !i.loadIndex() {
+			return false
+		}
+		if i.index.Last() {
+			return true
+		}
+	}
+	return false
+}
+
 // loadBlock loads the block at the current index position and leaves i.data
 // unpositioned. If unsuccessful, it sets i.err to any error encountered, which
 // may be nil if we have simply exhausted the entire table.
 func (i *Iterator) loadBlock() bool {
 	if !i.index.Valid() {
-		i.err = i.index.err
+		if i.index.err != nil {
+			i.err = i.index.err
+		}
 		// TODO(peter): Need to test that seeking to a key outside of the sstable
 		// invalidates the iterator.
 		i.data.offset = 0
@@ -86,22 +228,24 @@ func (i *Iterator) loadBlock() bool {
 		i.err = errors.New("pebble/table: corrupt index entry")
 		return false
 	}
-	block, _, err := i.reader.readBlock(h)
+	block, err := i.reader.readBlock(h, cache.DataBlock, cache.LowPriority)
 	if err != nil {
 		i.err = err
 		return false
 	}
-	i.err = i.data.init(i.reader.compare, block, i.reader.Properties.GlobalSeqNum)
+	i.err = i.data.initHandle(i.reader.compare, block, i.reader.Properties.GlobalSeqNum)
 	return i.err == nil
 }
 
 // seekBlock loads the block at the current index position and positions i.data
-// at the first key in that block which is >= the given key. If unsuccessful,
-// it sets i.err to any error encountered, which may be nil if we have simply
-// exhausted the entire table.
+// for a point lookup of the given key, using the block's hash index if it has
+// one (see blockIter.seekForGet). If unsuccessful, it sets i.err to any error
+// encountered, which may be nil if we have simply exhausted the entire table.
 func (i *Iterator) seekBlock(key []byte) bool {
 	if !i.index.Valid() {
-		i.err = i.index.err
+		if i.index.err != nil {
+			i.err = i.index.err
+		}
 		return false
 	}
 	// Load the next block.
@@ -111,17 +255,17 @@ func (i *Iterator) seekBlock(key []byte) bool {
 		i.err = errors.New("pebble/table: corrupt index entry")
 		return false
 	}
-	block, _, err := i.reader.readBlock(h)
+	block, err := i.reader.readBlock(h, cache.DataBlock, cache.LowPriority)
 	if err != nil {
 		i.err = err
 		return false
 	}
-	i.err = i.data.init(i.reader.compare, block, i.reader.Properties.GlobalSeqNum)
+	i.err = i.data.initHandle(i.reader.compare, block, i.reader.Properties.GlobalSeqNum)
 	if i.err != nil {
 		return false
 	}
 	// Look for the key inside that block.
-	i.data.SeekGE(key)
+	i.data.seekForGet(key)
 	return true
 }
 
@@ -135,7 +279,7 @@ func (i *Iterator) SeekGE(key []byte) bool {
 	// NB: the top-level Iterator has already adjusted key based on
 	// IterOptions.LowerBound.
 
-	if !i.index.SeekGE(key) {
+	if !i.indexSeekGE(key) {
 		return false
 	}
 	if !i.loadBlock() {
@@ -154,8 +298,8 @@ func (i *Iterator) SeekLT(key []byte) bool {
 	// NB: the top-level Iterator has already adjusted key based on
 	// IterOptions.UpperBound.
 
-	if !i.index.SeekGE(key) {
-		i.index.Last()
+	if !i.indexSeekGE(key) && i.err == nil {
+		i.indexLast()
 	}
 	if !i.loadBlock() {
 		return false
@@ -174,7 +318,7 @@ func (i *Iterator) SeekLT(key []byte) bool {
 	// be chosen as "compleu". The SeekGE in the index block will then point
 	// us to the block containing "complexion". If this happens, we want the
 	// last key from the previous data block.
-	if !i.index.Prev() {
+	if !i.indexPrev() {
 		return false
 	}
 	if !i.loadBlock() {
@@ -193,7 +337,7 @@ func (i *Iterator) First() bool {
 	// NB: the top-level Iterator will call SeekGE if IterOptions.LowerBound is
 	// set.
 
-	if !i.index.First() {
+	if !i.indexFirst() {
 		return false
 	}
 	if !i.loadBlock() {
@@ -212,7 +356,7 @@ func (i *Iterator) Last() bool {
 	// NB: the top-level Iterator will call SeekLT if IterOptions.UpperBound is
 	// set.
 
-	if !i.index.Last() {
+	if !i.indexLast() {
 		return false
 	}
 	if !i.loadBlock() {
@@ -235,7 +379,7 @@ func (i *Iterator) Next() bool {
 			i.err = i.data.err
 			break
 		}
-		if !i.index.Next() {
+		if !i.indexNext() {
 			break
 		}
 		if i.loadBlock() {
@@ -259,7 +403,7 @@ func (i *Iterator) Prev() bool {
 			i.err = i.data.err
 			break
 		}
-		if !i.index.Prev() {
+		if !i.indexPrev() {
 			break
 		}
 		if i.loadBlock() {
@@ -309,6 +453,9 @@ func (i *Iterator) Close() error {
 			return err
 		}
 	}
+	// Any error from the index blocks has already been recorded in i.err.
+	_ = i.topLevelIndex.Close()
+	_ = i.index.Close()
 	if err := i.data.Close(); err != nil {
 		return err
 	}
@@ -321,21 +468,67 @@ type weakCachedBlock struct {
 	handle cache.WeakHandle
 }
 
+// compressionDict holds the compression dictionary of a table, along with the
+// compressor that decompresses data blocks using it.
+type compressionDict struct {
+	mu         sync.Mutex
+	dict       []byte
+	blockType  byte
+	compressor Compressor
+}
+
+// compressorFor returns the compressor which decompresses data blocks of the
+// given type using the dictionary. The compressor is prepared on first use,
+// and retained for the lifetime of the reader.
+func (d *compressionDict) compressorFor(blockType byte) (Compressor, error) {
+	dc, ok := compressors[blockType].(DictCompressor)
+	if !ok {
+		// Compressors which do not support dictionaries ignore them.
+		return compressors[blockType], nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.compressor == nil || d.blockType != blockType {
+		c, err := dc.WithDict(d.dict)
+		if err != nil {
+			return nil, err
+		}
+		d.blockType = blockType
+		d.compressor = c
+	}
+	return d.compressor, nil
+}
+
 // Reader is a table reader.
 type Reader struct {
-	file        storage.File
-	fileNum     uint64
-	err         error
+	file    storage.File
+	fileNum uint64
+	err     error
+	// metaindexBH is the block handle of the metaindex block.
+	metaindexBH blockHandle
 	index       weakCachedBlock
 	filter      weakCachedBlock
 	rangeDel    weakCachedBlock
 	rangeDelV2  bool
-	opts        *db.Options
-	cache       *cache.Cache
-	compare     db.Compare
-	split       db.Split
-	tableFilter *tableFilterReader
-	Properties  Properties
+	// checksumType is the checksum type recorded in the footer. The blocks of
+	// tables written without checksums are not verified.
+	checksumType uint8
+	opts         *db.Options
+	cache        *cache.Cache
+	compare      db.Compare
+	split        db.Split
+	// At most one of tableFilter, blockFilter and partitionedFilter is set,
+	// according to the type of the filter block.
+	tableFilter       *tableFilterReader
+	blockFilter       *blockFilterReader
+	partitionedFilter *partitionedFilterReader
+	// compressionDict is nil unless the data blocks are compressed against a
+	// compression dictionary.
+	compressionDict *compressionDict
+	// pinned is 1 while the index and filter blocks are pinned in the block
+	// cache. Accessed atomically.
+	pinned     int32
+	Properties Properties
 }
 
 // Close implements DB.Close, as documented in the pebble package.
@@ -347,6 +540,7 @@ func (r *Reader) Close() error {
 		}
 		return r.err
 	}
+	r.UnpinIndexAndFilter()
 	if r.file != nil {
 		r.err = r.file.Close()
 		r.file = nil
@@ -366,25 +560,48 @@ func (r *Reader) get(key []byte, o *db.IterOptions) (value []byte, err error) {
 		return nil, r.err
 	}
 
-	if r.tableFilter != nil {
-		data, err := r.readFilter()
+	var lookupKey []byte
+	if r.split != nil {
+		lookupKey = key[:r.split(key)]
+	} else {
+		lookupKey = key
+	}
+
+	switch {
+	case r.tableFilter != nil:
+		h, err := r.readFilter()
 		if err != nil {
 			return nil, err
 		}
-		var lookupKey []byte
-		if r.split != nil {
-			lookupKey = key[:r.split(key)]
-		} else {
-			lookupKey = key
+		mayContain := r.tableFilter.mayContain(h.Get(), lookupKey)
+		h.Release()
+		if !mayContain {
+			return nil, db.ErrNotFound
+		}
+	case r.partitionedFilter != nil:
+		mayContain, err := r.partitionedFilterMayContain(key, lookupKey)
+		if err != nil {
+			return nil, err
 		}
-		if !r.tableFilter.mayContain(data, lookupKey) {
+		if !mayContain {
 			return nil, db.ErrNotFound
 		}
 	}
 
 	i := &Iterator{}
 	if err := i.init(r); err == nil {
-		i.index.SeekGE(key)
+		if i.indexSeekGE(key) && r.blockFilter != nil {
+			mayContain, err := r.blockFilterMayContain(i.index.Value(), lookupKey)
+			if err != nil || !mayContain {
+				if err1 := i.Close(); err == nil {
+					err = err1
+				}
+				if err == nil {
+					err = db.ErrNotFound
+				}
+				return nil, err
+			}
+		}
 		i.seekBlock(key)
 	}
 
@@ -395,7 +612,11 @@ func (r *Reader) get(key []byte, o *db.IterOptions) (value []byte, err error) {
 		}
 		return nil, err
 	}
-	return i.Value(), i.Close()
+	// The value refers to the block, which may be freed once the iterator is
+	// closed.
+	value = make([]byte, len(i.Value()))
+	copy(value, i.Value())
+	return value, i.Close()
 }
 
 // NewIter returns an internal iterator for the contents of the table.
@@ -418,11 +639,17 @@ func (r *Reader) NewRangeDelIter(o *db.IterOptions) *blockIter {
 	if r.rangeDel.bh.length == 0 {
 		return nil
 	}
-	b, err := r.readRangeDel()
+	h, err := r.readRangeDel()
 	if err != nil {
 		// TODO(peter): propagate the error
 		panic(err)
 	}
+	// The range-del iterator is not required to be closed, and range deletions
+	// outlive the iterator when they are added to a fragmenter, so it does not
+	// hold a reference to the cached block. Range-del blocks are small, and are
+	// copied onto the Go heap instead.
+	b := append([]byte(nil), h.Get()...)
+	h.Release()
 	i := &blockIter{}
 	if err := i.init(r.compare, b, r.Properties.GlobalSeqNum); err != nil {
 		// TODO(peter): propagate the error
@@ -431,30 +658,124 @@ func (r *Reader) NewRangeDelIter(o *db.IterOptions) *blockIter {
 	return i
 }
 
-func (r *Reader) readIndex() (block, error) {
-	return r.readWeakCachedBlock(&r.index)
+// PinIndexAndFilter loads the index and filter blocks into the block cache
+// and pins them, preventing them from being evicted until the reader is
+// closed or UnpinIndexAndFilter is called. By default, the index and filter
+// blocks are cached with high priority, which retains them in preference to
+// data blocks.
+func (r *Reader) PinIndexAndFilter() error {
+	if r.err != nil {
+		return r.err
+	}
+	atomic.StoreInt32(&r.pinned, 1)
+	h, err := r.readBlock(r.index.bh, cache.IndexBlock, cache.Pinned)
+	if err != nil {
+		return err
+	}
+	h.Release()
+	if r.hasFilter() {
+		h, err := r.readBlock(r.filter.bh, cache.FilterBlock, cache.Pinned)
+		if err != nil {
+			return err
+		}
+		h.Release()
+	}
+	return nil
+}
+
+// UnpinIndexAndFilter reduces the priority of the index and filter blocks
+// pinned by PinIndexAndFilter to high priority, allowing them to be evicted.
+// It is a no-op if the blocks are not pinned. UnpinIndexAndFilter is safe to
+// call concurrently with reads.
+func (r *Reader) UnpinIndexAndFilter() {
+	if !atomic.CompareAndSwapInt32(&r.pinned, 1, 0) {
+		return
+	}
+	r.cache.Unpin(r.fileNum, r.index.bh.offset)
+	if r.hasFilter() {
+		r.cache.Unpin(r.fileNum, r.filter.bh.offset)
+	}
 }
 
-func (r *Reader) readFilter() (block, error) {
-	return r.readWeakCachedBlock(&r.filter)
+func (r *Reader) readIndex() (cache.Handle, error) {
+	return r.readWeakCachedBlock(&r.index, cache.IndexBlock, cache.HighPriority)
 }
 
-func (r *Reader) readRangeDel() (block, error) {
+func (r *Reader) readFilter() (cache.Handle, error) {
+	return r.readWeakCachedBlock(&r.filter, cache.FilterBlock, cache.HighPriority)
+}
+
+func (r *Reader) hasFilter() bool {
+	return r.tableFilter != nil || r.blockFilter != nil || r.partitionedFilter != nil
+}
+
+// blockFilterMayContain returns whether the filter for the data block referred
+// to by the index entry may contain the key.
+func (r *Reader) blockFilterMayContain(indexValue, key []byte) (bool, error) {
+	bh, n := decodeBlockHandle(indexValue)
+	if n == 0 || n != len(indexValue) {
+		return false, errors.New("pebble/table: corrupt index entry")
+	}
+	h, err := r.readFilter()
+	if err != nil {
+		return false, err
+	}
+	mayContain := r.blockFilter.mayContain(h.Get(), bh.offset, key)
+	h.Release()
+	return mayContain, nil
+}
+
+// partitionedFilterMayContain returns whether the filter partition covering
+// key may contain lookupKey, which is either key or its prefix. Only the
+// top-level filter index and the relevant partition are loaded.
+func (r *Reader) partitionedFilterMayContain(key, lookupKey []byte) (bool, error) {
+	h, err := r.readFilter()
+	if err != nil {
+		return false, err
+	}
+	var iter blockIter
+	if err := iter.initHandle(r.compare, h, r.Properties.GlobalSeqNum); err != nil {
+		iter.Close()
+		return false, err
+	}
+	if !iter.SeekGE(key) {
+		// The key is larger than every key in the table.
+		return false, iter.Close()
+	}
+	v := iter.Value()
+	bh, n := decodeBlockHandle(v)
+	if n == 0 || n != len(v) {
+		iter.Close()
+		return false, errors.New("pebble/table: corrupt filter index entry")
+	}
+	if err := iter.Close(); err != nil {
+		return false, err
+	}
+	h, err = r.readBlock(bh, cache.FilterBlock, cache.HighPriority)
+	if err != nil {
+		return false, err
+	}
+	mayContain := r.partitionedFilter.mayContain(h.Get(), lookupKey)
+	h.Release()
+	return mayContain, nil
+}
+
+func (r *Reader) readRangeDel() (cache.Handle, error) {
 	// Fast-path for retrieving the block from a weak cache handle.
 	r.rangeDel.mu.RLock()
-	var b []byte
+	var h cache.Handle
 	if r.rangeDel.handle != nil {
-		b = r.rangeDel.handle.Get()
+		h = r.rangeDel.handle.Get()
 	}
 	r.rangeDel.mu.RUnlock()
-	if b != nil {
-		return b, nil
+	if h.Get() != nil {
+		return h, nil
 	}
 
 	// Slow-path: read the index block from disk. This checks the cache again,
 	// but that is ok because somebody else might have inserted it for us.
-	b, h, err := r.readBlock(r.rangeDel.bh)
-	if err == nil && h != nil {
+	h, err := r.readBlock(r.rangeDel.bh, cache.RangeDelBlock, cache.LowPriority)
+	if weak := h.Weak(); err == nil && weak != nil {
 		if !r.rangeDelV2 {
 			// TODO(peter): if we have a v1 range-del block, convert it on the fly
 			// and cache the converted version. We just need to create a
@@ -465,72 +786,89 @@ func (r *Reader) readRangeDel() (block, error) {
 		}
 
 		r.rangeDel.mu.Lock()
-		r.rangeDel.handle = h
+		r.rangeDel.handle = weak
 		r.rangeDel.mu.Unlock()
 	}
-	return b, err
+	return h, err
 }
 
-func (r *Reader) readWeakCachedBlock(w *weakCachedBlock) (block, error) {
+func (r *Reader) readWeakCachedBlock(
+	w *weakCachedBlock, t cache.BlockType, p cache.Priority,
+) (cache.Handle, error) {
 	// Fast-path for retrieving the block from a weak cache handle.
 	w.mu.RLock()
-	var b []byte
+	var h cache.Handle
 	if w.handle != nil {
-		b = w.handle.Get()
+		h = w.handle.Get()
 	}
 	w.mu.RUnlock()
-	if b != nil {
-		return b, nil
+	if h.Get() != nil {
+		return h, nil
 	}
 
 	// Slow-path: read the index block from disk. This checks the cache again,
 	// but that is ok because somebody else might have inserted it for us.
-	b, h, err := r.readBlock(w.bh)
-	if err == nil && h != nil {
+	h, err := r.readBlock(w.bh, t, p)
+	if weak := h.Weak(); err == nil && weak != nil {
 		w.mu.Lock()
-		w.handle = h
+		w.handle = weak
 		w.mu.Unlock()
 	}
-	return b, err
+	return h, err
 }
 
-// readBlock reads and decompresses a block from disk into memory.
-func (r *Reader) readBlock(bh blockHandle) (block, cache.WeakHandle, error) {
-	if b := r.cache.Get(r.fileNum, bh.offset); b != nil {
-		return b, nil, nil
+// readBlock reads and decompresses a block from disk into memory. A block
+// read from disk is added to the cache with the specified type and priority.
+// The returned handle must be released once the block is no longer in use.
+func (r *Reader) readBlock(
+	bh blockHandle, t cache.BlockType, p cache.Priority,
+) (cache.Handle, error) {
+	if h := r.cache.Get(r.fileNum, bh.offset, t); h.Get() != nil {
+		if p == cache.Pinned {
+			// The block may have been cached with a lower priority.
+			r.cache.Pin(r.fileNum, bh.offset)
+		}
+		return h, nil
+	}
+	if h := r.cache.GetSecondary(r.fileNum, bh.offset, t, p); h.Get() != nil {
+		return h, nil
 	}
 
-	b := make([]byte, bh.length+blockTrailerLen)
+	b := r.cache.Alloc(int(bh.length + blockTrailerLen))
 	if _, err := r.file.ReadAt(b, int64(bh.offset)); err != nil {
-		return nil, nil, err
-	}
-	checksum0 := binary.LittleEndian.Uint32(b[bh.length+1:])
-	checksum1 := crc.New(b[:bh.length+1]).Value()
-	if checksum0 != checksum1 {
-		return nil, nil, errors.New("pebble/table: invalid table (checksum mismatch)")
-	}
-	switch b[bh.length] {
-	case noCompressionBlockType:
-		b = b[:bh.length]
-		h := r.cache.Set(r.fileNum, bh.offset, b)
-		return b, h, nil
-	case snappyCompressionBlockType:
-		b, err := snappy.Decode(nil, b[:bh.length])
-		if err != nil {
-			return nil, nil, err
+		r.cache.Free(b)
+		return cache.Handle{}, err
+	}
+	if err := r.verifyBlockChecksum(b); err != nil {
+		r.cache.Free(b)
+		return cache.Handle{}, err
+	}
+	if b[bh.length] == noCompressionBlockType {
+		return r.cache.Set(r.fileNum, bh.offset, b[:bh.length], t, p), nil
+	}
+	defer r.cache.Free(b)
+	blockType := b[bh.length]
+	c := compressors[blockType]
+	if t == cache.DataBlock && r.compressionDict != nil {
+		var err error
+		if c, err = r.compressionDict.compressorFor(blockType); err != nil {
+			return cache.Handle{}, err
 		}
-		h := r.cache.Set(r.fileNum, bh.offset, b)
-		return b, h, nil
 	}
-	return nil, nil, fmt.Errorf("pebble/table: unknown block compression: %d", b[bh.length])
+	decoded, err := decompressBlock(c, blockType, b[:bh.length], r.cache.Alloc, r.cache.Free)
+	if err != nil {
+		return cache.Handle{}, err
+	}
+	return r.cache.Set(r.fileNum, bh.offset, decoded, t, p), nil
 }
 
 func (r *Reader) readMetaindex(metaindexBH blockHandle, o *db.Options) error {
-	b, _, err := r.readBlock(metaindexBH)
+	h, err := r.readBlock(metaindexBH, cache.MetaBlock, cache.LowPriority)
 	if err != nil {
 		return err
 	}
-	i, err := newRawBlockIter(bytes.Compare, b)
+	defer h.Release()
+	i, err := newRawBlockIter(bytes.Compare, h.Get())
 	if err != nil {
 		return err
 	}
@@ -548,13 +886,26 @@ func (r *Reader) readMetaindex(metaindexBH blockHandle, o *db.Options) error {
 	}
 
 	if bh, ok := meta[metaPropertiesName]; ok {
-		b, _, err = r.readBlock(bh)
+		h, err := r.readBlock(bh, cache.MetaBlock, cache.LowPriority)
+		if err != nil {
+			return err
+		}
+		err = r.Properties.load(h.Get(), bh.offset)
+		h.Release()
 		if err != nil {
 			return err
 		}
-		if err := r.Properties.load(b, bh.offset); err != nil {
+	}
+
+	if bh, ok := meta[metaCompressionDictName]; ok {
+		// The dictionary is read through the cache once, and retained by the
+		// reader as it is needed to read any data block.
+		h, err := r.readBlock(bh, cache.MetaBlock, cache.LowPriority)
+		if err != nil {
 			return err
 		}
+		r.compressionDict = &compressionDict{dict: append([]byte(nil), h.Get()...)}
+		h.Release()
 	}
 
 	if bh, ok := meta[metaRangeDelV2Name]; ok {
@@ -574,6 +925,8 @@ func (r *Reader) readMetaindex(metaindexBH blockHandle, o *db.Options) error {
 			prefix string
 		}{
 			{db.TableFilter, "fullfilter."},
+			{db.BlockFilter, "filter."},
+			{db.PartitionedFilter, "partitionedfilter."},
 		}
 		var done bool
 		for _, t := range types {
@@ -583,6 +936,10 @@ func (r *Reader) readMetaindex(metaindexBH blockHandle, o *db.Options) error {
 				switch t.ftype {
 				case db.TableFilter:
 					r.tableFilter = newTableFilterReader(fp)
+				case db.BlockFilter:
+					r.blockFilter = newBlockFilterReader(fp)
+				case db.PartitionedFilter:
+					r.partitionedFilter = newPartitionedFilterReader(fp)
 				default:
 					return fmt.Errorf("unknown filter type: %v", t.ftype)
 				}
@@ -619,6 +976,8 @@ func NewReader(f storage.File, fileNum uint64, o *db.Options) *Reader {
 		r.err = err
 		return r
 	}
+	r.checksumType = footer.checksum
+	r.metaindexBH = footer.metaindexBH
 	// Read the metaindex.
 	if err := r.readMetaindex(footer.metaindexBH, o); err != nil {
 		r.err = err
@@ -40,6 +40,21 @@ func TestReader(t *testing.T) {
 			FilterPolicy: bloom.FilterPolicy(100),
 			FilterType:   db.TableFilter,
 		},
+		"bloom10bitBlock": db.LevelOptions{
+			FilterPolicy: bloom.FilterPolicy(10),
+			FilterType:   db.BlockFilter,
+		},
+		"bloom10bitPartitioned": db.LevelOptions{
+			BlockSize:      32,
+			IndexBlockSize: 1,
+			FilterPolicy:   bloom.FilterPolicy(10),
+			FilterType:     db.PartitionedFilter,
+		},
+		"twoLevelIndex": db.LevelOptions{
+			// Tiny data blocks, with every index partition holding a single entry.
+			BlockSize:      32,
+			IndexBlockSize: 1,
+		},
 	}
 
 	opts := map[string]*db.Options{
@@ -214,8 +229,10 @@ func buildBenchmarkTable(b *testing.B, blockSize, restartInterval int) (*Reader,
 	if err != nil {
 		b.Fatal(err)
 	}
+	c := cache.New(128 << 20)
+	b.Cleanup(c.Close)
 	return NewReader(f1, 0, &db.Options{
-		Cache: cache.New(128 << 20),
+		Cache: c,
 	}), keys
 }
 
@@ -89,9 +89,23 @@ The table file format looks like:
 <end_of_file>
 
 Each block consists of some data and a 5 byte trailer: a 1 byte block type and
-a 4 byte checksum of the compressed data. The block type gives the per-block
-compression used; each block is compressed independently. The checksum
-algorithm is described in the pebble/crc package.
+a 4 byte checksum of the compressed data and the block type. The block type
+gives the per-block compression used; each block is compressed independently.
+The checksum algorithm is given by the checksum type in the footer: the masked
+CRC32c described in the pebble/crc package, xxHash32, or the low 32 bits of
+xxHash64. LevelDB tables always use CRC32c.
+
+The block types are those used by RocksDB: 0 for no compression, 1 for snappy,
+4 and 5 for LZ4 and LZ4HC, and 7 for zstd. The contents of LZ4 and zstd blocks
+are prefixed by the varint32 encoded length of the decompressed data, followed
+by a raw LZ4 block or a zstd frame respectively. A block is only stored
+compressed if compression reduces its size by at least 12.5%.
+
+The data blocks of a table may be compressed against a compression
+dictionary, which is stored uncompressed in the "rocksdb.compression_dict"
+meta block. The dictionary is raw content that LZ4 and zstd treat as
+preceding each block, or a zstd dictionary in the format produced by the zstd
+dictionary trainer. Other blocks are never compressed against the dictionary.
 
 The decompressed block data consists of a sequence of key/value entries
 followed by a trailer. Each key is encoded as a shared prefix length and a
@@ -112,6 +126,15 @@ uint32 values are the block offsets of each restart point. The final uint32
 value is P itself. Thus, when seeking for a particular key, one can use binary
 search to find the largest restart point whose key is <= the key sought.
 
+A data block may additionally have a hash index, which maps user keys to the
+restart interval containing them. If so, the high bit of the final uint32 of
+the trailer is set, and the restart points are followed by B one-byte buckets
+and then by B itself as a little-endian uint16. A user key hashes to bucket
+hash(key) % B, which holds the index of the restart interval containing the
+key, 255 if no key hashes to the bucket, or 254 if keys from multiple restart
+intervals hash to the bucket. In the latter case, a point lookup falls back to
+binary search.
+
 An index block is a block with N key/value entries. The i'th value is the
 encoded block handle of the i'th data block. The i'th key is a separator for
 i < N-1, and a successor for i == N-1. The separator between blocks i and i+1
@@ -119,6 +142,13 @@ is a key that is >= every key in block i and is < every key i block i+1. The
 successor for the final block is a key that is >= every key in block N-1. The
 index block restart interval is 1: every entry is a restart point.
 
+A table with a two-level index splits the index into partitions. Each partition
+is an index block over a contiguous range of data blocks, and is written before
+the properties block. The block handle in the footer then refers to a top-level
+index block, whose i'th value is the encoded block handle of the i'th
+partition and whose i'th key is the last key in that partition. The index type
+recorded in the properties block distinguishes the two layouts.
+
 A block handle is an offset and a length; the length does not include the 5
 byte trailer. Both numbers are varint-encoded, with no padding between the two
 values. The maximum size of an encoded block handle is therefore 20 bytes.
@@ -143,21 +173,36 @@ const (
 	levelDBFormatVersion  = 0
 	rocksDBFormatVersion2 = 2
 
-	noChecksum     = 0
-	checksumCRC32c = 1
-	checksumXXHash = 2
+	// The checksum type, stored in the RocksDB footer. These constants are part
+	// of the file format and should not be changed.
+	noChecksum       = 0
+	checksumCRC32c   = 1
+	checksumXXHash   = 2
+	checksumXXHash64 = 3
 
 	// The block type gives the per-block compression format.
 	// These constants are part of the file format and should not be changed.
 	// They are different from the db.Compression constants because the latter
 	// are designed so that the zero value of the db.Compression type means to
 	// use the default compression (which is snappy).
-	noCompressionBlockType     byte = 0
-	snappyCompressionBlockType byte = 1
+	noCompressionBlockType           byte = 0
+	snappyCompressionBlockType       byte = 1
+	lz4CompressionBlockType          byte = 4
+	lz4hcCompressionBlockType        byte = 5
+	zstdCompressionBlockType         byte = 7
+	zstdNotFinalCompressionBlockType byte = 0x40
+
+	// The index type, stored in the properties block. These constants are part
+	// of the file format and should not be changed.
+	binarySearchIndex = 0
+	hashSearchIndex   = 1
+	twoLevelIndex     = 2
 
 	metaPropertiesName = "rocksdb.properties"
 	metaRangeDelName   = "rocksdb.range_del"
 	metaRangeDelV2Name = "rocksdb.range_del2"
+
+	metaCompressionDictName = "rocksdb.compression_dict"
 )
 
 // legacy (LevelDB) footer format:
@@ -220,7 +265,7 @@ func readFooter(f storage.File) (footer, error) {
 		}
 		footer.format = db.TableFormatRocksDBv2
 		footer.checksum = uint8(buf[0])
-		if footer.checksum != checksumCRC32c {
+		if footer.checksum > checksumXXHash64 {
 			return footer, fmt.Errorf("pebble/table: unsupported checksum type %d", footer.checksum)
 		}
 		buf = buf[1:]
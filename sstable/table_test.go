@@ -18,6 +18,7 @@ import (
 
 	"github.com/kr/pretty"
 	"github.com/petermattis/pebble/bloom"
+	"github.com/petermattis/pebble/cache"
 	"github.com/petermattis/pebble/db"
 	"github.com/petermattis/pebble/storage"
 )
@@ -236,6 +237,14 @@ func build(
 	ftype db.FilterType,
 	comparer *db.Comparer,
 ) (storage.File, error) {
+	return buildWithLevelOptions(db.LevelOptions{
+		Compression:  compression,
+		FilterPolicy: fp,
+		FilterType:   ftype,
+	}, comparer)
+}
+
+func buildWithLevelOptions(lo db.LevelOptions, comparer *db.Comparer) (storage.File, error) {
 	// Create a sorted list of wordCount's keys.
 	keys := make([]string, len(wordCount))
 	i := 0
@@ -258,11 +267,7 @@ func build(
 			Name: "nullptr",
 		},
 		Comparer: comparer,
-	}, db.LevelOptions{
-		Compression:  compression,
-		FilterPolicy: fp,
-		FilterType:   ftype,
-	})
+	}, lo)
 	for _, k := range keys {
 		v := wordCount[k]
 		ikey := db.MakeInternalKey([]byte(k), 0, db.InternalKeyKindSet)
@@ -322,6 +327,7 @@ func TestReaderBloomUsed(t *testing.T) {
 		path     string
 		comparer *db.Comparer
 	}{
+		{"h.block-bloom.no-compression.sst", nil},
 		{"h.table-bloom.no-compression.sst", nil},
 		{"h.table-bloom.no-compression.prefix_extractor.no_whole_key_filter.sst", fixtureComparer},
 	}
@@ -464,6 +470,540 @@ func TestWriterRoundTrip(t *testing.T) {
 	}
 }
 
+func TestWriterDataBlockHashIndex(t *testing.T) {
+	for _, blockSize := range []int{256, 4096} {
+		t.Run(fmt.Sprintf("blockSize=%d", blockSize), func(t *testing.T) {
+			f, err := buildWithLevelOptions(db.LevelOptions{
+				BlockSize:          blockSize,
+				DataBlockIndexType: db.DataBlockBinaryAndHash,
+			}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := NewReader(f, 0, nil)
+			i := r.NewIter(nil)
+			if !i.First() {
+				t.Fatal(i.Error())
+			}
+			if i.data.hashIndex == nil {
+				t.Fatalf("expected data block hash index")
+			}
+			if err := i.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if err := check(f, nil, nil); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestWriterFilterTypes(t *testing.T) {
+	testCases := []struct {
+		name string
+		lo   db.LevelOptions
+	}{
+		{"table", db.LevelOptions{FilterType: db.TableFilter}},
+		{"block", db.LevelOptions{FilterType: db.BlockFilter}},
+		{"partitioned", db.LevelOptions{FilterType: db.PartitionedFilter}},
+		{"partitioned-two-level", db.LevelOptions{
+			BlockSize:      256,
+			IndexBlockSize: 128,
+			FilterType:     db.PartitionedFilter,
+		}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			lo := tc.lo
+			lo.FilterPolicy = bloom.FilterPolicy(10)
+			f, err := buildWithLevelOptions(lo, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c := &countingFilterPolicy{
+				FilterPolicy: bloom.FilterPolicy(10),
+			}
+			if err := check(f, nil, c); err != nil {
+				t.Fatal(err)
+			}
+			if c.truePositives != len(wordCount) {
+				t.Errorf("true positives: got %d, want %d", c.truePositives, len(wordCount))
+			}
+			if c.falseNegatives != 0 {
+				t.Errorf("false negatives: got %d, want %d", c.falseNegatives, 0)
+			}
+			if c.trueNegatives == 0 {
+				t.Errorf("true negatives: got %d, want > 0", c.trueNegatives)
+			}
+		})
+	}
+}
+
+func TestReaderPartitionedFilter(t *testing.T) {
+	f, err := buildWithLevelOptions(db.LevelOptions{
+		BlockSize:      256,
+		IndexBlockSize: 128,
+		FilterPolicy:   bloom.FilterPolicy(10),
+		FilterType:     db.PartitionedFilter,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := cache.New(1 << 20)
+	defer c.Close()
+	r := NewReader(f, 0, &db.Options{
+		Cache: c,
+		Levels: []db.LevelOptions{{
+			FilterPolicy: bloom.FilterPolicy(10),
+		}},
+	})
+	if r.partitionedFilter == nil {
+		t.Fatalf("expected partitioned filter")
+	}
+	if r.Properties.IndexPartitions <= 1 {
+		t.Fatalf("expected multiple index partitions, but found %d", r.Properties.IndexPartitions)
+	}
+
+	// A lookup loads only the top-level filter index and a single filter
+	// partition.
+	if _, err := r.get([]byte(minWord), nil); err != nil {
+		t.Fatal(err)
+	}
+	if s := c.Stats(cache.FilterBlock); s.Inserts != 2 {
+		t.Fatalf("expected 2 filter block inserts, but found %+v", s)
+	}
+	for k := range wordCount {
+		if _, err := r.get([]byte(k), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s := c.Stats(cache.FilterBlock); s.Inserts != int64(r.Properties.IndexPartitions)+1 {
+		t.Fatalf("expected %d filter block inserts, but found %+v",
+			r.Properties.IndexPartitions+1, s)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWriterTwoLevelIndex(t *testing.T) {
+	for _, compression := range []db.Compression{db.NoCompression, db.SnappyCompression} {
+		t.Run(compression.String(), func(t *testing.T) {
+			lo := db.LevelOptions{
+				BlockSize:      256,
+				IndexBlockSize: 128,
+				Compression:    compression,
+			}
+			f, err := buildWithLevelOptions(lo, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := check(f, nil, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			f, err = buildWithLevelOptions(lo, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c := cache.New(1 << 20)
+			defer c.Close()
+			r := NewReader(f, 0, &db.Options{Cache: c})
+			if r.Properties.IndexType != twoLevelIndex {
+				t.Fatalf("expected two-level index, but found index type %d", r.Properties.IndexType)
+			}
+			if r.Properties.IndexPartitions <= 1 {
+				t.Fatalf("expected multiple index partitions, but found %d", r.Properties.IndexPartitions)
+			}
+			if r.Properties.TopLevelIndexSize == 0 ||
+				r.Properties.TopLevelIndexSize >= r.Properties.IndexSize {
+				t.Fatalf("unexpected index sizes: top-level=%d, total=%d",
+					r.Properties.TopLevelIndexSize, r.Properties.IndexSize)
+			}
+
+			// Index partitions are loaded on demand: seeking loads only the
+			// top-level index and a single partition.
+			i := r.NewIter(nil)
+			if !i.SeekGE([]byte(maxWord)) || string(i.Key().UserKey) != maxWord {
+				t.Fatalf("expected to find %q", maxWord)
+			}
+			if s := c.Stats(cache.IndexBlock); s.Inserts != 2 {
+				t.Fatalf("expected 2 index block inserts, but found %+v", s)
+			}
+			n := 0
+			for valid := i.First(); valid; valid = i.Next() {
+				n++
+			}
+			if n != len(wordCount) {
+				t.Fatalf("expected %d keys, but found %d", len(wordCount), n)
+			}
+			if s := c.Stats(cache.IndexBlock); s.Inserts != int64(r.Properties.IndexPartitions)+1 {
+				t.Fatalf("expected %d index block inserts, but found %+v",
+					r.Properties.IndexPartitions+1, s)
+			}
+			if err := i.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if err := r.Close(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestWriterChecksum(t *testing.T) {
+	for _, checksum := range []db.ChecksumType{
+		db.CRC32cChecksum, db.XXHash32Checksum, db.XXHash64Checksum,
+	} {
+		t.Run(checksum.String(), func(t *testing.T) {
+			lo := db.LevelOptions{Checksum: checksum}
+			f, err := buildWithLevelOptions(lo, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := check(f, nil, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			f, err = buildWithLevelOptions(lo, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			footer, err := readFooter(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if footer.checksum != checksumTypeFor(checksum) {
+				t.Fatalf("expected checksum type %d, but found %d",
+					checksumTypeFor(checksum), footer.checksum)
+			}
+
+			// Corrupt a byte of the first data block, which must be detected when
+			// the block is read.
+			stat, err := f.Stat()
+			if err != nil {
+				t.Fatal(err)
+			}
+			contents := make([]byte, stat.Size())
+			if _, err := f.ReadAt(contents, 0); err != nil {
+				t.Fatal(err)
+			}
+			contents[10] ^= 0xff
+			fs := storage.NewMem()
+			f, err = fs.Create("corrupt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := f.Write(contents); err != nil {
+				t.Fatal(err)
+			}
+			if err := f.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if f, err = fs.Open("corrupt"); err != nil {
+				t.Fatal(err)
+			}
+			r := NewReader(f, 0, nil)
+			i := r.NewIter(nil)
+			i.First()
+			if err := i.Close(); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+				t.Fatalf("expected checksum mismatch, but found %v", err)
+			}
+			if err := r.Close(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestWriterFileChecksum(t *testing.T) {
+	f0, err := memFileSystem.Create("file-checksum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWriter(f0, nil, db.LevelOptions{})
+	for _, k := range []string{"a", "b", "c"} {
+		if err := w.Set([]byte(k), []byte(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	meta, err := w.Metadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f1, err := memFileSystem.Open("file-checksum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f1.Close()
+	checksum, err := FileChecksum(f1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.FileChecksum != checksum {
+		t.Fatalf("expected file checksum %08x, but found %08x", checksum, meta.FileChecksum)
+	}
+}
+
+func TestReaderVerifyBlockChecksums(t *testing.T) {
+	testCases := []db.LevelOptions{
+		{},
+		{FilterPolicy: bloom.FilterPolicy(10), FilterType: db.BlockFilter},
+		// A two-level index and a partitioned filter.
+		{
+			BlockSize:      256,
+			IndexBlockSize: 128,
+			FilterPolicy:   bloom.FilterPolicy(10),
+			FilterType:     db.PartitionedFilter,
+		},
+	}
+	for _, lo := range testCases {
+		t.Run("", func(t *testing.T) {
+			f, err := buildWithLevelOptions(lo, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			stat, err := f.Stat()
+			if err != nil {
+				t.Fatal(err)
+			}
+			contents := make([]byte, stat.Size())
+			if _, err := f.ReadAt(contents, 0); err != nil {
+				t.Fatal(err)
+			}
+			r := NewReader(f, 0, nil)
+			if err := r.VerifyBlockChecksums(); err != nil {
+				t.Fatal(err)
+			}
+			if err := r.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			// Corrupting any byte of any block is detected, other than the
+			// footer, which is not checksummed.
+			footer, err := readFooter(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			end := int(footer.indexBH.offset + footer.indexBH.length + blockTrailerLen)
+			for _, i := range []int{0, end / 3, end / 2, end - 1} {
+				fs := storage.NewMem()
+				cf, err := fs.Create("corrupt")
+				if err != nil {
+					t.Fatal(err)
+				}
+				corrupt := append([]byte(nil), contents...)
+				corrupt[i] ^= 0x10
+				if _, err := cf.Write(corrupt); err != nil {
+					t.Fatal(err)
+				}
+				if err := cf.Close(); err != nil {
+					t.Fatal(err)
+				}
+				if cf, err = fs.Open("corrupt"); err != nil {
+					t.Fatal(err)
+				}
+				r := NewReader(cf, 0, nil)
+				if err := r.VerifyBlockChecksums(); err == nil {
+					t.Fatalf("expected corruption at offset %d to be detected", i)
+				}
+				r.Close()
+			}
+		})
+	}
+}
+
+func TestWriterCompression(t *testing.T) {
+	sizes := make(map[db.Compression]int64)
+	for _, compression := range []db.Compression{
+		db.NoCompression, db.SnappyCompression, db.LZ4Compression, db.ZstdCompression,
+	} {
+		t.Run(compression.String(), func(t *testing.T) {
+			lo := db.LevelOptions{Compression: compression}
+			f, err := buildWithLevelOptions(lo, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := check(f, nil, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			f, err = buildWithLevelOptions(lo, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			stat, err := f.Stat()
+			if err != nil {
+				t.Fatal(err)
+			}
+			sizes[compression] = stat.Size()
+			r := NewReader(f, 0, nil)
+			if r.Properties.CompressionName != compression.String() {
+				t.Fatalf("expected compression %q, but found %q",
+					compression, r.Properties.CompressionName)
+			}
+			if err := r.Close(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+	for _, compression := range []db.Compression{db.SnappyCompression, db.LZ4Compression} {
+		if sizes[db.ZstdCompression] == 0 || sizes[compression] == 0 {
+			continue
+		}
+		if sizes[db.ZstdCompression] >= sizes[compression] {
+			t.Fatalf("expected zstd to be smaller than %s: %v", compression, sizes)
+		}
+	}
+}
+
+func TestWriterCompressionDict(t *testing.T) {
+	fileSize := func(f storage.File) int64 {
+		stat, err := f.Stat()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stat.Size()
+	}
+
+	for _, compression := range []db.Compression{db.LZ4Compression, db.ZstdCompression} {
+		// A small sample size trains the dictionary part way through the table,
+		// while a large one buffers every block until the table is closed.
+		for _, sampleSize := range []int{4096, 1 << 20} {
+			t.Run(fmt.Sprintf("%s/%d", compression, sampleSize), func(t *testing.T) {
+				lo := db.LevelOptions{
+					BlockSize:    512,
+					Compression:  compression,
+					FilterPolicy: bloom.FilterPolicy(10),
+					FilterType:   db.BlockFilter,
+				}
+				f, err := buildWithLevelOptions(lo, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				size := fileSize(f)
+
+				lo.CompressionDictSize = 1024
+				lo.CompressionDictSampleSize = sampleSize
+				f, err = buildWithLevelOptions(lo, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := check(f, nil, bloom.FilterPolicy(10)); err != nil {
+					t.Fatal(err)
+				}
+
+				f, err = buildWithLevelOptions(lo, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if dictSize := fileSize(f); dictSize >= size {
+					t.Fatalf("expected dictionary to reduce size %d, but found %d", size, dictSize)
+				}
+				c := cache.New(1 << 20)
+				defer c.Close()
+				r := NewReader(f, 0, &db.Options{Cache: c})
+				if r.compressionDict == nil || len(r.compressionDict.dict) == 0 ||
+					len(r.compressionDict.dict) > lo.CompressionDictSize {
+					t.Fatalf("expected a compression dictionary of at most %d bytes", lo.CompressionDictSize)
+				}
+				n, i := 0, r.NewIter(nil)
+				for valid := i.First(); valid; valid = i.Next() {
+					n++
+				}
+				if err := i.Close(); err != nil {
+					t.Fatal(err)
+				}
+				if n != len(wordCount) {
+					t.Fatalf("expected %d keys, but found %d", len(wordCount), n)
+				}
+				if err := r.Close(); err != nil {
+					t.Fatal(err)
+				}
+			})
+		}
+	}
+
+	// Snappy does not support dictionaries, and the option is ignored.
+	f, err := buildWithLevelOptions(db.LevelOptions{
+		Compression:         db.SnappyCompression,
+		CompressionDictSize: 1024,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReader(f, 0, nil)
+	if r.compressionDict != nil {
+		t.Fatalf("expected no compression dictionary for snappy")
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type testCompressor struct{}
+
+func (testCompressor) Compress(dst, src []byte) []byte {
+	return append(dst[:0], bytes.ToUpper(src)...)
+}
+
+func (testCompressor) DecodedLen(src []byte) (int, error) {
+	return len(src), nil
+}
+
+func (testCompressor) Decompress(dst, src []byte) error {
+	copy(dst, bytes.ToLower(src))
+	return nil
+}
+
+func TestRegisterCompressor(t *testing.T) {
+	const blockType = 0x80
+	alloc := func(n int) []byte { return make([]byte, n) }
+	free := func([]byte) {}
+	if _, err := decompressBlock(compressors[blockType], blockType, []byte("HELLO"), alloc, free); err == nil {
+		t.Fatalf("expected error for unregistered block type")
+	}
+	RegisterCompressor(blockType, testCompressor{})
+	defer func() { compressors[blockType] = nil }()
+	b, err := decompressBlock(compressors[blockType], blockType, []byte("HELLO"), alloc, free)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "hello" {
+		t.Fatalf("expected %q, but found %q", "hello", b)
+	}
+
+	// Blocks written with the LZ4 and zstd compressors can be read using any
+	// of the block types registered for them.
+	src := bytes.Repeat([]byte("hello world "), 100)
+	for _, c := range []struct {
+		compression db.Compression
+		blockTypes  []byte
+	}{
+		{db.LZ4Compression, []byte{lz4CompressionBlockType, lz4hcCompressionBlockType}},
+		{db.ZstdCompression, []byte{zstdCompressionBlockType, zstdNotFinalCompressionBlockType}},
+	} {
+		compressed := compressors[compressionBlockType(c.compression)].Compress(nil, src)
+		for _, blockType := range c.blockTypes {
+			b, err := decompressBlock(compressors[blockType], blockType, compressed, alloc, free)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(b, src) {
+				t.Fatalf("%s: block type %d: decoded contents differ", c.compression, blockType)
+			}
+		}
+		// A truncated block is corrupt.
+		if _, err := decompressBlock(compressors[c.blockTypes[0]], c.blockTypes[0], compressed[:len(compressed)-1], alloc, free); err == nil {
+			t.Fatalf("%s: expected error for truncated block", c.compression)
+		}
+	}
+}
+
 func TestFinalBlockIsWritten(t *testing.T) {
 	const blockSize = 100
 	keys := []string{"A", "B", "C", "D", "E", "F", "G", "H", "I", "J"}
@@ -521,6 +1061,137 @@ func TestFinalBlockIsWritten(t *testing.T) {
 	}
 }
 
+// countingCollector counts the entries added to a table and requests
+// compaction of tables containing more than a threshold number of deletions.
+type countingCollector struct {
+	entries   int
+	deletions int
+	threshold int
+}
+
+func (c *countingCollector) Add(key db.InternalKey, value []byte) error {
+	c.entries++
+	if key.Kind() == db.InternalKeyKindDelete {
+		c.deletions++
+	}
+	return nil
+}
+
+func (c *countingCollector) Finish(userProps map[string]string) error {
+	userProps["test.entries"] = fmt.Sprint(c.entries)
+	return nil
+}
+
+func (c *countingCollector) NeedCompact() bool {
+	return c.deletions > c.threshold
+}
+
+func (c *countingCollector) Name() string {
+	return "counting"
+}
+
+func TestTablePropertyCollector(t *testing.T) {
+	for _, deletions := range []int{0, 3} {
+		t.Run(fmt.Sprintf("deletions=%d", deletions), func(t *testing.T) {
+			mem := storage.NewMem()
+			f0, err := mem.Create("test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			opts := &db.Options{
+				TablePropertyCollectors: []func() db.TablePropertyCollector{
+					func() db.TablePropertyCollector {
+						return &countingCollector{threshold: 1}
+					},
+				},
+			}
+			w := NewWriter(f0, opts, db.LevelOptions{})
+			for i := 0; i < 5; i++ {
+				var kind db.InternalKeyKind = db.InternalKeyKindSet
+				if i < deletions {
+					kind = db.InternalKeyKindDelete
+				}
+				key := db.MakeInternalKey([]byte(fmt.Sprintf("k%d", i)), 0, kind)
+				if err := w.Add(key, nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			meta, err := w.Metadata()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expected := deletions > 1; expected != meta.MarkedForCompaction {
+				t.Fatalf("expected marked-for-compaction %t, but found %t",
+					expected, meta.MarkedForCompaction)
+			}
+
+			f1, err := mem.Open("test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := NewReader(f1, 0, nil)
+			defer r.Close()
+			if v := r.Properties.PropertyCollectorNames; v != "[counting]" {
+				t.Fatalf("expected [counting], but found %s", v)
+			}
+			if v := r.Properties.UserProperties["test.entries"]; v != "5" {
+				t.Fatalf("expected 5 entries, but found %s", v)
+			}
+		})
+	}
+}
+
+func TestWriterDeletionWindow(t *testing.T) {
+	testCases := []struct {
+		kinds    string
+		expected bool
+	}{
+		{"SSSSSSSSSS", false},
+		{"DSDSDSDSDS", false},
+		{"SSSSDDDSSS", true},
+		{"DDSSSSSSDD", false},
+		{"SSSSSSSDDD", true},
+	}
+	for _, c := range testCases {
+		t.Run(c.kinds, func(t *testing.T) {
+			f, err := storage.NewMem().Create("test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := NewWriter(f, &db.Options{
+				DeletionWindowSize:    4,
+				DeletionWindowTrigger: 3,
+			}, db.LevelOptions{})
+			for i := range c.kinds {
+				var kind db.InternalKeyKind = db.InternalKeyKindSet
+				if c.kinds[i] == 'D' {
+					kind = db.InternalKeyKindDelete
+				}
+				key := db.MakeInternalKey([]byte(fmt.Sprintf("k%02d", i)), 0, kind)
+				if err := w.Add(key, nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			meta, err := w.Metadata()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.expected != meta.MarkedForCompaction {
+				t.Fatalf("expected %t, but found %t", c.expected, meta.MarkedForCompaction)
+			}
+			if v := uint64(strings.Count(c.kinds, "D")); v != meta.NumDeletions {
+				t.Fatalf("expected %d deletions, but found %d", v, meta.NumDeletions)
+			}
+		})
+	}
+}
+
 func TestReaderGlobalSeqNum(t *testing.T) {
 	f, err := os.Open(filepath.FromSlash("testdata/h.sst"))
 	if err != nil {
@@ -540,6 +1211,51 @@ func TestReaderGlobalSeqNum(t *testing.T) {
 	}
 }
 
+func TestReaderPinIndexAndFilter(t *testing.T) {
+	f, err := os.Open(filepath.FromSlash("testdata/h.table-bloom.no-compression.sst"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := cache.New(1 << 20)
+	defer c.Close()
+	r := NewReader(f, 0, &db.Options{
+		Cache: c,
+		Levels: []db.LevelOptions{{
+			FilterPolicy: bloom.FilterPolicy(10),
+		}},
+	})
+	if err := r.PinIndexAndFilter(); err != nil {
+		t.Fatal(err)
+	}
+	for _, bt := range []cache.BlockType{cache.IndexBlock, cache.FilterBlock} {
+		if s := c.Stats(bt); s.Inserts != 1 {
+			t.Fatalf("%s: expected 1 insert, but found %+v", bt, s)
+		}
+	}
+
+	// The pinned index and filter blocks are retained while the cache is
+	// filled with data blocks.
+	for i := uint64(0); i < 1000; i++ {
+		c.Set(1, i, c.Alloc(4<<10), cache.DataBlock, cache.LowPriority).Release()
+	}
+	for _, b := range []struct {
+		offset uint64
+		bt     cache.BlockType
+	}{
+		{r.index.bh.offset, cache.IndexBlock},
+		{r.filter.bh.offset, cache.FilterBlock},
+	} {
+		h := c.Get(0, b.offset, b.bt)
+		if h.Get() == nil {
+			t.Fatalf("expected pinned %s block", b.bt)
+		}
+		h.Release()
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestFooterRoundTrip(t *testing.T) {
 	buf := make([]byte, 100+maxFooterLen)
 	for _, format := range []db.TableFormat{
@@ -547,7 +1263,11 @@ func TestFooterRoundTrip(t *testing.T) {
 		db.TableFormatLevelDB,
 	} {
 		t.Run(fmt.Sprintf("format=%d", format), func(t *testing.T) {
-			for _, checksum := range []uint8{checksumCRC32c} {
+			checksums := []uint8{noChecksum, checksumCRC32c, checksumXXHash, checksumXXHash64}
+			if format == db.TableFormatLevelDB {
+				checksums = []uint8{checksumCRC32c}
+			}
+			for _, checksum := range checksums {
 				t.Run(fmt.Sprintf("checksum=%d", checksum), func(t *testing.T) {
 					footer := footer{
 						format:      format,
@@ -614,8 +1334,7 @@ func TestReadFooter(t *testing.T) {
 		{strings.Repeat("a", rocksDBFooterLen), "bad magic number"},
 		{encode(db.TableFormatLevelDB, 0)[1:], "file size is too small"},
 		{encode(db.TableFormatRocksDBv2, 0)[1:], "footer too short"},
-		{encode(db.TableFormatRocksDBv2, noChecksum), "unsupported checksum type"},
-		{encode(db.TableFormatRocksDBv2, checksumXXHash), "unsupported checksum type"},
+		{encode(db.TableFormatRocksDBv2, checksumXXHash64+1), "unsupported checksum type"},
 	}
 	for _, c := range testCases {
 		t.Run("", func(t *testing.T) {
@@ -6,13 +6,13 @@ package sstable
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"math"
 
-	"github.com/golang/snappy"
 	"github.com/petermattis/pebble/db"
 	"github.com/petermattis/pebble/internal/crc"
 	"github.com/petermattis/pebble/internal/rangedel"
@@ -28,6 +28,17 @@ type WriterMetadata struct {
 	LargestRange   db.InternalKey
 	SmallestSeqNum uint64
 	LargestSeqNum  uint64
+	// NumEntries and NumDeletions are the number of point entries and point
+	// deletion tombstones in the table.
+	NumEntries   uint64
+	NumDeletions uint64
+	// MarkedForCompaction is true if one of the table property collectors
+	// requested that the table be compacted, or if the table contains a dense
+	// run of deletion tombstones.
+	MarkedForCompaction bool
+	// FileChecksum is the CRC32c of the entire file, as computed by
+	// FileChecksum.
+	FileChecksum uint32
 }
 
 func (m *WriterMetadata) updateSeqNum(seqNum uint64) {
@@ -84,6 +95,7 @@ type Writer struct {
 	// The following fields are copied from db.Options.
 	blockSize          int
 	blockSizeThreshold int
+	indexBlockSize     int
 	bytesPerSync       int
 	compare            db.Compare
 
@@ -93,6 +105,9 @@ type Writer struct {
 	separator   db.Separator
 	successor   db.Successor
 	tableFormat db.TableFormat
+	// checksumType is the checksum type recorded in the footer, which is used
+	// to checksum every block.
+	checksumType uint8
 	// A table is a series of blocks and a block's index entry contains a
 	// separator key between one block and the next. Thus, a finished block
 	// cannot be written until the first key in the next block is seen.
@@ -102,13 +117,20 @@ type Writer struct {
 	pendingBH blockHandle
 	// offset is the offset (relative to the table start) of the next block
 	// to be written.
-	offset        uint64
-	syncOffset    uint64
+	offset     uint64
+	syncOffset uint64
+	// fileChecksum accumulates the checksum of every byte written to the file.
+	fileChecksum  crc.CRC
 	block         blockWriter
 	indexBlock    blockWriter
 	rangeDelBlock blockWriter
-	props         Properties
-	// compressedBuf is the destination buffer for snappy compression. It is
+	// indexPartitions holds the finished partitions of a two-level index,
+	// which are written when the table is closed. It is empty if the index fits
+	// within a single index block.
+	indexPartitions     []indexPartition
+	indexPartitionsSize uint64
+	props               Properties
+	// compressedBuf is the destination buffer for block compression. It is
 	// re-used over the lifetime of the writer, avoiding the allocation of a
 	// temporary buffer for each block.
 	compressedBuf []byte
@@ -116,6 +138,20 @@ type Writer struct {
 	// either the output of w.split (i.e. a prefix extractor) if w.split is not
 	// nil, or the full keys otherwise.
 	filter filterWriter
+	// propCollectors are the table property collectors created from
+	// db.Options.TablePropertyCollectors.
+	propCollectors []db.TablePropertyCollector
+	// deletions tracks the density of deletion tombstones over the most recent
+	// point entries. Nil if db.Options.DeletionWindowSize is not set.
+	deletions *deletionWindow
+	// dictSamples buffers the finished data blocks from which the compression
+	// dictionary is trained. It is nil unless the writer is still sampling.
+	dictSamples *dictSampler
+	// dict is the trained compression dictionary, and dictCompressor the
+	// compressor that compresses data blocks against it. Both are nil if the
+	// table is written without a dictionary.
+	dict           []byte
+	dictCompressor Compressor
 	// tmp is a scratch buffer, large enough to hold either footerLen bytes,
 	// blockTrailerLen bytes, or (5 * binary.MaxVarintLen64) bytes.
 	tmp [rocksDBFooterLen]byte
@@ -201,7 +237,11 @@ func (w *Writer) addPoint(key db.InternalKey, value []byte) error {
 	w.meta.updateSeqNum(key.SeqNum())
 	w.meta.updateLargestPoint(key)
 
-	w.maybeAddToFilter(key.UserKey)
+	// The keys of sampled blocks are added to the filter when the blocks are
+	// written, as a block filter must see the keys of one block at a time.
+	if w.dictSamples == nil {
+		w.maybeAddToFilter(key.UserKey)
+	}
 
 	if w.props.NumEntries == 0 {
 		w.meta.SmallestPoint = key.Clone()
@@ -210,8 +250,17 @@ func (w *Writer) addPoint(key db.InternalKey, value []byte) error {
 	if key.Kind() == db.InternalKeyKindDelete {
 		w.props.NumDeletions++
 	}
+	if w.deletions != nil && w.deletions.add(key.Kind() == db.InternalKeyKindDelete) {
+		w.meta.MarkedForCompaction = true
+	}
 	w.props.RawKeySize += uint64(key.Size())
 	w.props.RawValueSize += uint64(len(value))
+	for i := range w.propCollectors {
+		if err := w.propCollectors[i].Add(key, value); err != nil {
+			w.err = err
+			return err
+		}
+	}
 	w.block.add(key, value)
 	return nil
 }
@@ -254,6 +303,12 @@ func (w *Writer) addTombstone(key db.InternalKey, value []byte) error {
 		w.meta.SmallestRange = key.Clone()
 	}
 	w.props.NumRangeDeletions++
+	for i := range w.propCollectors {
+		if err := w.propCollectors[i].Add(key, value); err != nil {
+			w.err = err
+			return err
+		}
+	}
 	w.rangeDelBlock.add(key, value)
 	return nil
 }
@@ -290,11 +345,35 @@ func (w *Writer) maybeFlush(key db.InternalKey, value []byte) error {
 		}
 	}
 
-	bh, err := w.finishBlock(&w.block)
-	if err != nil {
+	if err := w.finishDataBlock(key); err != nil {
 		w.err = err
 		return w.err
 	}
+	return nil
+}
+
+// finishDataBlock finishes the current data block, where key is the first key
+// of the next block, or zero if the block is the last. While the compression
+// dictionary is being sampled, the block is buffered along with its index
+// separator instead of being written.
+func (w *Writer) finishDataBlock(key db.InternalKey) error {
+	if s := w.dictSamples; s != nil {
+		s.add(append([]byte(nil), w.block.finish()...), w.indexSeparator(key).Clone())
+		w.block.reset()
+		if s.size >= s.sampleSize {
+			return w.writeDictSamples()
+		}
+		return nil
+	}
+
+	bh, err := w.writeDataBlock(w.block.finish())
+	if err != nil {
+		return err
+	}
+	if w.filter != nil {
+		w.filter.finishBlock(w.offset)
+	}
+	w.block.reset()
 	w.pendingBH = bh
 	w.flushPendingBH(key)
 	return nil
@@ -307,16 +386,124 @@ func (w *Writer) flushPendingBH(key db.InternalKey) {
 		// In particular, it must have a non-zero length.
 		return
 	}
+	n := encodeBlockHandle(w.tmp[:], w.pendingBH)
+	w.addIndexEntry(w.indexSeparator(key), w.tmp[:n])
+	w.pendingBH = blockHandle{}
+}
+
+// indexSeparator returns the index key for the data block ending with the
+// last key added, which separates it from key, the first key of the next
+// block. If key is zero, the index key is a successor of the last key.
+func (w *Writer) indexSeparator(key db.InternalKey) db.InternalKey {
 	prevKey := db.DecodeInternalKey(w.block.curKey)
-	var sep db.InternalKey
 	if key.UserKey == nil && key.Trailer == 0 {
-		sep = prevKey.Successor(w.compare, w.successor, nil)
-	} else {
-		sep = prevKey.Separator(w.compare, w.separator, nil, key)
+		return prevKey.Successor(w.compare, w.successor, nil)
 	}
-	n := encodeBlockHandle(w.tmp[:], w.pendingBH)
-	w.indexBlock.add(sep, w.tmp[:n])
-	w.pendingBH = blockHandle{}
+	return prevKey.Separator(w.compare, w.separator, nil, key)
+}
+
+// writeDictSamples trains the compression dictionary from the sampled data
+// blocks, and then writes the blocks in order, compressed against the
+// dictionary. The writer stops sampling, and subsequent data blocks are
+// written as they are finished.
+func (w *Writer) writeDictSamples() error {
+	s := w.dictSamples
+	w.dictSamples = nil
+	if dict := s.train(); len(dict) > 0 {
+		c, err := compressors[compressionBlockType(w.compression)].(DictCompressor).WithDict(dict)
+		if err != nil {
+			return err
+		}
+		w.dict = dict
+		w.dictCompressor = c
+	}
+
+	for i := range s.blocks {
+		b := &s.blocks[i]
+		if w.filter != nil {
+			iter, err := newBlockIter(w.compare, b.block)
+			if err != nil {
+				return err
+			}
+			for valid := iter.First(); valid; valid = iter.Next() {
+				w.maybeAddToFilter(iter.Key().UserKey)
+			}
+			if err := iter.Close(); err != nil {
+				return err
+			}
+		}
+		bh, err := w.writeDataBlock(b.block)
+		if err != nil {
+			return err
+		}
+		if w.filter != nil {
+			w.filter.finishBlock(w.offset)
+		}
+		n := encodeBlockHandle(w.tmp[:], bh)
+		w.addIndexEntry(b.sep, w.tmp[:n])
+	}
+	return nil
+}
+
+// indexPartition is a finished index block of a two-level index, along with
+// the last key it contains.
+type indexPartition struct {
+	sep   db.InternalKey
+	block []byte
+}
+
+// addIndexEntry adds an entry for a data block to the index. If the index
+// block reaches the target index block size, it is finished as a partition of
+// a two-level index.
+func (w *Writer) addIndexEntry(sep db.InternalKey, value []byte) {
+	w.indexBlock.add(sep, value)
+	w.props.NumDataBlocks++
+	if w.indexBlock.estimatedSize() >= w.indexBlockSize {
+		w.finishIndexPartition()
+	}
+}
+
+// finishIndexPartition finishes the current index block and buffers it as a
+// partition of a two-level index. A partitioned filter is cut at the same
+// point, so that each filter partition covers the keys of an index partition.
+func (w *Writer) finishIndexPartition() {
+	sep := db.DecodeInternalKey(w.indexBlock.curKey).Clone()
+	if w.filter != nil {
+		w.filter.finishPartition(sep)
+	}
+	block := append([]byte(nil), w.indexBlock.finish()...)
+	w.indexPartitions = append(w.indexPartitions, indexPartition{
+		sep:   sep,
+		block: block,
+	})
+	w.indexPartitionsSize += uint64(len(block))
+	w.indexBlock.reset()
+}
+
+// writeTwoLevelIndex writes the buffered index partitions and replaces the
+// contents of the index block with a top-level index which maps the last key
+// of each partition to its block handle.
+func (w *Writer) writeTwoLevelIndex() error {
+	w.props.IndexType = twoLevelIndex
+	w.props.IndexPartitions = uint64(len(w.indexPartitions))
+	w.props.IndexSize = 0
+	for i := range w.indexPartitions {
+		p := &w.indexPartitions[i]
+		bh, err := w.writeRawBlock(p.block, w.compression)
+		if err != nil {
+			return err
+		}
+		// NB: RocksDB includes the block trailer length in the index size
+		// property.
+		w.props.IndexSize += bh.length + blockTrailerLen
+		n := encodeBlockHandle(w.tmp[:], bh)
+		w.indexBlock.add(p.sep, w.tmp[:n])
+	}
+	w.props.TopLevelIndexSize = uint64(w.indexBlock.estimatedSize())
+	w.props.IndexSize += w.props.TopLevelIndexSize + blockTrailerLen
+	w.indexPartitions = nil
+	w.indexPartitionsSize = 0
+	return nil
 }
 
 // finishBlock finishes the current block and returns its block handle, which is
@@ -334,29 +521,45 @@ func (w *Writer) finishBlock(block *blockWriter) (blockHandle, error) {
 	return bh, err
 }
 
+// writeDataBlock writes a data block, compressed against the compression
+// dictionary if there is one.
+func (w *Writer) writeDataBlock(b []byte) (blockHandle, error) {
+	t := compressionBlockType(w.compression)
+	if w.dictCompressor != nil {
+		return w.writeCompressedBlock(b, t, w.dictCompressor)
+	}
+	return w.writeCompressedBlock(b, t, compressors[t])
+}
+
 func (w *Writer) writeRawBlock(b []byte, compression db.Compression) (blockHandle, error) {
-	blockType := noCompressionBlockType
-	if compression == db.SnappyCompression {
+	t := compressionBlockType(compression)
+	return w.writeCompressedBlock(b, t, compressors[t])
+}
+
+// writeCompressedBlock writes a block compressed using c, which is nil for
+// uncompressed blocks, identifying the compression by blockType.
+func (w *Writer) writeCompressedBlock(b []byte, blockType byte, c Compressor) (blockHandle, error) {
+	w.tmp[0] = noCompressionBlockType
+	if c != nil {
 		// Compress the buffer, discarding the result if the improvement isn't at
 		// least 12.5%.
-		compressed := snappy.Encode(w.compressedBuf, b)
+		compressed := c.Compress(w.compressedBuf, b)
 		w.compressedBuf = compressed[:cap(compressed)]
 		if len(compressed) < len(b)-len(b)/8 {
-			blockType = snappyCompressionBlockType
+			w.tmp[0] = blockType
 			b = compressed
 		}
 	}
-	w.tmp[0] = blockType
 
 	// Calculate the checksum.
-	checksum := crc.New(b).Update(w.tmp[:1]).Value()
+	checksum := blockChecksum(w.checksumType, b, w.tmp[0])
 	binary.LittleEndian.PutUint32(w.tmp[1:5], checksum)
 
 	// Write the bytes to the file.
-	if _, err := w.writer.Write(b); err != nil {
+	if err := w.write(b); err != nil {
 		return blockHandle{}, err
 	}
-	if _, err := w.writer.Write(w.tmp[:5]); err != nil {
+	if err := w.write(w.tmp[:5]); err != nil {
 		return blockHandle{}, err
 	}
 	bh := blockHandle{w.offset, uint64(len(b))}
@@ -377,6 +580,13 @@ func (w *Writer) writeRawBlock(b []byte, compression db.Compression) (blockHandl
 	return bh, nil
 }
 
+// write writes b to the file, adding it to the file checksum.
+func (w *Writer) write(b []byte) error {
+	w.fileChecksum = w.fileChecksum.Update(b)
+	_, err := w.writer.Write(b)
+	return err
+}
+
 // Close finishes writing the table and closes the underlying file that the
 // table was written to.
 func (w *Writer) Close() (err error) {
@@ -395,24 +605,42 @@ func (w *Writer) Close() (err error) {
 	}
 
 	// Finish the last data block, or force an empty data block if there
-	// aren't any data blocks at all.
+	// aren't any data blocks at all. If the writer is still sampling, the
+	// dictionary is trained from the blocks sampled so far.
 	w.flushPendingBH(db.InternalKey{})
-	if w.block.nEntries > 0 || w.indexBlock.nEntries == 0 {
-		bh, err := w.finishBlock(&w.block)
-		if err != nil {
+	if w.block.nEntries > 0 || (w.props.NumDataBlocks == 0 && w.dictSamples.empty()) {
+		if err := w.finishDataBlock(db.InternalKey{}); err != nil {
+			w.err = err
+			return w.err
+		}
+	}
+	if w.dictSamples != nil {
+		if err := w.writeDictSamples(); err != nil {
 			w.err = err
 			return w.err
 		}
-		w.pendingBH = bh
-		w.flushPendingBH(db.InternalKey{})
 	}
 	w.props.DataSize = w.offset
-	w.props.NumDataBlocks = uint64(w.indexBlock.nEntries)
+	w.meta.NumEntries = w.props.NumEntries
+	w.meta.NumDeletions = w.props.NumDeletions
+
+	// Finish the last index partition of a two-level index. If the index is a
+	// single block, the filter is notified of the end of the sole partition.
+	if len(w.indexPartitions) > 0 {
+		if w.indexBlock.nEntries > 0 {
+			w.finishIndexPartition()
+		}
+	} else if w.filter != nil {
+		w.filter.finishPartition(db.DecodeInternalKey(w.indexBlock.curKey))
+	}
 
 	// Write the filter block.
 	var metaindex rawBlockWriter
 	metaindex.restartInterval = 1
 	if w.filter != nil {
+		// NB: the filter size includes the size of any filter partitions, which
+		// are written by the call to finish.
+		filterOffset := w.offset
 		b, err := w.filter.finish()
 		if err != nil {
 			w.err = err
@@ -426,7 +654,7 @@ func (w *Writer) Close() (err error) {
 		n := encodeBlockHandle(w.tmp[:], bh)
 		metaindex.add(db.InternalKey{UserKey: []byte(w.filter.metaName())}, w.tmp[:n])
 		w.props.FilterPolicyName = w.filter.policyName()
-		w.props.FilterSize = bh.length
+		w.props.FilterSize = w.offset - filterOffset - blockTrailerLen
 	}
 
 	// Write the range-del block.
@@ -453,6 +681,27 @@ func (w *Writer) Close() (err error) {
 		metaindex.add(db.InternalKey{UserKey: []byte(metaRangeDelV2Name)}, w.tmp[:n])
 	}
 
+	// Write the compression dictionary block. The dictionary is stored
+	// uncompressed, as it is needed to decompress the data blocks.
+	if len(w.dict) > 0 {
+		bh, err := w.writeRawBlock(w.dict, db.NoCompression)
+		if err != nil {
+			w.err = err
+			return w.err
+		}
+		n := encodeBlockHandle(w.tmp[:], bh)
+		metaindex.add(db.InternalKey{UserKey: []byte(metaCompressionDictName)}, w.tmp[:n])
+	}
+
+	// Write the index partitions, if the index was too large to fit within a
+	// single index block.
+	if len(w.indexPartitions) > 0 {
+		if err := w.writeTwoLevelIndex(); err != nil {
+			w.err = err
+			return w.err
+		}
+	}
+
 	{
 		// Write the properties block.
 		var raw rawBlockWriter
@@ -460,7 +709,23 @@ func (w *Writer) Close() (err error) {
 		// NB: RocksDB includes the block trailer length in the index size
 		// property, though it doesn't include the trailer in the filter size
 		// property.
-		w.props.IndexSize = uint64(w.indexBlock.estimatedSize()) + blockTrailerLen
+		if w.props.IndexType != twoLevelIndex {
+			w.props.IndexSize = uint64(w.indexBlock.estimatedSize()) + blockTrailerLen
+		}
+		if len(w.propCollectors) > 0 {
+			if w.props.UserProperties == nil {
+				w.props.UserProperties = make(map[string]string)
+			}
+			for i := range w.propCollectors {
+				if err := w.propCollectors[i].Finish(w.props.UserProperties); err != nil {
+					w.err = err
+					return w.err
+				}
+				if w.propCollectors[i].NeedCompact() {
+					w.meta.MarkedForCompaction = true
+				}
+			}
+		}
 		w.props.save(&raw)
 		bh, err := w.writeRawBlock(raw.finish(), db.NoCompression)
 		if err != nil {
@@ -479,7 +744,7 @@ func (w *Writer) Close() (err error) {
 		return w.err
 	}
 
-	// Write the index block.
+	// Write the index block, which is the top-level index of a two-level index.
 	indexBH, err := w.finishBlock(&w.indexBlock)
 	if err != nil {
 		w.err = err
@@ -489,14 +754,15 @@ func (w *Writer) Close() (err error) {
 	// Write the table footer.
 	footer := footer{
 		format:      w.tableFormat,
-		checksum:    checksumCRC32c,
+		checksum:    w.checksumType,
 		metaindexBH: metaindexBH,
 		indexBH:     indexBH,
 	}
-	if _, err := w.writer.Write(footer.encode(w.tmp[:])); err != nil {
+	if err := w.write(footer.encode(w.tmp[:])); err != nil {
 		w.err = err
 		return w.err
 	}
+	w.meta.FileChecksum = uint32(w.fileChecksum)
 
 	// Flush the buffer.
 	if w.bufWriter != nil {
@@ -532,7 +798,13 @@ func (w *Writer) Close() (err error) {
 // EstimatedSize returns the estimated size of the sstable being written if a
 // called to Finish() was made without adding additional keys.
 func (w *Writer) EstimatedSize() uint64 {
-	return w.offset + uint64(w.block.estimatedSize()+w.indexBlock.estimatedSize())
+	size := w.offset + w.indexPartitionsSize +
+		uint64(w.block.estimatedSize()+w.indexBlock.estimatedSize())
+	if w.dictSamples != nil {
+		// The sampled blocks have yet to be compressed.
+		size += uint64(w.dictSamples.size)
+	}
+	return size
 }
 
 // Metadata returns the metadata for the finished sstable. Only valid to call
@@ -544,6 +816,83 @@ func (w *Writer) Metadata() (*WriterMetadata, error) {
 	return &w.meta, nil
 }
 
+// dictSample is a finished data block buffered for training the compression
+// dictionary, along with the separator for its index entry.
+type dictSample struct {
+	block []byte
+	sep   db.InternalKey
+}
+
+// dictSampler buffers the data blocks from which the compression dictionary
+// is trained.
+type dictSampler struct {
+	blocks     []dictSample
+	size       int
+	sampleSize int
+	dictSize   int
+}
+
+func (s *dictSampler) add(block []byte, sep db.InternalKey) {
+	s.blocks = append(s.blocks, dictSample{block: block, sep: sep})
+	s.size += len(block)
+}
+
+func (s *dictSampler) empty() bool {
+	return s == nil || len(s.blocks) == 0
+}
+
+// train returns a raw content dictionary of at most dictSize bytes. Whole
+// blocks are taken at even intervals across the samples, so that the
+// dictionary reflects the contents of the entire sample rather than its start.
+func (s *dictSampler) train() []byte {
+	if len(s.blocks) == 0 {
+		return nil
+	}
+	n := len(s.blocks)
+	if s.size > s.dictSize {
+		// Take enough blocks to fill the dictionary, judging by the average block
+		// size. The final block is truncated.
+		n = (s.dictSize*len(s.blocks) + s.size - 1) / s.size
+	}
+	dict := make([]byte, 0, s.dictSize)
+	for i := 0; i < n && len(dict) < s.dictSize; i++ {
+		b := s.blocks[i*len(s.blocks)/n].block
+		if r := s.dictSize - len(dict); len(b) > r {
+			b = b[:r]
+		}
+		dict = append(dict, b...)
+	}
+	return dict
+}
+
+// deletionWindow counts the deletion tombstones within a sliding window of the
+// most recently added point entries.
+type deletionWindow struct {
+	// window is a circular buffer recording whether each of the most recent
+	// entries was a deletion.
+	window  []bool
+	pos     int
+	count   int
+	trigger int
+}
+
+// add records an entry in the window, returning true if the number of
+// deletions within the window has reached the trigger.
+func (d *deletionWindow) add(deletion bool) bool {
+	if d.window[d.pos] {
+		d.count--
+	}
+	d.window[d.pos] = deletion
+	if deletion {
+		d.count++
+	}
+	d.pos++
+	if d.pos == len(d.window) {
+		d.pos = 0
+	}
+	return d.count >= d.trigger
+}
+
 // NewWriter returns a new table writer for the file. Closing the writer will
 // close the file.
 func NewWriter(f storage.File, o *db.Options, lo db.LevelOptions) *Writer {
@@ -556,6 +905,7 @@ func NewWriter(f storage.File, o *db.Options, lo db.LevelOptions) *Writer {
 		},
 		blockSize:          lo.BlockSize,
 		blockSizeThreshold: (lo.BlockSize*lo.BlockSizeThreshold + 99) / 100,
+		indexBlockSize:     lo.IndexBlockSize,
 		bytesPerSync:       o.BytesPerSync,
 		compare:            o.Comparer.Compare,
 		split:              o.Comparer.Split,
@@ -563,6 +913,7 @@ func NewWriter(f storage.File, o *db.Options, lo db.LevelOptions) *Writer {
 		separator:          o.Comparer.Separator,
 		successor:          o.Comparer.Successor,
 		tableFormat:        o.TableFormat,
+		checksumType:       checksumTypeFor(lo.Checksum),
 		block: blockWriter{
 			restartInterval: lo.BlockRestartInterval,
 		},
@@ -578,27 +929,77 @@ func NewWriter(f storage.File, o *db.Options, lo db.LevelOptions) *Writer {
 		return w
 	}
 
+	// The LevelDB format only supports snappy compression and CRC32c checksums.
+	if w.tableFormat == db.TableFormatLevelDB {
+		if w.compression != db.NoCompression {
+			w.compression = db.SnappyCompression
+		}
+		w.checksumType = checksumCRC32c
+	}
+
+	// The LevelDB format does not support data block hash indexes.
+	if lo.DataBlockIndexType == db.DataBlockBinaryAndHash && w.tableFormat != db.TableFormatLevelDB {
+		w.block.hashIndex = newHashIndexWriter(lo.DataBlockHashUtilRatio)
+	}
+
 	w.props.PrefixExtractorName = "nullptr"
 	if lo.FilterPolicy != nil {
 		switch lo.FilterType {
 		case db.TableFilter:
 			w.filter = newTableFilterWriter(lo.FilterPolicy)
-			if w.split != nil {
-				w.props.PrefixExtractorName = o.Comparer.Name
-				w.props.PrefixFiltering = true
-			} else {
-				w.props.WholeKeyFiltering = true
-			}
+		case db.BlockFilter:
+			w.filter = newBlockFilterWriter(lo.FilterPolicy)
+		case db.PartitionedFilter:
+			w.filter = newPartitionedFilterWriter(lo.FilterPolicy, func(b []byte) (blockHandle, error) {
+				return w.writeRawBlock(b, db.NoCompression)
+			})
 		default:
 			panic(fmt.Sprintf("unknown filter type: %v", lo.FilterType))
 		}
+		if w.split != nil {
+			w.props.PrefixExtractorName = o.Comparer.Name
+			w.props.PrefixFiltering = true
+		} else {
+			w.props.WholeKeyFiltering = true
+		}
 	}
 
 	w.props.ColumnFamilyID = math.MaxInt32
 	w.props.ComparatorName = o.Comparer.Name
-	w.props.CompressionName = lo.Compression.String()
+	w.props.CompressionName = w.compression.String()
 	w.props.MergeOperatorName = o.Merger.Name
+	// Compression dictionaries are only supported by some compressors, and are
+	// not supported by the LevelDB format.
+	if lo.CompressionDictSize > 0 && w.tableFormat != db.TableFormatLevelDB {
+		if _, ok := compressors[compressionBlockType(w.compression)].(DictCompressor); ok {
+			w.dictSamples = &dictSampler{
+				sampleSize: lo.CompressionDictSampleSize,
+				dictSize:   lo.CompressionDictSize,
+			}
+		}
+	}
+	if o.DeletionWindowSize > 0 {
+		w.deletions = &deletionWindow{
+			window:  make([]bool, o.DeletionWindowSize),
+			trigger: o.DeletionWindowTrigger,
+		}
+	}
+
 	w.props.PropertyCollectorNames = "[]"
+	if len(o.TablePropertyCollectors) > 0 {
+		w.propCollectors = make([]db.TablePropertyCollector, len(o.TablePropertyCollectors))
+		var buf bytes.Buffer
+		buf.WriteString("[")
+		for i := range o.TablePropertyCollectors {
+			w.propCollectors[i] = o.TablePropertyCollectors[i]()
+			if i > 0 {
+				buf.WriteString(",")
+			}
+			buf.WriteString(w.propCollectors[i].Name())
+		}
+		buf.WriteString("]")
+		w.props.PropertyCollectorNames = buf.String()
+	}
 	w.props.Version = 2 // TODO(peter): what is this?
 
 	// If f does not have a Flush method, do our own buffering.
@@ -35,6 +35,9 @@ const (
 
 	noFullKeyBloom = false
 	fullKeyBloom   = true
+
+	tableBloom = false
+	blockBloom = true
 )
 
 //go:generate make -C ./testdata
@@ -57,12 +60,13 @@ type fixtureOpts struct {
 	compression   bool
 	fullKeyFilter bool
 	prefixFilter  bool
+	blockFilter   bool
 }
 
 func (o fixtureOpts) String() string {
 	return fmt.Sprintf(
-		"compressed=%t,fullKeyFilter=%t,prefixFilter=%t",
-		o.compression, o.fullKeyFilter, o.prefixFilter,
+		"compressed=%t,fullKeyFilter=%t,prefixFilter=%t,blockFilter=%t",
+		o.compression, o.fullKeyFilter, o.prefixFilter, o.blockFilter,
 	)
 }
 
@@ -70,16 +74,19 @@ var fixtures = map[fixtureOpts]struct {
 	filename string
 	comparer *db.Comparer
 }{
-	{compressed, noFullKeyBloom, noPrefixFilter}: {
+	{compressed, noFullKeyBloom, noPrefixFilter, tableBloom}: {
 		"testdata/h.sst", nil,
 	},
-	{uncompressed, noFullKeyBloom, noPrefixFilter}: {
+	{uncompressed, noFullKeyBloom, noPrefixFilter, tableBloom}: {
 		"testdata/h.no-compression.sst", nil,
 	},
-	{uncompressed, fullKeyBloom, noPrefixFilter}: {
+	{uncompressed, fullKeyBloom, noPrefixFilter, tableBloom}: {
 		"testdata/h.table-bloom.no-compression.sst", nil,
 	},
-	{uncompressed, noFullKeyBloom, prefixFilter}: {
+	{uncompressed, fullKeyBloom, noPrefixFilter, blockBloom}: {
+		"testdata/h.block-bloom.no-compression.sst", nil,
+	},
+	{uncompressed, noFullKeyBloom, prefixFilter, tableBloom}: {
 		"testdata/h.table-bloom.no-compression.prefix_extractor.no_whole_key_filter.sst",
 		fixtureComparer,
 	},
@@ -101,6 +108,9 @@ func runTestFixtureOutput(opts fixtureOpts) error {
 		fp = bloom.FilterPolicy(10)
 	}
 	ftype := db.TableFilter
+	if opts.blockFilter {
+		ftype = db.BlockFilter
+	}
 
 	// Check that a freshly made table is byte-for-byte equal to a pre-made
 	// table.
@@ -0,0 +1,308 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package storage
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// The header of an encrypted file is laid out as:
+//
+//	magic (4 bytes) | key ID (4 bytes, little endian) | IV (16 bytes)
+//
+// The contents of the file follow the header, encrypted using AES in CTR mode
+// with the file's IV as the initial counter. The encrypted contents are the
+// same length as the plaintext, and the keystream for any offset can be
+// computed directly, allowing reads at arbitrary offsets.
+const (
+	encryptionMagic     = "\xf4\x70\x65\x01"
+	encryptionHeaderLen = 4 + 4 + aes.BlockSize
+)
+
+// EncryptedStorage is a Storage which encrypts the contents of the files in
+// an underlying Storage using AES in CTR mode. Each file is encrypted with a
+// random IV, which is stored in a small header at the start of the file along
+// with the ID of the key used to encrypt it. Both the header and the
+// encryption are invisible to users of the files, so an EncryptedStorage can
+// be used for all of the files in a DB: sstables, WALs, MANIFESTs, and so on.
+//
+// Keys are rotated by adding a new key and making it current using AddKey and
+// SetCurrentKey. New files are encrypted with the current key, while existing
+// files remain readable as long as the key they were encrypted with has been
+// added. Key IDs are opaque to the storage. The key for an ID must not change:
+// doing so would make files encrypted with the previous key unreadable.
+//
+// File names and directory structure are not encrypted.
+type EncryptedStorage struct {
+	fs Storage
+
+	mu struct {
+		sync.RWMutex
+		keys      map[uint32]cipher.Block
+		currentID uint32
+	}
+}
+
+var _ Storage = (*EncryptedStorage)(nil)
+
+// NewEncryptedStorage returns an EncryptedStorage wrapping fs which encrypts
+// new files with key, identified by keyID. The key must be 16, 24 or 32 bytes
+// long, selecting AES-128, AES-192 or AES-256 respectively.
+func NewEncryptedStorage(fs Storage, keyID uint32, key []byte) (*EncryptedStorage, error) {
+	s := &EncryptedStorage{fs: fs}
+	s.mu.keys = make(map[uint32]cipher.Block)
+	if err := s.AddKey(keyID, key); err != nil {
+		return nil, err
+	}
+	s.mu.currentID = keyID
+	return s, nil
+}
+
+// AddKey adds a key with which files can be decrypted. The key is not used to
+// encrypt new files until it is made current by SetCurrentKey.
+func (s *EncryptedStorage) AddKey(keyID uint32, key []byte) error {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return fmt.Errorf("pebble/storage: encryption key %d: %v", keyID, err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.mu.keys[keyID]; ok {
+		return fmt.Errorf("pebble/storage: encryption key %d already exists", keyID)
+	}
+	s.mu.keys[keyID] = block
+	return nil
+}
+
+// SetCurrentKey sets the key with which new files are encrypted. The key must
+// have been previously added.
+func (s *EncryptedStorage) SetCurrentKey(keyID uint32) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.mu.keys[keyID]; !ok {
+		return fmt.Errorf("pebble/storage: unknown encryption key %d", keyID)
+	}
+	s.mu.currentID = keyID
+	return nil
+}
+
+// CurrentKey returns the ID of the key with which new files are encrypted.
+func (s *EncryptedStorage) CurrentKey() uint32 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.mu.currentID
+}
+
+// Create implements Storage.Create.
+func (s *EncryptedStorage) Create(name string) (File, error) {
+	s.mu.RLock()
+	keyID := s.mu.currentID
+	block := s.mu.keys[keyID]
+	s.mu.RUnlock()
+
+	var header [encryptionHeaderLen]byte
+	copy(header[:4], encryptionMagic)
+	binary.LittleEndian.PutUint32(header[4:8], keyID)
+	iv := header[8:]
+	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+		return nil, err
+	}
+
+	f, err := s.fs.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Write(header[:]); err != nil {
+		f.Close()
+		return nil, err
+	}
+	ef := &encryptedFile{File: f, block: block}
+	copy(ef.iv[:], iv)
+	return ef, nil
+}
+
+// Link implements Storage.Link.
+func (s *EncryptedStorage) Link(oldname, newname string) error {
+	return s.fs.Link(oldname, newname)
+}
+
+// Open implements Storage.Open.
+func (s *EncryptedStorage) Open(name string) (File, error) {
+	f, err := s.fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	var header [encryptionHeaderLen]byte
+	n, _ := f.ReadAt(header[:], 0)
+	if n < len(header) {
+		// The header is written when the file is created but is not synced, so
+		// a crash can leave a file without a complete header. Nothing written
+		// after the header can have survived, so the file is empty.
+		if isTruncatedHeader(header[:n]) {
+			return &encryptedFile{File: f}, nil
+		}
+	}
+	if n != len(header) || string(header[:4]) != encryptionMagic {
+		f.Close()
+		return nil, fmt.Errorf("pebble/storage: %s: not an encrypted file", name)
+	}
+	keyID := binary.LittleEndian.Uint32(header[4:8])
+	s.mu.RLock()
+	block := s.mu.keys[keyID]
+	s.mu.RUnlock()
+	if block == nil {
+		f.Close()
+		return nil, fmt.Errorf("pebble/storage: %s: unknown encryption key %d", name, keyID)
+	}
+	ef := &encryptedFile{File: f, block: block}
+	copy(ef.iv[:], header[8:])
+	return ef, nil
+}
+
+// isTruncatedHeader returns true if b, which is shorter than an encryption
+// header, is the start of one.
+func isTruncatedHeader(b []byte) bool {
+	if len(b) > len(encryptionMagic) {
+		b = b[:len(encryptionMagic)]
+	}
+	return string(b) == encryptionMagic[:len(b)]
+}
+
+// OpenDir implements Storage.OpenDir.
+func (s *EncryptedStorage) OpenDir(name string) (File, error) {
+	return s.fs.OpenDir(name)
+}
+
+// Remove implements Storage.Remove.
+func (s *EncryptedStorage) Remove(name string) error {
+	return s.fs.Remove(name)
+}
+
+// Rename implements Storage.Rename.
+func (s *EncryptedStorage) Rename(oldname, newname string) error {
+	return s.fs.Rename(oldname, newname)
+}
+
+// MkdirAll implements Storage.MkdirAll.
+func (s *EncryptedStorage) MkdirAll(dir string, perm os.FileMode) error {
+	return s.fs.MkdirAll(dir, perm)
+}
+
+// Lock implements Storage.Lock. Lock files hold no data and are not
+// encrypted.
+func (s *EncryptedStorage) Lock(name string) (io.Closer, error) {
+	return s.fs.Lock(name)
+}
+
+// List implements Storage.List.
+func (s *EncryptedStorage) List(dir string) ([]string, error) {
+	return s.fs.List(dir)
+}
+
+// Stat implements Storage.Stat. The size of a file excludes its encryption
+// header.
+func (s *EncryptedStorage) Stat(name string) (os.FileInfo, error) {
+	stat, err := s.fs.Stat(name)
+	if err != nil || stat.IsDir() {
+		return stat, err
+	}
+	return encryptedFileInfo{stat}, nil
+}
+
+// FreeSpace implements Storage.FreeSpace.
+func (s *EncryptedStorage) FreeSpace(dir string) (uint64, error) {
+	return s.fs.FreeSpace(dir)
+}
+
+// encryptedFileInfo adjusts the size of an encrypted file to exclude its
+// header.
+type encryptedFileInfo struct {
+	os.FileInfo
+}
+
+func (fi encryptedFileInfo) Size() int64 {
+	if size := fi.FileInfo.Size() - encryptionHeaderLen; size > 0 {
+		return size
+	}
+	return 0
+}
+
+// encryptedFile implements File, encrypting and decrypting the contents of an
+// underlying file. Offsets are relative to the end of the header.
+type encryptedFile struct {
+	File
+	block cipher.Block
+	iv    [aes.BlockSize]byte
+	// The offset of the next Read, and of the next Write.
+	rpos, wpos int64
+	// Scratch space holding encrypted data before it is written.
+	buf []byte
+}
+
+// xorKeyStream XORs src with the keystream starting at the given offset of
+// the file, storing the result in dst.
+func (f *encryptedFile) xorKeyStream(dst, src []byte, offset int64) {
+	if len(src) == 0 {
+		// A file with a truncated header has no cipher, but is also empty.
+		return
+	}
+	// The counter for the block containing offset is the IV, treated as a
+	// big-endian 128-bit integer, plus the block's index.
+	var ctr [aes.BlockSize]byte
+	copy(ctr[:], f.iv[:])
+	carry := uint64(offset / aes.BlockSize)
+	for i := len(ctr) - 1; i >= 0 && carry > 0; i-- {
+		sum := uint64(ctr[i]) + carry&0xff
+		ctr[i] = byte(sum)
+		carry = carry>>8 + sum>>8
+	}
+	stream := cipher.NewCTR(f.block, ctr[:])
+	if skip := offset % aes.BlockSize; skip > 0 {
+		var discard [aes.BlockSize]byte
+		stream.XORKeyStream(discard[:skip], discard[:skip])
+	}
+	stream.XORKeyStream(dst, src)
+}
+
+func (f *encryptedFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.rpos)
+	f.rpos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *encryptedFile) ReadAt(p []byte, off int64) (int, error) {
+	n, err := f.File.ReadAt(p, off+encryptionHeaderLen)
+	f.xorKeyStream(p[:n], p[:n], off)
+	return n, err
+}
+
+func (f *encryptedFile) Write(p []byte) (int, error) {
+	if cap(f.buf) < len(p) {
+		f.buf = make([]byte, len(p))
+	}
+	buf := f.buf[:len(p)]
+	f.xorKeyStream(buf, p, f.wpos)
+	n, err := f.File.Write(buf)
+	f.wpos += int64(n)
+	return n, err
+}
+
+func (f *encryptedFile) Stat() (os.FileInfo, error) {
+	stat, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return encryptedFileInfo{stat}, nil
+}
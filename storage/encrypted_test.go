@@ -0,0 +1,295 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package storage
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"io/ioutil"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, 32)
+}
+
+func TestEncryptedStorage(t *testing.T) {
+	mem := NewMem()
+	fs, err := NewEncryptedStorage(mem, 1, testKey(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	plaintext := make([]byte, 10000)
+	rng.Read(plaintext)
+
+	// Write the plaintext in randomly sized pieces.
+	f, err := fs.Create("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for p := plaintext; len(p) > 0; {
+		n := rng.Intn(100)
+		if n > len(p) {
+			n = len(p)
+		}
+		if _, err := f.Write(p[:n]); err != nil {
+			t.Fatal(err)
+		}
+		p = p[n:]
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The underlying file holds the header followed by the plaintext encrypted
+	// using standard AES-CTR.
+	raw, err := mem.Open("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext, err := ioutil.ReadAll(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw.Close()
+	if len(ciphertext) != encryptionHeaderLen+len(plaintext) {
+		t.Fatalf("expected %d bytes, but found %d", encryptionHeaderLen+len(plaintext), len(ciphertext))
+	}
+	block, err := aes.NewCipher(testKey(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := make([]byte, len(plaintext))
+	cipher.NewCTR(block, ciphertext[8:encryptionHeaderLen]).XORKeyStream(expected, plaintext)
+	if !bytes.Equal(expected, ciphertext[encryptionHeaderLen:]) {
+		t.Fatalf("unexpected ciphertext")
+	}
+
+	stat, err := fs.Stat("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Size() != int64(len(plaintext)) {
+		t.Fatalf("expected size %d, but found %d", len(plaintext), stat.Size())
+	}
+
+	f, err = fs.Open("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if stat, err := f.Stat(); err != nil {
+		t.Fatal(err)
+	} else if stat.Size() != int64(len(plaintext)) {
+		t.Fatalf("expected size %d, but found %d", len(plaintext), stat.Size())
+	}
+	contents, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(plaintext, contents) {
+		t.Fatalf("read: unexpected contents")
+	}
+	for i := 0; i < 1000; i++ {
+		off := rng.Intn(len(plaintext))
+		n := rng.Intn(len(plaintext) - off + 1)
+		buf := make([]byte, n)
+		if _, err := f.ReadAt(buf, int64(off)); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(plaintext[off:off+n], buf) {
+			t.Fatalf("readat %d %d: unexpected contents", off, n)
+		}
+	}
+}
+
+func TestEncryptedStorageTruncatedHeader(t *testing.T) {
+	mem := NewMem()
+	fs, err := NewEncryptedStorage(mem, 1, testKey(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := fs.Create("full")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	f, err = mem.Open("full")
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	// A file whose header was cut short by a crash is empty, while a short file
+	// which does not start like a header is rejected.
+	testCases := []struct {
+		contents string
+		valid    bool
+	}{
+		{"", true},
+		{string(header[:2]), true},
+		{string(header[:10]), true},
+		{string(header[:encryptionHeaderLen-1]), true},
+		{"xyz", false},
+		{"\xf4\x70\x65\x02" + string(header[4:10]), false},
+	}
+	for i, c := range testCases {
+		f, err := mem.Create("truncated")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write([]byte(c.contents)); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+
+		f, err = fs.Open("truncated")
+		if !c.valid {
+			if err == nil {
+				t.Fatalf("%d: expected error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if data, err := ioutil.ReadAll(f); err != nil || len(data) != 0 {
+			t.Fatalf("%d: expected empty file, but found %q (%v)", i, data, err)
+		}
+		if stat, err := f.Stat(); err != nil || stat.Size() != 0 {
+			t.Fatalf("%d: expected size 0, but found %v (%v)", i, stat, err)
+		}
+		f.Close()
+	}
+}
+
+func TestEncryptedStorageCounter(t *testing.T) {
+	// The counter for a block is computed by adding the block index to the IV,
+	// carrying across bytes.
+	block, err := aes.NewCipher(testKey(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &encryptedFile{block: block}
+	for i := range f.iv {
+		f.iv[i] = 0xff
+	}
+	f.iv[0] = 0xfe
+
+	const n = 5 * aes.BlockSize
+	expected := make([]byte, n)
+	cipher.NewCTR(block, f.iv[:]).XORKeyStream(expected, expected)
+	for off := 0; off < n; off++ {
+		buf := make([]byte, n-off)
+		f.xorKeyStream(buf, buf, int64(off))
+		if !bytes.Equal(expected[off:], buf) {
+			t.Fatalf("%d: unexpected keystream", off)
+		}
+	}
+}
+
+func TestEncryptedStorageKeyRotation(t *testing.T) {
+	mem := NewMem()
+	fs, err := NewEncryptedStorage(mem, 1, testKey(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	write := func(name, data string) {
+		f, err := fs.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	read := func(fs Storage, name string) (string, error) {
+		f, err := fs.Open(name)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		data, err := ioutil.ReadAll(f)
+		return string(data), err
+	}
+
+	write("a", "old")
+	if err := fs.SetCurrentKey(2); err == nil {
+		t.Fatalf("expected error setting an unknown key")
+	}
+	if err := fs.AddKey(2, testKey(2)); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.AddKey(2, testKey(3)); err == nil {
+		t.Fatalf("expected error re-adding a key")
+	}
+	if err := fs.AddKey(3, []byte("short")); err == nil {
+		t.Fatalf("expected error adding an invalid key")
+	}
+	if err := fs.SetCurrentKey(2); err != nil {
+		t.Fatal(err)
+	}
+	if id := fs.CurrentKey(); id != 2 {
+		t.Fatalf("expected current key 2, but found %d", id)
+	}
+	write("b", "new")
+
+	for name, expected := range map[string]string{"a": "old", "b": "new"} {
+		if data, err := read(fs, name); err != nil {
+			t.Fatal(err)
+		} else if data != expected {
+			t.Fatalf("%s: expected %q, but found %q", name, expected, data)
+		}
+	}
+
+	// A storage which only knows the new key cannot read the old file.
+	fs2, err := NewEncryptedStorage(mem, 2, testKey(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := read(fs2, "a"); err == nil || !strings.Contains(err.Error(), "unknown encryption key 1") {
+		t.Fatalf("expected unknown key error, but found %v", err)
+	}
+	if data, err := read(fs2, "b"); err != nil || data != "new" {
+		t.Fatalf("expected %q, but found %q (%v)", "new", data, err)
+	}
+
+	// Unencrypted files cannot be read.
+	f, err := mem.Create("c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("plaintext which is not encrypted"))
+	f.Close()
+	if _, err := read(fs, "c"); err == nil || !strings.Contains(err.Error(), "not an encrypted file") {
+		t.Fatalf("expected not encrypted error, but found %v", err)
+	}
+
+	// Directories are opened as is.
+	if err := fs.MkdirAll("dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	d, err := fs.OpenDir("dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	d.Close()
+}
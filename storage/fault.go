@@ -0,0 +1,512 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package storage
+
+import (
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+)
+
+// Op is an operation on a FaultStorage into which an error can be injected.
+type Op int
+
+// The operations into which errors can be injected.
+const (
+	OpCreate Op = iota
+	OpLink
+	OpOpen
+	OpOpenDir
+	OpRead
+	OpWrite
+	OpSync
+	OpRemove
+	OpRename
+	OpMkdirAll
+	OpList
+	OpStat
+	nOp
+)
+
+var opNames = [nOp]string{
+	OpCreate:   "create",
+	OpLink:     "link",
+	OpOpen:     "open",
+	OpOpenDir:  "opendir",
+	OpRead:     "read",
+	OpWrite:    "write",
+	OpSync:     "sync",
+	OpRemove:   "remove",
+	OpRename:   "rename",
+	OpMkdirAll: "mkdirall",
+	OpList:     "list",
+	OpStat:     "stat",
+}
+
+func (o Op) String() string {
+	if o >= 0 && o < nOp {
+		return opNames[o]
+	}
+	return "unknown"
+}
+
+// An Injector decides whether to inject an error into an operation on the
+// named file, returning the error to inject or nil.
+type Injector interface {
+	MaybeError(op Op, name string) error
+}
+
+// InjectorFunc implements Injector using a function.
+type InjectorFunc func(op Op, name string) error
+
+// MaybeError implements Injector.MaybeError.
+func (f InjectorFunc) MaybeError(op Op, name string) error {
+	return f(op, name)
+}
+
+// OnIndex returns an Injector which injects err into the index'th (counting
+// from zero) operation of type op, and into no other operation.
+func OnIndex(op Op, index int32, err error) Injector {
+	var count int32 = -1
+	return InjectorFunc(func(o Op, name string) error {
+		if o == op && atomic.AddInt32(&count, 1) == index {
+			return err
+		}
+		return nil
+	})
+}
+
+// Randomly returns an Injector which injects err into operations of type op
+// with probability p. The random number generator is seeded with seed, making
+// the injected errors deterministic for a deterministic sequence of
+// operations.
+func Randomly(op Op, p float64, seed int64, err error) Injector {
+	var mu sync.Mutex
+	rng := rand.New(rand.NewSource(seed))
+	return InjectorFunc(func(o Op, name string) error {
+		if o != op {
+			return nil
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if rng.Float64() < p {
+			return err
+		}
+		return nil
+	})
+}
+
+// FaultStorage is a Storage, intended for testing, which wraps another
+// Storage in order to inject errors into its operations and to simulate a
+// crash.
+//
+// Errors are injected by an Injector, which is consulted before each
+// operation. Injected errors are returned wrapped in an *os.PathError, and
+// are typically errors such as syscall.ENOSPC or syscall.EIO. A write into
+// which an error is injected is short: only the first half of the data is
+// written.
+//
+// FaultStorage tracks the data written to each file since the file was last
+// synced, and Crash discards that data as the operating system would on a
+// power loss. If created with strictDirs, FaultStorage also tracks the
+// creation, renaming, linking and removal of files since their directory was
+// last synced, by opening the directory using OpenDir and calling Sync on it,
+// and Crash reverts those operations as well.
+//
+// Files which existed in the wrapped Storage before it was wrapped are
+// considered durable. Directory names are compared ignoring any leading
+// separator, as for the memory-backed Storage returned by NewMem, so that the
+// files named "/a" and "a" are both in the directory named "".
+type FaultStorage struct {
+	fs         Storage
+	strictDirs bool
+	injector   atomic.Value // injectorValue
+
+	mu struct {
+		sync.Mutex
+		// The durability state of the files created through the FaultStorage,
+		// by name. A file which is not present is durable. Hard links share
+		// the same state.
+		files map[string]*faultFileState
+		// The directory operations which have not been synced, oldest first.
+		dirOps []faultDirOp
+	}
+}
+
+var _ Storage = (*FaultStorage)(nil)
+
+type injectorValue struct {
+	Injector
+}
+
+type faultFileState struct {
+	// The number of bytes written to the file, and the number of those bytes
+	// which have been synced.
+	written, synced int64
+}
+
+type faultDirOpKind int
+
+const (
+	dirOpCreate faultDirOpKind = iota
+	dirOpLink
+	dirOpRemove
+	dirOpRename
+)
+
+// faultDirOp records a directory operation so that it can be reverted.
+type faultDirOp struct {
+	kind faultDirOpKind
+	// The directory whose sync makes the operation durable.
+	dir string
+	// The name of the file created, linked, removed, or the target of a
+	// rename.
+	name string
+	// The source of a link or rename.
+	oldname string
+	// The durable contents of the file replaced or removed by the operation,
+	// or nil if no file was replaced.
+	prev []byte
+}
+
+// NewFaultStorage returns a FaultStorage wrapping fs. If strictDirs is true,
+// directory operations are not durable until the directory is synced.
+// Otherwise they are durable immediately, and only unsynced file data is lost
+// in a crash.
+func NewFaultStorage(fs Storage, strictDirs bool) *FaultStorage {
+	s := &FaultStorage{
+		fs:         fs,
+		strictDirs: strictDirs,
+	}
+	s.mu.files = make(map[string]*faultFileState)
+	s.SetInjector(nil)
+	return s
+}
+
+// SetInjector sets the Injector which decides whether to inject an error into
+// each subsequent operation. A nil Injector injects no errors.
+func (s *FaultStorage) SetInjector(inj Injector) {
+	s.injector.Store(injectorValue{inj})
+}
+
+func (s *FaultStorage) maybeError(op Op, name string) error {
+	inj := s.injector.Load().(injectorValue)
+	if inj.Injector == nil {
+		return nil
+	}
+	if err := inj.MaybeError(op, name); err != nil {
+		return &os.PathError{Op: op.String(), Path: name, Err: err}
+	}
+	return nil
+}
+
+// durableContents returns the contents of the named file which would survive
+// a crash, or nil if the file does not exist. s.mu must be held.
+func (s *FaultStorage) durableContents(name string) []byte {
+	f, err := s.fs.Open(name)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil
+	}
+	if data == nil {
+		data = []byte{}
+	}
+	if st := s.mu.files[name]; st != nil && st.synced < int64(len(data)) {
+		data = data[:st.synced]
+	}
+	return data
+}
+
+// faultDirName normalizes the name of a directory.
+func faultDirName(dir string) string {
+	dir = filepath.Clean(dir)
+	for len(dir) > 0 && dir[0] == os.PathSeparator {
+		dir = dir[1:]
+	}
+	if dir == "" {
+		dir = "."
+	}
+	return dir
+}
+
+// recordDirOp records a directory operation if directory operations are not
+// durable until synced. s.mu must be held.
+func (s *FaultStorage) recordDirOp(op faultDirOp) {
+	if s.strictDirs {
+		op.dir = faultDirName(filepath.Dir(op.name))
+		s.mu.dirOps = append(s.mu.dirOps, op)
+	}
+}
+
+func (s *FaultStorage) syncDir(dir string) {
+	dir = faultDirName(dir)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ops := s.mu.dirOps[:0]
+	for _, op := range s.mu.dirOps {
+		if op.dir != dir {
+			ops = append(ops, op)
+		}
+	}
+	s.mu.dirOps = ops
+}
+
+// Crash simulates a crash of the machine, reverting the unsynced directory
+// operations if directories are strictly synced, and discarding the unsynced
+// data in each file. Files which are open when Crash is called must not be
+// used afterwards. All of the files remaining after a crash are durable.
+func (s *FaultStorage) Crash() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	write := func(name string, data []byte) error {
+		f, err := s.fs.Create(name)
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(data)
+		if err1 := f.Close(); err == nil {
+			err = err1
+		}
+		return err
+	}
+
+	// Revert the directory operations, most recent first.
+	for i := len(s.mu.dirOps) - 1; i >= 0; i-- {
+		op := &s.mu.dirOps[i]
+		var err error
+		switch op.kind {
+		case dirOpCreate, dirOpLink:
+			err = s.fs.Remove(op.name)
+			delete(s.mu.files, op.name)
+		case dirOpRename:
+			err = s.fs.Rename(op.name, op.oldname)
+			if st := s.mu.files[op.name]; st != nil {
+				s.mu.files[op.oldname] = st
+			}
+			delete(s.mu.files, op.name)
+		}
+		if err == nil && op.prev != nil {
+			err = write(op.name, op.prev)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	s.mu.dirOps = nil
+
+	// Discard the unsynced data.
+	for name, st := range s.mu.files {
+		if st.written == st.synced {
+			continue
+		}
+		if data := s.durableContents(name); data != nil {
+			if err := write(name, data); err != nil {
+				return err
+			}
+		}
+	}
+	s.mu.files = make(map[string]*faultFileState)
+	return nil
+}
+
+// Create implements Storage.Create.
+func (s *FaultStorage) Create(name string) (File, error) {
+	if err := s.maybeError(OpCreate, name); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prev := s.durableContents(name)
+	f, err := s.fs.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	st := &faultFileState{}
+	s.mu.files[name] = st
+	s.recordDirOp(faultDirOp{kind: dirOpCreate, name: name, prev: prev})
+	return &faultFile{File: f, s: s, name: name, state: st}, nil
+}
+
+// Link implements Storage.Link.
+func (s *FaultStorage) Link(oldname, newname string) error {
+	if err := s.maybeError(OpLink, newname); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.fs.Link(oldname, newname); err != nil {
+		return err
+	}
+	if st := s.mu.files[oldname]; st != nil {
+		s.mu.files[newname] = st
+	}
+	s.recordDirOp(faultDirOp{kind: dirOpLink, name: newname, oldname: oldname})
+	return nil
+}
+
+// Open implements Storage.Open.
+func (s *FaultStorage) Open(name string) (File, error) {
+	if err := s.maybeError(OpOpen, name); err != nil {
+		return nil, err
+	}
+	f, err := s.fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{File: f, s: s, name: name}, nil
+}
+
+// OpenDir implements Storage.OpenDir. Syncing the directory makes the
+// operations on the files within it durable.
+func (s *FaultStorage) OpenDir(name string) (File, error) {
+	if err := s.maybeError(OpOpenDir, name); err != nil {
+		return nil, err
+	}
+	f, err := s.fs.OpenDir(name)
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{File: f, s: s, name: name, dir: true}, nil
+}
+
+// Remove implements Storage.Remove.
+func (s *FaultStorage) Remove(name string) error {
+	if err := s.maybeError(OpRemove, name); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prev := s.durableContents(name)
+	if err := s.fs.Remove(name); err != nil {
+		return err
+	}
+	delete(s.mu.files, name)
+	s.recordDirOp(faultDirOp{kind: dirOpRemove, name: name, prev: prev})
+	return nil
+}
+
+// Rename implements Storage.Rename.
+func (s *FaultStorage) Rename(oldname, newname string) error {
+	if err := s.maybeError(OpRename, newname); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prev := s.durableContents(newname)
+	if err := s.fs.Rename(oldname, newname); err != nil {
+		return err
+	}
+	if st := s.mu.files[oldname]; st != nil {
+		s.mu.files[newname] = st
+	} else {
+		delete(s.mu.files, newname)
+	}
+	delete(s.mu.files, oldname)
+	s.recordDirOp(faultDirOp{kind: dirOpRename, name: newname, oldname: oldname, prev: prev})
+	return nil
+}
+
+// MkdirAll implements Storage.MkdirAll. Directories are durable once created.
+func (s *FaultStorage) MkdirAll(dir string, perm os.FileMode) error {
+	if err := s.maybeError(OpMkdirAll, dir); err != nil {
+		return err
+	}
+	return s.fs.MkdirAll(dir, perm)
+}
+
+// Lock implements Storage.Lock.
+func (s *FaultStorage) Lock(name string) (io.Closer, error) {
+	return s.fs.Lock(name)
+}
+
+// List implements Storage.List.
+func (s *FaultStorage) List(dir string) ([]string, error) {
+	if err := s.maybeError(OpList, dir); err != nil {
+		return nil, err
+	}
+	return s.fs.List(dir)
+}
+
+// Stat implements Storage.Stat.
+func (s *FaultStorage) Stat(name string) (os.FileInfo, error) {
+	if err := s.maybeError(OpStat, name); err != nil {
+		return nil, err
+	}
+	return s.fs.Stat(name)
+}
+
+// FreeSpace implements Storage.FreeSpace.
+func (s *FaultStorage) FreeSpace(dir string) (uint64, error) {
+	return s.fs.FreeSpace(dir)
+}
+
+// faultFile implements File for a FaultStorage.
+type faultFile struct {
+	File
+	s    *FaultStorage
+	name string
+	// The durability state of a file opened for writing.
+	state *faultFileState
+	// True if the file is a directory opened using OpenDir.
+	dir bool
+}
+
+func (f *faultFile) Read(p []byte) (int, error) {
+	if err := f.s.maybeError(OpRead, f.name); err != nil {
+		return 0, err
+	}
+	return f.File.Read(p)
+}
+
+func (f *faultFile) ReadAt(p []byte, off int64) (int, error) {
+	if err := f.s.maybeError(OpRead, f.name); err != nil {
+		return 0, err
+	}
+	return f.File.ReadAt(p, off)
+}
+
+func (f *faultFile) Write(p []byte) (int, error) {
+	injected := f.s.maybeError(OpWrite, f.name)
+	if injected != nil {
+		p = p[:len(p)/2]
+	}
+	n, err := f.File.Write(p)
+	if f.state != nil {
+		f.s.mu.Lock()
+		f.state.written += int64(n)
+		f.s.mu.Unlock()
+	}
+	if injected != nil {
+		return n, injected
+	}
+	return n, err
+}
+
+func (f *faultFile) Sync() error {
+	if err := f.s.maybeError(OpSync, f.name); err != nil {
+		return err
+	}
+	if err := f.File.Sync(); err != nil {
+		return err
+	}
+	if f.state != nil {
+		f.s.mu.Lock()
+		f.state.synced = f.state.written
+		f.s.mu.Unlock()
+	}
+	if f.dir {
+		f.s.syncDir(f.name)
+	}
+	return nil
+}
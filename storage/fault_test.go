@@ -0,0 +1,213 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestFaultStorageInjection(t *testing.T) {
+	fs := NewFaultStorage(NewMem(), false)
+
+	fs.SetInjector(OnIndex(OpCreate, 1, syscall.ENOSPC))
+	if _, err := fs.Create("a"); err != nil {
+		t.Fatal(err)
+	}
+	_, err := fs.Create("b")
+	if pe, ok := err.(*os.PathError); !ok || pe.Err != syscall.ENOSPC || pe.Op != "create" || pe.Path != "b" {
+		t.Fatalf("expected create b: ENOSPC, but found %v", err)
+	}
+	if _, err := fs.Create("c"); err != nil {
+		t.Fatal(err)
+	}
+
+	// An injected write error results in a short write.
+	f, err := fs.Create("d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.SetInjector(OnIndex(OpWrite, 0, syscall.EIO))
+	if n, err := f.Write([]byte("abcdef")); n != 3 || err == nil {
+		t.Fatalf("expected short write, but found %d, %v", n, err)
+	}
+	if n, err := f.Write([]byte("ghi")); n != 3 || err != nil {
+		t.Fatalf("expected successful write, but found %d, %v", n, err)
+	}
+	f.Close()
+	if data := readFile(t, fs, "d"); data != "abcghi" {
+		t.Fatalf("expected abcghi, but found %s", data)
+	}
+
+	// Errors are injected with the requested probability.
+	fs.SetInjector(Randomly(OpStat, 0.5, 1, syscall.EIO))
+	var failed int
+	for i := 0; i < 1000; i++ {
+		if _, err := fs.Stat("d"); err != nil {
+			failed++
+		}
+		if _, err := fs.Open("d"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if failed < 400 || failed > 600 {
+		t.Fatalf("expected ~500 failures, but found %d", failed)
+	}
+	fs.SetInjector(nil)
+	if _, err := fs.Stat("d"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(t *testing.T, fs Storage, name string) string {
+	f, err := fs.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func writeFile(t *testing.T, fs Storage, name, data string, sync bool) {
+	f, err := fs.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	if sync {
+		if err := f.Sync(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// listFiles returns a description of the files in the directory and their
+// contents.
+func listFiles(t *testing.T, fs Storage, dir string) string {
+	names, err := fs.List(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	var parts []string
+	for _, name := range names {
+		parts = append(parts, name+":"+readFile(t, fs, dir+"/"+name))
+	}
+	return strings.Join(parts, " ")
+}
+
+func TestFaultStorageCrash(t *testing.T) {
+	mem := NewMem()
+	if err := mem.MkdirAll("dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, mem, "dir/old", "old", false)
+
+	fs := NewFaultStorage(mem, false)
+	writeFile(t, fs, "dir/synced", "synced", true)
+	writeFile(t, fs, "dir/unsynced", "unsynced", false)
+
+	// Only the synced prefix of a file survives.
+	f, err := fs.Create("dir/partial")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("abc"))
+	f.Sync()
+	f.Write([]byte("def"))
+	f.Close()
+
+	if err := fs.Rename("dir/synced", "dir/renamed"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Remove("dir/old"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Crash(); err != nil {
+		t.Fatal(err)
+	}
+	expected := "partial:abc renamed:synced unsynced:"
+	if s := listFiles(t, fs, "dir"); s != expected {
+		t.Fatalf("expected %q, but found %q", expected, s)
+	}
+}
+
+func TestFaultStorageCrashStrictDirs(t *testing.T) {
+	mem := NewMem()
+	if err := mem.MkdirAll("dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, mem, "dir/old", "old", false)
+	writeFile(t, mem, "dir/target", "target", false)
+
+	fs := NewFaultStorage(mem, true)
+	syncDir := func() {
+		d, err := fs.OpenDir("dir")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Sync(); err != nil {
+			t.Fatal(err)
+		}
+		d.Close()
+	}
+
+	// A synced file whose directory entry is synced survives.
+	writeFile(t, fs, "dir/a", "a", true)
+	syncDir()
+
+	// Operations performed after the last sync of the directory are reverted,
+	// even though the file data was synced.
+	writeFile(t, fs, "dir/b", "b", true)
+	if err := fs.Link("dir/a", "dir/c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Remove("dir/old"); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, fs, "dir/tmp", "new-target", true)
+	if err := fs.Rename("dir/tmp", "dir/target"); err != nil {
+		t.Fatal(err)
+	}
+	// Overwriting a file is reverted too.
+	writeFile(t, fs, "dir/a", "overwritten", true)
+
+	before := listFiles(t, fs, "dir")
+	if expected := "a:overwritten b:b c:a target:new-target"; before != expected {
+		t.Fatalf("expected %q, but found %q", expected, before)
+	}
+	if err := fs.Crash(); err != nil {
+		t.Fatal(err)
+	}
+	if s, expected := listFiles(t, fs, "dir"), "a:a old:old target:target"; s != expected {
+		t.Fatalf("expected %q, but found %q", expected, s)
+	}
+
+	// After syncing the directory, the operations survive a crash.
+	writeFile(t, fs, "dir/tmp", "new-target", true)
+	if err := fs.Rename("dir/tmp", "dir/target"); err != nil {
+		t.Fatal(err)
+	}
+	syncDir()
+	if err := fs.Crash(); err != nil {
+		t.Fatal(err)
+	}
+	if s, expected := listFiles(t, fs, "dir"), "a:a old:old target:new-target"; s != expected {
+		t.Fatalf("expected %q, but found %q", expected, s)
+	}
+}
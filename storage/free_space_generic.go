@@ -0,0 +1,14 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+// +build !darwin,!dragonfly,!freebsd,!linux
+
+package storage
+
+import "math"
+
+func (defaultFS) FreeSpace(dir string) (uint64, error) {
+	// The free space is not known.
+	return math.MaxUint64, nil
+}
@@ -0,0 +1,29 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestFreeSpace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pebble-free-space")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, dir := range []string{dir, ""} {
+		free, err := Default.FreeSpace(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if free == 0 {
+			t.Fatalf("%q: expected free space", dir)
+		}
+	}
+}
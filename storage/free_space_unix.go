@@ -0,0 +1,21 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+// +build darwin dragonfly freebsd linux
+
+package storage
+
+import "syscall"
+
+func (defaultFS) FreeSpace(dir string) (uint64, error) {
+	if dir == "" {
+		dir = "."
+	}
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+	// Bavail excludes the blocks reserved for the superuser.
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
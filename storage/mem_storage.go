@@ -13,6 +13,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"os"
 	"sort"
 	"strings"
@@ -188,6 +189,41 @@ func (y *memStorage) Open(fullname string) (File, error) {
 	return ret, nil
 }
 
+func (y *memStorage) OpenDir(fullname string) (File, error) {
+	for len(fullname) > 0 && fullname[len(fullname)-1] == os.PathSeparator {
+		fullname = fullname[:len(fullname)-1]
+	}
+	var ret *file
+	err := y.walk(fullname, func(dir *node, frag string, final bool) error {
+		if final {
+			if frag == "" {
+				// The root directory.
+				ret = &file{
+					n:    dir,
+					read: true,
+				}
+			} else if n := dir.children[frag]; n != nil && n.isDir {
+				ret = &file{
+					n:    n,
+					read: true,
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if ret == nil {
+		return nil, &os.PathError{
+			Op:   "open",
+			Path: fullname,
+			Err:  os.ErrNotExist,
+		}
+	}
+	return ret, nil
+}
+
 func (y *memStorage) Remove(fullname string) error {
 	return y.walk(fullname, func(dir *node, frag string, final bool) error {
 		if final {
@@ -295,13 +331,22 @@ func (y *memStorage) Stat(name string) (os.FileInfo, error) {
 	return f.Stat()
 }
 
+func (y *memStorage) FreeSpace(dirname string) (uint64, error) {
+	// Memory-backed storage is only limited by the memory of the process.
+	return math.MaxUint64, nil
+}
+
 // node holds a file's data or a directory's children, and implements os.FileInfo.
 type node struct {
 	name     string
-	data     []byte
-	modTime  time.Time
 	children map[string]*node
 	isDir    bool
+
+	// mu protects data and modTime, so that a file may be read while it is
+	// being appended to, as with files on disk.
+	mu      sync.Mutex
+	data    []byte
+	modTime time.Time
 }
 
 func (f *node) IsDir() bool {
@@ -309,6 +354,8 @@ func (f *node) IsDir() bool {
 }
 
 func (f *node) ModTime() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	return f.modTime
 }
 
@@ -324,6 +371,8 @@ func (f *node) Name() string {
 }
 
 func (f *node) Size() int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	return int64(len(f.data))
 }
 
@@ -335,7 +384,7 @@ func (f *node) dump(w *bytes.Buffer, level int) {
 	if f.isDir {
 		w.WriteString("          ")
 	} else {
-		fmt.Fprintf(w, "%8d  ", len(f.data))
+		fmt.Fprintf(w, "%8d  ", f.Size())
 	}
 	for i := 0; i < level; i++ {
 		w.WriteString("  ")
@@ -375,6 +424,8 @@ func (f *file) Read(p []byte) (int, error) {
 	if f.n.isDir {
 		return 0, errors.New("pebble/storage: cannot read a directory")
 	}
+	f.n.mu.Lock()
+	defer f.n.mu.Unlock()
 	if f.rpos >= len(f.n.data) {
 		return 0, io.EOF
 	}
@@ -390,6 +441,8 @@ func (f *file) ReadAt(p []byte, off int64) (int, error) {
 	if f.n.isDir {
 		return 0, errors.New("pebble/storage: cannot read a directory")
 	}
+	f.n.mu.Lock()
+	defer f.n.mu.Unlock()
 	if off >= int64(len(f.n.data)) {
 		return 0, io.EOF
 	}
@@ -403,6 +456,8 @@ func (f *file) Write(p []byte) (int, error) {
 	if f.n.isDir {
 		return 0, errors.New("pebble/storage: cannot write a directory")
 	}
+	f.n.mu.Lock()
+	defer f.n.mu.Unlock()
 	f.n.modTime = time.Now()
 	f.n.data = append(f.n.data, p...)
 	return len(p), nil
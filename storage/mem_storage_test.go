@@ -238,3 +238,44 @@ func TestList(t *testing.T) {
 		}
 	}
 }
+
+func TestOpenDir(t *testing.T) {
+	fs := NewMem()
+	if err := fs.MkdirAll(normalize("/foo/bar"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := fs.Create(normalize("/foo/baz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	testCases := []struct {
+		name string
+		ok   bool
+	}{
+		{"", true},
+		{"/", true},
+		{"/foo", true},
+		{"/foo/", true},
+		{"/foo/bar", true},
+		{"/foo/baz", false},
+		{"/qux", false},
+	}
+	for _, tc := range testCases {
+		d, err := fs.OpenDir(normalize(tc.name))
+		if ok := err == nil; ok != tc.ok {
+			t.Errorf("OpenDir %q: got %v, want ok=%t", tc.name, err, tc.ok)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if err := d.Sync(); err != nil {
+			t.Errorf("Sync %q: %v", tc.name, err)
+		}
+		if err := d.Close(); err != nil {
+			t.Errorf("Close %q: %v", tc.name, err)
+		}
+	}
+}
@@ -37,6 +37,11 @@ type Storage interface {
 	// Open opens the named file for reading.
 	Open(name string) (File, error)
 
+	// OpenDir opens the named directory for syncing. Syncing a directory makes
+	// the creation, renaming and removal of the files within it durable, which
+	// syncing the files themselves does not guarantee on all file systems.
+	OpenDir(name string) (File, error)
+
 	// Remove removes the named file or directory.
 	Remove(name string) error
 
@@ -75,6 +80,11 @@ type Storage interface {
 
 	// Stat returns an os.FileInfo describing the named file.
 	Stat(name string) (os.FileInfo, error)
+
+	// FreeSpace returns the number of bytes available for new files on the
+	// device holding the given directory. Implementations which cannot
+	// determine the free space return math.MaxUint64.
+	FreeSpace(dir string) (uint64, error)
 }
 
 // Default is a Storage implementation backed by the underlying operating
@@ -95,6 +105,10 @@ func (defaultFS) Open(name string) (File, error) {
 	return os.Open(name)
 }
 
+func (defaultFS) OpenDir(name string) (File, error) {
+	return os.Open(name)
+}
+
 func (defaultFS) Remove(name string) error {
 	return os.Remove(name)
 }
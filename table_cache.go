@@ -22,6 +22,9 @@ type tableCache struct {
 	fs      storage.Storage
 	opts    *db.Options
 	size    int
+	// pinIndexAndFilter, if non-nil, reports whether the index and filter blocks
+	// of a table should be pinned in the block cache when the table is loaded.
+	pinIndexAndFilter func(fileNum uint64) bool
 
 	mu struct {
 		sync.Mutex
@@ -167,6 +170,18 @@ func (c *tableCache) unrefNode(n *tableCacheNode) bool {
 	return res
 }
 
+// unpinIndexAndFilter unpins the index and filter blocks of the specified
+// table after it has moved out of L0. It is a no-op if the table is not
+// present in the table cache or its blocks are not pinned.
+func (c *tableCache) unpinIndexAndFilter(fileNum uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if n := c.mu.nodes[fileNum]; n != nil && n.pinned != nil {
+		n.pinned.UnpinIndexAndFilter()
+		n.pinned = nil
+	}
+}
+
 func (c *tableCache) evict(fileNum uint64) {
 	c.mu.Lock()
 	if n := c.mu.nodes[fileNum]; n != nil {
@@ -223,6 +238,9 @@ type tableCacheNode struct {
 
 	next, prev *tableCacheNode
 	refCount   int
+	// pinned is the node's reader while the reader's index and filter blocks
+	// are pinned in the block cache.
+	pinned *sstable.Reader
 }
 
 func (n *tableCacheNode) load(c *tableCache) {
@@ -236,6 +254,23 @@ func (n *tableCacheNode) load(c *tableCache) {
 	if n.meta.smallestSeqNum == n.meta.largestSeqNum {
 		r.Properties.GlobalSeqNum = n.meta.largestSeqNum
 	}
+	if c.pinIndexAndFilter != nil && c.pinIndexAndFilter(n.meta.fileNum) {
+		if err := r.PinIndexAndFilter(); err != nil {
+			r.Close()
+			n.result <- tableReaderOrError{err: err}
+			return
+		}
+		// The table may have moved out of L0 while the blocks were being
+		// pinned, before unpinIndexAndFilter could find the reader. Checking
+		// again while holding the mutex ensures the blocks are unpinned.
+		c.mu.Lock()
+		if c.pinIndexAndFilter(n.meta.fileNum) {
+			n.pinned = r
+		} else {
+			r.UnpinIndexAndFilter()
+		}
+		c.mu.Unlock()
+	}
 	n.result <- tableReaderOrError{reader: r}
 }
 
@@ -0,0 +1,211 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/internal/rate"
+	"github.com/petermattis/pebble/sstable"
+	"github.com/petermattis/pebble/storage"
+)
+
+// CorruptTable describes a corrupt table found by DB.VerifyChecksums.
+type CorruptTable struct {
+	// FileNum is the file number of the table.
+	FileNum uint64
+	// Level is the level of the LSM the table resides in.
+	Level int
+	// Err describes the corruption.
+	Err error
+}
+
+// CorruptionError is returned by DB.VerifyChecksums if any live table is
+// corrupt.
+type CorruptionError struct {
+	Tables []CorruptTable
+}
+
+func (e *CorruptionError) Error() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "pebble: %d corrupt tables", len(e.Tables))
+	for i, t := range e.Tables {
+		if i == 0 {
+			buf.WriteString(": ")
+		} else {
+			buf.WriteString("; ")
+		}
+		fmt.Fprintf(&buf, "L%d %06d: %v", t.Level, t.FileNum, t.Err)
+	}
+	return buf.String()
+}
+
+// VerifyChecksums re-reads every live table from disk, verifying the
+// checksum of every block as well as the checksum of the entire file, which is
+// known for tables written or ingested since file checksums were recorded in
+// the MANIFEST. Verification continues past corrupt tables, which are reported
+// by returning a *CorruptionError. Verification stops early if ctx is
+// cancelled, returning the context's error.
+func (d *DB) VerifyChecksums(ctx context.Context) error {
+	d.mu.Lock()
+	v := d.mu.versions.currentVersion()
+	v.ref()
+	d.mu.Unlock()
+	defer v.unref()
+
+	var corrupt []CorruptTable
+	for level := range v.files {
+		for i := range v.files[level] {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			meta := &v.files[level][i]
+			if err := d.verifyTable(ctx, meta, nil); err != nil {
+				corrupt = append(corrupt, CorruptTable{
+					FileNum: meta.fileNum,
+					Level:   level,
+					Err:     err,
+				})
+			}
+		}
+	}
+	if len(corrupt) > 0 {
+		return &CorruptionError{Tables: corrupt}
+	}
+	return nil
+}
+
+// verifyTable verifies the file checksum of a table, if known, and the
+// checksum of each of its blocks. The table is read bypassing the block cache.
+// If limiter is non-nil, reads from the table are paced by it, and
+// verification is interrupted if ctx is cancelled while waiting.
+func (d *DB) verifyTable(ctx context.Context, meta *fileMetadata, limiter *rate.Limiter) error {
+	f, err := d.opts.Storage.Open(dbFilename(d.dirname, fileTypeTable, meta.fileNum))
+	if err != nil {
+		return err
+	}
+	if limiter != nil {
+		f = pacedFile{File: f, ctx: ctx, limiter: limiter}
+	}
+	if meta.hasFileChecksum {
+		checksum, err := sstable.FileChecksum(f)
+		if err == nil && checksum != meta.fileChecksum {
+			err = fmt.Errorf("pebble: file checksum mismatch: expected %08x, but found %08x",
+				meta.fileChecksum, checksum)
+		}
+		if err != nil {
+			f.Close()
+			return err
+		}
+	}
+	opts := *d.opts
+	opts.Cache = nil
+	r := sstable.NewReader(f, meta.fileNum, &opts)
+	return firstError(r.VerifyBlockChecksums(), r.Close())
+}
+
+// checkOutput reopens a table written by a flush or compaction and iterates
+// over it in full, checking the checksums of its blocks, that its keys are in
+// order and lie within the bounds in meta, and that the number of entries
+// matches writerMeta. Used when Options.ParanoidChecks is set.
+func (d *DB) checkOutput(meta *fileMetadata, writerMeta *sstable.WriterMetadata) (err error) {
+	f, err := d.opts.Storage.Open(dbFilename(d.dirname, fileTypeTable, meta.fileNum))
+	if err != nil {
+		return err
+	}
+	opts := *d.opts
+	opts.Cache = nil
+	r := sstable.NewReader(f, meta.fileNum, &opts)
+	defer func() {
+		err = firstError(err, r.Close())
+	}()
+
+	errorf := func(format string, args ...interface{}) error {
+		return fmt.Errorf("pebble: paranoid check of table %06d failed: %s",
+			meta.fileNum, fmt.Sprintf(format, args...))
+	}
+
+	// Verifying the checksums first ensures the iteration below does not
+	// encounter a corrupt block.
+	if err := r.VerifyBlockChecksums(); err != nil {
+		return errorf("%v", err)
+	}
+	if db.InternalCompare(d.cmp, meta.smallest, meta.largest) > 0 {
+		return errorf("inconsistent bounds: %s, %s", meta.smallest, meta.largest)
+	}
+
+	iter := r.NewIter(nil)
+	var prev db.InternalKey
+	var count uint64
+	for valid := iter.First(); valid; valid = iter.Next() {
+		key := iter.Key()
+		if count > 0 && db.InternalCompare(d.cmp, prev, key) >= 0 {
+			iter.Close()
+			return errorf("keys out of order: %s, %s", prev, key)
+		}
+		if db.InternalCompare(d.cmp, key, meta.smallest) < 0 ||
+			db.InternalCompare(d.cmp, meta.largest, key) < 0 {
+			iter.Close()
+			return errorf("key %s outside of bounds %s-%s", key, meta.smallest, meta.largest)
+		}
+		prev.UserKey = append(prev.UserKey[:0], key.UserKey...)
+		prev.Trailer = key.Trailer
+		count++
+	}
+	if err := iter.Close(); err != nil {
+		return errorf("%v", err)
+	}
+	if count != writerMeta.NumEntries {
+		return errorf("found %d entries, but %d were written", count, writerMeta.NumEntries)
+	}
+
+	// Range tombstones are fragmented, and so sorted by start key and
+	// non-empty.
+	if iter := r.NewRangeDelIter(nil); iter != nil {
+		var prevStart []byte
+		for valid := iter.First(); valid; valid = iter.Next() {
+			start, end := iter.Key(), iter.Value()
+			if d.cmp(start.UserKey, end) >= 0 {
+				iter.Close()
+				return errorf("empty range tombstone: %s-%s", start, end)
+			}
+			if prevStart != nil && d.cmp(prevStart, start.UserKey) > 0 {
+				iter.Close()
+				return errorf("range tombstones out of order: %s, %s", prevStart, start)
+			}
+			prevStart = append(prevStart[:0], start.UserKey...)
+		}
+		if err := iter.Close(); err != nil {
+			return errorf("%v", err)
+		}
+	}
+	return nil
+}
+
+// pacedFile wraps a file, waiting on a rate limiter for every byte read via
+// ReadAt.
+type pacedFile struct {
+	storage.File
+	ctx     context.Context
+	limiter *rate.Limiter
+}
+
+func (f pacedFile) ReadAt(p []byte, off int64) (int, error) {
+	// The limiter only permits waiting for up to its burst at a time.
+	for n := len(p); n > 0; {
+		c := n
+		if burst := f.limiter.Burst(); c > burst {
+			c = burst
+		}
+		if err := f.limiter.WaitN(f.ctx, c); err != nil {
+			return 0, err
+		}
+		n -= c
+	}
+	return f.File.ReadAt(p, off)
+}
@@ -0,0 +1,250 @@
+// Copyright 2018 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/sstable"
+	"github.com/petermattis/pebble/storage"
+)
+
+func TestVerifyChecksums(t *testing.T) {
+	fs := storage.NewMem()
+	d, err := Open("", &db.Options{Storage: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	for i := 0; i < 2; i++ {
+		for j := 0; j < 100; j++ {
+			key := []byte(fmt.Sprintf("%c%03d", 'a'+i, j))
+			if err := d.Set(key, key, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := d.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.VerifyChecksums(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := d.VerifyChecksums(ctx); err != context.Canceled {
+		t.Fatalf("expected %v, but found %v", context.Canceled, err)
+	}
+
+	d.mu.Lock()
+	files := d.mu.versions.currentVersion().files[0]
+	d.mu.Unlock()
+	if len(files) != 2 {
+		t.Fatalf("expected 2 tables in L0, but found %d", len(files))
+	}
+	for _, m := range files {
+		if !m.hasFileChecksum {
+			t.Fatalf("expected %06d to have a file checksum", m.fileNum)
+		}
+	}
+
+	// Flip a bit in the first table. The corruption is found both by the file
+	// checksum, and by the block checksums if the file checksum is unknown.
+	corrupt := files[0]
+	filename := dbFilename("", fileTypeTable, corrupt.fileNum)
+	f, err := fs.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	contents[10] ^= 1
+	if f, err = fs.Create(filename); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(contents); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	check := func(expected string) {
+		err := d.VerifyChecksums(context.Background())
+		cerr, ok := err.(*CorruptionError)
+		if !ok {
+			t.Fatalf("expected corruption error, but found %v", err)
+		}
+		if len(cerr.Tables) != 1 || cerr.Tables[0].FileNum != corrupt.fileNum {
+			t.Fatalf("expected %06d to be corrupt, but found %v", corrupt.fileNum, err)
+		}
+		if !strings.Contains(err.Error(), expected) {
+			t.Fatalf("expected %q, but found %v", expected, err)
+		}
+	}
+	check("file checksum mismatch")
+
+	d.mu.Lock()
+	d.mu.versions.currentVersion().files[0][0].hasFileChecksum = false
+	d.mu.Unlock()
+	check("checksum mismatch")
+}
+
+// corruptingStorage flips a bit in the first write to each table created
+// while corrupt is set.
+type corruptingStorage struct {
+	storage.Storage
+	corrupt int32
+}
+
+func (fs *corruptingStorage) Create(name string) (storage.File, error) {
+	f, err := fs.Storage.Create(name)
+	if err != nil || !strings.HasSuffix(name, ".sst") || atomic.LoadInt32(&fs.corrupt) == 0 {
+		return f, err
+	}
+	return &corruptingFile{File: f}, nil
+}
+
+type corruptingFile struct {
+	storage.File
+	written bool
+}
+
+func (f *corruptingFile) Write(p []byte) (int, error) {
+	if !f.written && len(p) > 0 {
+		f.written = true
+		p = append([]byte(nil), p...)
+		p[len(p)/2] ^= 1
+	}
+	return f.File.Write(p)
+}
+
+func TestParanoidChecks(t *testing.T) {
+	fs := &corruptingStorage{Storage: storage.NewMem()}
+	d, err := Open("", &db.Options{
+		Storage:        fs,
+		ParanoidChecks: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	for i := 0; i < 2; i++ {
+		for j := 0; j < 100; j++ {
+			key := []byte(fmt.Sprintf("%03d", j))
+			if err := d.Set(key, []byte(fmt.Sprint(i)), nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := d.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tables := func() string {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		var buf bytes.Buffer
+		v := d.mu.versions.currentVersion()
+		for level := range v.files {
+			for _, m := range v.files[level] {
+				fmt.Fprintf(&buf, "L%d:%06d ", level, m.fileNum)
+			}
+		}
+		return buf.String()
+	}
+	before := tables()
+
+	// A compaction whose output is corrupt fails, leaving the LSM unchanged.
+	atomic.StoreInt32(&fs.corrupt, 1)
+	err = d.Compact([]byte("000"), []byte("099"))
+	if err == nil || !strings.Contains(err.Error(), "paranoid check") {
+		t.Fatalf("expected paranoid check failure, but found %v", err)
+	}
+	if after := tables(); before != after {
+		t.Fatalf("expected tables %s, but found %s", before, after)
+	}
+
+	atomic.StoreInt32(&fs.corrupt, 0)
+	if err := d.Compact([]byte("000"), []byte("099")); err != nil {
+		t.Fatal(err)
+	}
+	if after := tables(); before == after {
+		t.Fatalf("expected compaction to replace tables %s", before)
+	}
+	if err := d.VerifyChecksums(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckOutput(t *testing.T) {
+	fs := storage.NewMem()
+	d, err := Open("", &db.Options{Storage: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	const fileNum = 100
+	f, err := fs.Create(dbFilename("", fileTypeTable, fileNum))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := sstable.NewWriter(f, nil, db.LevelOptions{})
+	for _, k := range []string{"a", "b", "c"} {
+		if err := w.Add(db.MakeInternalKey([]byte(k), 1, db.InternalKeyKindSet), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	writerMeta, err := w.Metadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		smallest   string
+		largest    string
+		numEntries uint64
+		expected   string
+	}{
+		{"a", "c", 3, ""},
+		{"a", "d", 3, ""},
+		{"a", "c", 4, "found 3 entries, but 4 were written"},
+		{"b", "c", 3, "outside of bounds"},
+		{"a", "b", 3, "outside of bounds"},
+		{"c", "a", 3, "inconsistent bounds"},
+	}
+	for _, c := range testCases {
+		meta := &fileMetadata{
+			fileNum:  fileNum,
+			smallest: db.MakeInternalKey([]byte(c.smallest), 1, db.InternalKeyKindSet),
+			largest:  db.MakeInternalKey([]byte(c.largest), 1, db.InternalKeyKindSet),
+		}
+		wm := *writerMeta
+		wm.NumEntries = c.numEntries
+		err := d.checkOutput(meta, &wm)
+		if c.expected == "" {
+			if err != nil {
+				t.Fatalf("%s-%s: %v", c.smallest, c.largest, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), c.expected) {
+			t.Fatalf("%s-%s: expected %q, but found %v", c.smallest, c.largest, c.expected, err)
+		}
+	}
+}
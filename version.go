@@ -29,6 +29,20 @@ type fileMetadata struct {
 	largestSeqNum  uint64
 	// true if client asked us nicely to compact this file.
 	markedForCompaction bool
+	// creationTime is the time the table was created, in seconds since the
+	// Unix epoch. Zero if unknown.
+	creationTime uint64
+	// fileChecksum is the CRC32c of the entire table file, computed as the
+	// table was written or ingested. It is only valid if hasFileChecksum is
+	// set, as tables recorded by older versions have no file checksum.
+	fileChecksum    uint32
+	hasFileChecksum bool
+	// numEntries and numDeletions are the number of point entries and point
+	// deletion tombstones in the table, taken from the table properties. Both
+	// are zero for tables recorded by older versions, which did not persist
+	// them in the MANIFEST.
+	numEntries   uint64
+	numDeletions uint64
 }
 
 func (m *fileMetadata) String() string {
@@ -44,9 +58,27 @@ func (m *fileMetadata) tableInfo(dirname string) db.TableInfo {
 		Largest:        m.largest,
 		SmallestSeqNum: m.smallestSeqNum,
 		LargestSeqNum:  m.largestSeqNum,
+		FileChecksum:   m.fileChecksum,
 	}
 }
 
+// deletionWeight is the multiplier applied to the excess deletion tombstones in
+// a table when computing its compensated size.
+const deletionWeight = 2
+
+// compensatedSize returns the size of the file used when prioritizing it for
+// compaction. Tables in which deletion tombstones dominate are inflated so that
+// they are compacted sooner: the tombstones are small, but compacting them
+// reclaims the space used by the entries they delete and speeds up iteration
+// which would otherwise have to skip over them.
+func (m *fileMetadata) compensatedSize() uint64 {
+	if m.numEntries == 0 || m.numDeletions*2 < m.numEntries {
+		return m.size
+	}
+	avgEntrySize := m.size / m.numEntries
+	return m.size + (m.numDeletions*2-m.numEntries)*avgEntrySize*deletionWeight
+}
+
 // totalSize returns the total size of all the files in f.
 func totalSize(f []fileMetadata) (size uint64) {
 	for _, x := range f {
@@ -55,6 +87,15 @@ func totalSize(f []fileMetadata) (size uint64) {
 	return size
 }
 
+// totalCompensatedSize returns the total compensated size of all the files in
+// f.
+func totalCompensatedSize(f []fileMetadata) (size uint64) {
+	for i := range f {
+		size += f[i].compensatedSize()
+	}
+	return size
+}
+
 // ikeyRange returns the minimum smallest and maximum largest internalKey for
 // all the fileMetadata in f0 and f1.
 func ikeyRange(ucmp db.Compare, f0, f1 []fileMetadata) (smallest, largest db.InternalKey) {
@@ -134,6 +175,11 @@ type version struct {
 
 	files [numLevels][]fileMetadata
 
+	// The file numbers of tables which are not in the version, but must not be
+	// deleted while it is live. See versionSet.pinFileNums. Protected by the
+	// mutex of the version list.
+	pinnedFileNums []uint64
+
 	// The list the version is linked into.
 	list *versionList
 
@@ -261,6 +307,15 @@ func (v *version) checkOrdering(cmp db.Compare) error {
 			for i := 1; i < len(ff); i++ {
 				prev := &ff[i-1]
 				f := &ff[i]
+				if prev.smallestSeqNum == prev.largestSeqNum &&
+					f.smallestSeqNum == f.largestSeqNum &&
+					prev.largestSeqNum == f.largestSeqNum &&
+					(db.InternalCompare(cmp, prev.largest, f.smallest) < 0 ||
+						db.InternalCompare(cmp, f.largest, prev.smallest) < 0) {
+					// Sstables ingested together share a single sequence number, but
+					// do not overlap.
+					continue
+				}
 				if prev.largestSeqNum >= f.largestSeqNum {
 					return fmt.Errorf("level 0 files are not in increasing largest seqNum order: %d, %d",
 						prev.largestSeqNum, f.largestSeqNum)
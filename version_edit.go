@@ -16,6 +16,11 @@ import (
 	"github.com/petermattis/pebble/db"
 )
 
+// fileChecksumName is the name of the file checksum function recorded in the
+// MANIFEST, which matches that of the equivalent RocksDB checksum. The
+// checksum itself is stored as a big-endian uint32.
+const fileChecksumName = "FileChecksumCrc32c"
+
 // TODO(peter): describe the MANIFEST file format, independently of the C++
 // project.
 
@@ -48,9 +53,17 @@ const (
 	tagColumnFamilyDrop = 202
 	tagMaxColumnFamily  = 203
 
-	// The custom tags sub-format used by tagNewFile4.
+	// The custom tags sub-format used by tagNewFile4. The number of entries and
+	// deletions in a table are specific to Pebble: their tags are safe to ignore
+	// (they are not covered by customTagNonSafeIgnoreMask) and lie above those
+	// used by RocksDB.
 	customTagTerminate         = 1
 	customTagNeedsCompaction   = 2
+	customTagCreationTime      = 6
+	customTagFileChecksum      = 7
+	customTagFileChecksumName  = 8
+	customTagNumEntries        = 32
+	customTagNumDeletions      = 33
 	customTagPathID            = 65
 	customTagNonSafeIgnoreMask = 1 << 6
 )
@@ -182,6 +195,10 @@ func (v *versionEdit) decode(r io.Reader) error {
 				}
 			}
 			var markedForCompaction bool
+			var creationTime uint64
+			var numEntries, numDeletions uint64
+			var fileChecksum []byte
+			checksumName := fileChecksumName
 			if tag == tagNewFile4 {
 				for {
 					customTag, err := d.readUvarint()
@@ -202,6 +219,33 @@ func (v *versionEdit) decode(r io.Reader) error {
 						}
 						markedForCompaction = (field[0] == 1)
 
+					case customTagCreationTime:
+						var n int
+						creationTime, n = binary.Uvarint(field)
+						if n != len(field) {
+							return fmt.Errorf("new-file4: creation-time field wrong size")
+						}
+
+					case customTagFileChecksum:
+						fileChecksum = field
+
+					case customTagFileChecksumName:
+						checksumName = string(field)
+
+					case customTagNumEntries:
+						var n int
+						numEntries, n = binary.Uvarint(field)
+						if n != len(field) {
+							return fmt.Errorf("new-file4: num-entries field wrong size")
+						}
+
+					case customTagNumDeletions:
+						var n int
+						numDeletions, n = binary.Uvarint(field)
+						if n != len(field) {
+							return fmt.Errorf("new-file4: num-deletions field wrong size")
+						}
+
 					case customTagPathID:
 						return fmt.Errorf("new-file4: path-id field not supported")
 
@@ -212,18 +256,28 @@ func (v *versionEdit) decode(r io.Reader) error {
 					}
 				}
 			}
-			v.newFiles = append(v.newFiles, newFileEntry{
-				level: level,
-				meta: fileMetadata{
-					fileNum:             fileNum,
-					size:                size,
-					smallest:            db.DecodeInternalKey(smallest),
-					largest:             db.DecodeInternalKey(largest),
-					smallestSeqNum:      smallestSeqNum,
-					largestSeqNum:       largestSeqNum,
-					markedForCompaction: markedForCompaction,
-				},
-			})
+			meta := fileMetadata{
+				fileNum:             fileNum,
+				size:                size,
+				smallest:            db.DecodeInternalKey(smallest),
+				largest:             db.DecodeInternalKey(largest),
+				smallestSeqNum:      smallestSeqNum,
+				largestSeqNum:       largestSeqNum,
+				markedForCompaction: markedForCompaction,
+				creationTime:        creationTime,
+				numEntries:          numEntries,
+				numDeletions:        numDeletions,
+			}
+			// A checksum computed by a different function cannot be verified, and
+			// is ignored.
+			if fileChecksum != nil && checksumName == fileChecksumName {
+				if len(fileChecksum) != 4 {
+					return fmt.Errorf("new-file4: file-checksum field wrong size")
+				}
+				meta.fileChecksum = binary.BigEndian.Uint32(fileChecksum)
+				meta.hasFileChecksum = true
+			}
+			v.newFiles = append(v.newFiles, newFileEntry{level: level, meta: meta})
 
 		case tagPrevLogNumber:
 			n, err := d.readUvarint()
@@ -271,7 +325,8 @@ func (v *versionEdit) encode(w io.Writer) error {
 	}
 	for _, x := range v.newFiles {
 		var customFields bool
-		if x.meta.markedForCompaction {
+		if x.meta.markedForCompaction || x.meta.creationTime != 0 || x.meta.hasFileChecksum ||
+			x.meta.numEntries != 0 || x.meta.numDeletions != 0 {
 			customFields = true
 			e.writeUvarint(tagNewFile4)
 		} else {
@@ -289,6 +344,32 @@ func (v *versionEdit) encode(w io.Writer) error {
 				e.writeUvarint(customTagNeedsCompaction)
 				e.writeBytes([]byte{1})
 			}
+			if x.meta.creationTime != 0 {
+				var buf [binary.MaxVarintLen64]byte
+				n := binary.PutUvarint(buf[:], x.meta.creationTime)
+				e.writeUvarint(customTagCreationTime)
+				e.writeBytes(buf[:n])
+			}
+			if x.meta.hasFileChecksum {
+				var buf [4]byte
+				binary.BigEndian.PutUint32(buf[:], x.meta.fileChecksum)
+				e.writeUvarint(customTagFileChecksum)
+				e.writeBytes(buf[:])
+				e.writeUvarint(customTagFileChecksumName)
+				e.writeString(fileChecksumName)
+			}
+			if x.meta.numEntries != 0 {
+				var buf [binary.MaxVarintLen64]byte
+				n := binary.PutUvarint(buf[:], x.meta.numEntries)
+				e.writeUvarint(customTagNumEntries)
+				e.writeBytes(buf[:n])
+			}
+			if x.meta.numDeletions != 0 {
+				var buf [binary.MaxVarintLen64]byte
+				n := binary.PutUvarint(buf[:], x.meta.numDeletions)
+				e.writeUvarint(customTagNumDeletions)
+				e.writeBytes(buf[:n])
+			}
 			e.writeUvarint(customTagTerminate)
 		}
 	}
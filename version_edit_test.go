@@ -77,6 +77,44 @@ func TestVersionEditRoundTrip(t *testing.T) {
 						markedForCompaction: true,
 					},
 				},
+				{
+					level: 6,
+					meta: fileMetadata{
+						fileNum:        807,
+						size:           8070,
+						smallest:       db.DecodeInternalKey([]byte("a\x00\x01\x02\x03\x04\x05\x06\x07")),
+						largest:        db.DecodeInternalKey([]byte("z\x01\xff\xfe\xfd\xfc\xfb\xfa\xf9")),
+						smallestSeqNum: 6,
+						largestSeqNum:  8,
+						creationTime:   1546300800,
+					},
+				},
+				{
+					level: 6,
+					meta: fileMetadata{
+						fileNum:         808,
+						size:            8080,
+						smallest:        db.DecodeInternalKey([]byte("b\x00\x01\x02\x03\x04\x05\x06\x07")),
+						largest:         db.DecodeInternalKey([]byte("y\x01\xff\xfe\xfd\xfc\xfb\xfa\xf9")),
+						smallestSeqNum:  9,
+						largestSeqNum:   9,
+						fileChecksum:    0xdeadbeef,
+						hasFileChecksum: true,
+					},
+				},
+				{
+					level: 6,
+					meta: fileMetadata{
+						fileNum:        809,
+						size:           8090,
+						smallest:       db.DecodeInternalKey([]byte("c\x00\x01\x02\x03\x04\x05\x06\x07")),
+						largest:        db.DecodeInternalKey([]byte("x\x01\xff\xfe\xfd\xfc\xfb\xfa\xf9")),
+						smallestSeqNum: 10,
+						largestSeqNum:  12,
+						numEntries:     100,
+						numDeletions:   60,
+					},
+				},
 			},
 		},
 	}
@@ -87,6 +125,34 @@ func TestVersionEditRoundTrip(t *testing.T) {
 	}
 }
 
+func TestVersionEditFileChecksumName(t *testing.T) {
+	// A file checksum computed by an unknown function is ignored.
+	e := versionEdit{
+		newFiles: []newFileEntry{{
+			level: 6,
+			meta: fileMetadata{
+				fileNum:         808,
+				smallest:        db.MakeInternalKey([]byte("a"), 1, db.InternalKeyKindSet),
+				largest:         db.MakeInternalKey([]byte("z"), 1, db.InternalKeyKindSet),
+				fileChecksum:    0xdeadbeef,
+				hasFileChecksum: true,
+			},
+		}},
+	}
+	buf := new(bytes.Buffer)
+	if err := e.encode(buf); err != nil {
+		t.Fatal(err)
+	}
+	encoded := bytes.Replace(buf.Bytes(), []byte(fileChecksumName), []byte("FileChecksumCrc32d"), 1)
+	var d versionEdit
+	if err := d.decode(bytes.NewReader(encoded)); err != nil {
+		t.Fatal(err)
+	}
+	if m := d.newFiles[0].meta; m.hasFileChecksum {
+		t.Fatalf("expected unknown file checksum to be ignored, but found %08x", m.fileChecksum)
+	}
+}
+
 func TestVersionEditDecode(t *testing.T) {
 	testCases := []struct {
 		filename     string
@@ -46,6 +46,15 @@ type versionSet struct {
 
 	writing    bool
 	writerCond sync.Cond
+
+	// The file numbers of the level 0 sstables in the current version, stored
+	// as a map[uint64]struct{}. Only maintained if
+	// Options.PinL0IndexAndFilterBlocks is set. Accessed without holding the
+	// mutex by the table cache.
+	l0FileNums atomic.Value
+	// unpinIndexAndFilter, if non-nil, is called with the file number of each
+	// table which is no longer in level 0 after a new version is installed.
+	unpinIndexAndFilter func(fileNum uint64)
 }
 
 // load loads the version set from the manifest file.
@@ -187,7 +196,8 @@ func (vs *versionSet) logAndApply(ve *versionEdit) error {
 		defer vs.mu.Lock()
 
 		// TODO(peter): if vs.manifest becomes too large, create a new one.
-		if vs.manifest == nil {
+		newManifest := vs.manifest == nil
+		if newManifest {
 			if err := vs.createManifest(vs.dirname); err != nil {
 				return err
 			}
@@ -206,12 +216,23 @@ func (vs *versionSet) logAndApply(ve *versionEdit) error {
 		if err := vs.manifestFile.Sync(); err != nil {
 			return err
 		}
-		if err := setCurrentFile(vs.dirname, vs.fs, vs.manifestFileNumber); err != nil {
-			return err
+		if newManifest {
+			if err := setCurrentFile(vs.dirname, vs.fs, vs.manifestFileNumber); err != nil {
+				return err
+			}
 		}
 		picker = newCompactionPicker(newVersion, vs.opts)
 		return nil
 	}(); err != nil {
+		if vs.manifest != nil {
+			// The manifest may now end with a partially written edit, or with an
+			// edit which was written but not synced. Rather than appending to it,
+			// the next edit creates a new manifest holding a snapshot of the
+			// current version.
+			vs.manifestFile.Close()
+			vs.manifest, vs.manifestFile = nil, nil
+			vs.manifestFileNumber = vs.nextFileNum()
+		}
 		return err
 	}
 
@@ -298,6 +319,34 @@ func (vs *versionSet) append(v *version) {
 	}
 	v.ref()
 	vs.versions.pushBack(v)
+
+	if vs.opts.PinL0IndexAndFilterBlocks {
+		l0 := make(map[uint64]struct{}, len(v.files[0]))
+		for i := range v.files[0] {
+			l0[v.files[0][i].fileNum] = struct{}{}
+		}
+		prev, _ := vs.l0FileNums.Load().(map[uint64]struct{})
+		vs.l0FileNums.Store(l0)
+		// Unpin the index and filter blocks of the tables which left L0, such as
+		// those trivially moved to L1. The new set of L0 tables must be stored
+		// first, so that a table being loaded concurrently is not pinned.
+		if vs.unpinIndexAndFilter != nil {
+			for fileNum := range prev {
+				if _, ok := l0[fileNum]; !ok {
+					vs.unpinIndexAndFilter(fileNum)
+				}
+			}
+		}
+	}
+}
+
+// isL0 returns true if the specified file is a level 0 sstable in the current
+// version. Always returns false if Options.PinL0IndexAndFilterBlocks is not
+// set.
+func (vs *versionSet) isL0(fileNum uint64) bool {
+	l0, _ := vs.l0FileNums.Load().(map[uint64]struct{})
+	_, ok := l0[fileNum]
+	return ok
 }
 
 func (vs *versionSet) currentVersion() *version {
@@ -311,5 +360,20 @@ func (vs *versionSet) addLiveFileNums(m map[uint64]struct{}) {
 				m[f.fileNum] = struct{}{}
 			}
 		}
+		for _, fileNum := range v.pinnedFileNums {
+			m[fileNum] = struct{}{}
+		}
+	}
+}
+
+// pinFileNums keeps the specified tables live until every version which is
+// live before the current one has been released, whether or not the tables
+// remain in the current version.
+//
+// DB.mu must be held when calling this.
+func (vs *versionSet) pinFileNums(fileNums []uint64) {
+	current := vs.currentVersion()
+	for v := vs.versions.root.next; v != current; v = v.next {
+		v.pinnedFileNums = append(v.pinnedFileNums, fileNums...)
 	}
 }
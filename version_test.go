@@ -79,6 +79,29 @@ func TestIkeyRange(t *testing.T) {
 	}
 }
 
+func TestCompensatedSize(t *testing.T) {
+	testCases := []struct {
+		size, entries, deletions uint64
+		expected                 uint64
+	}{
+		{1000, 0, 0, 1000},
+		{1000, 100, 0, 1000},
+		{1000, 100, 49, 1000},
+		// With half the entries deleted, the deletions and the entries they
+		// delete cancel out.
+		{1000, 100, 50, 1000},
+		{1000, 100, 75, 1000 + 50*10*deletionWeight},
+		{1000, 100, 100, 1000 + 100*10*deletionWeight},
+	}
+	for _, c := range testCases {
+		m := fileMetadata{size: c.size, numEntries: c.entries, numDeletions: c.deletions}
+		if v := m.compensatedSize(); c.expected != v {
+			t.Errorf("%d/%d/%d: expected %d, but found %d",
+				c.size, c.entries, c.deletions, c.expected, v)
+		}
+	}
+}
+
 func TestOverlaps(t *testing.T) {
 	m00 := fileMetadata{
 		fileNum:  700,